@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/sigman78/wayback-dl/internal/wayback"
+)
+
+// fileConfig is the -config file format: every wayback.Config field by its
+// json tag, plus the options that only exist on the command line.
+type fileConfig struct {
+	*wayback.Config
+	URL         string `json:"url"`
+	CookieFile  string `json:"cookie_file"`
+	CDXTimeout  string `json:"cdx_timeout"`       // time.ParseDuration syntax, e.g. "90s"
+	MaxDuration string `json:"max_duration"`      // time.ParseDuration syntax, e.g. "30m"
+	IdleTimeout string `json:"idle_conn_timeout"` // time.ParseDuration syntax, e.g. "2m"
+	DNSCache    string `json:"dns_cache"`         // time.ParseDuration syntax, e.g. "5m"
+}
+
+// configPathFromArgs returns the value of -config (or its alias -json-config)
+// in args, accepting both "-config path" and "-config=path" forms with one or
+// two leading dashes. Scanning stops at "--". It returns "" when absent.
+func configPathFromArgs(args []string) string {
+	var path string
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+		if a == "--" {
+			break
+		}
+		name, val, hasVal := strings.Cut(strings.TrimLeft(a, "-"), "=")
+		if !strings.HasPrefix(a, "-") || (name != "config" && name != "json-config") {
+			continue
+		}
+		if hasVal {
+			path = val
+		} else if i+1 < len(args) {
+			i++
+			path = args[i]
+		}
+	}
+	return path
+}
+
+// loadConfigFile reads the JSON file at path into cfg, urlFlag and cookieFile.
+// Keys absent from the file leave the existing values (the flag defaults)
+// untouched; unknown keys are rejected so typos do not pass silently.
+func loadConfigFile(path string, cfg *wayback.Config, urlFlag, cookieFile *string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	fc := fileConfig{Config: cfg, URL: *urlFlag, CookieFile: *cookieFile}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&fc); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	for _, d := range []struct {
+		key, val string
+		dst      *time.Duration
+	}{
+		{"cdx_timeout", fc.CDXTimeout, &cfg.CDXRequestTimeout},
+		{"max_duration", fc.MaxDuration, &cfg.MaxDuration},
+		{"idle_conn_timeout", fc.IdleTimeout, &cfg.IdleConnTimeout},
+		{"dns_cache", fc.DNSCache, &cfg.DNSCacheTTL},
+	} {
+		if d.val == "" {
+			continue
+		}
+		v, err := time.ParseDuration(d.val)
+		if err != nil {
+			return fmt.Errorf("%s: %s: %w", path, d.key, err)
+		}
+		*d.dst = v
+	}
+	*urlFlag, *cookieFile = fc.URL, fc.CookieFile
+	return nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sigman78/wayback-dl/internal/wayback"
+)
+
+// TestConfigPathFromArgs verifies the -config pre-scan accepts both flag
+// spellings and value forms, and ignores anything after "--".
+func TestConfigPathFromArgs(t *testing.T) {
+	cases := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"-threads", "2"}, ""},
+		{[]string{"-config", "a.json"}, "a.json"},
+		{[]string{"--config=b.json", "-debug"}, "b.json"},
+		{[]string{"-json-config", "c.json"}, "c.json"},
+		{[]string{"-debug", "--", "-config", "d.json"}, ""},
+		{[]string{"-config"}, ""},
+	}
+	for _, tc := range cases {
+		if got := configPathFromArgs(tc.args); got != tc.want {
+			t.Errorf("configPathFromArgs(%q) = %q, want %q", tc.args, got, tc.want)
+		}
+	}
+}
+
+// TestLoadConfigFile verifies that file values overlay the defaults, absent
+// keys keep them, and unknown keys are rejected.
+func TestLoadConfigFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "cfg.json")
+	body := `{"url": "example.com", "threads": 8, "subdomains": ["blog"], "cdx_timeout": "90s", "max_duration": "30m", "dns_cache": "5m", "cookie_file": "c.txt"}`
+	if err := os.WriteFile(path, []byte(body), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &wayback.Config{Threads: 3, CanonicalAction: "keep", CDXRatePerMin: 60}
+	var urlFlag, cookieFile string
+	if err := loadConfigFile(path, cfg, &urlFlag, &cookieFile); err != nil {
+		t.Fatal(err)
+	}
+	if urlFlag != "example.com" || cookieFile != "c.txt" {
+		t.Errorf("url, cookie_file = %q, %q", urlFlag, cookieFile)
+	}
+	if cfg.Threads != 8 || cfg.CDXRequestTimeout != 90*time.Second || cfg.MaxDuration != 30*time.Minute || cfg.DNSCacheTTL != 5*time.Minute || len(cfg.ExtraSubdomains) != 1 {
+		t.Errorf("file values not applied: %+v", cfg)
+	}
+	if cfg.CanonicalAction != "keep" || cfg.CDXRatePerMin != 60 {
+		t.Errorf("defaults overwritten: %+v", cfg)
+	}
+
+	bad := filepath.Join(dir, "bad.json")
+	if err := os.WriteFile(bad, []byte(`{"thread": 8}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadConfigFile(bad, &wayback.Config{}, &urlFlag, &cookieFile); err == nil {
+		t.Error("expected an error for an unknown key")
+	}
+}
+
+// TestConfigFlagsOverrideFile verifies that a flag on the command line beats
+// the same option in the -config file: the file's invalid threads value is
+// overridden, so the run gets as far as the missing-URL check.
+func TestConfigFlagsOverrideFile(t *testing.T) {
+	if os.Getenv(subprocessEnv) == "1" {
+		path := filepath.Join(os.TempDir(), "wayback-dl-override.json")
+		if err := os.WriteFile(path, []byte(`{"threads": 0}`), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		os.Args = []string{"wayback-dl", "-config", path, "-threads", "4"}
+		main()
+		return // unreachable; main calls os.Exit
+	}
+	stderr, err := runSubprocessStderr(t, "TestConfigFlagsOverrideFile")
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != exitUsage {
+		t.Fatalf("expected exit code %d, got: %v", exitUsage, err)
+	}
+	if !strings.Contains(stderr, "URL is required") {
+		t.Errorf("expected missing-URL error, got stderr:\n%s", stderr)
+	}
+}
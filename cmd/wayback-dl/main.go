@@ -1,37 +1,323 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
+	"maps"
+	"net"
+	"net/http"
 	"os"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/sigman78/wayback-dl/internal/wayback"
 )
 
+// Process exit codes. Scripts can rely on these to tell failure categories apart.
+const (
+	exitOK          = 0 // every resource downloaded
+	exitError       = 1 // unclassified failure
+	exitUsage       = 2 // bad flags or arguments
+	exitPartial     = 3 // run completed but some resources failed
+	exitNoSnapshots = 4 // the archive has nothing for the URL/time range
+	exitNetwork     = 5 // CDX index fetch or network failure
+	exitTimeLimit   = 6 // -max-duration reached; rerun to resume
+)
+
+// exitCode maps an error returned by wayback.DownloadAll to a process exit code.
+func exitCode(err error) int {
+	var partial *wayback.PartialError
+	var netErr net.Error
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.As(err, &partial):
+		return exitPartial
+	case errors.Is(err, wayback.ErrMaxDuration):
+		return exitTimeLimit
+	case errors.Is(err, wayback.ErrNoSnapshots):
+		return exitNoSnapshots
+	case errors.Is(err, wayback.ErrCDX), errors.As(err, &netErr):
+		return exitNetwork
+	default:
+		return exitError
+	}
+}
+
+// stringList is a repeatable string flag: each occurrence appends a value.
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// headerMap is a repeatable "Key: Value" flag: each occurrence sets a header.
+type headerMap map[string]string
+
+func (h *headerMap) String() string {
+	parts := make([]string, 0, len(*h))
+	for _, k := range slices.Sorted(maps.Keys(*h)) {
+		parts = append(parts, k+": "+(*h)[k])
+	}
+	return strings.Join(parts, ", ")
+}
+
+func (h *headerMap) Set(v string) error {
+	k, val, ok := strings.Cut(v, ":")
+	if k = strings.TrimSpace(k); !ok || k == "" {
+		return fmt.Errorf("%q: want \"Key: Value\"", v)
+	}
+	if *h == nil {
+		*h = make(headerMap)
+	}
+	(*h)[http.CanonicalHeaderKey(k)] = strings.TrimSpace(val)
+	return nil
+}
+
+// typeMap is a repeatable "ext=type[,ext=type...]" flag of Content-Type
+// overrides keyed by lower-case extension without its dot.
+type typeMap map[string]string
+
+func (m *typeMap) String() string {
+	parts := make([]string, 0, len(*m))
+	for _, ext := range slices.Sorted(maps.Keys(*m)) {
+		parts = append(parts, ext+"="+(*m)[ext])
+	}
+	return strings.Join(parts, ",")
+}
+
+func (m *typeMap) Set(v string) error {
+	for _, pair := range strings.Split(v, ",") {
+		ext, ct, ok := strings.Cut(pair, "=")
+		ext = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(ext), "."))
+		if ct = strings.TrimSpace(ct); !ok || ext == "" || ct == "" {
+			return fmt.Errorf("%q: want ext=type", pair)
+		}
+		if *m == nil {
+			*m = make(typeMap)
+		}
+		(*m)[ext] = ct
+	}
+	return nil
+}
+
+// extLimits is a repeatable "ext=n[,ext=n...]" flag of per-extension
+// download limits; a later limit for an extension replaces an earlier one.
+type extLimits map[string]int
+
+func (m *extLimits) String() string {
+	parts := make([]string, 0, len(*m))
+	for _, ext := range slices.Sorted(maps.Keys(*m)) {
+		parts = append(parts, ext+"="+strconv.Itoa((*m)[ext]))
+	}
+	return strings.Join(parts, ",")
+}
+
+func (m *extLimits) Set(v string) error {
+	for _, pair := range strings.Split(v, ",") {
+		ext, limit, ok := strings.Cut(pair, "=")
+		ext = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(ext), "."))
+		n, err := strconv.Atoi(strings.TrimSpace(limit))
+		if !ok || ext == "" || err != nil || n < 0 {
+			return fmt.Errorf("%q: want ext=n", pair)
+		}
+		if *m == nil {
+			*m = make(extLimits)
+		}
+		(*m)[ext] = n
+	}
+	return nil
+}
+
+// cdnMap is a repeatable "host=dir[,host=dir...]" flag mapping CDN hosts to
+// the directories their files are stored under.
+type cdnMap map[string]string
+
+func (m *cdnMap) String() string {
+	parts := make([]string, 0, len(*m))
+	for _, host := range slices.Sorted(maps.Keys(*m)) {
+		parts = append(parts, host+"="+(*m)[host])
+	}
+	return strings.Join(parts, ",")
+}
+
+func (m *cdnMap) Set(v string) error {
+	for _, pair := range strings.Split(v, ",") {
+		host, dir, ok := strings.Cut(pair, "=")
+		host = strings.ToLower(strings.TrimSpace(host))
+		dir = strings.Trim(strings.TrimSpace(dir), "/")
+		if !ok || host == "" || dir == "" {
+			return fmt.Errorf("%q: want host=dir", pair)
+		}
+		if *m == nil {
+			*m = make(cdnMap)
+		}
+		(*m)[host] = dir
+	}
+	return nil
+}
+
 func usage() {
 	fmt.Fprintf(os.Stderr, `Usage: wayback-dl [url] [options]
+       wayback-dl [options] -- url
 
 Arguments:
   url                     Domain or URL to archive (same as -url)
+  --                      End of options; everything after it is positional
 
 Options:
   -url string             Domain or URL to archive
+  -config string          Load options from a JSON file (alias -json-config); command-line flags override it
   -from string            Start timestamp YYYYMMDDhhmmss (default: none)
   -to string              End timestamp YYYYMMDDhhmmss (default: none)
+  -archive-org-snapshot-date string
+                          Only captures from this day, YYYYMMDD or RFC3339 (shorthand for -from/-to)
   -threads int            Concurrent download threads (default: 3)
   -directory string       Output directory (default: websites/<host>/)
+  -dated-dir              Save into a <YYYYMMDD-HHMMSS> subdirectory of the output directory, one per run
+                          (alias -timestamp-suffix)
+  -output-dir-template string
+                          Output directory from a template over {{.Host}} {{.Year}} {{.Month}} {{.Day}}
+                          (date of -from/-archive-org-snapshot-date, else today); overrides -directory
   -rewrite-links          Rewrite page links to relative paths
+  -repair                 Rewrite links over an already-downloaded directory; no CDX query, no downloads
+  -url-map string         Manifest written by -manifest-out (json|csv) mapping files to their URLs, for -repair
+  -rewrite-dry-run string With -repair, write nothing back; list each link that would change (file, attribute,
+                          original, local path) in this TSV file
+  -rewrite-out string     Write rewritten pages and CSS to this directory and keep the downloaded originals
+                          (with -rewrite-links or -repair; other files are not copied)
+  -keep-newer             Set each downloaded file's time to its capture; -repair then leaves files modified
+                          since (hand edits) alone (alias -no-clobber-newer; existing files are never re-downloaded)
+  -merge                  Add this capture to an existing directory; files of other captures are kept and
+                          colliding paths get a ~<hash> suffix (owners recorded in merge.tsv)
+  -safe-write             Flush every file to disk before it replaces the old one (slower, survives power loss)
+  -state-file string      Save the capture index and download progress to this file (binary); when it exists,
+                          resume from it instead of querying the CDX index (delete it to query again)
   -pretty-path            Map extension-less URLs to dir/index.html (default: preserve original path)
+  -max-path-depth int     Cut local paths to N components plus a hash suffix, for MAX_PATH limits or deep
+                          faceted URLs; links follow (alias -max-depth-segments, -max-depth; default: 0 = unlimited)
+  -max-abs-path-len int   Store files whose absolute path would be longer than N bytes under a hashed name,
+                          dropping trailing directories until it fits, e.g. 240 on Windows; links follow (default: 0 = off)
+  -trailing-slash string  Extension-less paths: keep, or collapse so /dir and /dir/ are both stored as dir/index.html (default: keep)
+  -filename-encoding string
+                          Non-ASCII in file names: percent (caf%%C3%%A9), unicode (café), ascii (cafe) or raw bytes;
+                          pretty paths take percent or ascii (default: percent)
+  -normalize-encoded-paths
+                          Decode escaped letters, digits and -_. in file names (my%%2Dfile.html → my-file.html);
+                          other escapes are kept (preserve mode only)
   -canonical string       Canonical tag handling: keep|remove (default: keep)
+  -remove-preconnect      Remove <link rel="dns-prefetch"/"preconnect"> hints (with -rewrite-links)
+  -strip-amp              Remove <link rel="amphtml"> and canonicals pointing at AMP pages (with -rewrite-links)
+  -no-wayback-metadata    Remove the Wayback toolbar block and archiving comments (FILE ARCHIVED ON, playback
+                          timings, HTTrack "Mirrored from", "saved from url") from pages (with -rewrite-links)
+  -rewrite-onclick        Point window.location='...' assignments in onclick handlers at local pages (with -rewrite-links)
+  -xhtml-output           Write rewritten pages as well-formed XML, e.g. for pages served as application/xhtml+xml
+                          (scripts and styles in CDATA sections; with -rewrite-links)
+  -rewrite-srcset-descriptors
+                          Keep only srcset candidates that were archived; fall back to src when none were
+  -html-parser string     Malformed markup: lenient, or strict to count the parser's corrections (default: lenient)
+  -html-max-corrections int
+                          With -html-parser strict, leave pages with more corrections unrewritten (default: 0 = no limit)
+  -concurrent-css         Rewrite CSS on a separate worker pool (with -rewrite-links)
+  -css-threads int        CSS rewrite workers for -concurrent-css (default: CPUs/2)
   -exact-url              Download only the exact URL, no wildcard /*
+  -only-latest-per-host   Download only the newest home page of the host and of each of its subdomains,
+                          each into a directory named after its host
+  -asset-only             Download only the given page and the same-host assets it embeds
+  -assets-first           Download styles, scripts, images and fonts before HTML pages
+  -no-fonts               Skip web fonts (woff, woff2, ttf, eot, otf) and drop <link rel="preload" as="font">
+  -skip-assets            Download HTML pages only; rewritten links to images, CSS and JS point at the archive
   -external-assets        Also download off-site (external) assets
+  -subdomain string       Also archive <sub>.<host> and treat it as internal (repeatable)
+  -cdn-map string         Also archive a CDN host and store its files under a directory,
+                          e.g. cdn.example.com=cdn; links to it are rewritten there (repeatable)
   -stop-on-error          Stop immediately on first download error (default: continue)
+  -max-duration duration  Stop cleanly after this long, e.g. 30m; a rerun resumes (default: no limit)
+  -accept-ranges          Keep partial files of interrupted downloads and resume them with Range requests
+                          where the archive supports them (local output directory only)
+  -track-404s             Count indexed URLs the archive answers 404 for at download time
+  -404-log string         Write those URLs, one per line, to a file (implies -track-404s)
+  -manifest-out string    Write the snapshot manifest (timestamp, url, local path, size, type) to a file
+  -manifest-format string Manifest format: json|csv (default: json)
+  -content-type-override string
+                          Content-Type by extension, replacing the archive's for rewriting and the manifest,
+                          e.g. js=application/javascript,wasm=application/wasm (alias -ct-override; repeatable)
+  -limit-per-ext string   Download at most N files per extension, newest first, e.g. css=50,js=100
+                          (0 skips the extension; repeatable)
+  -download-list-only string
+                          Write the capture URLs that would be fetched to a file, one per line, and exit
+  -metadata-only          Query the index and write the manifest, with each capture's local path, to
+                          -manifest-out without downloading (for scripting, e.g. with jq)
+  -dedupe-report          Query the index uncollapsed and report how many rows variant dedup, digest collapse
+                          and the newest-per-URL choice leave, with an estimated download size, then exit
+  -write-index            Write _index.html at the output root linking every downloaded page
+  -thumbnails             Also fetch the archive's screenshot of each page into _thumbs/
+  -preload-headers        Also fetch same-host assets named in archived Link: rel=preload headers
+  -source-maps            Also fetch the source map a script names in its //# sourceMappingURL comment, and
+                          point the comment at the local copy (with -rewrite-links)
+  -two-pass-extraction    After the download, also fetch the same-host URLs that pages link (href, src, srcset,
+                          action, style) but the CDX index does not list, dated like the page linking them
+  -probe-cdn              After the download, find subdomains (e.g. assets-1.example.com) that pages and
+                          stylesheets reference and that resolve in DNS, then index and fetch their captures too
+  -cookie string          Cookie header sent with every request ("name=value; name2=value2")
+  -mirror-header string   Header sent with archive downloads but not CDX queries, e.g. "Accept-Language: en-US"
+                          (repeatable)
+  -cookie-file string     Netscape-format cookie file (as exported by browsers/curl)
+  -insecure               Skip TLS certificate verification, for self-signed mirrors or intercepting proxies
+                          (alias -allow-insecure; use with care)
+  -max-idle-conns-per-host int
+                          Idle archive connections kept for reuse (default: -threads)
+  -idle-conn-timeout duration
+                          Close connections idle for this long (default: 90s)
+  -dns-cache duration     Reuse host name lookups for this long, e.g. 5m (default: 0 = look up every connection)
+  -capture-redirect-chains
+                          Record archived redirect hops into redirects.tsv
+  -schedule string        Daily throttle window: off-peak:HH:MM-HH:MM or peak:HH:MM-HH:MM (local time)
+  -peak-rate int          Downloads per minute during peak hours; 0 pauses (default: 0)
   -cdx-rate int           CDX API requests per minute (default: 60)
   -cdx-retries int        Max retries on CDX throttle or 5xx (default: 5)
-  -debug                  Enable verbose debug logging
+  -total-retries int      CDX retries allowed across the whole run before giving up; 0 = unlimited (default: 0)
+                          (downloads are not retried, so they do not draw on it)
+  -max-snapshot-index int Keep at most N captures in the download index, the newest (default: 0 = unlimited);
+                          applied once the CDX listing is fetched, so it does not cap the listing's memory
+  -cdx-timeout duration   Deadline for each CDX request, e.g. 90s; 0 = the client's 60s timeout (default: 60s)
+  -parallel-variants      Query the CDX index for all URL variants (http/https, www) concurrently
+  -collapse-mode string   CDX collapsing: digest|urlkey|timestamp:N (default: digest)
+  -drop-fragment-only-dupes
+                          Drop CDX entries whose URL only adds a #fragment to another entry's URL
+  -cdx-endpoint string    CDX API endpoint: xd|cdx (default: probe xd, fall back to cdx)
+  -cdx-filter string      Extra CDX filter, [!]field:regex, e.g. mimetype:text/html or !urlkey:.*\.pdf$ (repeatable);
+                          applied with the default statuscode:200 unless it tests statuscode itself
+  -archive-base string    Root of a Wayback-compatible archive (OpenWayback, pywb) used for CDX
+                          queries and downloads (default: https://web.archive.org)
+  -progress-format string Progress output: text (bars) or json (one object per update on stderr) (default: text)
+  -progress-file string   Rewrite a JSON status file (phase, current, total, failed, elapsed) every second
+  -metrics-addr string    Serve Prometheus metrics (files, bytes, failures, retries, ...) at http://<addr>/metrics
+  -serve string           After downloading, preview the output directory over HTTP at addr, e.g. :8080,
+                          with content types from -manifest-out or -url-map and index.html for directories
+  -serve-only             With -serve, preview the existing output directory without downloading
+  -probe                  Make a few CDX and download requests, report latency and throttling (429s),
+                          recommend -cdx-rate and -threads, and exit without downloading
+  -log-level string       Log level: debug (per-request detail), info (summaries), warn, error (default: info)
+  -debug                  Deprecated alias for -log-level debug
+  -debug-urls             Log each URL mapping step: CDX URL, local path, output file, rewritten links
   -version                Print version and exit
   -h / -help              Show this help and exit
+
+Exit codes:
+  0  success
+  1  unclassified error
+  2  invalid flags or arguments
+  3  partial success (some files failed to download)
+  4  no snapshots found
+  5  CDX index or network error
+  6  -max-duration reached (rerun to resume)
 `)
 }
 
@@ -42,53 +328,137 @@ func main() {
 	fs.Usage = usage
 
 	var (
-		urlFlag      string
-		fromFlag     string
-		toFlag       string
-		threadsFlag  int
-		dirFlag      string
-		rewriteLinks bool
-		prettyPath   bool
-		canonical    string
-		exactURL     bool
-		extAssets    bool
-		stopOnError  bool
-		cdxRate      int
-		cdxRetries   int
-		debug        bool
+		urlFlag     string
+		cookieFile  string
+		metricsAddr string
+		serveAddr   string
+		serveOnly   bool
+		configPath  string
+		probe       bool
+		cfg         = &wayback.Config{}
 	)
 
+	fs.StringVar(&configPath, "config", "", "Load options from a JSON file")
+	fs.StringVar(&configPath, "json-config", "", "Alias for -config")
 	fs.StringVar(&urlFlag, "url", "", "Domain or URL to archive")
-	fs.StringVar(&fromFlag, "from", "", "Start timestamp YYYYMMDDhhmmss")
-	fs.StringVar(&toFlag, "to", "", "End timestamp YYYYMMDDhhmmss")
-	fs.IntVar(&threadsFlag, "threads", 3, "Concurrent download threads")
-	fs.StringVar(&dirFlag, "directory", "", "Output directory")
-	fs.BoolVar(&rewriteLinks, "rewrite-links", false, "Rewrite page links to relative paths")
-	fs.BoolVar(&prettyPath, "pretty-path", false, "Prettify paths: map extension-less URLs to dir/index.html")
-	fs.StringVar(&canonical, "canonical", "keep", "Canonical tag handling: keep|remove")
-	fs.BoolVar(&exactURL, "exact-url", false, "Download only the exact URL, no wildcard /*")
-	fs.BoolVar(&extAssets, "external-assets", false, "Also download off-site (external) assets")
-	fs.BoolVar(&stopOnError, "stop-on-error", false, "Stop immediately on first download error")
-	fs.IntVar(&cdxRate, "cdx-rate", 60, "CDX API requests per minute")
-	fs.IntVar(&cdxRetries, "cdx-retries", 5, "Max retries on CDX throttle or 5xx")
-	fs.BoolVar(&debug, "debug", false, "Enable verbose debug logging")
+	fs.StringVar(&cfg.FromTimestamp, "from", "", "Start timestamp YYYYMMDDhhmmss")
+	fs.StringVar(&cfg.ToTimestamp, "to", "", "End timestamp YYYYMMDDhhmmss")
+	fs.StringVar(&cfg.SnapshotDate, "archive-org-snapshot-date", "", "Only captures from this day, YYYYMMDD or RFC3339")
+	fs.IntVar(&cfg.Threads, "threads", 3, "Concurrent download threads")
+	fs.StringVar(&cfg.Directory, "directory", "", "Output directory")
+	fs.StringVar(&cfg.OutputDirTemplate, "output-dir-template", "", "Output directory template, e.g. archives/{{.Year}}/{{.Host}}")
+	fs.BoolVar(&cfg.DatedDir, "dated-dir", false, "Save into a per-run <YYYYMMDD-HHMMSS> subdirectory")
+	fs.BoolVar(&cfg.DatedDir, "timestamp-suffix", false, "Alias for -dated-dir")
+	fs.BoolVar(&cfg.RewriteLinks, "rewrite-links", false, "Rewrite page links to relative paths")
+	fs.BoolVar(&cfg.Repair, "repair", false, "Rewrite links in an existing output directory without downloading")
+	fs.StringVar(&cfg.URLMap, "url-map", "", "Manifest from -manifest-out mapping files to URLs, for -repair")
+	fs.StringVar(&cfg.RewriteDryRun, "rewrite-dry-run", "", "With -repair, list the link changes in this TSV file instead of writing them")
+	fs.BoolVar(&cfg.KeepNewer, "keep-newer", false, "Stamp files with their capture time; -repair skips files modified since")
+	fs.BoolVar(&cfg.KeepNewer, "no-clobber-newer", false, "Alias for -keep-newer")
+	fs.StringVar(&cfg.RewriteOut, "rewrite-out", "", "Directory for rewritten files; the originals are kept")
+	fs.BoolVar(&cfg.Merge, "merge", false, "Merge into an existing output directory without clobbering other captures")
+	fs.BoolVar(&cfg.FsyncOnWrite, "safe-write", false, "Flush every file to disk before it replaces the old one")
+	fs.StringVar(&cfg.StateFile, "state-file", "", "Checkpoint of the capture index and progress; resumed from when present")
+	fs.BoolVar(&cfg.PrettyPath, "pretty-path", false, "Prettify paths: map extension-less URLs to dir/index.html")
+	fs.IntVar(&cfg.MaxPathDepth, "max-path-depth", 0, "Cut local paths to N components plus a hash suffix (0 = unlimited)")
+	fs.IntVar(&cfg.MaxPathDepth, "max-depth-segments", 0, "Alias for -max-path-depth")
+	fs.IntVar(&cfg.MaxPathDepth, "max-depth", 0, "Alias for -max-path-depth")
+	fs.IntVar(&cfg.MaxAbsPathLen, "max-abs-path-len", 0, "Hash names of files whose absolute path exceeds N bytes (0 = off)")
+	fs.StringVar(&cfg.TrailingSlash, "trailing-slash", "keep", "Extension-less paths: keep|collapse")
+	fs.StringVar(&cfg.FilenameEncoding, "filename-encoding", "percent", "Non-ASCII in file names: raw|percent|unicode|ascii")
+	fs.BoolVar(&cfg.NormalizeEncodedPaths, "normalize-encoded-paths", false, "Decode escaped letters, digits and -_. in file names")
+	fs.StringVar(&cfg.CanonicalAction, "canonical", "keep", "Canonical tag handling: keep|remove")
+	fs.BoolVar(&cfg.RemovePreconnect, "remove-preconnect", false, "Remove <link rel=dns-prefetch/preconnect> hints")
+	fs.BoolVar(&cfg.StripAMP, "strip-amp", false, "Remove AMP alternate and AMP canonical links")
+	fs.BoolVar(&cfg.StripWaybackComments, "no-wayback-metadata", false, "Remove Wayback toolbar and archiving comments from pages")
+	fs.BoolVar(&cfg.RewriteOnclick, "rewrite-onclick", false, "Rewrite window.location URLs in onclick handlers")
+	fs.BoolVar(&cfg.XHTMLOutput, "xhtml-output", false, "Write rewritten pages as well-formed XML")
+	fs.BoolVar(&cfg.RewriteSrcsetDescriptors, "rewrite-srcset-descriptors", false, "Keep only srcset candidates that were archived")
+	fs.StringVar(&cfg.HTMLParser, "html-parser", wayback.HTMLParserLenient, "Malformed markup handling: lenient|strict")
+	fs.IntVar(&cfg.HTMLMaxCorrections, "html-max-corrections", 0, "With -html-parser strict, leave pages with more corrections unrewritten")
+	fs.BoolVar(&cfg.ConcurrentCSS, "concurrent-css", false, "Rewrite CSS on a separate worker pool")
+	fs.IntVar(&cfg.CSSRewriteThreads, "css-threads", 0, "CSS rewrite workers for -concurrent-css (default: CPUs/2)")
+	fs.BoolVar(&cfg.ExactURL, "exact-url", false, "Download only the exact URL, no wildcard /*")
+	fs.BoolVar(&cfg.OnlyLatestPerHost, "only-latest-per-host", false, "Download only the newest home page of each host and subdomain")
+	fs.BoolVar(&cfg.DownloadExternalAssets, "external-assets", false, "Also download off-site (external) assets")
+	fs.BoolVar(&cfg.AssetOnly, "asset-only", false, "Download only the given page and the same-host assets it embeds")
+	fs.BoolVar(&cfg.AssetsFirst, "assets-first", false, "Download styles, scripts, images and fonts before HTML pages")
+	fs.BoolVar(&cfg.NoFonts, "no-fonts", false, "Skip web fonts and drop font preloads")
+	fs.BoolVar(&cfg.SkipAssets, "skip-assets", false, "Download HTML pages only and link assets to the archive")
+	fs.Var((*stringList)(&cfg.ExtraSubdomains), "subdomain", "Also archive <sub>.<host> and treat it as internal (repeatable)")
+	fs.BoolVar(&cfg.StopOnError, "stop-on-error", false, "Stop immediately on first download error")
+	fs.DurationVar(&cfg.MaxDuration, "max-duration", 0, "Stop cleanly after this long, e.g. 30m; rerun to resume")
+	fs.BoolVar(&cfg.AcceptRanges, "accept-ranges", false, "Resume interrupted downloads with Range requests")
+	fs.BoolVar(&cfg.Track404s, "track-404s", false, "Count indexed URLs that return 404 at download time")
+	fs.StringVar(&cfg.NotFoundLog, "404-log", "", "Write URLs that returned 404 to a file (implies -track-404s)")
+	fs.StringVar(&cfg.ManifestOut, "manifest-out", "", "Write the snapshot manifest to a file")
+	fs.StringVar(&cfg.ManifestFormat, "manifest-format", "json", "Manifest format: json|csv")
+	fs.StringVar(&cfg.DownloadListOnly, "download-list-only", "", "Write the capture URLs that would be fetched to a file and exit")
+	fs.BoolVar(&cfg.MetadataOnly, "metadata-only", false, "Write the manifest with local paths to -manifest-out without downloading")
+	fs.BoolVar(&cfg.DedupeReport, "dedupe-report", false, "Report what CDX deduplication saves, without downloading")
+	fs.BoolVar(&cfg.WriteIndex, "write-index", false, "Write _index.html at the output root linking every downloaded page")
+	fs.BoolVar(&cfg.Thumbnails, "thumbnails", false, "Also fetch the archive's screenshot of each page into _thumbs/")
+	fs.BoolVar(&cfg.PreloadHeaders, "preload-headers", false, "Also fetch same-host assets named in archived Link: rel=preload headers")
+	fs.BoolVar(&cfg.SourceMaps, "source-maps", false, "Also fetch source maps named by scripts and link them locally")
+	fs.BoolVar(&cfg.TwoPassExtraction, "two-pass-extraction", false, "Also fetch same-host URLs linked by pages but missing from the CDX index")
+	fs.BoolVar(&cfg.ProbeCDN, "probe-cdn", false, "Also fetch resolving subdomains referenced by pages and stylesheets")
+	fs.StringVar(&cfg.Cookies, "cookie", "", "Cookie header sent with every request")
+	fs.Var((*headerMap)(&cfg.MirrorHeaders), "mirror-header", "Header sent with archive downloads but not CDX queries, \"Key: Value\" (repeatable)")
+	fs.Var((*typeMap)(&cfg.ContentTypeOverrides), "content-type-override", "Content-Type by extension, ext=type[,ext=type...] (repeatable)")
+	fs.Var((*typeMap)(&cfg.ContentTypeOverrides), "ct-override", "Alias for -content-type-override")
+	fs.Var((*extLimits)(&cfg.LimitPerExt), "limit-per-ext", "Most files per extension, e.g. css=50,js=100 (repeatable)")
+	fs.Var((*cdnMap)(&cfg.CDNMap), "cdn-map", "Also archive a CDN host and store its files under a directory, e.g. cdn.example.com=cdn (repeatable)")
+	fs.StringVar(&cookieFile, "cookie-file", "", "Netscape-format cookie file")
+	fs.StringVar(&metricsAddr, "metrics-addr", "", "Serve Prometheus metrics at http://<addr>/metrics, e.g. :9090")
+	fs.StringVar(&serveAddr, "serve", "", "Preview the output directory over HTTP at addr after downloading, e.g. :8080")
+	fs.BoolVar(&serveOnly, "serve-only", false, "With -serve, preview the output directory without downloading")
+	fs.BoolVar(&probe, "probe", false, "Test CDX and download requests, recommend -cdx-rate/-threads, and exit")
+	fs.BoolVar(&cfg.Insecure, "insecure", false, "Skip TLS certificate verification")
+	fs.BoolVar(&cfg.Insecure, "allow-insecure", false, "Alias for -insecure")
+	fs.IntVar(&cfg.MaxIdleConnsPerHost, "max-idle-conns-per-host", 0, "Idle archive connections kept for reuse (default: -threads)")
+	fs.DurationVar(&cfg.IdleConnTimeout, "idle-conn-timeout", 90*time.Second, "Close connections idle for this long")
+	fs.DurationVar(&cfg.DNSCacheTTL, "dns-cache", 0, "Reuse host name lookups for this long, e.g. 5m")
+	fs.BoolVar(&cfg.CaptureRedirects, "capture-redirect-chains", false, "Record archived redirect hops into redirects.tsv")
+	fs.StringVar(&cfg.Schedule, "schedule", "", "Daily throttle window: off-peak:HH:MM-HH:MM or peak:HH:MM-HH:MM")
+	fs.IntVar(&cfg.PeakRatePerMin, "peak-rate", 0, "Downloads per minute during peak hours; 0 pauses")
+	fs.IntVar(&cfg.CDXRatePerMin, "cdx-rate", 60, "CDX API requests per minute")
+	fs.IntVar(&cfg.CDXMaxRetries, "cdx-retries", 5, "Max retries on CDX throttle or 5xx")
+	fs.IntVar(&cfg.TotalRetries, "total-retries", 0, "CDX retries allowed across the whole run before giving up (downloads are not retried); 0 = unlimited")
+	fs.IntVar(&cfg.MaxSnapshotIndex, "max-snapshot-index", 0, "Keep at most N captures in the download index, the newest, once the CDX listing is fetched; 0 = unlimited")
+	fs.DurationVar(&cfg.CDXRequestTimeout, "cdx-timeout", 60*time.Second, "Deadline for each CDX request; 0 = the client's timeout")
+	fs.BoolVar(&cfg.ParallelVariants, "parallel-variants", false, "Query the CDX index for all URL variants concurrently")
+	fs.StringVar(&cfg.CollapseMode, "collapse-mode", "digest", "CDX collapsing: digest|urlkey|timestamp:N")
+	fs.BoolVar(&cfg.DropFragmentDupes, "drop-fragment-only-dupes", false, "Drop CDX entries that differ from another only by a #fragment")
+	fs.StringVar(&cfg.CDXEndpoint, "cdx-endpoint", "", "CDX API endpoint: xd|cdx (default: auto-detect)")
+	fs.Var((*stringList)(&cfg.CDXFilters), "cdx-filter", "Extra CDX filter [!]field:regex (repeatable)")
+	fs.StringVar(&cfg.ArchiveBase, "archive-base", "", "Root of a Wayback-compatible archive (default: https://web.archive.org)")
+	fs.StringVar(&cfg.ProgressFile, "progress-file", "", "Keep a JSON status file up to date for headless monitoring")
+	fs.StringVar(&cfg.ProgressFormat, "progress-format", "text", "Progress output: text|json")
+	fs.StringVar(&cfg.LogLevel, "log-level", wayback.LogInfo, "Log level: debug|info|warn|error")
+	fs.BoolVar(&cfg.Debug, "debug", false, "Deprecated alias for -log-level debug")
+	fs.BoolVar(&cfg.DebugURLs, "debug-urls", false, "Log every URL to local path mapping step")
 
 	// Handle -version / -h / -help before the flag parser so we control the exit code.
+	// Arguments after "--" are positional and never treated as flags.
 	for _, a := range os.Args[1:] {
+		if a == "--" {
+			break
+		}
 		if a == "-version" || a == "--version" {
 			fmt.Printf("wayback-dl %s (commit %s, built %s)\n", version, commit, date)
-			os.Exit(0)
+			os.Exit(exitOK)
 		}
 		if a == "-h" || a == "-help" || a == "--help" {
 			usage()
-			os.Exit(0)
+			os.Exit(exitOK)
 		}
 	}
 
 	// Extract a leading positional URL argument before flag parsing so that
 	// "wayback-dl example.com -canonical remove" works (flags after the URL
 	// are still parsed correctly; the stdlib flag package stops at the first
-	// non-flag argument).
+	// non-flag argument). "wayback-dl -threads 8 -- example.com" is handled
+	// after parsing: everything after "--" is left in fs.Args().
 	args := os.Args[1:]
 	var positionalURL string
 	if len(args) > 0 && args[0] != "" && !strings.HasPrefix(args[0], "-") {
@@ -96,66 +466,146 @@ func main() {
 		args = args[1:]
 	}
 
+	// Precedence: flag defaults < -config file < explicit flags. The file is
+	// loaded over the defaults before parsing so that parsing overrides it.
+	if path := configPathFromArgs(args); path != "" {
+		if err := loadConfigFile(path, cfg, &urlFlag, &cookieFile); err != nil {
+			fmt.Fprintf(os.Stderr, "error: -config: %v\n", err)
+			os.Exit(exitUsage)
+		}
+	}
+
 	if err := fs.Parse(args); err != nil {
 		// Unknown/malformed flag: fs already printed the error message
-		os.Exit(2)
+		os.Exit(exitUsage)
 	}
 
-	// Merge positional URL with -url flag (explicit -url wins)
-	if urlFlag == "" {
+	// A URL that follows the flags (typically after "--") is positional too.
+	rest := fs.Args()
+	if positionalURL == "" && len(rest) > 0 {
+		positionalURL, rest = rest[0], rest[1:]
+	}
+	if len(rest) > 0 {
+		fmt.Fprintf(os.Stderr, "error: unexpected argument %q\n", rest[0])
+		os.Exit(exitUsage)
+	}
+
+	// Merge positional URL with -url flag (explicit -url wins). A positional
+	// URL is on the command line, so it also beats a url from -config.
+	urlSet := false
+	fs.Visit(func(f *flag.Flag) { urlSet = urlSet || f.Name == "url" })
+	if !urlSet && positionalURL != "" {
 		urlFlag = positionalURL
 	}
 
 	// Validation — check flags before checking URL so flag errors surface clearly
-	if threadsFlag <= 0 {
-		fmt.Fprintln(os.Stderr, "error: -threads must be greater than 0")
-		os.Exit(1)
+	cfg.CanonicalAction = strings.ToLower(cfg.CanonicalAction)
+	cfg.ManifestFormat = strings.ToLower(cfg.ManifestFormat)
+	cfg.ProgressFormat = strings.ToLower(cfg.ProgressFormat)
+	cfg.HTMLParser = strings.ToLower(cfg.HTMLParser)
+	cfg.LogLevel = strings.ToLower(cfg.LogLevel)
+	if err := cfg.Validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(exitUsage)
 	}
-	canonical = strings.ToLower(canonical)
-	if canonical != "keep" && canonical != "remove" {
-		fmt.Fprintln(os.Stderr, "error: -canonical must be 'keep' or 'remove'")
-		os.Exit(1)
+	if serveOnly && serveAddr == "" {
+		fmt.Fprintln(os.Stderr, "error: -serve-only requires -serve")
+		os.Exit(exitUsage)
+	}
+	if serveAddr != "" && (cfg.OutputDirTemplate != "" || cfg.DatedDir) {
+		fmt.Fprintln(os.Stderr, "error: -serve needs a fixed -directory, not -output-dir-template or -dated-dir")
+		os.Exit(exitUsage)
 	}
 	if urlFlag == "" {
 		fmt.Fprintln(os.Stderr, "error: URL is required")
 		usage()
-		os.Exit(1)
+		os.Exit(exitUsage)
 	}
 
-	base, err := wayback.NormalizeBaseURL(urlFlag)
+	base, err := wayback.NormalizeBaseURL(urlFlag, cfg.ExtraSubdomains...)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "error: invalid URL: %v\n", err)
-		os.Exit(1)
-	}
-
-	outDir := dirFlag
-	if outDir == "" {
-		outDir = "websites/" + base.BareHost
-	}
-
-	cfg := &wayback.Config{
-		BaseURL:                base.CanonicalURL,
-		Variants:               base.Variants,
-		BareHost:               base.BareHost,
-		UnicodeHost:            base.UnicodeHost,
-		ExactURL:               exactURL,
-		Directory:              outDir,
-		FromTimestamp:          fromFlag,
-		ToTimestamp:            toFlag,
-		Threads:                threadsFlag,
-		RewriteLinks:           rewriteLinks,
-		PrettyPath:             prettyPath,
-		CanonicalAction:        canonical,
-		DownloadExternalAssets: extAssets,
-		StopOnError:            stopOnError,
-		CDXRatePerMin:          cdxRate,
-		CDXMaxRetries:          cdxRetries,
-		Debug:                  debug,
-	}
-
-	fmt.Printf("Fetching snapshot index for %s ...\n", base.CanonicalURL)
-	if err := wayback.DownloadAll(cfg); err != nil {
+		os.Exit(exitUsage)
+	}
+
+	if cookieFile != "" {
+		f, err := os.Open(cookieFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: -cookie-file: %v\n", err)
+			os.Exit(exitUsage)
+		}
+		cfg.CookieList, err = wayback.ParseNetscapeCookies(f)
+		_ = f.Close()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: -cookie-file: %v\n", err)
+			os.Exit(exitUsage)
+		}
+	}
+
+	cfg.BaseURL = base.CanonicalURL
+	cfg.Variants = base.Variants
+	cfg.BareHost = base.BareHost
+	cfg.UnicodeHost = base.UnicodeHost
+	if cfg.Directory == "" && cfg.OutputDirTemplate == "" {
+		cfg.Directory = "websites/" + base.BareHost
+	}
+
+	if cfg.Insecure {
+		if cfg.LogEnabled(wayback.LogWarn) {
+			fmt.Fprintln(os.Stderr, "warning: TLS certificate verification is disabled (-insecure)")
+		}
+	}
+	if probe {
+		rep, err := wayback.Probe(cfg)
+		printProbe(os.Stdout, rep)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		}
+		os.Exit(exitCode(err))
+	}
+	var previewLn net.Listener
+	if serveAddr != "" {
+		// Listen before downloading so a busy port fails the run up front.
+		if previewLn, err = net.Listen("tcp", serveAddr); err != nil {
+			fmt.Fprintf(os.Stderr, "error: -serve: %v\n", err)
+			os.Exit(exitUsage)
+		}
+	}
+	if serveOnly {
+		err = servePreview(previewLn, cfg)
+		fmt.Fprintf(os.Stderr, "error: -serve: %v\n", err)
+		os.Exit(exitCode(err))
+	}
+	if cfg.LogEnabled(wayback.LogInfo) {
+		if cfg.Repair {
+			fmt.Printf("Repairing links in %s ...\n", cfg.Directory)
+		} else {
+			fmt.Printf("Fetching snapshot index for %s ...\n", base.CanonicalURL)
+		}
+	}
+	if metricsAddr != "" {
+		m := &metrics{}
+		if err := serveMetrics(metricsAddr, m); err != nil {
+			fmt.Fprintf(os.Stderr, "error: -metrics-addr: %v\n", err)
+			os.Exit(exitUsage)
+		}
+		cfg.Hooks = m.hooks()
+	}
+	err = wayback.DownloadAll(cfg)
+	switch {
+	case err == nil:
+	case errors.Is(err, wayback.ErrNoSnapshots):
+		if cfg.LogEnabled(wayback.LogInfo) {
+			fmt.Println("No snapshots found.")
+		}
+	default:
 		fmt.Fprintf(os.Stderr, "error: %v\n", err)
-		os.Exit(1)
 	}
+	var partial *wayback.PartialError
+	if previewLn != nil && (err == nil || errors.As(err, &partial)) {
+		if serr := servePreview(previewLn, cfg); serr != nil {
+			fmt.Fprintf(os.Stderr, "error: -serve: %v\n", serr)
+		}
+	}
+	os.Exit(exitCode(err))
 }
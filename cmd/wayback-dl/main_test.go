@@ -2,10 +2,16 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"io"
+	"net"
 	"os"
 	"os/exec"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/sigman78/wayback-dl/internal/wayback"
 )
 
 // subprocessEnv is set in the re-executed subprocess so it knows to call main()
@@ -24,6 +30,18 @@ func runSubprocess(t *testing.T, testName string) error {
 	return cmd.Run()
 }
 
+// runSubprocessStderr is like runSubprocess but also returns captured stderr.
+func runSubprocessStderr(t *testing.T, testName string) (string, error) {
+	t.Helper()
+	var stderr strings.Builder
+	cmd := exec.Command(os.Args[0], "-test.run="+testName)
+	cmd.Env = append(os.Environ(), subprocessEnv+"=1")
+	cmd.Stdout = io.Discard
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	return stderr.String(), err
+}
+
 // TestHelpExitsZero verifies that -help prints usage and exits with code 0.
 func TestHelpExitsZero(t *testing.T) {
 	if os.Getenv(subprocessEnv) == "1" {
@@ -52,3 +70,175 @@ func TestUnknownFlagExitsTwo(t *testing.T) {
 		t.Fatalf("expected exit code 2, got %d", exitErr.ExitCode())
 	}
 }
+
+// TestMissingURLExitsUsage verifies that running without a URL is reported
+// as a usage error (exit code 2).
+func TestMissingURLExitsUsage(t *testing.T) {
+	if os.Getenv(subprocessEnv) == "1" {
+		os.Args = []string{"wayback-dl", "-threads", "2"}
+		main()
+		return // unreachable; main calls os.Exit
+	}
+	err := runSubprocess(t, "TestMissingURLExitsUsage")
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != exitUsage {
+		t.Fatalf("expected exit code %d, got: %v", exitUsage, err)
+	}
+}
+
+// TestCDXTimeoutZero verifies that -cdx-timeout 0 is accepted (it leaves
+// CDX requests to the client's timeout): the run gets as far as the missing
+// URL.
+func TestCDXTimeoutZero(t *testing.T) {
+	if os.Getenv(subprocessEnv) == "1" {
+		os.Args = []string{"wayback-dl", "-cdx-timeout", "0"}
+		main()
+		return // unreachable; main calls os.Exit
+	}
+	stderr, err := runSubprocessStderr(t, "TestCDXTimeoutZero")
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != exitUsage {
+		t.Fatalf("expected exit code %d, got: %v", exitUsage, err)
+	}
+	if strings.Contains(stderr, "timeout must") {
+		t.Errorf("-cdx-timeout 0 rejected:\n%s", stderr)
+	}
+}
+
+// TestExitCodeCategories verifies that DownloadAll errors map to distinct codes.
+func TestExitCodeCategories(t *testing.T) {
+	cases := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"success", nil, exitOK},
+		{"partial", &wayback.PartialError{Failed: 1, Total: 3}, exitPartial},
+		{"time limit", fmt.Errorf("%w (30m0s)", wayback.ErrMaxDuration), exitTimeLimit},
+		{"no snapshots", wayback.ErrNoSnapshots, exitNoSnapshots},
+		{"cdx", fmt.Errorf("%w: %w", wayback.ErrCDX, errors.New("cdx HTTP 500")), exitNetwork},
+		{"network", fmt.Errorf("http get: %w", &net.DNSError{Err: "no such host"}), exitNetwork},
+		{"other", errors.New("store: disk full"), exitError},
+	}
+	for _, tc := range cases {
+		if got := exitCode(tc.err); got != tc.want {
+			t.Errorf("%s: exitCode = %d, want %d", tc.name, got, tc.want)
+		}
+	}
+}
+
+// TestDoubleDashPositionalURL verifies that arguments after "--" are taken as
+// positional: "-help" is not treated as a flag, and a second positional
+// argument is rejected as a usage error.
+func TestDoubleDashPositionalURL(t *testing.T) {
+	if os.Getenv(subprocessEnv) == "1" {
+		os.Args = []string{"wayback-dl", "-threads", "8", "--", "example.com", "-help"}
+		main()
+		return // unreachable; main calls os.Exit
+	}
+	stderr, err := runSubprocessStderr(t, "TestDoubleDashPositionalURL")
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != exitUsage {
+		t.Fatalf("expected exit code %d, got: %v", exitUsage, err)
+	}
+	if !strings.Contains(stderr, `unexpected argument "-help"`) {
+		t.Errorf("expected unexpected-argument error, got stderr:\n%s", stderr)
+	}
+}
+
+// TestDoubleDashMissingURL verifies that a trailing "--" with nothing after it
+// still reports the missing URL as a usage error.
+func TestDoubleDashMissingURL(t *testing.T) {
+	if os.Getenv(subprocessEnv) == "1" {
+		os.Args = []string{"wayback-dl", "-threads", "8", "--"}
+		main()
+		return // unreachable; main calls os.Exit
+	}
+	stderr, err := runSubprocessStderr(t, "TestDoubleDashMissingURL")
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != exitUsage {
+		t.Fatalf("expected exit code %d, got: %v", exitUsage, err)
+	}
+	if !strings.Contains(stderr, "URL is required") {
+		t.Errorf("expected missing-URL error, got stderr:\n%s", stderr)
+	}
+}
+
+// TestHeaderMapFlag verifies that -mirror-header parses "Key: Value" pairs
+// into canonical header names and rejects values without a colon.
+func TestHeaderMapFlag(t *testing.T) {
+	var h headerMap
+	for _, v := range []string{"accept-language: en-US", "Accept:text/html"} {
+		if err := h.Set(v); err != nil {
+			t.Fatalf("Set(%q): %v", v, err)
+		}
+	}
+	if got := h.String(); got != "Accept: text/html, Accept-Language: en-US" {
+		t.Errorf("String() = %q", got)
+	}
+	for _, v := range []string{"Accept-Language", ": en"} {
+		if err := h.Set(v); err == nil {
+			t.Errorf("Set(%q): expected an error", v)
+		}
+	}
+}
+
+func TestTypeMapFlag(t *testing.T) {
+	var m typeMap
+	for _, v := range []string{"js=application/javascript, .WASM=application/wasm", "js=text/javascript"} {
+		if err := m.Set(v); err != nil {
+			t.Fatalf("Set(%q): %v", v, err)
+		}
+	}
+	if got := m.String(); got != "js=text/javascript,wasm=application/wasm" {
+		t.Errorf("String() = %q", got)
+	}
+	for _, v := range []string{"js", "=text/plain", "js="} {
+		if err := m.Set(v); err == nil {
+			t.Errorf("Set(%q): expected an error", v)
+		}
+	}
+}
+
+func TestExtLimitsFlag(t *testing.T) {
+	var m extLimits
+	for _, v := range []string{"css=50, .JS=100", "css=2"} {
+		if err := m.Set(v); err != nil {
+			t.Fatalf("Set(%q): %v", v, err)
+		}
+	}
+	if got := m.String(); got != "css=2,js=100" {
+		t.Errorf("String() = %q", got)
+	}
+	for _, v := range []string{"css", "=5", "css=", "css=x", "css=-1"} {
+		if err := m.Set(v); err == nil {
+			t.Errorf("Set(%q): expected an error", v)
+		}
+	}
+}
+
+func TestCDNMapFlag(t *testing.T) {
+	var m cdnMap
+	if err := m.Set("CDN.example.com=cdn/, static.example.com=static"); err != nil {
+		t.Fatal(err)
+	}
+	if got := m.String(); got != "cdn.example.com=cdn,static.example.com=static" {
+		t.Errorf("String() = %q", got)
+	}
+	for _, v := range []string{"cdn.example.com", "=cdn", "cdn.example.com=/"} {
+		if err := m.Set(v); err == nil {
+			t.Errorf("Set(%q): expected an error", v)
+		}
+	}
+}
+
+func TestPrintProbe(t *testing.T) {
+	var b strings.Builder
+	printProbe(&b, &wayback.ProbeReport{CDXRequests: 4, CDXThrottled: 1, CDXLatency: 1500 * time.Millisecond, CDXRate: 30, Threads: 3})
+	want := "CDX:         4 request(s), 1 throttled (429), 1.5s average\n" +
+		"Download:    not tested, no capture found\n" +
+		"Recommended: -cdx-rate 30 -threads 3\n"
+	if b.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", b.String(), want)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/sigman78/wayback-dl/internal/wayback"
+)
+
+// metrics counts download pipeline events, fed by wayback.Hooks, and serves
+// them in the Prometheus text exposition format for -metrics-addr.
+type metrics struct {
+	downloaded atomic.Int64 // files fetched and stored
+	bytes      atomic.Int64 // bytes stored
+	skipped    atomic.Int64 // files already on disk
+	notFound   atomic.Int64 // captures the archive answered 404 for
+	failures   atomic.Int64 // downloads that failed
+	retries    atomic.Int64 // retried requests
+	cdxPages   atomic.Int64 // CDX pages fetched
+	inFlight   atomic.Int64 // downloads in progress
+}
+
+// hooks returns the callbacks that keep m up to date.
+func (m *metrics) hooks() *wayback.Hooks {
+	return &wayback.Hooks{
+		OnCDXPage:       func(wayback.CDXPageEvent) { m.cdxPages.Add(1) },
+		OnRetry:         func(wayback.RetryEvent) { m.retries.Add(1) },
+		OnSnapshotStart: func(wayback.Snapshot) { m.inFlight.Add(1) },
+		OnSnapshotDone: func(r wayback.SnapshotResult) {
+			m.inFlight.Add(-1)
+			switch {
+			case r.Err != nil:
+				m.failures.Add(1)
+			case r.NotFound:
+				m.notFound.Add(1)
+			case r.Skipped:
+				m.skipped.Add(1)
+			default:
+				m.downloaded.Add(1)
+				m.bytes.Add(r.Bytes)
+			}
+		},
+	}
+}
+
+// ServeHTTP writes every metric with its HELP and TYPE lines.
+func (m *metrics) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	for _, mt := range []struct {
+		name, kind, help string
+		v                *atomic.Int64
+	}{
+		{"wayback_files_downloaded_total", "counter", "Files fetched from the archive and stored.", &m.downloaded},
+		{"wayback_bytes_downloaded_total", "counter", "Bytes stored from fetched files.", &m.bytes},
+		{"wayback_files_skipped_total", "counter", "Files skipped because they were already stored.", &m.skipped},
+		{"wayback_files_not_found_total", "counter", "Indexed captures the archive answered 404 for.", &m.notFound},
+		{"wayback_download_failures_total", "counter", "Downloads that failed.", &m.failures},
+		{"wayback_retries_total", "counter", "Requests retried after throttling or a server error.", &m.retries},
+		{"wayback_cdx_pages_total", "counter", "CDX index pages fetched.", &m.cdxPages},
+		{"wayback_downloads_in_flight", "gauge", "Downloads in progress.", &m.inFlight},
+	} {
+		_, _ = fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", mt.name, mt.help, mt.name, mt.kind, mt.name, mt.v.Load())
+	}
+}
+
+// serveMetrics starts serving m at /metrics on addr in the background.
+func serveMetrics(addr string, m *metrics) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m)
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() { _ = srv.Serve(ln) }()
+	return nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/sigman78/wayback-dl/internal/wayback"
+)
+
+// TestMetricsHooks verifies that hook events update the exported metrics.
+func TestMetricsHooks(t *testing.T) {
+	m := &metrics{}
+	h := m.hooks()
+	h.OnCDXPage(wayback.CDXPageEvent{})
+	h.OnRetry(wayback.RetryEvent{})
+	for _, r := range []wayback.SnapshotResult{
+		{Bytes: 100},
+		{Bytes: 20},
+		{Skipped: true},
+		{NotFound: true},
+		{Err: errors.New("HTTP 502")},
+	} {
+		h.OnSnapshotStart(r.Snapshot)
+		h.OnSnapshotDone(r)
+	}
+	h.OnSnapshotStart(wayback.Snapshot{})
+
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+	for _, want := range []string{
+		"# TYPE wayback_files_downloaded_total counter\nwayback_files_downloaded_total 2\n",
+		"wayback_bytes_downloaded_total 120\n",
+		"wayback_files_skipped_total 1\n",
+		"wayback_files_not_found_total 1\n",
+		"wayback_download_failures_total 1\n",
+		"wayback_retries_total 1\n",
+		"wayback_cdx_pages_total 1\n",
+		"# TYPE wayback_downloads_in_flight gauge\nwayback_downloads_in_flight 1\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics lack %q\n  got:\n%s", want, body)
+		}
+	}
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/sigman78/wayback-dl/internal/wayback"
+)
+
+// printProbe writes the -probe report rep to w. rep may describe a probe
+// that stopped early.
+func printProbe(w io.Writer, rep *wayback.ProbeReport) {
+	if rep == nil {
+		return
+	}
+	ms := func(d time.Duration) time.Duration { return d.Round(time.Millisecond) }
+	fmt.Fprintf(w, "CDX:         %d request(s), %d throttled (429), %s average\n",
+		rep.CDXRequests, rep.CDXThrottled, ms(rep.CDXLatency))
+	if rep.Capture == "" {
+		fmt.Fprintln(w, "Download:    not tested, no capture found")
+	} else {
+		fmt.Fprintf(w, "Download:    %d request(s), %d throttled (429), last HTTP %d, %s average\n",
+			rep.DownloadRequests, rep.DownloadThrottled, rep.DownloadStatus, ms(rep.DownloadLatency))
+		fmt.Fprintf(w, "             %s\n", rep.Capture)
+	}
+	fmt.Fprintf(w, "Recommended: -cdx-rate %d -threads %d\n", rep.CDXRate, rep.Threads)
+}
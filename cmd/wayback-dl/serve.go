@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/sigman78/wayback-dl/internal/wayback"
+)
+
+// servePreview serves the capture in cfg.Directory on ln for -serve until
+// the process is stopped. Content types come from the -manifest-out (or
+// -url-map) manifest when one exists; without one, they are guessed.
+func servePreview(ln net.Listener, cfg *wayback.Config) error {
+	var types map[string]string
+	for _, manifest := range []string{cfg.ManifestOut, cfg.URLMap} {
+		if manifest == "" {
+			continue
+		}
+		t, err := wayback.PreviewTypes(manifest)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			if cfg.LogEnabled(wayback.LogWarn) {
+				fmt.Fprintf(os.Stderr, "warning: -serve: content types from %s: %v\n", manifest, err)
+			}
+			continue
+		}
+		types = t
+		break
+	}
+	if cfg.LogEnabled(wayback.LogInfo) {
+		fmt.Printf("Serving %s at http://%s/ (Ctrl-C to stop)\n", cfg.Directory, previewHost(ln.Addr()))
+	}
+	srv := &http.Server{Handler: wayback.PreviewHandler(cfg.Directory, types), ReadHeaderTimeout: 10 * time.Second}
+	return srv.Serve(ln)
+}
+
+// previewHost returns addr as a host:port to browse, naming localhost
+// when the listener is on all interfaces.
+func previewHost(addr net.Addr) string {
+	host, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	if ip := net.ParseIP(host); ip == nil || ip.IsUnspecified() {
+		host = "localhost"
+	}
+	return net.JoinHostPort(host, port)
+}
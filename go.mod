@@ -7,6 +7,7 @@ require (
 	github.com/panjf2000/ants/v2 v2.11.5
 	golang.org/x/net v0.24.0
 	golang.org/x/sync v0.19.0
+	golang.org/x/text v0.14.0
 )
 
 require (
@@ -15,6 +16,5 @@ require (
 	github.com/schollz/progressbar/v3 v3.19.0 // indirect
 	golang.org/x/sys v0.29.0 // indirect
 	golang.org/x/term v0.28.0 // indirect
-	golang.org/x/text v0.14.0 // indirect
 	golang.org/x/time v0.14.0 // indirect
 )
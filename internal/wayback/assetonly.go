@@ -0,0 +1,63 @@
+package wayback
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"golang.org/x/net/html"
+)
+
+// assetOnlyManifest implements AssetOnly mode. It downloads the page at
+// cfg.BaseURL, extracts the same-host assets it references directly and
+// returns them as the manifest to download. Anchor links are not followed.
+// Asset timestamps are resolved through idx, falling back to the page's own
+// capture time (the archive redirects to the closest capture).
+func assetOnlyManifest(ctx context.Context, client *http.Client, cfg *Config, store Storage, idx *SnapshotIndex) ([]Snapshot, error) {
+	page, ok := idx.Lookup(cfg.BaseURL)
+	if !ok {
+		return nil, ErrNoSnapshots
+	}
+
+	// Fetch the page without rewriting so its links are still the originals.
+	pageCfg := cfg.Clone()
+	pageCfg.RewriteLinks = false
+	if err := downloadOne(ctx, client, page, pageCfg, store, idx, nil, nil, nil, nil); err != nil {
+		return nil, fmt.Errorf("asset-only page %s: %w", page.FileURL, err)
+	}
+	logicalPath := localPathFor(page.FileURL, cfg)
+	data, err := store.Get(logicalPath)
+	if err != nil {
+		return nil, fmt.Errorf("asset-only page %s: %w", page.FileURL, err)
+	}
+	doc, err := html.Parse(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("asset-only parse %s: %w", page.FileURL, err)
+	}
+	pageU, err := url.Parse(page.FileURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.RewriteLinks {
+		if err := (HTMLRewriter{}).Rewrite(rewriteTarget(store, cfg), logicalPath, page.FileURL, cfg, idx); err != nil {
+			return nil, fmt.Errorf("rewrite %s: %w", logicalPath, err)
+		}
+	}
+
+	var assets []Snapshot
+	for _, raw := range extractAssetURLs(doc, pageU) {
+		u, err := url.Parse(raw)
+		if err != nil || !isInternalHost(u.Host, cfg) {
+			continue
+		}
+		assets = append(assets, Snapshot{
+			FileURL:   raw,
+			Timestamp: idx.Resolve(raw, page.Timestamp),
+			FileID:    fileIDFor(u),
+		})
+	}
+	return assets, nil
+}
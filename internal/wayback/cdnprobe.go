@@ -0,0 +1,151 @@
+package wayback
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// lookupHost resolves host names for Config.ProbeCDN; a variable so tests
+// can stand in for DNS.
+var lookupHost = net.DefaultResolver.LookupHost
+
+// cdnCandidates scans the HTML and CSS files of recs in store for hosts
+// under cfg.BareHost that are not yet internal (see isInternalHost), such as
+// assets-1.example.com. It returns those hosts, sorted, and the records of
+// the files that reference them.
+func cdnCandidates(store Storage, recs []ManifestRecord, cfg *Config) ([]string, []ManifestRecord) {
+	bare := strings.ToLower(cfg.BareHost)
+	found := make(map[string]bool)
+	var referrers []ManifestRecord
+	for _, r := range recs {
+		if r.LocalPath == "" {
+			continue
+		}
+		data, err := store.Get(r.LocalPath)
+		if err != nil {
+			continue
+		}
+		var urls []string
+		switch DetectRewriter(r.LocalPath, contentTypeFor(r.LocalPath, r.MimeType, cfg), data[:min(len(data), 512)]).(type) {
+		case HTMLRewriter:
+			urls, err = extractHTMLURLs(data, r.URL, cfg.ArchiveBase, func(string) bool { return true })
+		case CSSRewriter:
+			urls, err = extractCSSURLs(string(data), r.URL, cfg.ArchiveBase)
+		default:
+			continue
+		}
+		if err != nil {
+			cfg.Log(LogDebug, "extract %s: %v", r.LocalPath, err)
+			continue
+		}
+		refers := false
+		for _, raw := range urls {
+			u, err := url.Parse(raw)
+			if err != nil {
+				continue
+			}
+			host := strings.ToLower(u.Hostname())
+			if !strings.HasSuffix(host, "."+bare) || isInternalHost(host, cfg) {
+				continue
+			}
+			found[host] = true
+			refers = true
+		}
+		if refers {
+			referrers = append(referrers, r)
+		}
+	}
+	hosts := make([]string, 0, len(found))
+	for h := range found {
+		hosts = append(hosts, h)
+	}
+	slices.Sort(hosts)
+	return hosts, referrers
+}
+
+// resolvingHosts returns those of hosts that resolve in DNS; a host that
+// no longer exists is unlikely to be the site's own CDN.
+func resolvingHosts(ctx context.Context, hosts []string, cfg *Config) []string {
+	var out []string
+	for _, h := range hosts {
+		if _, err := lookupHost(ctx, h); err != nil {
+			cfg.Log(LogDebug, "probe cdn %s: %v", h, err)
+			continue
+		}
+		out = append(out, h)
+	}
+	return out
+}
+
+// probeCDN implements Config.ProbeCDN after the download pass: it finds the
+// resolving subdomains the stored pages and stylesheets reference (see
+// cdnCandidates), adds them to cfg.ExtraSubdomains and cfg.Variants, and
+// queries the CDX index for them. The captures found are registered in idx
+// and returned to be downloaded, with the records of the files to rewrite
+// again so their links to those hosts become local. Hosts the index has no
+// captures of are left external. An index error is logged, not returned:
+// the capture of the site itself is complete.
+func probeCDN(ctx context.Context, cfg *Config, store Storage, idx *SnapshotIndex, statusFile *progressFile) ([]Snapshot, []ManifestRecord) {
+	candidates, referrers := cdnCandidates(store, idx.Records(), cfg)
+	hosts := resolvingHosts(ctx, candidates, cfg)
+	if len(hosts) == 0 {
+		return nil, nil
+	}
+	cfg.printf(LogInfo, "Found CDN host(s) %s; querying the index for them.\n", strings.Join(hosts, ", "))
+	collapse, err := CDXCollapseParam(cfg.CollapseMode)
+	if err != nil {
+		return nil, nil
+	}
+	var variants []string
+	for _, h := range hosts {
+		variants = append(variants, "https://"+h+"/", "http://"+h+"/")
+	}
+	query := cfg.Clone()
+	query.Variants = variants
+	entries, _, err := fetchEntries(ctx, query, statusFile, collapse, false)
+	if err != nil {
+		if !errors.Is(err, ErrNoSnapshots) {
+			cfg.Log(LogWarn, "probe cdn: %v", err)
+		}
+		return nil, nil
+	}
+
+	// The hosts are internal from here on, so their links are rewritten.
+	bare := strings.ToLower(cfg.BareHost)
+	for _, h := range hosts {
+		cfg.ExtraSubdomains = append(cfg.ExtraSubdomains, strings.TrimSuffix(strings.TrimPrefix(h, "www."), "."+bare))
+	}
+	cfg.Variants = append(cfg.Variants, variants...)
+	// FileIDs carry the host, so a CDN file on a path the site also has is
+	// new, and importing it leaves the site's entry alone.
+	known := make(map[string]bool)
+	for _, s := range idx.GetManifest() {
+		known[s.FileID] = true
+	}
+	idx.Import(entries)
+	var extra []Snapshot
+	for _, s := range downloadManifest(idx, entries, cfg) {
+		if !known[s.FileID] {
+			extra = append(extra, s)
+		}
+	}
+	return extra, referrers
+}
+
+// rewriteStored runs the rewriter for the file stored for r over it again,
+// as repair does.
+func rewriteStored(store Storage, r ManifestRecord, cfg *Config, idx *SnapshotIndex) error {
+	data, err := store.Get(r.LocalPath)
+	if err != nil {
+		return err
+	}
+	rw := DetectRewriter(r.LocalPath, contentTypeFor(r.LocalPath, r.MimeType, cfg), data[:min(len(data), 512)])
+	if rw == nil {
+		return nil
+	}
+	return rw.Rewrite(rewriteTarget(store, cfg), r.LocalPath, r.URL, cfg, idx)
+}
@@ -0,0 +1,74 @@
+package wayback
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/sigman78/wayback-dl/internal/wayback/testserver"
+)
+
+// With ProbeCDN, a subdomain the page references that resolves is indexed
+// and fetched, and the page's links to it rewritten; one that does not
+// resolve, and other domains, are left alone. A CDN file on the same path
+// as one of the site's is fetched and stored apart from it.
+func TestDownloadAllProbeCDN(t *testing.T) {
+	var looked []string
+	old := lookupHost
+	lookupHost = func(_ context.Context, host string) ([]string, error) {
+		looked = append(looked, host)
+		if host == "assets-1.example.com" {
+			return []string{"192.0.2.1"}, nil
+		}
+		return nil, errors.New("no such host")
+	}
+	t.Cleanup(func() { lookupHost = old })
+
+	srv := testserver.NewTestServer(t, map[string]testserver.TestEntry{
+		"http://example.com/": {Timestamp: "20200101000000", ContentType: "text/html",
+			Body: `<html><body><img src="https://assets-1.example.com/img/logo.png">` +
+				`<img src="https://gone.example.com/x.png"><img src="https://other.org/y.png"></body></html>`},
+		"https://assets-1.example.com/img/logo.png": {Timestamp: "20200101000000", Body: "PNG"},
+		"http://example.com/img/logo.png":           {Timestamp: "20200101000000", Body: "SITE"},
+	})
+	for _, probe := range []bool{false, true} {
+		looked = nil
+		dir := t.TempDir()
+		cfg := archiveConfig(srv, filepath.Join(dir, "out"))
+		cfg.RewriteLinks = true
+		cfg.ProbeCDN = probe
+		if err := DownloadAll(cfg); err != nil {
+			t.Fatal(err)
+		}
+		page := readOutput(t, cfg.Directory, "index.html")
+		if !probe {
+			if len(looked) > 0 {
+				t.Errorf("looked up %q without ProbeCDN", looked)
+			}
+			if !strings.Contains(page, "https://assets-1.example.com/img/logo.png") {
+				t.Errorf("CDN link rewritten without ProbeCDN:\n%s", page)
+			}
+			continue
+		}
+		if want := []string{"assets-1.example.com", "gone.example.com"}; !slices.Equal(looked, want) {
+			t.Errorf("looked up %q, want %q", looked, want)
+		}
+		if got := readOutput(t, cfg.Directory, "assets-1.example.com/img/logo.png"); got != "PNG" {
+			t.Errorf("assets-1.example.com/img/logo.png = %q", got)
+		}
+		if got := readOutput(t, cfg.Directory, "img/logo.png"); got != "SITE" {
+			t.Errorf("img/logo.png = %q", got)
+		}
+		if !strings.Contains(page, `src="assets-1.example.com/img/logo.png"`) {
+			t.Errorf("CDN link not rewritten:\n%s", page)
+		}
+		for _, ext := range []string{"https://gone.example.com/x.png", "https://other.org/y.png"} {
+			if !strings.Contains(page, ext) {
+				t.Errorf("%s rewritten:\n%s", ext, page)
+			}
+		}
+	}
+}
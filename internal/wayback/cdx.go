@@ -1,14 +1,19 @@
 package wayback
 
 import (
+	"cmp"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+	"regexp"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/time/rate"
@@ -18,6 +23,170 @@ import (
 type CDXEntry struct {
 	Timestamp   string
 	OriginalURL string
+	Digest      string // content digest; only with cdxOptions.Details
+	Length      int64  // archived (compressed) size in bytes; only with cdxOptions.Details
+}
+
+// reDoubledScheme matches a scheme repeated in front of another, e.g.
+// "http://https://example.com"; group 1 is the inner (real) URL.
+var reDoubledScheme = regexp.MustCompile(`(?i)^https?:/*(https?:/.*)$`)
+
+// reSchemePrefix matches a leading http(s) scheme and any run of slashes.
+var reSchemePrefix = regexp.MustCompile(`(?i)^(https?):/*`)
+
+// normalizeCDXURL repairs malformed CDX "original" values so Register and
+// URLToLocalPath see a well-formed absolute URL: surrounding whitespace is
+// trimmed, doubled schemes are collapsed, "http:/host" and "http:///host"
+// become "http://host", the scheme is lower-cased, a missing scheme defaults
+// to http, and embedded spaces are percent-encoded.
+func normalizeCDXURL(raw string) string {
+	u := strings.TrimSpace(raw)
+	if u == "" {
+		return ""
+	}
+	for {
+		m := reDoubledScheme.FindStringSubmatch(u)
+		if m == nil {
+			break
+		}
+		u = m[1]
+	}
+	if m := reSchemePrefix.FindStringSubmatch(u); m != nil {
+		u = strings.ToLower(m[1]) + "://" + u[len(m[0]):]
+	} else {
+		u = "http://" + strings.TrimLeft(u, "/")
+	}
+	return strings.ReplaceAll(u, " ", "%20")
+}
+
+// SnapshotDateRange converts a date in YYYYMMDD or RFC3339 form into the
+// from/to CDX timestamps bracketing that whole (UTC) day. RFC3339 values are
+// converted to UTC first, since Wayback timestamps are UTC.
+func SnapshotDateRange(date string) (from, to string, err error) {
+	date = strings.TrimSpace(date)
+	t, err := time.Parse("20060102", date)
+	if err != nil {
+		t, err = time.Parse(time.RFC3339, date)
+		if err != nil {
+			return "", "", fmt.Errorf("snapshot date %q: want YYYYMMDD or RFC3339", date)
+		}
+	}
+	day := t.UTC().Format("20060102")
+	return day + "000000", day + "235959", nil
+}
+
+// CDXCollapseParam maps a collapse mode to the CDX "collapse" parameter:
+// "digest" (the default for "") keeps every distinct-content capture,
+// "urlkey" keeps one capture per URL, and "timestamp:N" keeps one capture
+// per URL for each N-digit timestamp prefix (4 = per year, 6 = per month, …).
+func CDXCollapseParam(mode string) (string, error) {
+	switch mode {
+	case "", "digest":
+		return "digest", nil
+	case "urlkey":
+		return "urlkey", nil
+	}
+	if n, ok := strings.CutPrefix(mode, "timestamp:"); ok {
+		if d, err := strconv.Atoi(n); err == nil && d >= 1 && d <= 14 {
+			return "timestamp:" + n, nil
+		}
+	}
+	return "", fmt.Errorf("collapse mode %q: want digest, urlkey or timestamp:N (N = 1..14)", mode)
+}
+
+// cdxFilterFields are the CDX fields a filter expression can test.
+var cdxFilterFields = []string{"urlkey", "timestamp", "original", "mimetype", "statuscode", "digest", "length"}
+
+// cdxFilterField returns the field of a CDX filter expression
+// "[!]field:regex", and false when expr does not have that shape.
+func cdxFilterField(expr string) (string, bool) {
+	field, re, ok := strings.Cut(strings.TrimPrefix(expr, "!"), ":")
+	if !ok || re == "" || !slices.Contains(cdxFilterFields, field) {
+		return "", false
+	}
+	return field, true
+}
+
+// checkCDXFilter reports whether expr is a CDX filter expression
+// "[!]field:regex". The regex is the archive's (Java) syntax and is passed
+// through unchecked.
+func checkCDXFilter(expr string) error {
+	if _, ok := cdxFilterField(expr); !ok {
+		return fmt.Errorf("cdx filter %q: want [!]field:regex with field one of %s", expr, strings.Join(cdxFilterFields, ", "))
+	}
+	return nil
+}
+
+// cdxSearchURL returns the CDX API prefix of the archive at base (see
+// archiveRoot); the endpoint name ("xd" or "cdx") follows it.
+func cdxSearchURL(base string) string {
+	return archiveRoot(base) + "/cdx/search/"
+}
+
+// cdxEndpointCache remembers the CDX endpoint found to work for each API
+// prefix, so the probe in resolveCDXEndpoint runs once per process.
+type cdxEndpointCache struct {
+	mu    sync.Mutex
+	known map[string]string // cdxSearchURL(base) → "xd" | "cdx"
+}
+
+var cdxEndpoints = &cdxEndpointCache{known: make(map[string]string)}
+
+// resolveCDXEndpoint returns configured when set, and otherwise the CDX
+// endpoint the archive answers on: it probes "xd" with a one-row query for
+// probeURL on the archive at base, waiting on lim (when non-nil) like any
+// CDX request, and falls back to "cdx" when the archive answers 404 or 400.
+// That answer, or a 200, is cached in cache per archive. Any other status,
+// such as a 429 or 503, and a transport error leave the default "xd"
+// uncached, for the real queries to retry.
+func resolveCDXEndpoint(ctx context.Context, client *http.Client, lim *rate.Limiter, cache *cdxEndpointCache, configured, base, probeURL string) string {
+	if configured != "" {
+		return configured
+	}
+	search := cdxSearchURL(base)
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if ep, ok := cache.known[search]; ok {
+		return ep
+	}
+
+	params := url.Values{}
+	params.Set("url", probeURL)
+	params.Set("output", "json")
+	params.Set("limit", "1")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, search+"xd?"+params.Encode(), nil)
+	if err != nil {
+		return "xd"
+	}
+	if lim != nil {
+		if err := lim.Wait(ctx); err != nil {
+			return "xd"
+		}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "xd"
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+
+	var ep string
+	switch resp.StatusCode {
+	case http.StatusOK:
+		ep = "xd"
+	case http.StatusNotFound, http.StatusBadRequest:
+		ep = "cdx"
+	default:
+		return "xd"
+	}
+	cache.known[search] = ep
+	return ep
+}
+
+// newCDXLimiter returns the limiter that spaces a run's CDX requests at
+// ratePerMin per minute.
+func newCDXLimiter(ratePerMin int) *rate.Limiter {
+	return rate.NewLimiter(rate.Every(time.Minute/time.Duration(ratePerMin)), 5)
 }
 
 var cdxHTTPClient = &http.Client{
@@ -46,74 +215,90 @@ func retryDelay(attempt int, resp *http.Response) time.Duration {
 	return d
 }
 
+// cdxOptions carries the per-run CDX query settings.
+type cdxOptions struct {
+	FromTS, ToTS string
+	RatePerMin   int           // CDX API requests per minute
+	MaxRetries   int           // retries on 429 / 5xx
+	Timeout      time.Duration // per-request deadline; 0 leaves only the client timeout
+	Parallel     bool          // fetch URL variants concurrently
+	Collapse     string        // CDX collapse parameter (see CDXCollapseParam); "" = digest, "none" = off
+	Endpoint     string        // "xd" or "cdx" (see resolveCDXEndpoint); "" = xd
+	ArchiveBase  string        // archive root (see archiveRoot); "" = DefaultArchiveBase
+	Retries      *retryBudget  // retries shared by the whole run; nil = unlimited
+	MatchDomain  bool          // variants are hosts, matched with all their subdomains
+	Hooks        *Hooks        // notified of each page and retry; may be nil
+	Limit        int           // cap on the rows returned; 0 = no limit
+	DedupeFrags  bool          // drop entries whose URL differs from another's only by a #fragment
+	Details      bool          // also fetch each row's digest and length
+	Filters      []string      // extra CDX filter expressions; one on statuscode replaces the default
+	Limiter      *rate.Limiter // shared with other requests of the run; nil = a new one at RatePerMin
+}
+
 // fetchCDXPage fetches a single page of CDX results.
 // pageIndex == -1 means no pagination parameter (fetch all at once for exact URL).
-// It retries on 429 / 5xx up to maxRetries times with exponential backoff.
-func fetchCDXPage(ctx context.Context, lim *rate.Limiter, baseURL string, pageIndex int, fromTS, toTS string, maxRetries int) ([]CDXEntry, error) {
+// It retries on 429 / 5xx up to opts.MaxRetries times with exponential backoff,
+// and fails with ErrArchiveUnavailable once opts.Retries is spent.
+func fetchCDXPage(ctx context.Context, client *http.Client, lim *rate.Limiter, baseURL string, pageIndex int, opts cdxOptions) ([]CDXEntry, error) {
 	params := url.Values{}
 	params.Set("output", "json")
 	params.Set("fl", "timestamp,original")
-	params.Set("collapse", "digest")
+	if opts.Details {
+		params.Set("fl", "timestamp,original,digest,length")
+	}
+	collapse := opts.Collapse
+	if collapse == "" {
+		collapse = "digest"
+	}
+	if collapse != "none" {
+		params.Set("collapse", collapse)
+	}
 	params.Set("gzip", "false")
-	params.Set("filter", "statuscode:200")
-	if fromTS != "" {
-		params.Set("from", fromTS)
+	if !slices.ContainsFunc(opts.Filters, func(f string) bool {
+		field, _ := cdxFilterField(f)
+		return field == "statuscode"
+	}) {
+		params.Set("filter", "statuscode:200")
+	}
+	for _, f := range opts.Filters {
+		params.Add("filter", f)
+	}
+	if opts.FromTS != "" {
+		params.Set("from", opts.FromTS)
 	}
-	if toTS != "" {
-		params.Set("to", toTS)
+	if opts.ToTS != "" {
+		params.Set("to", opts.ToTS)
 	}
 	params.Set("url", baseURL)
+	if opts.MatchDomain {
+		params.Set("matchType", "domain")
+	}
 	if pageIndex >= 0 {
 		params.Set("page", strconv.Itoa(pageIndex))
 	}
+	if opts.Limit > 0 {
+		params.Set("limit", strconv.Itoa(opts.Limit))
+	}
 
-	apiURL := "https://web.archive.org/cdx/search/xd?" + params.Encode()
+	endpoint := opts.Endpoint
+	if endpoint == "" {
+		endpoint = "xd"
+	}
+	apiURL := cdxSearchURL(opts.ArchiveBase) + endpoint + "?" + params.Encode()
+	maxRetries := opts.MaxRetries
 
 	for attempt := 0; attempt <= maxRetries; attempt++ {
 		if err := lim.Wait(ctx); err != nil {
 			return nil, fmt.Errorf("cdx rate limiter: %w", err)
 		}
 
-		req, err := http.NewRequestWithContext(ctx, http.MethodGet, apiURL, nil)
-		if err != nil {
-			return nil, fmt.Errorf("cdx create request: %w", err)
-		}
-		resp, err := cdxHTTPClient.Do(req)
+		entries, resp, err := cdxAttempt(ctx, client, apiURL, opts.Timeout)
 		if err != nil {
-			return nil, fmt.Errorf("cdx GET: %w", err)
+			return nil, err
 		}
-
 		status := resp.StatusCode
 		if status == http.StatusOK {
-			body, err := io.ReadAll(resp.Body)
-			_ = resp.Body.Close()
-			if err != nil {
-				return nil, fmt.Errorf("cdx read body: %w", err)
-			}
-
-			// The CDX API returns a JSON array of arrays, first row is the header.
-			var rows [][]string
-			if err := json.Unmarshal(body, &rows); err != nil {
-				if strings.TrimSpace(string(body)) == "" {
-					return nil, nil
-				}
-				return nil, fmt.Errorf("cdx json decode: %w", err)
-			}
-
-			var entries []CDXEntry
-			for i, row := range rows {
-				if i == 0 {
-					// Skip header row (["timestamp","original"])
-					continue
-				}
-				if len(row) < 2 {
-					continue
-				}
-				entries = append(entries, CDXEntry{
-					Timestamp:   row[0],
-					OriginalURL: row[1],
-				})
-			}
+			opts.Hooks.cdxPage(CDXPageEvent{Query: baseURL, Page: pageIndex, Entries: len(entries)})
 			return entries, nil
 		}
 
@@ -123,18 +308,18 @@ func fetchCDXPage(ctx context.Context, lim *rate.Limiter, baseURL string, pageIn
 			(status >= 500 && status < 600)
 
 		if !retriable {
-			_ = resp.Body.Close()
 			return nil, fmt.Errorf("cdx HTTP %d for %s", status, apiURL)
 		}
 
 		if attempt == maxRetries {
-			_ = resp.Body.Close()
 			return nil, fmt.Errorf("cdx HTTP %d after %d retries for %s", status, maxRetries, apiURL)
 		}
+		if !opts.Retries.take() {
+			return nil, fmt.Errorf("%w: retry budget spent (cdx HTTP %d for %s)", ErrArchiveUnavailable, status, apiURL)
+		}
 
 		delay := retryDelay(attempt, resp)
-		_ = resp.Body.Close()
-
+		opts.Hooks.retry(RetryEvent{URL: apiURL, Attempt: attempt + 1, Status: status, Delay: delay})
 		select {
 		case <-ctx.Done():
 			return nil, ctx.Err()
@@ -146,53 +331,242 @@ func fetchCDXPage(ctx context.Context, lim *rate.Limiter, baseURL string, pageIn
 	return nil, fmt.Errorf("cdx: exhausted retries for %s", apiURL)
 }
 
-// fetchAllSnapshots collects every CDX entry for all URL variants.
-// When exactURL is false it appends /* for wildcard and paginates.
-// prog is advanced by one step for each CDX page successfully fetched.
-func fetchAllSnapshots(ctx context.Context, variants []string, exactURL bool, fromTS, toTS string, prog *Progress, ratePerMin, maxRetries int) ([]CDXEntry, error) {
-	lim := rate.NewLimiter(rate.Every(time.Minute/time.Duration(ratePerMin)), 5)
+// cdxAttempt performs one CDX request under its own deadline of timeout
+// (bounded by ctx's deadline). On HTTP 200 it returns the parsed entries;
+// for any other status it returns the response (body already closed) so the
+// caller can decide whether to retry.
+func cdxAttempt(ctx context.Context, client *http.Client, apiURL string, timeout time.Duration) ([]CDXEntry, *http.Response, error) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, apiURL, nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cdx create request: %w", err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cdx GET: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, resp, nil
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cdx read body: %w", err)
+	}
+
+	// The CDX API returns a JSON array of arrays, first row is the header.
+	var rows [][]string
+	if err := json.Unmarshal(body, &rows); err != nil {
+		if strings.TrimSpace(string(body)) == "" {
+			return nil, resp, nil
+		}
+		return nil, nil, fmt.Errorf("cdx json decode: %w", err)
+	}
+
+	var entries []CDXEntry
+	for i, row := range rows {
+		if i == 0 {
+			// Skip header row (["timestamp","original"])
+			continue
+		}
+		if len(row) < 2 {
+			continue
+		}
+		orig := normalizeCDXURL(row[1])
+		if orig == "" {
+			continue
+		}
+		e := CDXEntry{
+			Timestamp:   row[0],
+			OriginalURL: orig,
+		}
+		if len(row) >= 4 {
+			// "-" (unknown length) parses as 0.
+			e.Digest = row[2]
+			e.Length, _ = strconv.ParseInt(row[3], 10, 64)
+		}
+		entries = append(entries, e)
+	}
+	return entries, resp, nil
+}
+
+// VariantResult is the CDX outcome for one URL variant.
+type VariantResult struct {
+	Variant string
+	Entries int   // entries fetched before any error
+	Err     error // nil when every page was fetched
+}
 
-	seen := make(map[string]bool)
-	var all []CDXEntry
+func (r VariantResult) String() string {
+	if r.Err != nil {
+		return fmt.Sprintf("%s: error after %d entries: %v", r.Variant, r.Entries, r.Err)
+	}
+	return fmt.Sprintf("%s: %d entries", r.Variant, r.Entries)
+}
+
+// fetchAllSnapshots collects every CDX entry for all URL variants, one after
+// another or, with opts.Parallel, concurrently (still bounded by the shared
+// rate limiter). A failing variant does not stop the others: each outcome is
+// reported in the returned results, in variant order, and err is non-nil only
+// when every variant failed without yielding any entries or the run's retry
+// budget ran out (ErrArchiveUnavailable). prog is advanced by one step for each CDX page
+// successfully fetched. The entries are sorted by timestamp and then URL, so
+// the same CDX data yields the same list whatever order the pages arrived in.
+func fetchAllSnapshots(ctx context.Context, client *http.Client, variants []string, exactURL bool, prog *Progress, opts cdxOptions) ([]CDXEntry, []VariantResult, error) {
+	lim := opts.Limiter
+	if lim == nil {
+		lim = newCDXLimiter(opts.RatePerMin)
+	}
 
 	prog.SetMax(len(variants))
 
-	for _, variant := range variants {
-		if exactURL {
-			entries, err := fetchCDXPage(ctx, lim, variant, -1, fromTS, toTS, maxRetries)
-			if err != nil {
-				return nil, err
-			}
-			prog.Inc()
-			for _, e := range entries {
-				key := e.Timestamp + "|" + e.OriginalURL
-				if !seen[key] {
-					seen[key] = true
-					all = append(all, e)
-				}
-			}
-		} else {
-			// Wildcard: append /* and paginate
-			wildcardURL := strings.TrimRight(variant, "/") + "/*"
-			for page := 0; page < 100; page++ {
-				entries, err := fetchCDXPage(ctx, lim, wildcardURL, page, fromTS, toTS, maxRetries)
-				if err != nil {
-					// On error stop paginating this variant
-					break
-				}
-				prog.Inc()
-				if len(entries) == 0 {
-					break
-				}
-				for _, e := range entries {
-					key := e.Timestamp + "|" + e.OriginalURL
-					if !seen[key] {
-						seen[key] = true
-						all = append(all, e)
-					}
-				}
+	found := &cdxURLCount{seen: make(map[string]bool)}
+	perVariant := make([][]CDXEntry, len(variants))
+	results := make([]VariantResult, len(variants))
+	fetch := func(i int) {
+		perVariant[i], results[i].Err = fetchVariant(ctx, client, lim, variants[i], exactURL, prog, found, opts)
+		results[i].Variant = variants[i]
+		results[i].Entries = len(perVariant[i])
+	}
+	if opts.Parallel {
+		var wg sync.WaitGroup
+		for i := range variants {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				fetch(i)
+			}()
+		}
+		wg.Wait()
+	} else {
+		for i := range variants {
+			fetch(i)
+		}
+	}
+
+	seen := make(map[string]bool)
+	var all []CDXEntry
+	var errs []error
+	for i, entries := range perVariant {
+		if results[i].Err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", variants[i], results[i].Err))
+		}
+		for _, e := range entries {
+			key := e.Timestamp + "|" + e.OriginalURL
+			if !seen[key] {
+				seen[key] = true
+				all = append(all, e)
 			}
 		}
 	}
+	if opts.DedupeFrags {
+		all = dropFragmentDupes(all)
+	}
+	slices.SortFunc(all, func(a, b CDXEntry) int {
+		return cmp.Or(strings.Compare(a.Timestamp, b.Timestamp), strings.Compare(a.OriginalURL, b.OriginalURL))
+	})
+	for _, r := range results {
+		if errors.Is(r.Err, ErrArchiveUnavailable) {
+			return nil, results, fmt.Errorf("%s: %w", r.Variant, r.Err)
+		}
+	}
+	if len(all) == 0 && len(errs) > 0 && len(errs) == len(variants) {
+		return nil, results, errors.Join(errs...)
+	}
+	return all, results, nil
+}
+
+// fetchVariant fetches every CDX entry for one variant. When exactURL is
+// false it appends /* for wildcard (or, with opts.MatchDomain, queries the
+// variant as a domain) and paginates. On error it returns the
+// entries gathered so far together with the error.
+func fetchVariant(ctx context.Context, client *http.Client, lim *rate.Limiter, variant string, exactURL bool, prog *Progress, found *cdxURLCount, opts cdxOptions) ([]CDXEntry, error) {
+	if exactURL {
+		entries, err := fetchCDXPage(ctx, client, lim, variant, -1, opts)
+		if err != nil {
+			return nil, err
+		}
+		found.add(entries, prog)
+		prog.Inc()
+		return entries, nil
+	}
+
+	// Wildcard: append /* (unless matching a whole domain) and paginate
+	wildcardURL := strings.TrimRight(variant, "/") + "/*"
+	if opts.MatchDomain {
+		wildcardURL = variant
+	}
+	var all []CDXEntry
+	for page := 0; page < 100; page++ {
+		entries, err := fetchCDXPage(ctx, client, lim, wildcardURL, page, opts)
+		if err != nil {
+			return all, fmt.Errorf("page %d: %w", page, err)
+		}
+		found.add(entries, prog)
+		prog.Inc()
+		if len(entries) == 0 {
+			break
+		}
+		all = append(all, entries...)
+	}
 	return all, nil
 }
+
+// dropFragmentDupes returns entries without those whose original URL only
+// adds a #fragment to the URL of another entry. Malformed references leak
+// such URLs into the index; the fragment never reaches the server, so they
+// name the same resource. Other fragments are stripped.
+func dropFragmentDupes(entries []CDXEntry) []CDXEntry {
+	bare := make(map[string]bool)
+	for _, e := range entries {
+		if !strings.Contains(e.OriginalURL, "#") {
+			bare[e.OriginalURL] = true
+		}
+	}
+	out := entries[:0:0]
+	for _, e := range entries {
+		if u := stripFragment(e.OriginalURL); u != e.OriginalURL {
+			if bare[u] {
+				continue
+			}
+			e.OriginalURL = u
+		}
+		out = append(out, e)
+	}
+	return out
+}
+
+// cdxURLCount counts the distinct original URLs among the CDX entries of
+// all variants as their pages arrive, for the CDX progress label.
+type cdxURLCount struct {
+	mu   sync.Mutex
+	seen map[string]bool
+}
+
+// add records the URLs of entries and shows the running total on prog.
+func (c *cdxURLCount) add(entries []CDXEntry, prog *Progress) {
+	c.mu.Lock()
+	for _, e := range entries {
+		c.seen[e.OriginalURL] = true
+	}
+	n := len(c.seen)
+	c.mu.Unlock()
+	prog.SetDescription(fmt.Sprintf("[green][1/2][reset] Fetching CDX (%d URLs so far)", n))
+}
+
+// variantSummary formats results as one indented line per variant.
+func variantSummary(results []VariantResult) string {
+	var b strings.Builder
+	for _, r := range results {
+		b.WriteString("  ")
+		b.WriteString(r.String())
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
@@ -0,0 +1,463 @@
+package wayback
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+func TestSnapshotDateRange(t *testing.T) {
+	cases := []struct {
+		in       string
+		from, to string
+	}{
+		{"20230601", "20230601000000", "20230601235959"},
+		{"2023-06-01T12:00:00Z", "20230601000000", "20230601235959"},
+		// 23:30 at UTC-5 is already the next day in UTC.
+		{"2023-06-01T23:30:00-05:00", "20230602000000", "20230602235959"},
+	}
+	for _, tc := range cases {
+		from, to, err := SnapshotDateRange(tc.in)
+		if err != nil {
+			t.Fatalf("SnapshotDateRange(%q): %v", tc.in, err)
+		}
+		if from != tc.from || to != tc.to {
+			t.Errorf("SnapshotDateRange(%q) = %s..%s, want %s..%s", tc.in, from, to, tc.from, tc.to)
+		}
+	}
+
+	for _, bad := range []string{"", "2023-06-01", "20231301", "yesterday"} {
+		if _, _, err := SnapshotDateRange(bad); err == nil {
+			t.Errorf("SnapshotDateRange(%q): expected error", bad)
+		}
+	}
+}
+
+func TestNormalizeCDXURL(t *testing.T) {
+	cases := []struct {
+		in   string
+		want string
+	}{
+		// Well-formed URLs are untouched
+		{"https://example.com/page.html", "https://example.com/page.html"},
+		{"http://example.com/a?b=c", "http://example.com/a?b=c"},
+		// Stray whitespace
+		{"  http://example.com/page.html\t", "http://example.com/page.html"},
+		{"http://example.com/page.html\r\n", "http://example.com/page.html"},
+		// Missing or extra slashes after the scheme
+		{"http:/example.com/page.html", "http://example.com/page.html"},
+		{"https:///example.com/", "https://example.com/"},
+		// Doubled schemes
+		{"http://http://example.com/page.html", "http://example.com/page.html"},
+		{"https://http:/example.com/", "http://example.com/"},
+		{"http://https://http://example.com/x", "http://example.com/x"},
+		// Upper-case scheme
+		{"HTTP://example.com/", "http://example.com/"},
+		// Missing scheme
+		{"example.com/page.html", "http://example.com/page.html"},
+		{"//example.com/page.html", "http://example.com/page.html"},
+		// Embedded spaces
+		{"http://example.com/my page.html", "http://example.com/my%20page.html"},
+		// Empty
+		{"   ", ""},
+	}
+	for _, tc := range cases {
+		if got := normalizeCDXURL(tc.in); got != tc.want {
+			t.Errorf("normalizeCDXURL(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+// redirectTransport sends every request to target, keeping path and query,
+// so code that hard-codes web.archive.org can be pointed at an httptest server.
+type redirectTransport struct {
+	target *url.URL
+}
+
+func (rt redirectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.URL.Scheme = rt.target.Scheme
+	req.URL.Host = rt.target.Host
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func testClientFor(t *testing.T, srv *httptest.Server) *http.Client {
+	t.Helper()
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &http.Client{Transport: redirectTransport{target: u}}
+}
+
+// A per-request timeout must fire on a slow CDX server even though the parent
+// context has no deadline.
+func TestFetchCDXPageTimeout(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	lim := rate.NewLimiter(rate.Inf, 1)
+	start := time.Now()
+	_, err := fetchCDXPage(context.Background(), testClientFor(t, srv), lim, "example.com/*", 0,
+		cdxOptions{Timeout: 50 * time.Millisecond})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("timeout fired too late: %v", elapsed)
+	}
+}
+
+// A fast server is unaffected by the per-request timeout.
+func TestFetchCDXPageWithinTimeout(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`[["timestamp","original"],["20230101000000","http://example.com/"]]`))
+	}))
+	defer srv.Close()
+
+	lim := rate.NewLimiter(rate.Inf, 1)
+	entries, err := fetchCDXPage(context.Background(), testClientFor(t, srv), lim, "example.com/*", 0,
+		cdxOptions{Timeout: 5 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].OriginalURL != "http://example.com/" {
+		t.Errorf("unexpected entries %+v", entries)
+	}
+}
+
+// A failing variant must not discard the others: its error is reported in
+// the per-variant results, sequentially and in parallel.
+func TestFetchAllSnapshotsPartialVariants(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("url") == "http://example.com/" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		_, _ = w.Write([]byte(`[["timestamp","original"],["20230101000000","https://example.com/"],["20230102000000","https://example.com/a"]]`))
+	}))
+	defer srv.Close()
+
+	variants := []string{"https://example.com/", "http://example.com/"}
+	for _, parallel := range []bool{false, true} {
+		entries, results, err := fetchAllSnapshots(context.Background(), testClientFor(t, srv), variants, true, nil,
+			cdxOptions{RatePerMin: 60000, Parallel: parallel})
+		if err != nil {
+			t.Fatalf("parallel=%v: %v", parallel, err)
+		}
+		if len(entries) != 2 {
+			t.Errorf("parallel=%v: got %d entries, want 2", parallel, len(entries))
+		}
+		if len(results) != 2 || results[0].Err != nil || results[0].Entries != 2 || results[1].Err == nil {
+			t.Fatalf("parallel=%v: unexpected results %v", parallel, results)
+		}
+		if got := results[1].String(); got != "http://example.com/: error after 0 entries: "+results[1].Err.Error() {
+			t.Errorf("summary line = %q", got)
+		}
+	}
+}
+
+// Entries come back sorted by timestamp, then URL, however the variants'
+// pages were ordered and whichever variant answered first.
+func TestFetchAllSnapshotsSorted(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("url") == "http://example.com/" {
+			_, _ = w.Write([]byte(`[["timestamp","original"],["20230301000000","http://example.com/c"],["20230101000000","http://example.com/b"]]`))
+			return
+		}
+		_, _ = w.Write([]byte(`[["timestamp","original"],["20230201000000","https://example.com/a"],["20230101000000","https://example.com/a"]]`))
+	}))
+	defer srv.Close()
+
+	want := []CDXEntry{
+		{Timestamp: "20230101000000", OriginalURL: "http://example.com/b"},
+		{Timestamp: "20230101000000", OriginalURL: "https://example.com/a"},
+		{Timestamp: "20230201000000", OriginalURL: "https://example.com/a"},
+		{Timestamp: "20230301000000", OriginalURL: "http://example.com/c"},
+	}
+	for _, variants := range [][]string{
+		{"http://example.com/", "https://example.com/"},
+		{"https://example.com/", "http://example.com/"},
+	} {
+		entries, _, err := fetchAllSnapshots(context.Background(), testClientFor(t, srv), variants, true, nil,
+			cdxOptions{RatePerMin: 60000, Parallel: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(entries, want) {
+			t.Errorf("variants %v: entries\n  got  %v\n  want %v", variants, entries, want)
+		}
+	}
+}
+
+// The CDX bar's label counts the distinct URLs found across all variants.
+func TestFetchVariantURLCount(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("url") == "http://example.com/" {
+			_, _ = w.Write([]byte(`[["timestamp","original"],["20230101000000","http://example.com/a"],["20230102000000","http://example.com/a"]]`))
+			return
+		}
+		_, _ = w.Write([]byte(`[["timestamp","original"],["20230101000000","http://example.com/a"],["20230101000000","https://example.com/b"]]`))
+	}))
+	defer srv.Close()
+
+	p := testProgress()
+	found := &cdxURLCount{seen: make(map[string]bool)}
+	lim := rate.NewLimiter(rate.Inf, 1)
+	opts := cdxOptions{Timeout: 5 * time.Second}
+	for i, want := range []string{"(1 URLs so far)", "(2 URLs so far)"} {
+		variant := []string{"http://example.com/", "https://example.com/"}[i]
+		if _, err := fetchVariant(context.Background(), testClientFor(t, srv), lim, variant, true, p, found, opts); err != nil {
+			t.Fatal(err)
+		}
+		if got := p.bar.State().Description; !strings.HasSuffix(got, want) {
+			t.Errorf("after %s: description = %q, want suffix %q", variant, got, want)
+		}
+	}
+}
+
+// When every variant fails, fetchAllSnapshots returns an error naming each.
+func TestFetchAllSnapshotsAllVariantsFail(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer srv.Close()
+
+	variants := []string{"https://example.com/", "http://example.com/"}
+	_, results, err := fetchAllSnapshots(context.Background(), testClientFor(t, srv), variants, true, nil,
+		cdxOptions{RatePerMin: 60000, Parallel: true})
+	if err == nil {
+		t.Fatal("expected an error when every variant fails")
+	}
+	for _, v := range variants {
+		if !strings.Contains(err.Error(), v) {
+			t.Errorf("error %q does not name %s", err, v)
+		}
+	}
+	if len(results) != 2 {
+		t.Errorf("got %d results, want 2", len(results))
+	}
+}
+
+func TestCDXCollapseParam(t *testing.T) {
+	for in, want := range map[string]string{
+		"":            "digest",
+		"digest":      "digest",
+		"urlkey":      "urlkey",
+		"timestamp:4": "timestamp:4",
+	} {
+		got, err := CDXCollapseParam(in)
+		if err != nil || got != want {
+			t.Errorf("CDXCollapseParam(%q) = %q, %v; want %q", in, got, err, want)
+		}
+	}
+	for _, bad := range []string{"URLKEY", "timestamp", "timestamp:0", "timestamp:15", "length"} {
+		if _, err := CDXCollapseParam(bad); err == nil {
+			t.Errorf("CDXCollapseParam(%q): expected error", bad)
+		}
+	}
+}
+
+// The collapse option is passed through to the CDX query.
+func TestFetchCDXPageCollapse(t *testing.T) {
+	var got string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.URL.Query().Get("collapse")
+		_, _ = w.Write([]byte(`[]`))
+	}))
+	defer srv.Close()
+
+	lim := rate.NewLimiter(rate.Inf, 1)
+	for opt, want := range map[string]string{"": "digest", "urlkey": "urlkey"} {
+		if _, err := fetchCDXPage(context.Background(), testClientFor(t, srv), lim, "example.com/*", 0,
+			cdxOptions{Collapse: opt}); err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("Collapse %q: query collapse=%q, want %q", opt, got, want)
+		}
+	}
+}
+
+// Extra filters are added to the query after the default statuscode filter,
+// which one testing statuscode itself replaces.
+func TestFetchCDXPageFilters(t *testing.T) {
+	var got []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.URL.Query()["filter"]
+		_, _ = w.Write([]byte(`[]`))
+	}))
+	defer srv.Close()
+
+	lim := rate.NewLimiter(rate.Inf, 1)
+	cases := []struct{ filters, want []string }{
+		{nil, []string{"statuscode:200"}},
+		{[]string{"mimetype:text/html", `!urlkey:.*\.pdf$`}, []string{"statuscode:200", "mimetype:text/html", `!urlkey:.*\.pdf$`}},
+		{[]string{"!statuscode:200"}, []string{"!statuscode:200"}},
+	}
+	for _, tc := range cases {
+		if _, err := fetchCDXPage(context.Background(), testClientFor(t, srv), lim, "example.com/*", 0,
+			cdxOptions{Filters: tc.filters}); err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(got, tc.want) {
+			t.Errorf("Filters %q: query filters %q, want %q", tc.filters, got, tc.want)
+		}
+	}
+}
+
+// Without a configured endpoint the xd probe decides: a mirror that only
+// serves /cdx/search/cdx is detected once, cached, and then queried there.
+func TestResolveCDXEndpointFallback(t *testing.T) {
+	var probes atomic.Int32
+	var queried string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/cdx/search/xd":
+			probes.Add(1)
+			http.NotFound(w, r)
+		case "/cdx/search/cdx":
+			queried = r.URL.Path
+			_, _ = w.Write([]byte(`[["timestamp","original"],["20230101000000","http://example.com/"]]`))
+		}
+	}))
+	defer srv.Close()
+	client := testClientFor(t, srv)
+	cache := &cdxEndpointCache{known: make(map[string]string)}
+
+	for range 2 {
+		if ep := resolveCDXEndpoint(context.Background(), client, nil, cache, "", "", "example.com"); ep != "cdx" {
+			t.Fatalf("endpoint = %q, want cdx", ep)
+		}
+	}
+	if n := probes.Load(); n != 1 {
+		t.Errorf("probed %d times, want 1 (cached)", n)
+	}
+
+	lim := rate.NewLimiter(rate.Inf, 1)
+	entries, err := fetchCDXPage(context.Background(), client, lim, "example.com", -1, cdxOptions{Endpoint: "cdx"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if queried != "/cdx/search/cdx" || len(entries) != 1 {
+		t.Errorf("queried %q, got %d entries", queried, len(entries))
+	}
+}
+
+// A working xd endpoint is kept, and a configured endpoint skips the probe.
+func TestResolveCDXEndpointPrefersXD(t *testing.T) {
+	var probes atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		probes.Add(1)
+		_, _ = w.Write([]byte(`[]`))
+	}))
+	defer srv.Close()
+	client := testClientFor(t, srv)
+
+	if ep := resolveCDXEndpoint(context.Background(), client, nil, &cdxEndpointCache{known: make(map[string]string)}, "", "", "example.com"); ep != "xd" {
+		t.Errorf("endpoint = %q, want xd", ep)
+	}
+	if ep := resolveCDXEndpoint(context.Background(), client, nil, &cdxEndpointCache{known: make(map[string]string)}, "cdx", "", "example.com"); ep != "cdx" {
+		t.Errorf("configured endpoint = %q, want cdx", ep)
+	}
+	if n := probes.Load(); n != 1 {
+		t.Errorf("probed %d times, want 1", n)
+	}
+}
+
+// A throttled or failing probe neither switches to cdx nor is cached: the
+// next resolve probes again. A 400 falls back like a 404. The probe waits on
+// the limiter it is given.
+func TestResolveCDXEndpointRetriable(t *testing.T) {
+	statuses := []int{http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusBadRequest}
+	var probes atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(statuses[probes.Add(1)-1])
+	}))
+	defer srv.Close()
+	client := testClientFor(t, srv)
+	cache := &cdxEndpointCache{known: make(map[string]string)}
+	lim := rate.NewLimiter(rate.Inf, 1)
+
+	for i, want := range []string{"xd", "xd", "cdx", "cdx"} {
+		if ep := resolveCDXEndpoint(context.Background(), client, lim, cache, "", "", "example.com"); ep != want {
+			t.Errorf("resolve %d: endpoint = %q, want %q", i, ep, want)
+		}
+	}
+	if n := probes.Load(); n != 3 {
+		t.Errorf("probed %d times, want 3", n)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	blocked := rate.NewLimiter(rate.Every(time.Hour), 1)
+	blocked.Allow()
+	if ep := resolveCDXEndpoint(ctx, client, blocked, &cdxEndpointCache{known: make(map[string]string)}, "", "", "example.com"); ep != "xd" || probes.Load() != 3 {
+		t.Errorf("probe past an exhausted limiter: endpoint %q, %d probes", ep, probes.Load())
+	}
+}
+
+// Once the run's retry budget is spent, a throttled request fails at once
+// with ErrArchiveUnavailable instead of retrying on its own.
+func TestFetchCDXPageRetryBudget(t *testing.T) {
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	budget := newRetryBudget(1)
+	if !budget.take() || budget.take() {
+		t.Fatal("a budget of 1 should allow exactly one retry")
+	}
+	lim := rate.NewLimiter(rate.Inf, 1)
+	_, err := fetchCDXPage(context.Background(), testClientFor(t, srv), lim, "example.com/*", 0,
+		cdxOptions{MaxRetries: 5, Retries: budget})
+	if !errors.Is(err, ErrArchiveUnavailable) {
+		t.Fatalf("expected ErrArchiveUnavailable, got %v", err)
+	}
+	if n := hits.Load(); n != 1 {
+		t.Errorf("server hit %d times, want 1", n)
+	}
+	if !newRetryBudget(0).take() {
+		t.Error("a zero budget should be unlimited")
+	}
+}
+
+// Entries whose URL only adds a fragment to another entry's are dropped;
+// other fragments are stripped.
+func TestDropFragmentDupes(t *testing.T) {
+	in := []CDXEntry{
+		{Timestamp: "20200101000000", OriginalURL: "http://example.com/page"},
+		{Timestamp: "20200102000000", OriginalURL: "http://example.com/page#section"},
+		{Timestamp: "20200103000000", OriginalURL: "http://example.com/other#top"},
+	}
+	got := dropFragmentDupes(in)
+	want := []CDXEntry{
+		{Timestamp: "20200101000000", OriginalURL: "http://example.com/page"},
+		{Timestamp: "20200103000000", OriginalURL: "http://example.com/other"},
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if in[2].OriginalURL != "http://example.com/other#top" {
+		t.Error("input entries modified")
+	}
+}
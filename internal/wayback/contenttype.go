@@ -0,0 +1,39 @@
+package wayback
+
+import (
+	"mime"
+	"path"
+	"strings"
+)
+
+// contentTypeFor returns the Content-Type to treat the file stored at
+// logicalPath as: the cfg.ContentTypeOverrides entry for its extension when
+// there is one, else reported (as sent by the archive). The archive is
+// sometimes wrong, e.g. serving .js as text/plain.
+func contentTypeFor(logicalPath, reported string, cfg *Config) string {
+	if len(cfg.ContentTypeOverrides) == 0 {
+		return reported
+	}
+	name := strings.ToLower(logicalPath)
+	if i := strings.Index(name, "%3f"); i >= 0 {
+		name = name[:i] // preserve mode appends the query after the extension
+	}
+	if ct, ok := cfg.ContentTypeOverrides[strings.TrimPrefix(path.Ext(name), ".")]; ok {
+		return ct
+	}
+	return reported
+}
+
+// validContentTypeOverrides reports whether every key of overrides is a
+// lower-case extension without its dot and every value a media type.
+func validContentTypeOverrides(overrides map[string]string) bool {
+	for ext, ct := range overrides {
+		if ext == "" || ext != strings.ToLower(ext) || strings.ContainsAny(ext, "./") {
+			return false
+		}
+		if _, _, err := mime.ParseMediaType(ct); err != nil {
+			return false
+		}
+	}
+	return true
+}
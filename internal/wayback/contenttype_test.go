@@ -0,0 +1,49 @@
+package wayback
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sigman78/wayback-dl/internal/wayback/testserver"
+)
+
+func TestContentTypeFor(t *testing.T) {
+	cfg := &Config{ContentTypeOverrides: map[string]string{"js": "application/javascript", "css": "text/css"}}
+	cases := []struct{ path, reported, want string }{
+		{"app.js", "text/plain", "application/javascript"},
+		{"lib/App.JS%3Fv=2", "text/plain", "application/javascript"},
+		{"page.html", "text/html", "text/html"},
+		{"data", "application/octet-stream", "application/octet-stream"},
+	}
+	for _, tc := range cases {
+		if got := contentTypeFor(tc.path, tc.reported, cfg); got != tc.want {
+			t.Errorf("contentTypeFor(%q, %q) = %q, want %q", tc.path, tc.reported, got, tc.want)
+		}
+	}
+}
+
+// An override decides the rewriter and the manifest's mime type: JSON the
+// archive served as text/html is neither rewritten as a page nor recorded
+// as one.
+func TestDownloadAllContentTypeOverride(t *testing.T) {
+	const data = `{"next":"/page/2"}`
+	srv := testserver.NewTestServer(t, map[string]testserver.TestEntry{
+		"http://example.com/api/items.json": {Timestamp: "20200101000000", ContentType: "text/html", Body: data},
+	})
+	dir := t.TempDir()
+	cfg := archiveConfig(srv, dir)
+	cfg.RewriteLinks = true
+	cfg.ContentTypeOverrides = map[string]string{"json": "application/json"}
+	cfg.ManifestOut = filepath.Join(dir, "manifest.csv")
+	cfg.ManifestFormat = "csv"
+	if err := DownloadAll(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if got := readOutput(t, dir, "api/items.json"); got != data {
+		t.Errorf("JSON rewritten as HTML: %s", got)
+	}
+	if m := readOutput(t, dir, "manifest.csv"); !strings.Contains(m, ",application/json\n") {
+		t.Errorf("manifest lacks the overridden type:\n%s", m)
+	}
+}
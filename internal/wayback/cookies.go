@@ -0,0 +1,115 @@
+package wayback
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cookieTransport adds cookies to every outgoing request.
+type cookieTransport struct {
+	base    http.RoundTripper
+	header  string         // raw "name=value; …" sent on every request
+	cookies []*http.Cookie // domain-scoped cookies, sent when the host matches
+}
+
+// RoundTrip implements http.RoundTripper. The request is cloned before the
+// Cookie header is set, as required by the RoundTripper contract.
+func (t *cookieTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	parts := make([]string, 0, len(t.cookies)+1)
+	if t.header != "" {
+		parts = append(parts, t.header)
+	}
+	host := strings.ToLower(req.URL.Hostname())
+	for _, c := range t.cookies {
+		if c.Secure && req.URL.Scheme != "https" {
+			continue
+		}
+		if cookieDomainMatch(host, c.Domain) {
+			parts = append(parts, c.Name+"="+c.Value)
+		}
+	}
+	if len(parts) == 0 {
+		return t.base.RoundTrip(req)
+	}
+	req = req.Clone(req.Context())
+	req.Header.Set("Cookie", strings.Join(parts, "; "))
+	return t.base.RoundTrip(req)
+}
+
+// cookieDomainMatch reports whether host falls under a cookie domain
+// (".archive.org" and "archive.org" both match "web.archive.org").
+func cookieDomainMatch(host, domain string) bool {
+	d := strings.TrimPrefix(strings.ToLower(domain), ".")
+	return d != "" && (host == d || strings.HasSuffix(host, "."+d))
+}
+
+// withCookies returns a copy of c whose transport adds cfg.Cookies and
+// cfg.CookieList to each request, or c itself when no cookies are configured.
+func withCookies(c *http.Client, cfg *Config) *http.Client {
+	if cfg.Cookies == "" && len(cfg.CookieList) == 0 {
+		return c
+	}
+	base := c.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	cp := *c
+	cp.Transport = &cookieTransport{
+		base:    base,
+		header:  strings.TrimSpace(cfg.Cookies),
+		cookies: cfg.CookieList,
+	}
+	return &cp
+}
+
+// ParseNetscapeCookies reads a Netscape/curl-format cookie file:
+// one cookie per line with seven tab-separated fields
+// (domain, include-subdomains, path, secure, expiry, name, value).
+// Comment and blank lines are skipped; the "#HttpOnly_" domain prefix is
+// honoured. Cookies that have already expired are dropped.
+func ParseNetscapeCookies(r io.Reader) ([]*http.Cookie, error) {
+	var cookies []*http.Cookie
+	now := time.Now()
+	sc := bufio.NewScanner(r)
+	lineNo := 0
+	for sc.Scan() {
+		lineNo++
+		line := strings.TrimRight(sc.Text(), "\r")
+		httpOnly := false
+		if strings.HasPrefix(line, "#HttpOnly_") {
+			line = strings.TrimPrefix(line, "#HttpOnly_")
+			httpOnly = true
+		}
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		f := strings.Split(line, "\t")
+		if len(f) != 7 {
+			return nil, fmt.Errorf("cookie file line %d: expected 7 tab-separated fields, got %d", lineNo, len(f))
+		}
+		c := &http.Cookie{
+			Domain:   f[0],
+			Path:     f[2],
+			Secure:   strings.EqualFold(f[3], "TRUE"),
+			Name:     f[5],
+			Value:    f[6],
+			HttpOnly: httpOnly,
+		}
+		if exp, err := strconv.ParseInt(f[4], 10, 64); err == nil && exp > 0 {
+			c.Expires = time.Unix(exp, 0)
+			if c.Expires.Before(now) {
+				continue
+			}
+		}
+		cookies = append(cookies, c)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("read cookie file: %w", err)
+	}
+	return cookies, nil
+}
@@ -0,0 +1,68 @@
+package wayback
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Cookies from -cookie and domain-matching file cookies must reach the server.
+func TestWithCookiesSetsHeader(t *testing.T) {
+	var got string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get("Cookie")
+	}))
+	defer srv.Close()
+
+	cfg := &Config{
+		Cookies: "session=abc; lang=en",
+		CookieList: []*http.Cookie{
+			{Domain: "127.0.0.1", Name: "file", Value: "1"},
+			{Domain: ".other.org", Name: "foreign", Value: "2"},
+		},
+	}
+	client := withCookies(&http.Client{}, cfg)
+	resp, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+
+	if want := "session=abc; lang=en; file=1"; got != want {
+		t.Errorf("Cookie header\n  got  %q\n  want %q", got, want)
+	}
+}
+
+// Without configured cookies the client is returned unchanged.
+func TestWithCookiesNoop(t *testing.T) {
+	c := &http.Client{}
+	if withCookies(c, &Config{}) != c {
+		t.Error("expected the original client when no cookies are set")
+	}
+}
+
+func TestParseNetscapeCookies(t *testing.T) {
+	in := "# Netscape HTTP Cookie File\n" +
+		"\n" +
+		".archive.org\tTRUE\t/\tTRUE\t0\tlogged-in-user\tme\n" +
+		"#HttpOnly_web.archive.org\tFALSE\t/\tFALSE\t4102444800\tsid\txyz\n" +
+		"example.com\tFALSE\t/\tFALSE\t1\texpired\tgone\n"
+	cookies, err := ParseNetscapeCookies(strings.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cookies) != 2 {
+		t.Fatalf("expected 2 cookies (expired dropped), got %d", len(cookies))
+	}
+	if c := cookies[0]; c.Domain != ".archive.org" || c.Name != "logged-in-user" || c.Value != "me" || !c.Secure {
+		t.Errorf("unexpected first cookie: %+v", c)
+	}
+	if c := cookies[1]; c.Domain != "web.archive.org" || c.Name != "sid" || !c.HttpOnly {
+		t.Errorf("unexpected second cookie: %+v", c)
+	}
+
+	if _, err := ParseNetscapeCookies(strings.NewReader("bad line\n")); err == nil {
+		t.Error("expected error for malformed line")
+	}
+}
@@ -1,15 +1,20 @@
 package wayback
 
 import (
+	"fmt"
 	"net/url"
 	"path"
-	"path/filepath"
 	"regexp"
 	"strings"
+	"sync"
+
+	"github.com/panjf2000/ants/v2"
 )
 
 var (
-	// Three patterns for url(): double-quoted, single-quoted, unquoted
+	// Three patterns for url(): double-quoted, single-quoted, unquoted.
+	// \s also matches \n and \r, so values split across lines
+	// ("url(\n  \"a.png\"\n)") match without the (?s) flag.
 	reURLDouble = regexp.MustCompile(`(?i)url\(\s*"([^"]+)"\s*\)`)
 	reURLSingle = regexp.MustCompile(`(?i)url\(\s*'([^']+)'\s*\)`)
 	reURLBare   = regexp.MustCompile(`(?i)url\(\s*([^)'"]+?)\s*\)`)
@@ -17,7 +22,66 @@ var (
 	reImportSgl = regexp.MustCompile(`(?i)@import\s+'([^']+)'`)
 )
 
+// cssRefPatterns lists every url()/@import pattern; group 1 is the reference.
+var cssRefPatterns = []*regexp.Regexp{reURLDouble, reURLSingle, reURLBare, reImportDbl, reImportSgl}
+
+// cssRefs returns the raw (unresolved) url() and @import references in css.
+func cssRefs(css string) []string {
+	var refs []string
+	for _, re := range cssRefPatterns {
+		for _, m := range re.FindAllStringSubmatch(css, -1) {
+			refs = append(refs, unescapeSlashes(strings.TrimSpace(m[1])))
+		}
+	}
+	return refs
+}
+
+// unescapeSlashes turns the "\/" escapes some templating systems emit
+// (url("http:\/\/example.com\/a.png")) back into plain slashes.
+func unescapeSlashes(ref string) string {
+	return strings.ReplaceAll(ref, `\/`, "/")
+}
+
+// ExtractURLs returns the absolute URLs of the url() and @import references
+// in css, resolved against pageURL, in pattern order without duplicates.
+// Nested archive URLs are reduced to the original URL; data:, javascript:
+// and fragment references, and those that are not http(s), are left out.
+// Nothing is rewritten: callers use it to list a stylesheet's assets.
+func ExtractURLs(css, pageURL string) ([]string, error) {
+	return extractCSSURLs(css, pageURL, "")
+}
+
+// extractCSSURLs is ExtractURLs for a stylesheet downloaded from the
+// archive at base (see archiveRoot).
+func extractCSSURLs(css, pageURL, base string) ([]string, error) {
+	pageU, err := url.Parse(pageURL)
+	if err != nil {
+		return nil, fmt.Errorf("page url: %w", err)
+	}
+	var urls []string
+	seen := make(map[string]bool)
+	for _, ref := range cssRefs(css) {
+		if ref == "" || strings.HasPrefix(ref, "data:") || strings.HasPrefix(ref, "javascript:") || strings.HasPrefix(ref, "#") {
+			continue
+		}
+		resolved, err := pageU.Parse(ref)
+		if err != nil {
+			continue
+		}
+		resolved = stripWaybackPrefix(resolved, base)
+		if resolved.Scheme != "http" && resolved.Scheme != "https" {
+			continue
+		}
+		if u := resolved.String(); !seen[u] {
+			seen[u] = true
+			urls = append(urls, u)
+		}
+	}
+	return urls, nil
+}
+
 // RewriteCSSContent rewrites url() and @import references in CSS text.
+// References with escaped slashes are unescaped before they are resolved.
 func RewriteCSSContent(css, pageURL string, cfg *Config, idx *SnapshotIndex) string {
 	pageU, err := url.Parse(pageURL)
 	if err != nil {
@@ -25,28 +89,30 @@ func RewriteCSSContent(css, pageURL string, cfg *Config, idx *SnapshotIndex) str
 	}
 
 	// Compute local directory of the page file for RelativeLink
-	localPath := URLToLocalPath(pageURL, cfg.PrettyPath)
-	localPath = filepath.Join(cfg.Directory, filepath.FromSlash(localPath))
-	localDir := ToPosix(filepath.ToSlash(filepath.Dir(localPath)))
+	localDir := localDirFor(localPathFor(pageURL, cfg), cfg)
 
 	replace := func(src, ref string) string {
 		ref = strings.TrimSpace(ref)
-		if ref == "" ||
-			strings.HasPrefix(ref, "data:") ||
-			strings.HasPrefix(ref, "javascript:") ||
-			strings.HasPrefix(ref, "#") {
+		target := unescapeSlashes(ref)
+		if target == "" ||
+			strings.HasPrefix(target, "data:") ||
+			strings.HasPrefix(target, "javascript:") ||
+			strings.HasPrefix(target, "#") {
 			return src
 		}
 
-		resolved, err := pageU.Parse(ref)
+		resolved, err := pageU.Parse(target)
 		if err != nil {
 			return src
 		}
+		// Nested captures rewritten by the archive point at web.archive.org;
+		// recover the original URL so it maps to a local path.
+		resolved = stripWaybackPrefix(resolved, cfg.ArchiveBase)
 		if resolved.Scheme != "http" && resolved.Scheme != "https" {
 			return src
 		}
 
-		if !isInternalHost(resolved.Host, cfg.BareHost) {
+		if !isInternalHost(resolved.Host, cfg) {
 			if !cfg.DownloadExternalAssets {
 				return src
 			}
@@ -54,13 +120,9 @@ func RewriteCSSContent(css, pageURL string, cfg *Config, idx *SnapshotIndex) str
 			return src
 		}
 
-		localTarget := URLToLocalPath(resolved.String(), cfg.PrettyPath)
-		localTarget = filepath.Join(cfg.Directory, filepath.FromSlash(localTarget))
-		localTarget = ToPosix(localTarget)
-
-		rel := RelativeLink(localDir, localTarget)
-		rel = strings.ReplaceAll(rel, "%", "%25")
-		return strings.Replace(src, ref, rel, 1)
+		local := internalHref(resolved, localDir, cfg, idx)
+		cfg.recordRewrite("css", ref, local)
+		return strings.Replace(src, ref, local, 1)
 	}
 
 	// Rewrite url(...) — double-quoted, single-quoted, then bare
@@ -113,3 +175,48 @@ func (CSSRewriter) Rewrite(store Storage, logicalPath, pageURL string, cfg *Conf
 	rewritten := RewriteCSSContent(string(data), pageURL, cfg, idx)
 	return store.PutBytes(logicalPath, []byte(rewritten))
 }
+
+// cssRewriteQueue runs CSS rewrites on a dedicated worker pool so CSS text
+// processing overlaps with download I/O instead of holding a download slot.
+type cssRewriteQueue struct {
+	pool  *ants.Pool
+	wg    sync.WaitGroup
+	store Storage
+	cfg   *Config
+	idx   *SnapshotIndex
+}
+
+// newCSSRewriteQueue creates a queue backed by a pool of threads workers.
+func newCSSRewriteQueue(threads int, store Storage, cfg *Config, idx *SnapshotIndex) (*cssRewriteQueue, error) {
+	pool, err := ants.NewPool(threads)
+	if err != nil {
+		return nil, err
+	}
+	return &cssRewriteQueue{pool: pool, store: store, cfg: cfg, idx: idx}, nil
+}
+
+// Enqueue schedules logicalPath for rewriting. If the pool rejects the task
+// the rewrite runs synchronously on the caller's goroutine.
+func (q *cssRewriteQueue) Enqueue(logicalPath, pageURL string) {
+	q.wg.Add(1)
+	task := func() {
+		defer q.wg.Done()
+		if err := (CSSRewriter{}).Rewrite(q.store, logicalPath, pageURL, q.cfg, q.idx); err != nil {
+			q.cfg.Log(LogDebug, "rewrite %s: %v", logicalPath, err)
+		}
+	}
+	if err := q.pool.Submit(task); err != nil {
+		task()
+	}
+}
+
+// Wait blocks until every enqueued rewrite has finished.
+func (q *cssRewriteQueue) Wait() {
+	q.wg.Wait()
+}
+
+// Release waits for pending rewrites and frees the worker pool.
+func (q *cssRewriteQueue) Release() {
+	q.Wait()
+	q.pool.Release()
+}
@@ -1,6 +1,9 @@
 package wayback
 
 import (
+	"fmt"
+	"runtime"
+	"slices"
 	"strings"
 	"testing"
 )
@@ -123,3 +126,175 @@ func TestRewriteCSSURLQueryPretty(t *testing.T) {
 		t.Errorf("expected pretty local path with query suffix\n  got: %s", got)
 	}
 }
+
+// The CSS queue must finish every enqueued rewrite before Wait returns.
+func TestCSSRewriteQueueRewritesAll(t *testing.T) {
+	cfg := testCSSCfg()
+	idx := NewSnapshotIndex()
+	store := NewLocalStorage(t.TempDir())
+	paths := seedCSSFiles(t, store, 20)
+
+	q, err := newCSSRewriteQueue(4, store, cfg, idx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range paths {
+		q.Enqueue(p, "http://example.com/"+p)
+	}
+	q.Release()
+
+	for _, p := range paths {
+		got, err := store.Get(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(got), "http://example.com") {
+			t.Errorf("%s not rewritten: %s", p, got)
+		}
+	}
+}
+
+// seedCSSFiles writes n small stylesheets with absolute internal URLs.
+func seedCSSFiles(tb testing.TB, store Storage, n int) []string {
+	tb.Helper()
+	css := strings.Repeat(`.a { background: url("http://example.com/img/bg.png"); }`+"\n", 200)
+	paths := make([]string, n)
+	for i := range paths {
+		paths[i] = fmt.Sprintf("css/s%d.css", i)
+		if err := store.PutBytes(paths[i], []byte(css)); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	return paths
+}
+
+func BenchmarkCSSRewriteSerial(b *testing.B) {
+	cfg := testCSSCfg()
+	idx := NewSnapshotIndex()
+	store := NewLocalStorage(b.TempDir())
+	paths := seedCSSFiles(b, store, 64)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, p := range paths {
+			_ = (CSSRewriter{}).Rewrite(store, p, "http://example.com/"+p, cfg, idx)
+		}
+	}
+}
+
+func BenchmarkCSSRewriteConcurrent(b *testing.B) {
+	cfg := testCSSCfg()
+	idx := NewSnapshotIndex()
+	store := NewLocalStorage(b.TempDir())
+	paths := seedCSSFiles(b, store, 64)
+	q, err := newCSSRewriteQueue(max(runtime.NumCPU()/2, 1), store, cfg, idx)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer q.Release()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, p := range paths {
+			q.Enqueue(p, "http://example.com/"+p)
+		}
+		q.Wait()
+	}
+}
+
+// Escaped slashes (url("http:\/\/…")) emitted by templating systems must be
+// unescaped so the reference is resolved and rewritten.
+func TestRewriteCSSEscapedSlashes(t *testing.T) {
+	cfg := testCSSCfg()
+	idx := NewSnapshotIndex()
+
+	css := `.a { background: url("http:\/\/example.com\/img\/bg.png"); }
+.b { background: url('\/img\/b.png'); }`
+	got := RewriteCSSContent(css, "http://example.com/style.css", cfg, idx)
+
+	for _, want := range []string{`url("img/bg.png")`, `url('img/b.png')`} {
+		if !strings.Contains(got, want) {
+			t.Errorf("expected %s\n  got: %s", want, got)
+		}
+	}
+	if refs := cssRefs(css); len(refs) != 2 || refs[0] != "http://example.com/img/bg.png" {
+		t.Errorf("cssRefs = %q, want unescaped references", refs)
+	}
+}
+
+// url() references to nested Wayback captures (im_, id_ or bare, absolute or
+// protocol-relative) must be unwrapped and rewritten to local paths.
+func TestRewriteCSSWaybackPrefixStripped(t *testing.T) {
+	cfg := testCSSCfg()
+	idx := NewSnapshotIndex()
+
+	css := `.a { background: url(https://web.archive.org/web/20230601000000im_/https://example.com/img/bg.png); }
+.b { background: url("//web.archive.org/web/20230601000000id_/http://example.com/img/b.png"); }
+.c { background: url('https://web.archive.org/web/20230601000000/http://www.example.com/img/c.png'); }
+.d { background: url(https://web.archive.org/web/20230601000000im_/https://other.com/x.png); }`
+	got := RewriteCSSContent(css, "http://example.com/style.css", cfg, idx)
+
+	for _, want := range []string{"url(img/bg.png)", `url("img/b.png")`, `url('img/c.png')`} {
+		if !strings.Contains(got, want) {
+			t.Errorf("expected %s\n  got: %s", want, got)
+		}
+	}
+	// External originals are left untouched, including their Wayback prefix.
+	if !strings.Contains(got, "https://web.archive.org/web/20230601000000im_/https://other.com/x.png") {
+		t.Errorf("external wayback reference should be unchanged\n  got: %s", got)
+	}
+}
+
+// url() values split across lines, as left by CSS beautifiers, are matched
+// and rewritten in every quoting style, and the line breaks are kept.
+func TestRewriteCSSMultiLineURL(t *testing.T) {
+	cfg := testCSSCfg()
+	idx := NewSnapshotIndex()
+
+	css := ".a { background-image: url(\n  \"http://example.com/img/a.png\"\n); }\n" +
+		".b { background-image: url(\r\n\t'http://example.com/img/b.png'\r\n); }\n" +
+		".c { background-image: url(\n  http://example.com/img/c.png\n  ); }\n"
+	got := RewriteCSSContent(css, "http://example.com/style.css", cfg, idx)
+
+	for _, want := range []string{
+		"url(\n  \"img/a.png\"\n)",
+		"url(\r\n\t'img/b.png'\r\n)",
+		"url(\n  img/c.png\n  )",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("expected %q\n  got: %q", want, got)
+		}
+	}
+	if refs := cssRefs(css); len(refs) != 3 {
+		t.Errorf("cssRefs = %q, want 3 references", refs)
+	}
+}
+
+// ExtractURLs resolves every url() quoting style and both @import forms
+// against the page, once each, and leaves the CSS alone.
+func TestExtractURLs(t *testing.T) {
+	css := `@import "base.css";
+@import '/theme/dark.css';
+.a { background: url("img/a.png"); }
+.b { background: url('../img/b.png'); }
+.c { background: url( https://cdn.example.net/c.png ); }
+.d { background: url(img/a.png); }
+.e { background: url(data:image/png;base64,AAAA); }
+.f { background: url(https://web.archive.org/web/20230601000000im_/http://example.com/f.png); }`
+	got, err := ExtractURLs(css, "http://example.com/css/site.css")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"http://example.com/css/img/a.png",
+		"http://example.com/img/b.png",
+		"https://cdn.example.net/c.png",
+		"http://example.com/f.png",
+		"http://example.com/css/base.css",
+		"http://example.com/theme/dark.css",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("ExtractURLs =\n  %q\nwant\n  %q", got, want)
+	}
+	if _, err := ExtractURLs(css, "http://[::1"); err == nil {
+		t.Error("expected an error for an invalid page URL")
+	}
+}
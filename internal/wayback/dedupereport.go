@@ -0,0 +1,59 @@
+package wayback
+
+import (
+	"context"
+	"fmt"
+)
+
+// DedupeReport counts the CDX rows of a site left after each deduplication
+// step, for Config.DedupeReport.
+type DedupeReport struct {
+	Rows      int   // rows the CDX index returned for all variants, uncollapsed
+	Unique    int   // rows left once those returned for several variants are dropped
+	Collapsed int   // rows left once unchanged recaptures (same URL and digest) are collapsed
+	Downloads int   // captures a run would fetch: the newest of each URL, after filtering
+	Bytes     int64 // archived (compressed) size of those captures, as the index reports it
+}
+
+// String returns the report as a one-line summary.
+func (r *DedupeReport) String() string {
+	return fmt.Sprintf("CDX returned %d rows; %d unique after variant dedup; %d after digest collapse; "+
+		"%d to download, estimated %.1f MB", r.Rows, r.Unique, r.Collapsed, r.Downloads, float64(r.Bytes)/1e6)
+}
+
+// dedupeReport queries the CDX index for cfg's variants without collapsing
+// and counts what each step of the index build removes. Digest collapsing is
+// emulated locally, on the rows of each URL in timestamp order.
+func dedupeReport(ctx context.Context, cfg *Config, statusFile *progressFile) (*DedupeReport, error) {
+	entries, results, err := fetchEntries(ctx, cfg, statusFile, "none", true)
+	if err != nil {
+		return nil, err
+	}
+	rep := &DedupeReport{Unique: len(entries)}
+	for _, r := range results {
+		rep.Rows += r.Entries
+	}
+
+	// entries are sorted by timestamp, so each URL's captures come in order.
+	var collapsed []CDXEntry
+	lastDigest := make(map[string]string)
+	for _, e := range entries {
+		if d, ok := lastDigest[e.OriginalURL]; ok && d == e.Digest && e.Digest != "" {
+			continue
+		}
+		lastDigest[e.OriginalURL] = e.Digest
+		collapsed = append(collapsed, e)
+	}
+	rep.Collapsed = len(collapsed)
+
+	length := make(map[string]int64, len(collapsed))
+	for _, e := range collapsed {
+		length[e.Timestamp+"|"+stripFragment(e.OriginalURL)] = e.Length
+	}
+	manifest := downloadManifest(buildIndex(collapsed, cfg), collapsed, cfg)
+	rep.Downloads = len(manifest)
+	for _, s := range manifest {
+		rep.Bytes += length[s.Timestamp+"|"+s.FileURL]
+	}
+	return rep, nil
+}
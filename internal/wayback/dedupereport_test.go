@@ -0,0 +1,65 @@
+package wayback
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// The report counts the uncollapsed rows of both variants, the rows left
+// after dropping cross-variant duplicates and unchanged recaptures, and the
+// newest capture per URL with its size; nothing is downloaded.
+func TestDedupeReport(t *testing.T) {
+	var downloads atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/cdx/search/") {
+			downloads.Add(1)
+			http.NotFound(w, r)
+			return
+		}
+		q := r.URL.Query()
+		if q.Has("collapse") || q.Get("fl") != "timestamp,original,digest,length" {
+			t.Errorf("unexpected CDX query %s", r.URL.RawQuery)
+		}
+		// /a is recaptured unchanged once, then changes; /b shows up for
+		// both variants.
+		rows := `["20200101000000","http://example.com/a","AAA","1000"],` +
+			`["20200201000000","http://example.com/a","AAA","1000"],` +
+			`["20200301000000","http://example.com/a","BBB","3000"],` +
+			`["20200101000000","http://example.com/b","CCC","500"]`
+		if q.Get("url") == "https://example.com/" {
+			rows = `["20200101000000","http://example.com/b","CCC","500"]`
+		}
+		_, _ = io.WriteString(w, `[["timestamp","original","digest","length"],`+rows+`]`)
+	}))
+	defer srv.Close()
+	useTestArchive(t, srv)
+
+	cfg := &Config{
+		BaseURL: "http://example.com/", Variants: []string{"http://example.com/", "https://example.com/"},
+		BareHost: "example.com", ExactURL: true, Directory: t.TempDir(), Threads: 1, CDXRatePerMin: 6000,
+		CDXEndpoint: "xd", DedupeReport: true, LogLevel: LogError,
+	}
+	rep, err := dedupeReport(context.Background(), cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := DedupeReport{Rows: 5, Unique: 4, Collapsed: 3, Downloads: 2, Bytes: 3500}
+	if *rep != want {
+		t.Errorf("report = %+v, want %+v", *rep, want)
+	}
+	if got := rep.String(); got != "CDX returned 5 rows; 4 unique after variant dedup; 3 after digest collapse; 2 to download, estimated 0.0 MB" {
+		t.Errorf("String() = %q", got)
+	}
+
+	if err := DownloadAll(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if n := downloads.Load(); n != 0 {
+		t.Errorf("%d download request(s) made, want 0", n)
+	}
+}
@@ -0,0 +1,20 @@
+// Package wayback downloads the captures of a website from the Wayback
+// Machine and rewrites their links so the copy can be browsed offline.
+//
+// The entry point is DownloadAll. It takes a Config describing the site and
+// the run: the target URL (fill BaseURL, Variants, BareHost and UnicodeHost
+// from NormalizeBaseURL), the time range, link rewriting and output options.
+// A run queries the CDX index for every variant, keeps the newest capture of
+// each URL in a SnapshotIndex, downloads them concurrently into a Storage and
+// then rewrites HTML, CSS and feeds so internal links point at the local
+// copies.
+//
+// Files go to Config.Storage when it is set, otherwise to a LocalStorage on
+// Config.Directory; MemStorage keeps them in memory instead. Hooks reports
+// progress to the caller, and Config.LogLevel controls what is printed to
+// stdout and the standard logger.
+//
+// DownloadAll never exits the process. It returns ErrNoSnapshots when nothing
+// is archived, an error wrapping ErrCDX when the index cannot be fetched and a
+// *PartialError when only some files failed; see DownloadAll for the rest.
+package wayback
@@ -2,12 +2,21 @@ package wayback
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"maps"
 	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"slices"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -16,25 +25,286 @@ import (
 )
 
 // Config holds all runtime configuration for the downloader.
+//
+// The json tags define the -config file format. Fields derived from the
+// target URL (BaseURL, Variants, BareHost, UnicodeHost) and runtime-only
+// values are excluded.
 type Config struct {
-	BaseURL                string
-	Variants               []string
-	BareHost               string
-	UnicodeHost            string
-	ExactURL               bool
-	Directory              string
-	FromTimestamp          string
-	ToTimestamp            string
-	Threads                int
-	RewriteLinks           bool
-	PrettyPath             bool
-	CanonicalAction        string
-	DownloadExternalAssets bool
-	Debug                  bool
-	StopOnError            bool
-	CDXRatePerMin          int     // CDX API requests per minute (default 60)
-	CDXMaxRetries          int     // max retry attempts on throttle/5xx (default 5)
-	Storage                Storage // if nil, NewLocalStorage(Directory) is used
+	BaseURL                  string            `json:"-"`
+	Variants                 []string          `json:"-"`
+	BareHost                 string            `json:"-"`
+	UnicodeHost              string            `json:"-"`
+	ExactURL                 bool              `json:"exact_url"`
+	OnlyLatestPerHost        bool              `json:"only_latest_per_host"`     // fetch just the newest root page of each host under BareHost
+	DropFragmentDupes        bool              `json:"drop_fragment_only_dupes"` // drop CDX entries that differ from another only by a #fragment
+	Directory                string            `json:"directory"`
+	OutputDirTemplate        string            `json:"output_dir_template"` // if set, replaces Directory; see ParseOutputDirTemplate
+	DatedDir                 bool              `json:"dated_dir"`           // download into a DatedDirLayout subdirectory named for the run's start
+	Repair                   bool              `json:"repair"`              // only rewrite links in the files already in Directory
+	Merge                    bool              `json:"merge"`               // add to an existing Directory, keeping other captures' files (see MergeIndexFile)
+	URLMap                   string            `json:"url_map"`             // manifest (-manifest-out) mapping files to URLs for Repair
+	RewriteDryRun            string            `json:"rewrite_dry_run"`     // Repair: write nothing back, list the link changes in this OS file (TSV) instead
+	FromTimestamp            string            `json:"from"`
+	ToTimestamp              string            `json:"to"`
+	SnapshotDate             string            `json:"snapshot_date"` // YYYYMMDD or RFC3339; overrides From/ToTimestamp with that day
+	Threads                  int               `json:"threads"`
+	RewriteLinks             bool              `json:"rewrite_links"`
+	PrettyPath               bool              `json:"pretty_path"`
+	MaxPathDepth             int               `json:"max_path_depth"` // truncate local paths to this many components (0 = unlimited)
+	TrailingSlash            string            `json:"trailing_slash"` // "keep" (default) or "collapse": store extension-less paths as directories
+	CanonicalAction          string            `json:"canonical"`
+	RemovePreconnect         bool              `json:"remove_preconnect"`          // drop <link rel="dns-prefetch"/"preconnect"> when rewriting
+	RewriteSrcsetDescriptors bool              `json:"rewrite_srcset_descriptors"` // keep only srcset candidates that were archived
+	HTMLParser               string            `json:"html_parser"`                // "lenient" (default) or "strict"; see htmlCorrections
+	HTMLMaxCorrections       int               `json:"html_max_corrections"`       // strict: leave pages with more corrections unrewritten (0 = no limit)
+	StripAMP                 bool              `json:"strip_amp"`                  // drop <link rel="amphtml"> and canonicals naming AMP pages when rewriting
+	StripWaybackComments     bool              `json:"strip_wayback_comments"`     // drop the Wayback toolbar block and archiving tools' comments when rewriting
+	MaxAbsPathLen            int               `json:"max_abs_path_len"`           // hash names (and drop directories) of files whose absolute path would be longer (0 = no limit)
+	RewriteOnclick           bool              `json:"rewrite_onclick"`            // point window.location='...' in onclick handlers at local copies
+	FilenameEncoding         string            `json:"filename_encoding"`          // non-ASCII in preserve-mode names: FilenamePercent (default), Raw, Unicode or ASCII
+	NormalizeEncodedPaths    bool              `json:"normalize_encoded_paths"`    // decode escaped letters, digits and -_. in preserve-mode names (my%2Dfile → my-file)
+	XHTMLOutput              bool              `json:"xhtml_output"`               // write rewritten pages as well-formed XML (CDATA scripts and styles)
+	AcceptRanges             bool              `json:"accept_ranges"`              // keep partial files of interrupted downloads and resume them with Range requests
+	KeepNewer                bool              `json:"keep_newer"`                 // stamp files with their capture time; repair leaves files modified since alone (and refuses a mirror never stamped)
+	ProbeCDN                 bool              `json:"probe_cdn"`                  // after downloading, query the index for resolving subdomains the pages reference and fetch them too
+	TwoPassExtraction        bool              `json:"two_pass_extraction"`        // in a second pass, download the internal URLs pages reference that the CDX index lacks
+	MaxIdleConnsPerHost      int               `json:"max_idle_conns_per_host"`    // idle archive connections kept for reuse (0 = Threads)
+	IdleConnTimeout          time.Duration     `json:"-"`                          // close idle connections after this long (0 = 90s)
+	DNSCacheTTL              time.Duration     `json:"-"`                          // reuse host name lookups for this long (0 = no cache)
+	ContentTypeOverrides     map[string]string `json:"content_type_overrides"`     // extension (lower-case, no dot) → Content-Type replacing the archive's
+	LimitPerExt              map[string]int    `json:"limit_per_ext"`              // extension (lower-case, no dot) → most files of it to download, newest first
+	CDNMap                   map[string]string `json:"cdn_map"`                    // CDN host (lower-case) → directory its files are downloaded to; the host counts as internal
+	DownloadExternalAssets   bool              `json:"external_assets"`
+	ExtraSubdomains          []string          `json:"subdomains"`      // subdomains of BareHost treated as internal (e.g. "blog")
+	ProgressFile             string            `json:"progress_file"`   // OS path of a JSON status file rewritten every second ("" = none)
+	ProgressFormat           string            `json:"progress_format"` // "text" (default, progress bars) or "json" (one object per update on stderr)
+	LogLevel                 string            `json:"log_level"`       // LogDebug, LogInfo (default), LogWarn or LogError
+	Debug                    bool              `json:"debug"`           // Deprecated: same as LogLevel LogDebug
+	DebugURLs                bool              `json:"debug_urls"`      // log each URL → local path mapping step
+	StopOnError              bool              `json:"stop_on_error"`
+	MirrorHeaders            map[string]string `json:"mirror_headers"`     // extra headers sent with download requests (not CDX queries), e.g. Accept-Language
+	Cookies                  string            `json:"cookie"`             // raw Cookie header sent with every request
+	Insecure                 bool              `json:"insecure"`           // skip TLS certificate verification (self-signed mirrors, intercepting proxies)
+	CookieList               []*http.Cookie    `json:"-"`                  // domain-scoped cookies (see ParseNetscapeCookies)
+	AssetOnly                bool              `json:"asset_only"`         // fetch only BaseURL's page and the assets it embeds
+	ManifestOut              string            `json:"manifest_out"`       // OS path to export the manifest to ("" = none)
+	ManifestFormat           string            `json:"manifest_format"`    // "json" (default) or "csv"
+	DownloadListOnly         string            `json:"download_list_only"` // OS path to list the capture URLs in, instead of downloading
+	MetadataOnly             bool              `json:"metadata_only"`      // write the ManifestOut manifest with local paths, instead of downloading
+	DedupeReport             bool              `json:"dedupe_report"`      // print a DedupeReport of the uncollapsed index, instead of downloading
+	WriteIndex               bool              `json:"write_index"`        // write IndexFile listing every downloaded page
+	NoFonts                  bool              `json:"no_fonts"`           // skip web fonts (see fontExtensions) and drop font preloads
+	SkipAssets               bool              `json:"skip_assets"`        // download pages only (see isPageURL); rewritten asset links point at the archive
+	AssetsFirst              bool              `json:"assets_first"`       // download styles, scripts, images and fonts before pages
+	PreloadHeaders           bool              `json:"preload_headers"`    // also fetch same-host assets named in archived Link: rel=preload headers
+	SourceMaps               bool              `json:"source_maps"`        // also fetch the source maps scripts name in sourceMappingURL comments, and link them locally
+	Thumbnails               bool              `json:"thumbnails"`         // also fetch the archive's screenshot of each HTML page
+	CaptureRedirects         bool              `json:"capture_redirects"`  // record archived redirect hops into RedirectsFile
+	ConcurrentCSS            bool              `json:"concurrent_css"`     // rewrite CSS on a separate worker pool
+	CSSRewriteThreads        int               `json:"css_threads"`        // CSS pool size (default runtime.NumCPU()/2)
+	Schedule                 string            `json:"schedule"`           // daily throttle window, see ParseSchedule ("" = none)
+	PeakRatePerMin           int               `json:"peak_rate"`          // downloads per minute in peak hours; 0 pauses
+	CDXRatePerMin            int               `json:"cdx_rate"`           // CDX API requests per minute (default 60)
+	CDXMaxRetries            int               `json:"cdx_retries"`        // max retry attempts on throttle/5xx (default 5)
+	TotalRetries             int               `json:"total_retries"`      // CDX retries allowed across the whole run (downloads are not retried); 0 = unlimited
+	MaxSnapshotIndex         int               `json:"max_snapshot_index"` // captures kept in the SnapshotIndex, newest first, applied after the CDX fetch; 0 = unlimited
+	CDXRequestTimeout        time.Duration     `json:"-"`                  // deadline for each CDX request (default 60s; 0 = client timeout)
+	MaxDuration              time.Duration     `json:"-"`                  // stop the run cleanly after this long (0 = no limit)
+	Track404s                bool              `json:"track_404s"`         // count indexed URLs the archive answers 404 for
+	NotFoundLog              string            `json:"404_log"`            // OS path to list those URLs in (implies Track404s)
+	Stats                    *DownloadStats    `json:"-"`                  // if non-nil, receives the run's counters
+	Hooks                    *Hooks            `json:"-"`                  // if non-nil, called back as the run progresses
+	ParallelVariants         bool              `json:"parallel_variants"`  // query the CDX index for all Variants concurrently
+	CollapseMode             string            `json:"collapse_mode"`      // digest (default), urlkey or timestamp:N; see CDXCollapseParam
+	CDXEndpoint              string            `json:"cdx_endpoint"`       // "xd" or "cdx"; "" probes xd and falls back to cdx
+	CDXFilters               []string          `json:"cdx_filters"`        // extra CDX filter expressions "[!]field:regex"; one on statuscode replaces the default
+	ArchiveBase              string            `json:"archive_base"`       // Wayback-compatible archive root ("" = DefaultArchiveBase)
+	CaseSensitiveFS          *bool             `json:"case_sensitive_fs"`  // nil = probe Directory (see IsCaseSensitiveFS)
+	FsyncOnWrite             bool              `json:"fsync_on_write"`     // flush every file to disk before it replaces the old one
+	StateFile                string            `json:"state_file"`         // OS path of the run's checkpoint (see WriteState), resumed from when present
+	RewriteOut               string            `json:"rewrite_out"`        // OS directory for rewritten files; originals stay in Directory ("" = in place)
+	RewriteStorage           Storage           `json:"-"`                  // if nil and RewriteOut is set, a LocalStorage on RewriteOut is used
+	Storage                  Storage           `json:"-"`                  // if nil, a LocalStorage on Directory is used
+
+	rewrites *rewriteRecorder // set by a RewriteDryRun walk; see recordRewrite
+}
+
+// Clone returns a copy of c that shares no mutable state with it: slices and
+// maps are copied and cookies and CaseSensitiveFS duplicated. Storage (an
+// interface), Stats and Hooks (meant to be shared with the caller) are kept
+// as-is.
+func (c *Config) Clone() *Config {
+	cp := *c
+	cp.Variants = append([]string(nil), c.Variants...)
+	cp.ExtraSubdomains = append([]string(nil), c.ExtraSubdomains...)
+	cp.CDXFilters = append([]string(nil), c.CDXFilters...)
+	cp.MirrorHeaders = maps.Clone(c.MirrorHeaders)
+	cp.ContentTypeOverrides = maps.Clone(c.ContentTypeOverrides)
+	cp.LimitPerExt = maps.Clone(c.LimitPerExt)
+	cp.CDNMap = maps.Clone(c.CDNMap)
+	if c.CaseSensitiveFS != nil {
+		v := *c.CaseSensitiveFS
+		cp.CaseSensitiveFS = &v
+	}
+	if c.CookieList != nil {
+		cp.CookieList = make([]*http.Cookie, len(c.CookieList))
+		for i, ck := range c.CookieList {
+			dup := *ck
+			cp.CookieList[i] = &dup
+		}
+	}
+	return &cp
+}
+
+// Validate reports the first option in c that is out of range or malformed.
+// It does not check the target URL; callers resolve that via NormalizeBaseURL.
+// CanonicalAction, ManifestFormat, ProgressFormat and HTMLParser are expected
+// in lower case; an empty ManifestFormat means JSON, an empty ProgressFormat
+// text and an empty HTMLParser lenient.
+func (c *Config) Validate() error {
+	switch {
+	case c.Threads <= 0:
+		return errors.New("threads must be greater than 0")
+	case c.CSSRewriteThreads < 0:
+		return errors.New("css threads must not be negative")
+	case c.MaxPathDepth < 0:
+		return errors.New("max path depth must not be negative")
+	case !validFilenameEncoding(c.FilenameEncoding):
+		return fmt.Errorf("filename encoding %q: want raw, percent, unicode or ascii", c.FilenameEncoding)
+	case c.PrettyPath && (c.FilenameEncoding == FilenameRaw || c.FilenameEncoding == FilenameUnicode):
+		return fmt.Errorf("filename encoding %s needs preserve mode; pretty paths are ASCII", c.FilenameEncoding)
+	case c.PrettyPath && c.NormalizeEncodedPaths:
+		return errors.New("normalize encoded paths needs preserve mode; pretty paths are decoded already")
+	case c.TrailingSlash != "" && c.TrailingSlash != "keep" && c.TrailingSlash != "collapse":
+		return fmt.Errorf("trailing slash %q: want keep or collapse", c.TrailingSlash)
+	case c.CanonicalAction != "" && c.CanonicalAction != "keep" && c.CanonicalAction != "remove":
+		return fmt.Errorf("canonical action %q: want keep or remove", c.CanonicalAction)
+	case c.ManifestFormat != "" && c.ManifestFormat != "json" && c.ManifestFormat != "csv":
+		return fmt.Errorf("manifest format %q: want json or csv", c.ManifestFormat)
+	case c.LogLevel != "" && !slices.Contains([]string{LogDebug, LogInfo, LogWarn, LogError}, c.LogLevel):
+		return fmt.Errorf("log level %q: want debug, info, warn or error", c.LogLevel)
+	case c.ProgressFormat != "" && c.ProgressFormat != "text" && c.ProgressFormat != "json":
+		return fmt.Errorf("progress format %q: want text or json", c.ProgressFormat)
+	case c.HTMLParser != "" && c.HTMLParser != HTMLParserLenient && c.HTMLParser != HTMLParserStrict:
+		return fmt.Errorf("html parser %q: want strict or lenient", c.HTMLParser)
+	case c.HTMLMaxCorrections < 0:
+		return errors.New("html max corrections must not be negative")
+	case c.PeakRatePerMin < 0:
+		return errors.New("peak rate must not be negative")
+	case c.CDXRatePerMin <= 0:
+		return errors.New("cdx rate must be greater than 0")
+	case c.CDXMaxRetries < 0:
+		return errors.New("cdx retries must not be negative")
+	case c.TotalRetries < 0:
+		return errors.New("total retries must not be negative")
+	case c.MaxSnapshotIndex < 0:
+		return errors.New("max snapshot index must not be negative")
+	case c.CDXRequestTimeout < 0:
+		return errors.New("cdx timeout must not be negative")
+	case c.MaxDuration < 0:
+		return errors.New("max duration must not be negative")
+	case c.MaxIdleConnsPerHost < 0:
+		return errors.New("max idle connections per host must not be negative")
+	case c.IdleConnTimeout < 0:
+		return errors.New("idle connection timeout must not be negative")
+	case c.DNSCacheTTL < 0:
+		return errors.New("dns cache ttl must not be negative")
+	case c.MaxAbsPathLen < 0:
+		return errors.New("max absolute path length must not be negative")
+	case c.CDXEndpoint != "" && c.CDXEndpoint != "xd" && c.CDXEndpoint != "cdx":
+		return fmt.Errorf("cdx endpoint %q: want xd or cdx", c.CDXEndpoint)
+	case c.Repair && c.Directory == "" && c.OutputDirTemplate == "":
+		return errors.New("repair needs an output directory")
+	case c.Repair && c.DatedDir:
+		return errors.New("dated dir cannot be combined with repair")
+	case c.DownloadListOnly != "" && (c.Repair || c.AssetOnly):
+		return errors.New("download list cannot be combined with repair or asset-only")
+	case c.MetadataOnly && c.ManifestOut == "":
+		return errors.New("metadata only needs a manifest out file")
+	case c.MetadataOnly && (c.Repair || c.AssetOnly || c.DownloadListOnly != ""):
+		return errors.New("metadata only cannot be combined with repair, asset-only or download list")
+	case c.DedupeReport && (c.Repair || c.AssetOnly || c.DownloadListOnly != "" || c.MetadataOnly || c.StateFile != ""):
+		return errors.New("dedupe report cannot be combined with repair, asset-only, download list, metadata only or a state file")
+	case !validHeaders(c.MirrorHeaders):
+		return errors.New("mirror headers need valid header names and values")
+	case !validContentTypeOverrides(c.ContentTypeOverrides):
+		return errors.New("content type overrides need lower-case extensions without a dot and valid media types")
+	case !validExtLimits(c.LimitPerExt):
+		return errors.New("limits per extension need lower-case extensions without a dot and limits of 0 or more")
+	case !validCDNMap(c.CDNMap):
+		return errors.New("cdn map needs lower-case hosts and relative directories inside the output directory")
+	case c.RewriteDryRun != "" && (!c.Repair || c.RewriteOut != ""):
+		return errors.New("rewrite dry run needs repair and no rewrite output directory")
+	case c.RewriteOut != "" && !c.RewriteLinks && !c.Repair:
+		return errors.New("rewrite out needs rewrite links or repair")
+	case c.SkipAssets && (c.Repair || c.AssetOnly || c.PreloadHeaders):
+		return errors.New("skip assets cannot be combined with repair, asset-only or preload headers")
+	case c.StateFile != "" && (c.Repair || c.OnlyLatestPerHost):
+		return errors.New("state file cannot be combined with repair or only-latest-per-host")
+	case c.OnlyLatestPerHost && (c.Repair || c.AssetOnly || c.ExactURL):
+		return errors.New("only latest per host cannot be combined with repair, asset-only or exact-url")
+	}
+	if c.ArchiveBase != "" {
+		u, err := url.Parse(c.ArchiveBase)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("archive base %q: want an http(s) URL", c.ArchiveBase)
+		}
+	}
+	if c.SnapshotDate != "" {
+		if c.FromTimestamp != "" || c.ToTimestamp != "" {
+			return errors.New("snapshot date cannot be combined with from/to timestamps")
+		}
+		if _, _, err := SnapshotDateRange(c.SnapshotDate); err != nil {
+			return err
+		}
+	}
+	if c.Schedule != "" {
+		if _, err := ParseSchedule(c.Schedule); err != nil {
+			return fmt.Errorf("schedule: %w", err)
+		}
+	}
+	if _, err := CDXCollapseParam(c.CollapseMode); err != nil {
+		return err
+	}
+	for _, f := range c.CDXFilters {
+		if err := checkCDXFilter(f); err != nil {
+			return err
+		}
+	}
+	if c.OutputDirTemplate != "" {
+		if _, err := ParseOutputDirTemplate(c.OutputDirTemplate); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ErrNoSnapshots is returned by DownloadAll when the CDX index contains no
+// snapshots for the requested URL and time range.
+var ErrNoSnapshots = errors.New("no snapshots found")
+
+// ErrCDX wraps every failure that happens while fetching the CDX index.
+var ErrCDX = errors.New("CDX fetch")
+
+// ErrMaxDuration is returned by DownloadAll when Config.MaxDuration ran out
+// before every snapshot was fetched. Completed files are kept, so a later run
+// resumes where this one stopped.
+var ErrMaxDuration = errors.New("maximum run duration reached")
+
+// ErrArchiveUnavailable is returned by DownloadAll when the CDX retries
+// allowed by Config.TotalRetries are spent: the index keeps failing, so the
+// run stops instead of retrying every remaining query.
+var ErrArchiveUnavailable = errors.New("archive appears unavailable")
+
+// PartialError is returned by DownloadAll when the run completed but some
+// resources could not be downloaded (only possible without StopOnError).
+type PartialError struct {
+	Failed int // number of resources that failed
+	Total  int // number of resources attempted
+}
+
+func (e *PartialError) Error() string {
+	return fmt.Sprintf("%d of %d resource(s) failed to download", e.Failed, e.Total)
 }
 
 var downloadHTTPClient = &http.Client{
@@ -42,36 +312,120 @@ var downloadHTTPClient = &http.Client{
 }
 
 // DownloadAll fetches the CDX index and downloads every snapshot concurrently.
+// It returns ErrNoSnapshots when nothing is archived, an error wrapping ErrCDX
+// when the index cannot be fetched, and a *PartialError when some downloads
+// failed but the run otherwise completed. cfg is checked with Validate before
+// any request is made. With cfg.Repair set it neither queries the index nor
+// downloads, and only rewrites links in the files already in cfg.Directory.
+// With cfg.DownloadListOnly set it queries the index and writes the capture
+// URLs it would fetch to that file, without downloading; with cfg.MetadataOnly
+// it writes the manifest, with the local path each capture would be stored
+// at, to cfg.ManifestOut instead, and with cfg.DedupeReport it prints a
+// DedupeReport. With cfg.Merge set, files other captures left in
+// cfg.Directory are kept: a different URL that maps to an owned path is
+// stored under a suffixed name (see mergeIndex).
+//
+// cfg is cloned on entry and never modified, so one Config may be reused for
+// several sequential or concurrent runs.
 func DownloadAll(cfg *Config) error {
-	ctx, cancel := context.WithCancel(context.Background())
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	cfg = cfg.Clone()
+	if cfg.SnapshotDate != "" {
+		from, to, err := SnapshotDateRange(cfg.SnapshotDate)
+		if err != nil {
+			return err
+		}
+		cfg.FromTimestamp, cfg.ToTimestamp = from, to
+	}
+	start := time.Now()
+	if cfg.OutputDirTemplate != "" {
+		tmpl, err := ParseOutputDirTemplate(cfg.OutputDirTemplate)
+		if err != nil {
+			return err
+		}
+		if cfg.Directory, err = ExpandOutputDir(tmpl, cfg.BareHost, outputDirDate(cfg, start)); err != nil {
+			return err
+		}
+	}
+	if cfg.DatedDir {
+		cfg.Directory = datedDir(cfg.Directory, start)
+	}
+	if cfg.RewriteStorage == nil && cfg.RewriteOut != "" {
+		cfg.RewriteStorage = openLocalStorage(cfg.RewriteOut, cfg)
+	}
+	if cfg.Repair {
+		return repairLinks(cfg)
+	}
+
+	var (
+		ctx    context.Context
+		cancel context.CancelFunc
+	)
+	if cfg.MaxDuration > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), cfg.MaxDuration)
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
 	defer cancel()
+	runCtx := ctx
+	timedOut := func() bool { return errors.Is(runCtx.Err(), context.DeadlineExceeded) }
+	errTimedOut := fmt.Errorf("%w (%s); rerun to resume", ErrMaxDuration, cfg.MaxDuration)
 
-	cdxProg := NewCDXProgress()
-	entries, err := fetchAllSnapshots(ctx, cfg.Variants, cfg.ExactURL, cfg.FromTimestamp, cfg.ToTimestamp, cdxProg, cfg.CDXRatePerMin, cfg.CDXMaxRetries)
-	cdxProg.Finish()
-	if err != nil {
-		return fmt.Errorf("CDX fetch: %w", err)
+	var statusFile *progressFile
+	if cfg.ProgressFile != "" {
+		statusFile = newProgressFile(cfg.ProgressFile)
+		defer func() { _ = statusFile.Close() }()
 	}
-	if len(entries) == 0 {
-		fmt.Println("No snapshots found.")
+	if cfg.DedupeReport {
+		rep, err := dedupeReport(ctx, cfg, statusFile)
+		if timedOut() {
+			return errTimedOut
+		}
+		if err != nil {
+			return err
+		}
+		cfg.printf(LogInfo, "%s.\n", rep)
 		return nil
 	}
-
-	// Build deduplication index
-	idx := NewSnapshotIndex()
-	for _, e := range entries {
-		idx.Register(e.OriginalURL, e.Timestamp)
+	idx, err := resumeIndex(cfg)
+	if err != nil {
+		return err
+	}
+	var entries []CDXEntry
+	if idx == nil {
+		idx, entries, err = queryIndex(ctx, cfg, statusFile)
+		if timedOut() {
+			return errTimedOut
+		}
+		if err != nil {
+			return err
+		}
 	}
 
-	manifest := idx.GetManifest()
-	total := len(manifest)
-	if cfg.Debug {
-		fmt.Printf("Found %d unique snapshots to download.\n", total)
+	manifest := downloadManifest(idx, entries, cfg)
+
+	if cfg.DownloadListOnly != "" {
+		if err := writeDownloadList(cfg.DownloadListOnly, manifest, cfg.ArchiveBase); err != nil {
+			return fmt.Errorf("write download list: %w", err)
+		}
+		cfg.printf(LogInfo, "Wrote %d download URL(s) to %s.\n", len(manifest), cfg.DownloadListOnly)
+		return nil
+	}
+	if cfg.MetadataOnly {
+		if err := writeMetadata(cfg.ManifestOut, manifest, cfg); err != nil {
+			return fmt.Errorf("write manifest: %w", err)
+		}
+		cfg.printf(LogInfo, "Wrote %d manifest record(s) to %s.\n", len(manifest), cfg.ManifestOut)
+		return nil
 	}
 
-	store := cfg.Storage
-	if store == nil {
-		store = NewLocalStorage(cfg.Directory)
+	store := openStorage(cfg)
+	if cfg.Merge {
+		if idx.merge, err = loadMergeIndex(store); err != nil {
+			return fmt.Errorf("read merge index: %w", err)
+		}
 	}
 
 	pool, err := ants.NewPool(cfg.Threads)
@@ -80,100 +434,560 @@ func DownloadAll(cfg *Config) error {
 	}
 	defer pool.Release()
 
-	g, ctx := errgroup.WithContext(ctx)
-	dlProg := NewDownloadProgress(total)
+	var cssQ *cssRewriteQueue
+	if cfg.RewriteLinks && cfg.ConcurrentCSS {
+		threads := cfg.CSSRewriteThreads
+		if threads <= 0 {
+			threads = max(runtime.NumCPU()/2, 1)
+		}
+		cssQ, err = newCSSRewriteQueue(threads, rewriteTarget(store, cfg), cfg, idx)
+		if err != nil {
+			return fmt.Errorf("create CSS worker pool: %w", err)
+		}
+		defer cssQ.Release()
+	}
+
+	dlClient := withMirrorHeaders(withCookies(withInsecureTLS(withTransportTuning(downloadHTTPClient, cfg), cfg), cfg), cfg)
+	var redirects *RedirectLog
+	if cfg.CaptureRedirects {
+		redirects = &RedirectLog{archiveBase: cfg.ArchiveBase}
+		c := *dlClient
+		c.CheckRedirect = redirects.checkRedirect
+		dlClient = &c
+	}
+
+	if cfg.AssetOnly {
+		manifest, err = assetOnlyManifest(ctx, dlClient, cfg, store, idx)
+		if err != nil {
+			return err
+		}
+	}
+	total := len(manifest)
+	cfg.printf(LogDebug, "Found %d unique snapshots to download.\n", total)
+
+	var sched *scheduledLimiter
+	if cfg.Schedule != "" {
+		sc, err := ParseSchedule(cfg.Schedule)
+		if err != nil {
+			return err
+		}
+		sched = newScheduledLimiter(sc, cfg.PeakRatePerMin)
+	}
+
+	track404s := cfg.Track404s || cfg.NotFoundLog != ""
+	stats := cfg.Stats
+	if stats == nil && track404s {
+		stats = new(DownloadStats)
+	}
+
+	// fetch runs in g, which the second pass of TwoPassExtraction replaces
+	// (with ctx) once the first has been waited for.
+	g, ctx := errgroup.WithContext(runCtx)
+	dlProg := NewProgress(cfg.ProgressFormat, PhaseDownload, total).WithFile(statusFile).WithContext(runCtx)
 	var failed atomic.Int32
+	var totalQueued atomic.Int32
+	totalQueued.Store(int32(total))
 
-	for _, snap := range manifest {
-		s := snap
+	// queued holds the FileID of every snapshot handed to the pool, so an
+	// asset preloaded by several pages (see PreloadHeaders) is fetched once.
+	var queuedMu sync.Mutex
+	queued := make(map[string]bool, len(manifest))
+	var fetch func(Snapshot)
+	var discover func(Snapshot)
+	var discoveredMu sync.Mutex
+	var discovered []Snapshot
+	if cfg.TwoPassExtraction {
+		discover = func(s Snapshot) {
+			discoveredMu.Lock()
+			discovered = append(discovered, s)
+			discoveredMu.Unlock()
+		}
+	}
+	enqueue := func(s Snapshot) {
+		queuedMu.Lock()
+		if queued[s.FileID] {
+			queuedMu.Unlock()
+			return
+		}
+		queued[s.FileID] = true
+		queuedMu.Unlock()
+		dlProg.SetMax(int(totalQueued.Add(1)))
+		fetch(s)
+	}
+	fetch = func(s Snapshot) {
 		g.Go(func() error {
 			if ctx.Err() != nil {
 				return ctx.Err()
 			}
+			if err := sched.Wait(ctx); err != nil {
+				return err
+			}
 			errCh := make(chan error, 1)
 			if err := pool.Submit(func() {
-				errCh <- downloadOne(ctx, s, cfg, store, idx, dlProg)
+				errCh <- downloadOne(ctx, dlClient, s, cfg, store, idx, dlProg, cssQ, enqueue, discover)
 			}); err != nil {
 				return fmt.Errorf("submit task: %w", err)
 			}
-			if err := <-errCh; err != nil {
+			err := <-errCh
+			if errors.Is(err, errNotFound) {
+				if track404s {
+					stats.add404(s.FileURL)
+				}
+				return nil
+			}
+			if err != nil {
 				if cfg.StopOnError {
 					return err
 				}
 				failed.Add(1)
-				if cfg.Debug {
-					log.Printf("download error %s: %v", s.FileURL, err)
-				}
+				dlProg.Fail()
+				cfg.Log(LogDebug, "download error %s: %v", s.FileURL, err)
 			}
 			return nil
 		})
 	}
+	for _, s := range manifest {
+		queued[s.FileID] = true
+	}
+	for _, s := range manifest {
+		fetch(s)
+	}
 
-	if err := g.Wait(); err != nil {
-		return err
+	// On timeout, in-flight downloads are aborted (Put never leaves a partial
+	// file) and the run is wrapped up as usual for what was completed.
+	waitErr := g.Wait()
+	if waitErr == nil && len(discovered) > 0 {
+		// Second pass: the internal URLs the pages reference that the CDX
+		// index did not list, registered so the manifest and index know them.
+		// Registering invalidates the index's lookup maps, so the CSS queue
+		// must be idle first and the maps are rebuilt before the workers
+		// resolve against them. The pages of this pass are not scanned again.
+		if cssQ != nil {
+			cssQ.Wait()
+		}
+		var extra []Snapshot
+		for _, s := range discovered {
+			if !queued[s.FileID] {
+				queued[s.FileID] = true
+				idx.Register(s.FileURL, s.Timestamp)
+				extra = append(extra, s)
+			}
+		}
+		idx.GetManifest()
+		discover = nil
+		cfg.printf(LogDebug, "Found %d URL(s) in pages that the index does not list.\n", len(extra))
+		dlProg.SetMax(int(totalQueued.Add(int32(len(extra)))))
+		g, ctx = errgroup.WithContext(runCtx)
+		for _, s := range extra {
+			fetch(s)
+		}
+		manifest = append(manifest, extra...)
+		waitErr = g.Wait()
+	}
+	if waitErr == nil && cfg.ProbeCDN {
+		// The scan reads stylesheets the CSS queue may still be rewriting.
+		if cssQ != nil {
+			cssQ.Wait()
+		}
+		found, referrers := probeCDN(runCtx, cfg, store, idx, statusFile)
+		var extra []Snapshot
+		for _, s := range found {
+			if !queued[s.FileID] {
+				queued[s.FileID] = true
+				extra = append(extra, s)
+			}
+		}
+		dlProg.SetMax(int(totalQueued.Add(int32(len(extra)))))
+		g, ctx = errgroup.WithContext(runCtx)
+		for _, s := range extra {
+			fetch(s)
+		}
+		manifest = append(manifest, extra...)
+		waitErr = g.Wait()
+		if waitErr == nil && cfg.RewriteLinks {
+			// Written while the CDN hosts were external: point their links
+			// at the local copies now.
+			for _, r := range referrers {
+				if err := rewriteStored(store, r, cfg, idx); err != nil {
+					cfg.Log(LogDebug, "rewrite %s: %v", r.LocalPath, err)
+				}
+			}
+		}
+	}
+	if cfg.StateFile != "" {
+		// Saved even when the run stops early, for the rerun to resume.
+		if err := WriteState(cfg.StateFile, idx, idx.downloadedSet()); err != nil && waitErr == nil {
+			return fmt.Errorf("write state: %w", err)
+		}
+	}
+	if waitErr != nil && !timedOut() {
+		return waitErr
+	}
+	if cssQ != nil {
+		cssQ.Wait()
 	}
 	dlProg.Finish()
+	if cfg.KeepNewer {
+		// After the CSS queue, whose rewrites would bump the times again.
+		if err := stampCaptureTimes(store, idx); err != nil {
+			return fmt.Errorf("stamp capture times: %w", err)
+		}
+	}
+	if redirects != nil {
+		var buf bytes.Buffer
+		if err := redirects.WriteTSV(&buf); err != nil {
+			return fmt.Errorf("write redirects: %w", err)
+		}
+		if err := store.PutBytes(RedirectsFile, buf.Bytes()); err != nil {
+			return fmt.Errorf("write redirects: %w", err)
+		}
+		cfg.printf(LogDebug, "Recorded %d redirect(s) in %s.\n", redirects.Len(), RedirectsFile)
+	}
+	if idx.merge != nil {
+		var buf bytes.Buffer
+		if err := idx.merge.WriteTSV(&buf); err != nil {
+			return fmt.Errorf("write merge index: %w", err)
+		}
+		if err := store.PutBytes(MergeIndexFile, buf.Bytes()); err != nil {
+			return fmt.Errorf("write merge index: %w", err)
+		}
+	}
+	if cfg.ManifestOut != "" {
+		if err := writeManifestFile(idx, cfg.ManifestOut, cfg.ManifestFormat); err != nil {
+			return fmt.Errorf("write manifest: %w", err)
+		}
+	}
+	if cfg.WriteIndex {
+		if err := WriteIndex(store, manifest, cfg, idx); err != nil {
+			return fmt.Errorf("write index: %w", err)
+		}
+	}
+	if track404s {
+		n := stats.Downloaded404s.Load()
+		cfg.printf(LogInfo, "%d indexed URL(s) returned 404 at download time.\n", n)
+		if cfg.NotFoundLog != "" {
+			if err := writeNotFoundLog(cfg.NotFoundLog, stats.NotFoundURLs()); err != nil {
+				return fmt.Errorf("write 404 log: %w", err)
+			}
+		}
+	}
+	if timedOut() {
+		return errTimedOut
+	}
 	if n := failed.Load(); n > 0 {
-		fmt.Printf("%d resource(s) failed to download.\n", n)
+		return &PartialError{Failed: int(n), Total: int(totalQueued.Load())}
 	}
 	return nil
 }
 
+// queryIndex queries the CDX index for cfg's variants, and the hosts of
+// cfg.CDNMap, and builds the
+// SnapshotIndex of the captures found; entries are the raw CDX rows.
+// Progress goes to statusFile too when it is non-nil.
+func queryIndex(ctx context.Context, cfg *Config, statusFile *progressFile) (*SnapshotIndex, []CDXEntry, error) {
+	collapse, err := CDXCollapseParam(cfg.CollapseMode)
+	if err != nil {
+		return nil, nil, err
+	}
+	query := cfg
+	if extra := cdnVariants(cfg); len(extra) > 0 {
+		query = cfg.Clone()
+		query.Variants = append(query.Variants, extra...)
+	}
+	entries, _, err := fetchEntries(ctx, query, statusFile, collapse, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	return buildIndex(entries, cfg), entries, nil
+}
+
+// cdnVariants returns the URL variants to query for the hosts of
+// cfg.CDNMap, so their files are downloaded along with the site; none for
+// an exact-URL or per-host run, which do not crawl the site's assets.
+func cdnVariants(cfg *Config) []string {
+	if cfg.ExactURL || cfg.OnlyLatestPerHost {
+		return nil
+	}
+	hosts := slices.Sorted(maps.Keys(cfg.CDNMap))
+	var variants []string
+	for _, h := range hosts {
+		variants = append(variants, "https://"+h+"/", "http://"+h+"/")
+	}
+	return variants
+}
+
+// fetchEntries queries the CDX index for cfg's variants with the collapse
+// parameter collapse, fetching digests and lengths too when details is set.
+// It fails with ErrNoSnapshots when nothing is archived.
+func fetchEntries(ctx context.Context, cfg *Config, statusFile *progressFile, collapse string, details bool) ([]CDXEntry, []VariantResult, error) {
+	cdxClient := newCDXClient(cfg)
+	var probeURL string
+	if len(cfg.Variants) > 0 {
+		probeURL = cfg.Variants[0]
+	}
+	lim := newCDXLimiter(cfg.CDXRatePerMin)
+	endpoint := resolveCDXEndpoint(ctx, cdxClient, lim, cdxEndpoints, cfg.CDXEndpoint, cfg.ArchiveBase, probeURL)
+	cdxProg := NewProgress(cfg.ProgressFormat, PhaseCDX, -1).WithFile(statusFile).WithContext(ctx)
+	// A per-host survey queries the bare host once, with all its subdomains.
+	variants := cfg.Variants
+	if cfg.OnlyLatestPerHost {
+		variants = []string{cfg.BareHost}
+	}
+	entries, results, err := fetchAllSnapshots(ctx, cdxClient, variants, cfg.ExactURL, cdxProg, cdxOptions{
+		FromTS:      cfg.FromTimestamp,
+		ToTS:        cfg.ToTimestamp,
+		RatePerMin:  cfg.CDXRatePerMin,
+		MaxRetries:  cfg.CDXMaxRetries,
+		Retries:     newRetryBudget(cfg.TotalRetries),
+		MatchDomain: cfg.OnlyLatestPerHost,
+		DedupeFrags: cfg.DropFragmentDupes,
+		Hooks:       cfg.Hooks,
+		Timeout:     cfg.CDXRequestTimeout,
+		Parallel:    cfg.ParallelVariants,
+		Collapse:    collapse,
+		Details:     details,
+		Filters:     cfg.CDXFilters,
+		Endpoint:    endpoint,
+		ArchiveBase: cfg.ArchiveBase,
+		Limiter:     lim,
+	})
+	cdxProg.Finish()
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %w", ErrCDX, err)
+	}
+	// A variant that failed leaves the index incomplete; say which.
+	summaryLevel := LogDebug
+	if slices.ContainsFunc(results, func(r VariantResult) bool { return r.Err != nil }) {
+		summaryLevel = LogWarn
+	}
+	cfg.printf(summaryLevel, "CDX index by variant:\n%s", variantSummary(results))
+	if len(entries) == 0 {
+		return nil, nil, ErrNoSnapshots
+	}
+	return entries, results, nil
+}
+
+// downloadManifest returns the snapshots of idx a run under cfg fetches, in
+// download order; entries are the CDX rows idx was built from.
+func downloadManifest(idx *SnapshotIndex, entries []CDXEntry, cfg *Config) []Snapshot {
+	manifest := dropCyclicPaths(idx.GetManifest(), cfg)
+	if cfg.OnlyLatestPerHost {
+		manifest = latestRootPerHost(entries)
+	}
+	if cfg.NoFonts {
+		manifest = dropFonts(manifest, cfg)
+	}
+	if cfg.SkipAssets {
+		manifest = dropAssets(manifest, cfg)
+	}
+	if len(cfg.LimitPerExt) > 0 {
+		manifest = limitPerExt(manifest, cfg)
+	}
+	if cfg.AssetsFirst {
+		sortAssetsFirst(manifest)
+	}
+	return manifest
+}
+
+// buildIndex registers entries in a new SnapshotIndex capped at
+// cfg.MaxSnapshotIndex.
+func buildIndex(entries []CDXEntry, cfg *Config) *SnapshotIndex {
+	idx := NewSnapshotIndex()
+	idx.MaxSize = cfg.MaxSnapshotIndex
+	idx.Import(entries)
+	if n := idx.Evicted(); n > 0 {
+		cfg.Log(LogWarn, "snapshot index capped at %d captures: dropped %d older ones", idx.MaxSize, n)
+	}
+	return idx
+}
+
+// newCDXClient returns the client for CDX queries under cfg: cookies and
+// TLS settings applied, and with cfg.CDXRequestTimeout set, no client-wide
+// timeout.
+func newCDXClient(cfg *Config) *http.Client {
+	cdxClient := withCookies(withInsecureTLS(withTransportTuning(cdxHTTPClient, cfg), cfg), cfg)
+	if cfg.CDXRequestTimeout > 0 {
+		// The per-request deadline replaces the client-wide timeout.
+		c := *cdxClient
+		c.Timeout = 0
+		cdxClient = &c
+	}
+	return cdxClient
+}
+
+// openStorage returns cfg.Storage, or a LocalStorage on cfg.Directory (see
+// openLocalStorage). For the latter, a nil cfg.CaseSensitiveFS is set to
+// the probed sensitivity, so that links are mapped as the files are (see
+// storedPath).
+func openStorage(cfg *Config) Storage {
+	if cfg.Storage != nil {
+		return cfg.Storage
+	}
+	if cfg.CaseSensitiveFS == nil {
+		sensitive := IsCaseSensitiveFS(cfg.Directory)
+		cfg.CaseSensitiveFS = &sensitive
+	}
+	return openLocalStorage(cfg.Directory, cfg)
+}
+
+// openLocalStorage returns a LocalStorage on dir suited to the case
+// sensitivity of its filesystem (cfg.CaseSensitiveFS, or probed) that fsyncs
+// when cfg.FsyncOnWrite is set.
+func openLocalStorage(dir string, cfg *Config) *LocalStorage {
+	var sensitive bool
+	if cfg.CaseSensitiveFS != nil {
+		sensitive = *cfg.CaseSensitiveFS
+	} else {
+		sensitive = IsCaseSensitiveFS(dir)
+	}
+	store := NewLocalStorage(dir)
+	if !sensitive {
+		store = NewCaseInsensitiveStorage(dir)
+	}
+	store.SetFsync(cfg.FsyncOnWrite)
+	store.SetMaxPathLen(cfg.MaxAbsPathLen, func(format string, args ...any) { cfg.Log(LogDebug, format, args...) })
+	return store
+}
+
 // downloadOne downloads a single snapshot and optionally rewrites its links.
-func downloadOne(ctx context.Context, snap Snapshot, cfg *Config, store Storage, idx *SnapshotIndex, dlProg *Progress) error {
+// When cssQ is non-nil CSS rewrites are handed off to it instead of running inline.
+// With cfg.PreloadHeaders, assets preloaded by the response's Link headers,
+// and with cfg.SourceMaps the source map a script names, are passed to
+// enqueue when it is non-nil. The internal URLs a page references
+// that idx does not know are passed to discover when it is non-nil.
+func downloadOne(ctx context.Context, client *http.Client, snap Snapshot, cfg *Config, store Storage, idx *SnapshotIndex, dlProg *Progress, cssQ *cssRewriteQueue, enqueue, discover func(Snapshot)) (err error) {
 
 	if ctx.Err() != nil {
 		return ctx.Err()
 	}
+	// Fonts can still arrive outside the filtered manifest (asset-only
+	// pages, preload headers).
+	if cfg.NoFonts && isFontURL(snap.FileURL) {
+		dlProg.Inc()
+		return nil
+	}
 
-	logicalPath := URLToLocalPath(snap.FileURL, cfg.PrettyPath)
+	logicalPath := idx.merge.place(localPathFor(snap.FileURL, cfg), snap.FileURL)
+	cfg.Hooks.snapshotStart(snap)
+	res := SnapshotResult{Snapshot: snap, LocalPath: logicalPath}
+	start := time.Now()
+	defer func() {
+		res.Duration = time.Since(start)
+		if res.NotFound = errors.Is(err, errNotFound); !res.NotFound {
+			res.Err = err
+		}
+		cfg.Hooks.snapshotDone(res)
+	}()
+	if cfg.DebugURLs {
+		debugURL("cdx", snap.FileURL, snap.FileURL)
+		debugURL("local", snap.FileURL, logicalPath)
+		debugURL("file", snap.FileURL, filepath.Join(cfg.Directory, filepath.FromSlash(logicalPath)))
+	}
 
-	// Skip existing files
-	if store.Exists(logicalPath) {
+	// Skip existing files; the index answers for files stored in this run
+	// without touching the (possibly network-mounted) output directory.
+	if idx.IsDownloaded(logicalPath) || store.Exists(logicalPath) {
+		idx.MarkDownloaded(logicalPath)
+		idx.RecordFile(snap.FileID, StoredFile{LocalPath: logicalPath})
 		dlProg.Inc()
+		res.Skipped = true
 		return nil
 	}
 
 	// Build Wayback Machine URL using the id_ flag to get raw content
-	waybackURL := fmt.Sprintf("https://web.archive.org/web/%sid_/%s", snap.Timestamp, snap.FileURL)
+	waybackURL := rawCaptureURL(cfg.ArchiveBase, snap.Timestamp, snap.FileURL)
 
-	if cfg.Debug {
-		log.Printf("GET %s", waybackURL)
-	}
+	cfg.Log(LogDebug, "GET %s", waybackURL)
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, waybackURL, nil)
-	if err != nil {
-		return fmt.Errorf("create request: %w", err)
-	}
-	resp, err := downloadHTTPClient.Do(req)
+	parts, offset := resumeState(store, logicalPath, cfg)
+	resp, offset, err := getCapture(ctx, client, waybackURL, parts, logicalPath, offset)
 	if err != nil {
-		return fmt.Errorf("http get: %w", err)
+		return err
 	}
 	defer func() { _ = resp.Body.Close() }()
 
 	if resp.StatusCode == http.StatusNotFound {
-		// Skip 404s gracefully
+		// Skip 404s gracefully; DownloadAll decides whether to count them.
 		dlProg.Inc()
-		return nil
+		return errNotFound
 	}
-	if resp.StatusCode != http.StatusOK {
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
 		return fmt.Errorf("HTTP %d for %s", resp.StatusCode, waybackURL)
 	}
 
-	// Read first 512 bytes for content sniffing, then stream remainder via storage
-	first := make([]byte, 512)
-	n, _ := io.ReadFull(resp.Body, first)
-	first = first[:n]
-
-	if err := store.Put(logicalPath, io.MultiReader(bytes.NewReader(first), resp.Body)); err != nil {
+	contentType := contentTypeFor(logicalPath, resp.Header.Get("Content-Type"), cfg)
+	var first []byte
+	counted := &countingReader{r: resp.Body}
+	if offset > 0 {
+		// A resumed download continues the archive's bytes already in the
+		// partial file; its start, and so anything to sniff, is on disk.
+		err = storePart(parts, logicalPath, counted)
+	} else {
+		// Read first 512 bytes for content sniffing, then stream remainder via storage
+		raw := counted
+		var body io.Reader
+		if first, body, err = sniffBody(raw, logicalPath, contentType); err != nil {
+			return err
+		}
+		counted = &countingReader{r: body}
+		if keepsPart(parts, resp) {
+			err = storePart(parts, logicalPath, counted)
+			if err != nil && raw.n != counted.n {
+				// sniffBody gunzipped the body: the partial file does not
+				// hold the archive's bytes, so it cannot be resumed.
+				_ = parts.RemovePart(logicalPath)
+			}
+		} else {
+			err = store.Put(logicalPath, counted)
+		}
+	}
+	if err != nil {
 		return fmt.Errorf("store: %w", err)
 	}
+	idx.MarkDownloaded(logicalPath)
+	res.Bytes = counted.n
+	idx.RecordFile(snap.FileID, StoredFile{
+		LocalPath: logicalPath,
+		Size:      offset + counted.n,
+		MimeType:  contentType,
+		Written:   true,
+	})
+	if cfg.PreloadHeaders && enqueue != nil {
+		for _, asset := range preloadSnapshots(resp.Header, snap, cfg, idx) {
+			enqueue(asset)
+		}
+	}
+	if cfg.SourceMaps && enqueue != nil && (JSRewriter{}).Match(logicalPath, contentType, first) {
+		for _, m := range sourceMapSnapshots(store, logicalPath, snap, cfg, idx) {
+			enqueue(m)
+		}
+	}
+
+	// Extracted before the page is rewritten, from the archived links.
+	if discover != nil && isPage(logicalPath, contentType, first) {
+		for _, s := range unindexedLinks(store, logicalPath, snap, cfg, idx) {
+			discover(s)
+		}
+	}
+
+	// Thumbnails are best-effort: a missing or failed screenshot never fails the page.
+	if cfg.Thumbnails && isPage(logicalPath, contentType, first) {
+		if _, err := fetchThumbnail(ctx, client, cfg.ArchiveBase, snap, logicalPath, store); err != nil {
+			cfg.Log(LogDebug, "thumbnail %s: %v", logicalPath, err)
+		}
+	}
 
 	// Post-process HTML / CSS
 	if cfg.RewriteLinks {
-		if rw := DetectRewriter(logicalPath, resp.Header.Get("Content-Type"), first); rw != nil {
-			if err := rw.Rewrite(store, logicalPath, snap.FileURL, cfg, idx); err != nil && cfg.Debug {
-				log.Printf("rewrite %s: %v", logicalPath, err)
+		rw := DetectRewriter(logicalPath, contentType, first)
+		if _, isCSS := rw.(CSSRewriter); isCSS && cssQ != nil {
+			cssQ.Enqueue(logicalPath, snap.FileURL)
+		} else if rw != nil {
+			if err := rw.Rewrite(rewriteTarget(store, cfg), logicalPath, snap.FileURL, cfg, idx); err != nil {
+				cfg.Log(LogDebug, "rewrite %s: %v", logicalPath, err)
 			}
 		}
 	}
@@ -182,15 +996,198 @@ func downloadOne(ctx context.Context, snap Snapshot, cfg *Config, store Storage,
 	return nil
 }
 
-// WaybackAssetURL builds a Wayback raw-content URL for an asset, resolving the
-// best available timestamp via the snapshot index.
-func WaybackAssetURL(assetURL, fallbackTS string, idx *SnapshotIndex) string {
+// unindexedLinks returns a snapshot, dated like snap, for every internal URL
+// the page stored at logicalPath references that idx has no capture of;
+// with cfg.SkipAssets only pages are returned.
+func unindexedLinks(store Storage, logicalPath string, snap Snapshot, cfg *Config, idx *SnapshotIndex) []Snapshot {
+	data, err := store.Get(logicalPath)
+	if err != nil {
+		return nil
+	}
+	urls, err := HTMLRewriter{}.ExtractURLs(data, snap.FileURL, cfg)
+	if err != nil {
+		cfg.Log(LogDebug, "extract %s: %v", logicalPath, err)
+		return nil
+	}
+	var out []Snapshot
+	for _, raw := range urls {
+		u, err := url.Parse(raw)
+		if err != nil {
+			continue
+		}
+		if _, ok := idx.Lookup(raw); ok || cfg.SkipAssets && !isPageURL(raw) {
+			continue
+		}
+		out = append(out, Snapshot{FileURL: raw, Timestamp: snap.Timestamp, FileID: fileIDFor(u)})
+	}
+	return out
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// writeManifestFile exports idx to the OS file at path in the given format
+// ("json" when empty).
+func writeManifestFile(idx *SnapshotIndex, path, format string) error {
+	if format == "" {
+		format = "json"
+	}
+	f, err := os.Create(path) //nolint:gosec // G304: path is supplied by the user
+	if err != nil {
+		return err
+	}
+	if err := idx.Export(f, format); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// writeMetadata writes the manifest records of the snapshots in manifest to
+// the OS file at path in cfg.ManifestFormat, with the local path each would
+// be stored at but no size or type, since nothing was downloaded.
+func writeMetadata(path string, manifest []Snapshot, cfg *Config) error {
+	format := cfg.ManifestFormat
+	if format == "" {
+		format = "json"
+	}
+	recs := make([]ManifestRecord, len(manifest))
+	for i, s := range manifest {
+		recs[i] = ManifestRecord{Timestamp: s.Timestamp, URL: s.FileURL, LocalPath: localPathFor(s.FileURL, cfg)}
+	}
+	f, err := os.Create(path) //nolint:gosec // G304: path is supplied by the user
+	if err != nil {
+		return err
+	}
+	if err := exportRecords(f, recs, format); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// writeDownloadList writes the raw-content capture URL of each snapshot in
+// manifest, one per line, to the OS file at path: the same URLs downloadOne
+// fetches, for handing to an external downloader such as wget or aria2.
+func writeDownloadList(path string, manifest []Snapshot, base string) error {
+	var b strings.Builder
+	for _, s := range manifest {
+		b.WriteString(rawCaptureURL(base, s.Timestamp, s.FileURL))
+		b.WriteByte('\n')
+	}
+	return os.WriteFile(path, []byte(b.String()), 0600)
+}
+
+// isPage reports whether a resource is an HTML page rather than a feed (whose
+// XML markup HTMLRewriter's sniffing would also accept).
+func isPage(logicalPath, contentType string, firstBytes []byte) bool {
+	return (HTMLRewriter{}).Match(logicalPath, contentType, firstBytes) &&
+		!(FeedRewriter{}).Match(logicalPath, contentType, firstBytes)
+}
+
+// sniffBody reads up to 512 leading bytes of r for content sniffing and
+// returns them together with a reader for the full body.
+//
+// The archive occasionally serves gzip-compressed bodies without a
+// Content-Encoding header. When the gzip magic bytes are seen and the resource
+// is not itself a gzip file (by extension or Content-Type), the body is
+// transparently decompressed so it is stored and classified as its real type.
+func sniffBody(r io.Reader, logicalPath, contentType string) ([]byte, io.Reader, error) {
+	first := make([]byte, 512)
+	n, _ := io.ReadFull(r, first)
+	first = first[:n]
+	body := io.MultiReader(bytes.NewReader(first), r)
+
+	if !isGzipMagic(first) || isGzipResource(logicalPath, contentType) {
+		return first, body, nil
+	}
+	zr, err := gzip.NewReader(body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("gunzip: %w", err)
+	}
+	first = make([]byte, 512)
+	n, err = io.ReadFull(zr, first)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, nil, fmt.Errorf("gunzip: %w", err)
+	}
+	first = first[:n]
+	return first, io.MultiReader(bytes.NewReader(first), zr), nil
+}
+
+// isGzipMagic reports whether b starts with the gzip magic number 1f 8b.
+func isGzipMagic(b []byte) bool {
+	return len(b) >= 2 && b[0] == 0x1f && b[1] == 0x8b
+}
+
+// isGzipResource reports whether the resource is a gzip file in its own right
+// and must be stored compressed.
+func isGzipResource(logicalPath, contentType string) bool {
+	ct := strings.ToLower(contentType)
+	if strings.Contains(ct, "gzip") {
+		return true
+	}
+	p := strings.ToLower(logicalPath)
+	if i := strings.Index(p, "%3f"); i >= 0 {
+		p = p[:i] // preserve mode appends the query after the extension
+	}
+	switch path.Ext(p) {
+	case ".gz", ".tgz", ".svgz":
+		return true
+	}
+	return false
+}
+
+// WaybackAssetURL builds a raw-content URL for an asset on the archive at
+// cfg.ArchiveBase, resolving the best available timestamp via the snapshot
+// index.
+func WaybackAssetURL(assetURL, fallbackTS string, idx *SnapshotIndex, cfg *Config) string {
 	ts := idx.Resolve(assetURL, fallbackTS)
-	return fmt.Sprintf("https://web.archive.org/web/%sid_/%s", ts, assetURL)
+	return rawCaptureURL(cfg.ArchiveBase, ts, assetURL)
+}
+
+// DefaultArchiveBase is the archive root used when Config.ArchiveBase is empty.
+const DefaultArchiveBase = "https://web.archive.org"
+
+// archiveRoot returns base without trailing slashes, or DefaultArchiveBase
+// when base is empty. Self-hosted archives (OpenWayback, pywb) serve the same
+// /cdx/search/ and /web/<timestamp>id_/ URL shapes under their own root.
+func archiveRoot(base string) string {
+	if base = strings.TrimRight(base, "/"); base == "" {
+		return DefaultArchiveBase
+	}
+	return base
+}
+
+// rawCaptureURL returns the raw-content (id_) URL of the capture of origURL
+// at timestamp on the archive at base (see archiveRoot). A #fragment of
+// origURL is dropped: it would end the archive URL's path.
+func rawCaptureURL(base, timestamp, origURL string) string {
+	return fmt.Sprintf("%s/web/%sid_/%s", archiveRoot(base), timestamp, stripFragment(origURL))
 }
 
-// isInternalHost returns true when host (stripped of www.) matches bareHost.
-func isInternalHost(host, bareHost string) bool {
+// isInternalHost returns true when host (stripped of www.) matches
+// cfg.BareHost or one of cfg.ExtraSubdomains under it, or when host is a
+// CDN mapped by cfg.CDNMap.
+func isInternalHost(host string, cfg *Config) bool {
 	h := strings.TrimPrefix(strings.ToLower(host), "www.")
-	return h == strings.ToLower(bareHost)
+	bare := strings.ToLower(cfg.BareHost)
+	if h == bare {
+		return true
+	}
+	for _, sub := range normalizeSubdomains(cfg.ExtraSubdomains) {
+		if h == sub+"."+bare {
+			return true
+		}
+	}
+	_, cdn := cfg.CDNMap[strings.ToLower(host)]
+	return cdn
 }
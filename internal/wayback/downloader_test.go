@@ -0,0 +1,864 @@
+package wayback
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sigman78/wayback-dl/internal/wayback/testserver"
+)
+
+// Clone must not share slices or cookies with the original.
+func TestConfigCloneIsDeep(t *testing.T) {
+	orig := &Config{
+		BareHost:        "example.com",
+		Variants:        []string{"https://example.com/"},
+		ExtraSubdomains: []string{"blog"},
+		CookieList:      []*http.Cookie{{Name: "a", Value: "1"}},
+	}
+	cp := orig.Clone()
+
+	cp.BareHost = "other.com"
+	cp.Variants[0] = "changed"
+	cp.ExtraSubdomains[0] = "changed"
+	cp.CookieList[0].Value = "changed"
+
+	if orig.BareHost != "example.com" ||
+		orig.Variants[0] != "https://example.com/" ||
+		orig.ExtraSubdomains[0] != "blog" ||
+		orig.CookieList[0].Value != "1" {
+		t.Errorf("modifying the clone changed the original: %+v", orig)
+	}
+}
+
+func gzipBytes(t *testing.T, data string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write([]byte(data)); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// A gzip body without Content-Encoding must be decompressed so the HTML
+// sniffer sees the real markup.
+func TestSniffBodyGunzipsHTML(t *testing.T) {
+	page := "<!DOCTYPE html><html><body>hello</body></html>"
+	first, body, err := sniffBody(bytes.NewReader(gzipBytes(t, page)), "index.html", "text/html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !(HTMLRewriter{}).Match("page", "", first) {
+		t.Errorf("decompressed first bytes should sniff as HTML: %q", first)
+	}
+	all, _ := io.ReadAll(body)
+	if string(all) != page {
+		t.Errorf("body\n  got  %q\n  want %q", all, page)
+	}
+}
+
+// Genuine .gz resources must be stored byte-for-byte.
+func TestSniffBodyKeepsGzipFiles(t *testing.T) {
+	raw := gzipBytes(t, "archive contents")
+	cases := []struct{ path, ct string }{
+		{"dist/app.tar.gz", ""},
+		{"data.bin", "application/gzip"},
+		{"dl/file.gz%3Fv=1", ""},
+	}
+	for _, tc := range cases {
+		_, body, err := sniffBody(bytes.NewReader(raw), tc.path, tc.ct)
+		if err != nil {
+			t.Fatal(err)
+		}
+		all, _ := io.ReadAll(body)
+		if !bytes.Equal(all, raw) {
+			t.Errorf("%s (%s): gzip resource was modified", tc.path, tc.ct)
+		}
+	}
+}
+
+// TestConfigValidate verifies that Validate accepts a default configuration
+// and rejects each out-of-range option.
+func TestConfigValidate(t *testing.T) {
+	valid := func() *Config {
+		return &Config{Threads: 3, CanonicalAction: "keep", ManifestFormat: "json", CDXRatePerMin: 60, CDXMaxRetries: 5}
+	}
+	if err := valid().Validate(); err != nil {
+		t.Fatalf("default config: %v", err)
+	}
+	cases := []struct {
+		name   string
+		mutate func(*Config)
+	}{
+		{"threads", func(c *Config) { c.Threads = 0 }},
+		{"css threads", func(c *Config) { c.CSSRewriteThreads = -1 }},
+		{"max path depth", func(c *Config) { c.MaxPathDepth = -1 }},
+		{"metadata only without manifest", func(c *Config) { c.MetadataOnly = true }},
+		{"limit per ext", func(c *Config) { c.LimitPerExt = map[string]int{".css": 2} }},
+		{"negative limit per ext", func(c *Config) { c.LimitPerExt = map[string]int{"css": -1} }},
+		{"dedupe report with repair", func(c *Config) { c.DedupeReport, c.Repair, c.Directory = true, true, "out" }},
+		{"trailing slash", func(c *Config) { c.TrailingSlash = "add" }},
+		{"filename encoding", func(c *Config) { c.FilenameEncoding = "utf8" }},
+		{"unicode filenames with pretty paths", func(c *Config) { c.FilenameEncoding, c.PrettyPath = FilenameUnicode, true }},
+		{"canonical", func(c *Config) { c.CanonicalAction = "drop" }},
+		{"manifest format", func(c *Config) { c.ManifestFormat = "xml" }},
+		{"progress format", func(c *Config) { c.ProgressFormat = "yaml" }},
+		{"html parser", func(c *Config) { c.HTMLParser = "pedantic" }},
+		{"html max corrections", func(c *Config) { c.HTMLMaxCorrections = -1 }},
+		{"log level", func(c *Config) { c.LogLevel = "verbose" }},
+		{"dated dir with repair", func(c *Config) { c.DatedDir, c.Repair, c.Directory = true, true, "out" }},
+		{"peak rate", func(c *Config) { c.PeakRatePerMin = -1 }},
+		{"cdx rate", func(c *Config) { c.CDXRatePerMin = 0 }},
+		{"total retries", func(c *Config) { c.TotalRetries = -1 }},
+		{"snapshot date", func(c *Config) { c.SnapshotDate = "2020-13-01" }},
+		{"snapshot date with from", func(c *Config) { c.SnapshotDate, c.FromTimestamp = "20200101", "2019" }},
+		{"schedule", func(c *Config) { c.Schedule = "sometimes" }},
+		{"collapse mode", func(c *Config) { c.CollapseMode = "length" }},
+		{"cdx endpoint", func(c *Config) { c.CDXEndpoint = "json" }},
+		{"cdx filter without regex", func(c *Config) { c.CDXFilters = []string{"mimetype:"} }},
+		{"cdx filter field", func(c *Config) { c.CDXFilters = []string{"mime:text/html"} }},
+		{"max duration", func(c *Config) { c.MaxDuration = -time.Second }},
+		{"dns cache ttl", func(c *Config) { c.DNSCacheTTL = -time.Second }},
+		{"max abs path len", func(c *Config) { c.MaxAbsPathLen = -1 }},
+		{"normalize encoded paths with pretty paths", func(c *Config) { c.PrettyPath, c.NormalizeEncodedPaths = true, true }},
+		{"cdn map outside the output", func(c *Config) { c.CDNMap = map[string]string{"cdn.example.com": "../cdn"} }},
+		{"rewrite dry run without repair", func(c *Config) { c.RewriteDryRun = "rewrites.tsv" }},
+		{"download list with repair", func(c *Config) { c.DownloadListOnly, c.Repair, c.Directory = "urls.txt", true, "out" }},
+		{"only latest per host with exact url", func(c *Config) { c.OnlyLatestPerHost, c.ExactURL = true, true }},
+		{"rewrite out without rewriting", func(c *Config) { c.RewriteOut = "out" }},
+		{"skip assets with asset only", func(c *Config) { c.SkipAssets, c.AssetOnly = true, true }},
+		{"max snapshot index", func(c *Config) { c.MaxSnapshotIndex = -1 }},
+		{"state file with repair", func(c *Config) { c.StateFile, c.Repair = "state.gob", true }},
+		{"content type override extension", func(c *Config) { c.ContentTypeOverrides = map[string]string{".js": "text/javascript"} }},
+		{"content type override type", func(c *Config) { c.ContentTypeOverrides = map[string]string{"js": "not a type"} }},
+		{"archive base", func(c *Config) { c.ArchiveBase = "wayback.internal" }},
+	}
+	for _, tc := range cases {
+		c := valid()
+		tc.mutate(c)
+		if err := c.Validate(); err == nil {
+			t.Errorf("%s: expected an error", tc.name)
+		}
+	}
+}
+
+// With DebugURLs set, downloadOne logs every mapping step for the page and
+// the rewriter logs each link it makes local.
+func TestDebugURLsLogsEachStep(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = io.WriteString(w, `<html><body><a href="/about/">About</a></body></html>`)
+	}))
+	defer srv.Close()
+
+	var buf bytes.Buffer
+	prev := log.Writer()
+	log.SetOutput(&buf)
+	defer log.SetOutput(prev)
+
+	dir := t.TempDir()
+	cfg := &Config{BareHost: "example.com", Directory: dir, RewriteLinks: true, DebugURLs: true}
+	snap := Snapshot{FileURL: "http://example.com/blog/post.html", Timestamp: "20200101000000", FileID: "example.com/blog/post.html"}
+	err := downloadOne(context.Background(), testClientFor(t, srv), snap, cfg, NewLocalStorage(dir), NewSnapshotIndex(), nil, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := buf.String()
+	for _, want := range []string{
+		"url: cdx   http://example.com/blog/post.html => http://example.com/blog/post.html",
+		"url: local http://example.com/blog/post.html => blog/post.html",
+		"url: file  http://example.com/blog/post.html => " + dir,
+		"url: link  http://example.com/about/ => ../about/index.html",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing log line %q\n  got: %s", want, out)
+		}
+	}
+}
+
+// A run whose time budget is already spent stops with ErrMaxDuration before
+// making any request.
+func TestDownloadAllMaxDuration(t *testing.T) {
+	cfg := &Config{
+		Variants: []string{"https://example.com/"}, BareHost: "example.com", Directory: t.TempDir(),
+		Threads: 1, CDXRatePerMin: 60, MaxDuration: time.Nanosecond,
+	}
+	if err := DownloadAll(cfg); !errors.Is(err, ErrMaxDuration) {
+		t.Fatalf("expected ErrMaxDuration, got %v", err)
+	}
+}
+
+// useTestArchive points the CDX and download clients at srv for the
+// duration of the test.
+func useTestArchive(t *testing.T, srv *httptest.Server) {
+	t.Helper()
+	c := testClientFor(t, srv)
+	oldCDX, oldDL := cdxHTTPClient, downloadHTTPClient
+	cdxHTTPClient, downloadHTTPClient = c, c
+	t.Cleanup(func() { cdxHTTPClient, downloadHTTPClient = oldCDX, oldDL })
+}
+
+// Indexed URLs that the archive answers 404 for are counted and logged, not
+// treated as failures.
+func TestDownloadAllTracks404s(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/cdx/search/"):
+			_, _ = io.WriteString(w, `[["timestamp","original"],`+
+				`["20200101000000","http://example.com/a.html"],`+
+				`["20200101000000","http://example.com/gone.html"],`+
+				`["20200101000000","http://example.com/missing.css"]]`)
+		case strings.HasSuffix(r.URL.Path, "/a.html"):
+			_, _ = io.WriteString(w, "<html></html>")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	useTestArchive(t, srv)
+
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "404.txt")
+	stats := new(DownloadStats)
+	cfg := &Config{
+		BaseURL: "http://example.com/", Variants: []string{"http://example.com/"}, BareHost: "example.com",
+		ExactURL: true, Directory: filepath.Join(dir, "out"), Threads: 2, CDXRatePerMin: 6000,
+		Track404s: true, NotFoundLog: logPath, Stats: stats,
+	}
+	if err := DownloadAll(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if n := stats.Downloaded404s.Load(); n != 2 {
+		t.Errorf("Downloaded404s = %d, want 2", n)
+	}
+	got, err := os.ReadFile(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "http://example.com/gone.html\nhttp://example.com/missing.css\n"; string(got) != want {
+		t.Errorf("404 log = %q, want %q", got, want)
+	}
+}
+
+// With ArchiveBase set, both the CDX query and the capture downloads go to
+// that archive, path prefix included.
+func TestDownloadAllArchiveBase(t *testing.T) {
+	var mu sync.Mutex
+	var paths []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		paths = append(paths, r.URL.Path)
+		mu.Unlock()
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/wayback/cdx/search/"):
+			_, _ = io.WriteString(w, `[["timestamp","original"],["20200101000000","http://example.com/a.html"]]`)
+		case r.URL.Path == "/wayback/web/20200101000000id_/http://example.com/a.html":
+			_, _ = io.WriteString(w, "<html></html>")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	cfg := &Config{
+		BaseURL: "http://example.com/", Variants: []string{"http://example.com/"}, BareHost: "example.com",
+		ExactURL: true, Directory: dir, Threads: 1, CDXRatePerMin: 6000, ArchiveBase: srv.URL + "/wayback/",
+	}
+	if err := DownloadAll(cfg); err != nil {
+		t.Fatalf("DownloadAll: %v (requests: %v)", err, paths)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "a.html")); err != nil {
+		t.Errorf("capture not stored: %v (requests: %v)", err, paths)
+	}
+}
+
+// DownloadListOnly writes the capture URLs of the manifest and downloads
+// nothing.
+func TestDownloadAllDownloadListOnly(t *testing.T) {
+	var downloads atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/cdx/search/") {
+			_, _ = io.WriteString(w, `[["timestamp","original"],`+
+				`["20200101000000","http://example.com/a.html"],`+
+				`["20210101000000","http://example.com/b.css"]]`)
+			return
+		}
+		downloads.Add(1)
+		http.NotFound(w, r)
+	}))
+	defer srv.Close()
+	useTestArchive(t, srv)
+
+	dir := t.TempDir()
+	listPath := filepath.Join(dir, "urls.txt")
+	cfg := &Config{
+		BaseURL: "http://example.com/", Variants: []string{"http://example.com/"}, BareHost: "example.com",
+		ExactURL: true, Directory: filepath.Join(dir, "out"), Threads: 1, CDXRatePerMin: 6000,
+		DownloadListOnly: listPath,
+	}
+	if err := DownloadAll(cfg); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(listPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "https://web.archive.org/web/20210101000000id_/http://example.com/b.css\n" +
+		"https://web.archive.org/web/20200101000000id_/http://example.com/a.html\n"
+	if string(got) != want {
+		t.Errorf("download list\n  got  %q\n  want %q", got, want)
+	}
+	if n := downloads.Load(); n != 0 {
+		t.Errorf("%d download request(s) made, want 0", n)
+	}
+	if _, err := os.Stat(cfg.Directory); !os.IsNotExist(err) {
+		t.Errorf("output directory created: %v", err)
+	}
+}
+
+// MetadataOnly writes the manifest with local paths to ManifestOut and
+// downloads nothing.
+func TestDownloadAllMetadataOnly(t *testing.T) {
+	srv := testserver.NewTestServer(t, map[string]testserver.TestEntry{
+		"http://example.com/":         {Timestamp: "20200101000000", Body: "<html>home</html>"},
+		"http://example.com/blog/a":   {Timestamp: "20210101000000", Body: "<html>a</html>"},
+		"http://example.com/site.css": {Timestamp: "20190101000000", Body: "body{}"},
+	})
+	dir := t.TempDir()
+	cfg := archiveConfig(srv, filepath.Join(dir, "out"))
+	cfg.MetadataOnly = true
+	cfg.PrettyPath = true
+	cfg.ManifestOut = filepath.Join(dir, "manifest.json")
+	if err := DownloadAll(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(cfg.ManifestOut)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var recs []ManifestRecord
+	if err := json.Unmarshal(data, &recs); err != nil {
+		t.Fatalf("manifest is not JSON: %v\n%s", err, data)
+	}
+	want := []ManifestRecord{
+		{Timestamp: "20210101000000", URL: "http://example.com/blog/a", LocalPath: "blog/a/index.html"},
+		{Timestamp: "20200101000000", URL: "http://example.com/", LocalPath: "index.html"},
+		{Timestamp: "20190101000000", URL: "http://example.com/site.css", LocalPath: "site.css"},
+	}
+	if !slices.Equal(recs, want) {
+		t.Errorf("manifest\n  got  %+v\n  want %+v", recs, want)
+	}
+	if n := len(srv.ContentRequests()); n != 0 {
+		t.Errorf("%d download request(s) made, want 0", n)
+	}
+	if _, err := os.Stat(cfg.Directory); !os.IsNotExist(err) {
+		t.Errorf("output directory created: %v", err)
+	}
+}
+
+// WaybackAssetURL uses the indexed timestamp and the configured archive.
+func TestWaybackAssetURL(t *testing.T) {
+	idx := NewSnapshotIndex()
+	idx.Register("http://example.com/img/a.png", "20200101000000")
+	cases := []struct {
+		base, asset, want string
+	}{
+		{"", "http://example.com/img/a.png", "https://web.archive.org/web/20200101000000id_/http://example.com/img/a.png"},
+		{"https://wayback.internal/", "http://example.com/img/a.png", "https://wayback.internal/web/20200101000000id_/http://example.com/img/a.png"},
+		{"http://10.0.0.5:8080/pywb", "http://example.com/b.png", "http://10.0.0.5:8080/pywb/web/20210101000000id_/http://example.com/b.png"},
+	}
+	for _, tc := range cases {
+		if got := WaybackAssetURL(tc.asset, "20210101000000", idx, &Config{ArchiveBase: tc.base}); got != tc.want {
+			t.Errorf("base %q: got %q, want %q", tc.base, got, tc.want)
+		}
+	}
+}
+
+// OnlyLatestPerHost queries the whole domain and stores the newest home page
+// of each host in a directory of its own.
+func TestDownloadAllOnlyLatestPerHost(t *testing.T) {
+	var query url.Values
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/cdx/search/"):
+			if r.URL.Query().Get("page") != "0" {
+				_, _ = io.WriteString(w, `[["timestamp","original"]]`)
+				return
+			}
+			query = r.URL.Query()
+			_, _ = io.WriteString(w, `[["timestamp","original"],`+
+				`["20200101000000","http://example.com/"],`+
+				`["20210101000000","http://example.com/about.html"],`+
+				`["20220101000000","http://blog.example.com/"]]`)
+		case strings.HasSuffix(r.URL.Path, ".com/"):
+			_, _ = io.WriteString(w, "<html>"+r.URL.Path+"</html>")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	useTestArchive(t, srv)
+
+	dir := t.TempDir()
+	cfg := &Config{
+		BaseURL: "http://example.com/", Variants: []string{"http://example.com/", "http://www.example.com/"},
+		BareHost: "example.com", Directory: dir, Threads: 1, CDXRatePerMin: 6000, OnlyLatestPerHost: true,
+	}
+	if err := DownloadAll(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if query.Get("url") != "example.com" || query.Get("matchType") != "domain" {
+		t.Errorf("CDX query = %v, want a domain match on example.com", query)
+	}
+	for _, p := range []string{"example.com/index.html", "blog.example.com/index.html"} {
+		if _, err := os.Stat(filepath.Join(dir, filepath.FromSlash(p))); err != nil {
+			t.Errorf("%s not stored: %v", p, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "example.com", "about.html")); err == nil {
+		t.Error("non-root page should not be downloaded")
+	}
+}
+
+// A subdomain's captures are kept apart from the base host's even where the
+// paths match: each is indexed and stored on its own, and links between them
+// point at the right copy.
+func TestDownloadAllSubdomainSamePath(t *testing.T) {
+	srv := testserver.NewTestServer(t, map[string]testserver.TestEntry{
+		"http://example.com/": {Timestamp: "20200101000000", ContentType: "text/html",
+			Body: `<html><a href="http://blog.example.com/about.html">blog</a></html>`},
+		"http://example.com/about.html":      {Timestamp: "20200101000000", ContentType: "text/html", Body: "<html>site about</html>"},
+		"http://blog.example.com/":           {Timestamp: "20200101000000", ContentType: "text/html", Body: "<html>blog home</html>"},
+		"http://blog.example.com/about.html": {Timestamp: "20200101000000", ContentType: "text/html", Body: "<html>blog about</html>"},
+	})
+	cfg := archiveConfig(srv, t.TempDir())
+	cfg.ExtraSubdomains = []string{"blog"}
+	cfg.Variants = append(cfg.Variants, "http://blog.example.com/")
+	cfg.RewriteLinks = true
+	if err := DownloadAll(cfg); err != nil {
+		t.Fatal(err)
+	}
+	for p, want := range map[string]string{
+		"about.html":                  "site about",
+		"blog.example.com/index.html": "blog home",
+		"blog.example.com/about.html": "blog about",
+		"index.html":                  `href="blog.example.com/about.html"`,
+	} {
+		if got := readOutput(t, cfg.Directory, p); !strings.Contains(got, want) {
+			t.Errorf("%s = %q, want it to contain %q", p, got, want)
+		}
+	}
+}
+
+// The hosts of CDNMap are queried along with the site: their files are
+// downloaded into the mapped directory the rewritten links point at.
+func TestDownloadAllCDNMap(t *testing.T) {
+	srv := testserver.NewTestServer(t, map[string]testserver.TestEntry{
+		"http://example.com/": {Timestamp: "20200101000000", ContentType: "text/html",
+			Body: `<html><img src="https://cdn.example.net/img/a.png"></html>`},
+		"https://cdn.example.net/img/a.png": {Timestamp: "20200101000000", ContentType: "image/png", Body: "PNG"},
+	})
+	cfg := archiveConfig(srv, t.TempDir())
+	cfg.CDNMap = map[string]string{"cdn.example.net": "cdn"}
+	cfg.RewriteLinks = true
+	if err := DownloadAll(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if page := readOutput(t, cfg.Directory, "index.html"); !strings.Contains(page, `src="cdn/img/a.png"`) {
+		t.Errorf("CDN link not rewritten:\n%s", page)
+	}
+	if got := readOutput(t, cfg.Directory, "cdn/img/a.png"); got != "PNG" {
+		t.Errorf("cdn/img/a.png = %q", got)
+	}
+}
+
+// With MaxAbsPathLen, links from and to a page stored under a shortened
+// name lead to the files as stored.
+func TestDownloadAllMaxAbsPathLenLinks(t *testing.T) {
+	long := "/docs/chapter-one/section-two/part-three/" + strings.Repeat("x", 80) + ".html"
+	srv := testserver.NewTestServer(t, map[string]testserver.TestEntry{
+		"http://example.com/": {Timestamp: "20200101000000", ContentType: "text/html",
+			Body: `<html><a href="` + long + `">long</a></html>`},
+		"http://example.com" + long: {Timestamp: "20200101000000", ContentType: "text/html",
+			Body: `<html><link rel="stylesheet" href="/css/site.css"><a href="/">home</a></html>`},
+		"http://example.com/css/site.css": {Timestamp: "20200101000000", ContentType: "text/css", Body: "body{}"},
+	})
+	dir, err := filepath.Abs(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := archiveConfig(srv, dir)
+	cfg.MaxAbsPathLen = len(dir) + 50 // room for docs/<hash>.html only
+	cfg.RewriteLinks = true
+	if err := DownloadAll(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	var files []string
+	_ = filepath.WalkDir(dir, func(p string, d os.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			files = append(files, p)
+		}
+		return err
+	})
+	reHref := regexp.MustCompile(`href="([^"]*)"`)
+	var links int
+	for _, f := range files {
+		if filepath.Ext(f) != ".html" {
+			continue
+		}
+		data, err := os.ReadFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, m := range reHref.FindAllStringSubmatch(string(data), -1) {
+			links++
+			target, _ := url.PathUnescape(m[1])
+			if _, err := os.Stat(filepath.Join(filepath.Dir(f), filepath.FromSlash(target))); err != nil {
+				t.Errorf("%s: link %s does not lead to a file: %v", f, m[1], err)
+			}
+		}
+	}
+	if links != 3 {
+		t.Errorf("checked %d links in %q, want 3", links, files)
+	}
+}
+
+// archiveConfig returns a Config that downloads example.com from srv into dir.
+func archiveConfig(srv *testserver.TestServer, dir string) *Config {
+	return &Config{
+		BaseURL: "http://example.com/", BareHost: "example.com", Directory: dir,
+		Variants: []string{"http://example.com/", "https://example.com/"},
+		Threads:  2, CDXRatePerMin: 6000, ArchiveBase: srv.URL,
+	}
+}
+
+// readOutput returns the content of the file at logical path p under dir.
+func readOutput(t *testing.T, dir, p string) string {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(p)))
+	if err != nil {
+		t.Fatalf("read %s: %v", p, err)
+	}
+	return string(data)
+}
+
+// With TwoPassExtraction, URLs a page links that the CDX query does not
+// return are downloaded in a second pass and added to the manifest.
+func TestDownloadAllTwoPassExtraction(t *testing.T) {
+	srv := testserver.NewTestServer(t, map[string]testserver.TestEntry{
+		"http://example.com/": {Timestamp: "20200101000000", ContentType: "text/html",
+			Body: `<html><body><img src="/hidden.png"><a href="/old.html">old</a></body></html>`},
+		// Older than -from: outside the CDX results, but still served.
+		"http://example.com/hidden.png": {Timestamp: "20100101000000", Body: "PNG"},
+		"http://example.com/old.html":   {Timestamp: "20100101000000", ContentType: "text/html", Body: "<html>old</html>"},
+	})
+	for _, twoPass := range []bool{false, true} {
+		dir := t.TempDir()
+		cfg := archiveConfig(srv, filepath.Join(dir, "out"))
+		cfg.FromTimestamp = "2019"
+		cfg.TwoPassExtraction = twoPass
+		cfg.ManifestOut = filepath.Join(dir, "manifest.json")
+		if err := DownloadAll(cfg); err != nil {
+			t.Fatal(err)
+		}
+		recs, err := readURLMap(cfg.ManifestOut)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := 1
+		if twoPass {
+			want = 3
+			for p, body := range map[string]string{"hidden.png": "PNG", "old.html": "<html>old</html>"} {
+				if got := readOutput(t, cfg.Directory, p); got != body {
+					t.Errorf("%s = %q, want %q", p, got, body)
+				}
+			}
+		}
+		if len(recs) != want {
+			t.Errorf("TwoPassExtraction %v: %d manifest records, want %d: %+v", twoPass, len(recs), want, recs)
+		}
+	}
+}
+
+// The second pass of TwoPassExtraction resolves source maps from many
+// workers at once; run under -race, this checks the index's lookup maps
+// are rebuilt before they start rather than lazily by each of them.
+func TestDownloadAllTwoPassSourceMaps(t *testing.T) {
+	entries := map[string]testserver.TestEntry{}
+	var page strings.Builder
+	page.WriteString("<html><body>")
+	for i := range 16 {
+		js := fmt.Sprintf("http://example.com/js/s%d.js", i)
+		fmt.Fprintf(&page, `<script src="/js/s%d.js"></script>`, i)
+		// Older than -from: outside the CDX results, but still served.
+		entries[js] = testserver.TestEntry{Timestamp: "20100101000000", ContentType: "application/javascript",
+			Body: fmt.Sprintf("f();\n//# sourceMappingURL=s%d.js.map\n", i)}
+		entries[js+".map"] = testserver.TestEntry{Timestamp: "20100101000000", ContentType: "application/json", Body: `{"version":3}`}
+	}
+	page.WriteString("</body></html>")
+	entries["http://example.com/"] = testserver.TestEntry{Timestamp: "20200101000000", ContentType: "text/html", Body: page.String()}
+	srv := testserver.NewTestServer(t, entries)
+
+	cfg := archiveConfig(srv, filepath.Join(t.TempDir(), "out"))
+	cfg.FromTimestamp = "2019"
+	cfg.TwoPassExtraction = true
+	cfg.SourceMaps = true
+	cfg.Threads = 8
+	if err := DownloadAll(cfg); err != nil {
+		t.Fatal(err)
+	}
+	for i := range 16 {
+		if got := readOutput(t, cfg.Directory, fmt.Sprintf("js/s%d.js.map", i)); got != `{"version":3}` {
+			t.Errorf("js/s%d.js.map = %q", i, got)
+		}
+	}
+}
+
+// A whole site is indexed through every variant and each capture stored once.
+func TestIntegrationDownloadSite(t *testing.T) {
+	srv := testserver.NewTestServer(t, map[string]testserver.TestEntry{
+		"http://example.com/":             {Timestamp: "20200101000000", Body: "<html>home</html>", ContentType: "text/html"},
+		"https://example.com/style.css":   {Timestamp: "20200102000000", Body: "body{}", ContentType: "text/css"},
+		"http://example.com/img/logo.png": {Timestamp: "20200103000000", Body: "PNG"},
+	})
+	dir := t.TempDir()
+	if err := DownloadAll(archiveConfig(srv, dir)); err != nil {
+		t.Fatal(err)
+	}
+	for p, want := range map[string]string{"index.html": "<html>home</html>", "style.css": "body{}", "img/logo.png": "PNG"} {
+		if got := readOutput(t, dir, p); got != want {
+			t.Errorf("%s = %q, want %q", p, got, want)
+		}
+	}
+	if n := len(srv.ContentRequests()); n != 3 {
+		t.Errorf("%d content requests, want 3: %v", n, srv.ContentRequests())
+	}
+}
+
+// With RewriteLinks, a page's links to other captures become relative paths.
+func TestIntegrationRewriteLinks(t *testing.T) {
+	srv := testserver.NewTestServer(t, map[string]testserver.TestEntry{
+		"http://example.com/blog/post.html": {Timestamp: "20200101000000", ContentType: "text/html",
+			Body: `<html><head><link rel="stylesheet" href="http://example.com/css/site.css"></head>` +
+				`<body><a href="/about.html">About</a></body></html>`},
+		"http://example.com/css/site.css": {Timestamp: "20200101000000", ContentType: "text/css", Body: `body{background:url(/img/bg.png)}`},
+		"http://example.com/about.html":   {Timestamp: "20200101000000", ContentType: "text/html", Body: "<html></html>"},
+	})
+	dir := t.TempDir()
+	cfg := archiveConfig(srv, dir)
+	cfg.RewriteLinks = true
+	if err := DownloadAll(cfg); err != nil {
+		t.Fatal(err)
+	}
+	page := readOutput(t, dir, "blog/post.html")
+	for _, want := range []string{`href="../css/site.css"`, `href="../about.html"`} {
+		if !strings.Contains(page, want) {
+			t.Errorf("page lacks %s\n  got: %s", want, page)
+		}
+	}
+	if css := readOutput(t, dir, "css/site.css"); !strings.Contains(css, "url(../img/bg.png)") {
+		t.Errorf("CSS not rewritten: %s", css)
+	}
+}
+
+// With RewriteOut, rewritten pages and CSS go to a second directory and the
+// downloaded originals are left as archived.
+func TestIntegrationRewriteOut(t *testing.T) {
+	page := `<html><body><a href="/about.html">About</a></body></html>`
+	srv := testserver.NewTestServer(t, map[string]testserver.TestEntry{
+		"http://example.com/blog/post.html": {Timestamp: "20200101000000", ContentType: "text/html", Body: page},
+		"http://example.com/css/site.css":   {Timestamp: "20200101000000", ContentType: "text/css", Body: `body{background:url(/img/bg.png)}`},
+		"http://example.com/img/bg.png":     {Timestamp: "20200101000000", Body: "PNG"},
+	})
+	dir, out := t.TempDir(), t.TempDir()
+	cfg := archiveConfig(srv, dir)
+	cfg.RewriteLinks, cfg.RewriteOut = true, out
+	if err := DownloadAll(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if got := readOutput(t, dir, "blog/post.html"); got != page {
+		t.Errorf("original page changed: %s", got)
+	}
+	if got := readOutput(t, out, "blog/post.html"); !strings.Contains(got, `href="../about.html"`) {
+		t.Errorf("page not rewritten: %s", got)
+	}
+	if got := readOutput(t, out, "css/site.css"); !strings.Contains(got, "url(../img/bg.png)") {
+		t.Errorf("CSS not rewritten: %s", got)
+	}
+	if _, err := os.Stat(filepath.Join(out, "img", "bg.png")); err == nil {
+		t.Error("image should not be copied to the rewrite directory")
+	}
+}
+
+// From and To limit the run to the captures inside the range.
+func TestIntegrationTimestampRange(t *testing.T) {
+	srv := testserver.NewTestServer(t, map[string]testserver.TestEntry{
+		"http://example.com/old.html": {Timestamp: "20150101000000", Body: "old"},
+		"http://example.com/mid.html": {Timestamp: "20200601000000", Body: "mid"},
+		"http://example.com/new.html": {Timestamp: "20240101000000", Body: "new"},
+	})
+	dir := t.TempDir()
+	cfg := archiveConfig(srv, dir)
+	cfg.FromTimestamp, cfg.ToTimestamp = "2019", "2021"
+	if err := DownloadAll(cfg); err != nil {
+		t.Fatal(err)
+	}
+	readOutput(t, dir, "mid.html")
+	for _, p := range []string{"old.html", "new.html"} {
+		if _, err := os.Stat(filepath.Join(dir, p)); err == nil {
+			t.Errorf("%s is outside the range but was downloaded", p)
+		}
+	}
+}
+
+// A second run over the same directory finds every file in place and
+// fetches no content.
+func TestIntegrationRerunSkipsExisting(t *testing.T) {
+	srv := testserver.NewTestServer(t, map[string]testserver.TestEntry{
+		"http://example.com/a.html": {Timestamp: "20200101000000", Body: "a"},
+		"http://example.com/b.css":  {Timestamp: "20200101000000", Body: "b"},
+	})
+	dir := t.TempDir()
+	if err := DownloadAll(archiveConfig(srv, dir)); err != nil {
+		t.Fatal(err)
+	}
+	before := len(srv.ContentRequests())
+	if err := DownloadAll(archiveConfig(srv, dir)); err != nil {
+		t.Fatal(err)
+	}
+	if after := len(srv.ContentRequests()); after != before {
+		t.Errorf("rerun made %d content requests, want 0", after-before)
+	}
+}
+
+// AssetOnly fetches the page and what it embeds, but not the pages it links.
+func TestIntegrationAssetOnly(t *testing.T) {
+	srv := testserver.NewTestServer(t, map[string]testserver.TestEntry{
+		"http://example.com/post.html": {Timestamp: "20200101000000", ContentType: "text/html",
+			Body: `<html><body><img src="/pic.jpg"><a href="/other.html">x</a></body></html>`},
+		"http://example.com/pic.jpg":    {Timestamp: "20200101000000", Body: "JPG"},
+		"http://example.com/other.html": {Timestamp: "20200101000000", Body: "<html></html>"},
+	})
+	dir := t.TempDir()
+	cfg := archiveConfig(srv, dir)
+	cfg.BaseURL, cfg.Variants, cfg.ExactURL = "http://example.com/post.html", []string{"http://example.com/post.html"}, true
+	cfg.AssetOnly = true
+	// The exact-URL index only knows the page; the asset resolves to the
+	// page's capture time.
+	if err := DownloadAll(cfg); err != nil {
+		t.Fatal(err)
+	}
+	readOutput(t, dir, "post.html")
+	if got := readOutput(t, dir, "pic.jpg"); got != "JPG" {
+		t.Errorf("pic.jpg = %q", got)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "other.html")); err == nil {
+		t.Error("linked page should not be downloaded")
+	}
+}
+
+// Captures the archive cannot serve are counted as 404s or reported as a
+// PartialError, and never stop the others.
+func TestIntegrationFailedCaptures(t *testing.T) {
+	srv := testserver.NewTestServer(t, map[string]testserver.TestEntry{
+		"http://example.com/ok.html":     {Timestamp: "20200101000000", Body: "ok"},
+		"http://example.com/gone.html":   {Timestamp: "20200101000000", Status: http.StatusNotFound},
+		"http://example.com/broken.html": {Timestamp: "20200101000000", Status: http.StatusBadGateway},
+	})
+	dir := t.TempDir()
+	cfg := archiveConfig(srv, dir)
+	cfg.Stats = new(DownloadStats)
+	cfg.Track404s = true
+	err := DownloadAll(cfg)
+	var partial *PartialError
+	if !errors.As(err, &partial) || partial.Failed != 1 {
+		t.Fatalf("err = %v, want a PartialError with 1 failure", err)
+	}
+	if n := cfg.Stats.Downloaded404s.Load(); n != 1 {
+		t.Errorf("Downloaded404s = %d, want 1", n)
+	}
+	readOutput(t, dir, "ok.html")
+}
+
+// SkipAssets fetches only the pages and points their asset links at the
+// archived captures instead of local files.
+func TestIntegrationSkipAssets(t *testing.T) {
+	srv := testserver.NewTestServer(t, map[string]testserver.TestEntry{
+		"http://example.com/": {Timestamp: "20200101000000", ContentType: "text/html",
+			Body: `<html><head><link rel="stylesheet" href="/site.css"></head>` +
+				`<body style="background:url(/bg.png)"><img src="/logo.png"><a href="/about">About</a></body></html>`},
+		"http://example.com/about":    {Timestamp: "20200101000000", ContentType: "text/html", Body: "<html></html>"},
+		"http://example.com/site.css": {Timestamp: "20200102000000", Body: "body{}"},
+		"http://example.com/logo.png": {Timestamp: "20200103000000", Body: "PNG"},
+	})
+	dir := t.TempDir()
+	cfg := archiveConfig(srv, dir)
+	cfg.SkipAssets, cfg.RewriteLinks = true, true
+	if err := DownloadAll(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(srv.ContentRequests()); n != 2 {
+		t.Errorf("%d content requests, want 2: %v", n, srv.ContentRequests())
+	}
+	page := readOutput(t, dir, "index.html")
+	for _, want := range []string{
+		`href="` + srv.URL + `/web/20200102000000id_/http://example.com/site.css"`,
+		`src="` + srv.URL + `/web/20200103000000id_/http://example.com/logo.png"`,
+		`url(http://example.com/bg.png)`,
+		`href="about"`,
+	} {
+		if !strings.Contains(page, want) {
+			t.Errorf("page lacks %s\n  got: %s", want, page)
+		}
+	}
+}
+
+// NoFonts drops font captures from the index and never fetches them.
+func TestIntegrationNoFonts(t *testing.T) {
+	srv := testserver.NewTestServer(t, map[string]testserver.TestEntry{
+		"http://example.com/index.html":      {Timestamp: "20200101000000", Body: "<html></html>"},
+		"http://example.com/fonts/a.woff2":   {Timestamp: "20200101000000", Body: "WOFF2"},
+		"http://example.com/fonts/B.TTF?v=1": {Timestamp: "20200101000000", Body: "TTF"},
+		"http://example.com/site.css":        {Timestamp: "20200101000000", Body: "body{}"},
+	})
+	dir := t.TempDir()
+	cfg := archiveConfig(srv, dir)
+	cfg.NoFonts = true
+	if err := DownloadAll(cfg); err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range srv.ContentRequests() {
+		if strings.Contains(r, "/fonts/") {
+			t.Errorf("font requested: %s", r)
+		}
+	}
+	readOutput(t, dir, "site.css")
+	if _, err := os.Stat(filepath.Join(dir, "fonts")); err == nil {
+		t.Error("fonts directory should not exist")
+	}
+}
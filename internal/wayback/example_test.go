@@ -0,0 +1,57 @@
+package wayback_test
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/sigman78/wayback-dl/internal/wayback"
+	"github.com/sigman78/wayback-dl/internal/wayback/testserver"
+)
+
+// Download a site into memory with its links rewritten. The archive here is
+// a local mock; leave ArchiveBase empty to use web.archive.org.
+func Example_downloadSite() {
+	srv := testserver.New(map[string]testserver.TestEntry{
+		"http://example.com/": {
+			Timestamp:   "20200101000000",
+			Body:        `<html><body><a href="http://example.com/about.html">About</a></body></html>`,
+			ContentType: "text/html",
+		},
+		"http://example.com/about.html": {
+			Timestamp: "20200102000000", Body: "<html>About us</html>", ContentType: "text/html",
+		},
+	})
+	defer srv.Close()
+
+	base, err := wayback.NormalizeBaseURL("http://example.com")
+	if err != nil {
+		log.Fatal(err)
+	}
+	store := wayback.NewMemStorage()
+	cfg := &wayback.Config{
+		BaseURL:       base.CanonicalURL,
+		Variants:      base.Variants,
+		BareHost:      base.BareHost,
+		UnicodeHost:   base.UnicodeHost,
+		ArchiveBase:   srv.URL,
+		Storage:       store,
+		Threads:       2,
+		CDXRatePerMin: 6000,
+		RewriteLinks:  true,
+		LogLevel:      wayback.LogError,
+	}
+	if err := wayback.DownloadAll(cfg); err != nil {
+		log.Fatal(err)
+	}
+
+	_ = store.Walk(func(p string) error {
+		fmt.Println(p)
+		return nil
+	})
+	home, _ := store.Get("index.html")
+	fmt.Println(string(home))
+	// Output:
+	// about.html
+	// index.html
+	// <html><head></head><body><a href="about.html">About</a></body></html>
+}
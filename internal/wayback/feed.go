@@ -0,0 +1,121 @@
+package wayback
+
+import (
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+var (
+	// reFeedText matches a URL held as element text (RSS <link>, <guid>,
+	// <comments>), optionally wrapped in CDATA. Groups: 1 open tag, 2 CDATA
+	// opener, 3 URL.
+	reFeedText = regexp.MustCompile(`(?is)(<(?:[a-z]+:)?(?:link|guid|comments)(?:\s[^>]*)?>)\s*(<!\[CDATA\[)?\s*([^<\s\]]+)\s*(?:\]\]>)?\s*</`)
+	// reFeedHref matches the href attribute of an Atom <link> (or
+	// <atom:link>). Groups: 1 prefix, 2 quote, 3 URL.
+	reFeedHref = regexp.MustCompile(`(?is)(<(?:[a-z]+:)?link\b[^>]*?\shref\s*=\s*)(["'])([^"']*)["']`)
+	// reNotPermaLink matches a <guid> that is an opaque id, not a URL.
+	reNotPermaLink = regexp.MustCompile(`(?i)ispermalink\s*=\s*["']false["']`)
+)
+
+// FeedRewriter implements Rewriter for RSS and Atom feeds, pointing entry
+// and channel links at their local copies so captured feeds work offline.
+type FeedRewriter struct{}
+
+// Match reports whether this resource is an RSS or Atom feed. Checks the
+// Content-Type, the file extension (.rss/.atom), then the leading markup;
+// anything served as HTML or XHTML is left to HTMLRewriter.
+func (FeedRewriter) Match(logicalPath, contentType string, firstBytes []byte) bool {
+	ct := strings.ToLower(contentType)
+	if strings.Contains(ct, "rss+xml") || strings.Contains(ct, "atom+xml") {
+		return true
+	}
+	if strings.Contains(ct, "text/html") || strings.Contains(ct, "application/xhtml+xml") {
+		return false
+	}
+	ext := strings.ToLower(path.Ext(logicalPath))
+	if ext == ".rss" || ext == ".atom" {
+		return true
+	}
+	return isFeedMarkup(firstBytes)
+}
+
+// isFeedMarkup reports whether b starts an XML document whose root element
+// is <rss>, <feed> or <rdf:RDF>.
+func isFeedMarkup(b []byte) bool {
+	s := strings.ToLower(strings.TrimSpace(strings.TrimPrefix(string(b), "\ufeff")))
+	if !strings.HasPrefix(s, "<?xml") && !strings.HasPrefix(s, "<rss") &&
+		!strings.HasPrefix(s, "<feed") && !strings.HasPrefix(s, "<rdf:rdf") {
+		return false
+	}
+	return strings.Contains(s, "<rss") || strings.Contains(s, "<feed") || strings.Contains(s, "<rdf:rdf")
+}
+
+func (FeedRewriter) Rewrite(store Storage, logicalPath, pageURL string, cfg *Config, idx *SnapshotIndex) error {
+	data, err := store.Get(logicalPath)
+	if err != nil {
+		return err
+	}
+	rewritten := RewriteFeedContent(string(data), logicalPath, pageURL, cfg, idx)
+	return store.PutBytes(logicalPath, []byte(rewritten))
+}
+
+// RewriteFeedContent rewrites internal URLs in an RSS/Atom document stored at
+// logicalPath: element-text links (<link>, <guid>, <comments>) and Atom
+// <link href>. <guid isPermaLink="false"> values are ids and are kept.
+func RewriteFeedContent(feed, logicalPath, feedURL string, cfg *Config, idx *SnapshotIndex) string {
+	feedU, err := url.Parse(feedURL)
+	if err != nil {
+		return feed
+	}
+	localDir := localDirFor(logicalPath, cfg)
+
+	// local returns the relative local link for the (unescaped) ref, or ""
+	// when it stays as-is.
+	local := func(ref string) string {
+		resolved, err := feedU.Parse(strings.TrimSpace(ref))
+		if err != nil {
+			return ""
+		}
+		resolved = stripWaybackPrefix(resolved, cfg.ArchiveBase)
+		if resolved.Scheme != "http" && resolved.Scheme != "https" || !isInternalHost(resolved.Host, cfg) {
+			return ""
+		}
+		l := localHref(resolved, localDir, cfg, idx)
+		cfg.recordRewrite("feed", ref, l)
+		return l
+	}
+
+	feed = reFeedText.ReplaceAllStringFunc(feed, func(match string) string {
+		sub := reFeedText.FindStringSubmatchIndex(match)
+		openTag := match[sub[2]:sub[3]]
+		if reNotPermaLink.MatchString(openTag) {
+			return match
+		}
+		cdata := sub[4] >= 0
+		ref := match[sub[6]:sub[7]]
+		if !cdata {
+			ref = html.UnescapeString(ref)
+		}
+		rel := local(ref)
+		if rel == "" {
+			return match
+		}
+		if !cdata {
+			rel = html.EscapeString(rel)
+		}
+		return match[:sub[6]] + rel + match[sub[7]:]
+	})
+
+	return reFeedHref.ReplaceAllStringFunc(feed, func(match string) string {
+		sub := reFeedHref.FindStringSubmatchIndex(match)
+		rel := local(html.UnescapeString(match[sub[6]:sub[7]]))
+		if rel == "" {
+			return match
+		}
+		return match[:sub[6]] + html.EscapeString(rel) + match[sub[7]:]
+	})
+}
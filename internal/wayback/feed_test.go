@@ -0,0 +1,87 @@
+package wayback
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestFeedRewriterMatch verifies feeds are recognised by Content-Type,
+// extension and root element, and take precedence over HTML sniffing.
+func TestFeedRewriterMatch(t *testing.T) {
+	cases := []struct {
+		path, ct, body string
+		want           bool
+	}{
+		{"example.com/feed", "application/rss+xml; charset=utf-8", "", true},
+		{"example.com/feed", "application/atom+xml", "", true},
+		{"example.com/blog.rss", "", "", true},
+		{"example.com/feed", "text/xml", `<?xml version="1.0"?><rss version="2.0">`, true},
+		{"example.com/feed", "", "\ufeff<feed xmlns=\"http://www.w3.org/2005/Atom\">", true},
+		{"example.com/index.html", "text/html", `<?xml version="1.0"?><rss>`, false},
+		{"example.com/sitemap.xml", "text/xml", `<?xml version="1.0"?><urlset>`, false},
+	}
+	for _, tc := range cases {
+		if got := (FeedRewriter{}).Match(tc.path, tc.ct, []byte(tc.body)); got != tc.want {
+			t.Errorf("Match(%q, %q, %q) = %v, want %v", tc.path, tc.ct, tc.body, got, tc.want)
+		}
+	}
+	rw := DetectRewriter("example.com/feed", "", []byte(`<?xml version="1.0"?><rss>`))
+	if _, ok := rw.(FeedRewriter); !ok {
+		t.Errorf("DetectRewriter picked %T for an RSS document", rw)
+	}
+}
+
+// TestRewriteFeedContentRSS verifies RSS channel and item links are rewritten
+// to local paths while external links and opaque guids are kept.
+func TestRewriteFeedContentRSS(t *testing.T) {
+	cfg := testCSSCfg()
+	feed := `<?xml version="1.0"?>
+<rss version="2.0" xmlns:atom="http://www.w3.org/2005/Atom"><channel>
+  <link>http://example.com/</link>
+  <atom:link href="http://example.com/feed.rss" rel="self"/>
+  <item>
+    <link>http://example.com/posts/one.html?a=1&amp;b=2</link>
+    <guid>http://example.com/posts/one.html</guid>
+    <comments><![CDATA[ https://web.archive.org/web/2020/http://example.com/posts/one.html#c ]]></comments>
+  </item>
+  <item>
+    <link>https://other.org/post</link>
+    <guid isPermaLink="false">http://example.com/?p=2</guid>
+  </item>
+</channel></rss>`
+	got := RewriteFeedContent(feed, "feed.rss", "http://example.com/feed.rss", cfg, nil)
+
+	for _, want := range []string{
+		`<link>index.html</link>`,
+		`<atom:link href="feed.rss" rel="self"/>`,
+		`<link>posts/one.html%253Fa=1&amp;b=2</link>`,
+		`<guid>posts/one.html</guid>`,
+		`<comments><![CDATA[ posts/one.html ]]></comments>`,
+		`<link>https://other.org/post</link>`,
+		`<guid isPermaLink="false">http://example.com/?p=2</guid>`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("missing %s\n  got: %s", want, got)
+		}
+	}
+}
+
+// TestRewriteFeedContentAtom verifies Atom <link href> attributes are rewritten.
+func TestRewriteFeedContentAtom(t *testing.T) {
+	cfg := testCSSCfg()
+	feed := `<feed xmlns="http://www.w3.org/2005/Atom">
+  <link rel="alternate" href="http://example.com/blog/"/>
+  <entry><link href='/blog/post.html'/><id>http://example.com/blog/post.html</id></entry>
+</feed>`
+	got := RewriteFeedContent(feed, "blog/atom.xml", "http://example.com/blog/atom.xml", cfg, nil)
+
+	for _, want := range []string{
+		`<link rel="alternate" href="index.html"/>`,
+		`<link href='post.html'/>`,
+		`<id>http://example.com/blog/post.html</id>`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("missing %s\n  got: %s", want, got)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package wayback
+
+import (
+	"net/url"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Filename encodings for Config.FilenameEncoding: how the non-ASCII
+// characters of a URL path are written in preserve-mode file names.
+const (
+	FilenamePercent = "percent" // caf%C3%A9, as the URL spells it (the default)
+	FilenameRaw     = "raw"     // the decoded bytes, whether or not they are UTF-8
+	FilenameUnicode = "unicode" // café; bytes that are not UTF-8 stay percent-encoded
+	FilenameASCII   = "ascii"   // cafe; characters without an ASCII form stay percent-encoded
+)
+
+// validFilenameEncoding reports whether enc is a FilenameEncoding value; ""
+// means FilenamePercent.
+func validFilenameEncoding(enc string) bool {
+	switch enc {
+	case "", FilenamePercent, FilenameRaw, FilenameUnicode, FilenameASCII:
+		return true
+	}
+	return false
+}
+
+// encodeFilename rewrites the percent-encoded non-ASCII bytes (%80-%FF) of
+// the preserve-mode logical path p in the encoding enc. ASCII escapes such
+// as %3F and %25 are never decoded, so the name stays unambiguous.
+func encodeFilename(p, enc string) string {
+	if enc == "" || enc == FilenamePercent || !strings.Contains(p, "%") {
+		return p
+	}
+	var b strings.Builder
+	b.Grow(len(p))
+	for i := 0; i < len(p); {
+		run := highBytes(p[i:])
+		if len(run) == 0 {
+			b.WriteByte(p[i])
+			i++
+			continue
+		}
+		i += 3 * len(run)
+		if enc == FilenameRaw {
+			b.Write(run)
+			continue
+		}
+		for len(run) > 0 {
+			r, size := utf8.DecodeRune(run)
+			switch {
+			case r == utf8.RuneError && size <= 1:
+				writePercent(&b, run[:1])
+			case enc == FilenameASCII:
+				if s := transliterate(r); s != "" {
+					b.WriteString(s)
+				} else {
+					writePercent(&b, run[:size])
+				}
+			default:
+				b.WriteRune(r)
+			}
+			run = run[max(size, 1):]
+		}
+	}
+	return b.String()
+}
+
+// decodeSafeEscapes decodes the %XX escapes of letters, digits, "-", "_"
+// and "." in the preserve-mode logical path p, e.g. my%2Dfile.html becomes
+// my-file.html; a URL means the same with those characters escaped or not.
+// Other escapes are kept, and so is a segment that would decode to "." or
+// "..".
+func decodeSafeEscapes(p string) string {
+	if !strings.Contains(p, "%") {
+		return p
+	}
+	segs := strings.Split(p, "/")
+	for i, seg := range segs {
+		var b strings.Builder
+		b.Grow(len(seg))
+		for j := 0; j < len(seg); j++ {
+			if seg[j] == '%' && j+2 < len(seg) {
+				if c, ok := unhex(seg[j+1], seg[j+2]); ok && isSafeFilenameByte(c) {
+					b.WriteByte(c)
+					j += 2
+					continue
+				}
+			}
+			b.WriteByte(seg[j])
+		}
+		if d := b.String(); d != "." && d != ".." {
+			segs[i] = d
+		}
+	}
+	return strings.Join(segs, "/")
+}
+
+// isSafeFilenameByte reports whether c is a letter, digit, "-", "_" or ".".
+func isSafeFilenameByte(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.'
+}
+
+// highBytes decodes the run of %XX escapes of bytes 0x80-0xFF at the start
+// of s; it returns nil when s does not start with one.
+func highBytes(s string) []byte {
+	var run []byte
+	for len(s) >= 3 && s[0] == '%' {
+		c, ok := unhex(s[1], s[2])
+		if !ok || c < 0x80 {
+			break
+		}
+		run = append(run, c)
+		s = s[3:]
+	}
+	return run
+}
+
+// unhex returns the byte spelled by the hex digits h and l.
+func unhex(h, l byte) (byte, bool) {
+	hv, ok1 := hexVal(h)
+	lv, ok2 := hexVal(l)
+	return hv<<4 | lv, ok1 && ok2
+}
+
+func hexVal(c byte) (byte, bool) {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0', true
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10, true
+	case 'A' <= c && c <= 'F':
+		return c - 'A' + 10, true
+	}
+	return 0, false
+}
+
+// writePercent writes data to b as %XX escapes.
+func writePercent(b *strings.Builder, data []byte) {
+	const hexChars = "0123456789ABCDEF"
+	for _, c := range data {
+		b.WriteByte('%')
+		b.WriteByte(hexChars[c>>4])
+		b.WriteByte(hexChars[c&0xf])
+	}
+}
+
+// asciiLetters transliterates letters that do not decompose into an ASCII
+// base letter plus combining marks.
+var asciiLetters = map[rune]string{
+	'ß': "ss", 'æ': "ae", 'Æ': "AE", 'œ': "oe", 'Œ': "OE", 'ø': "o", 'Ø': "O",
+	'đ': "d", 'Đ': "D", 'ð': "d", 'Ð': "D", 'ł': "l", 'Ł': "L", 'þ': "th", 'Þ': "Th",
+	'ı': "i", 'ŀ': "l", 'Ŀ': "L",
+}
+
+// transliterate returns an ASCII form of r: r itself when it is ASCII, its
+// base letter with accents removed (é → e), an entry of asciiLetters, or ""
+// when it has none.
+func transliterate(r rune) string {
+	if r < utf8.RuneSelf {
+		return string(r)
+	}
+	if s, ok := asciiLetters[r]; ok {
+		return s
+	}
+	var b strings.Builder
+	for _, d := range norm.NFD.String(string(r)) {
+		switch {
+		case unicode.Is(unicode.Mn, d):
+		case d < utf8.RuneSelf:
+			b.WriteRune(d)
+		default:
+			return ""
+		}
+	}
+	return b.String()
+}
+
+// asciiURLPath returns rawURL with the characters of its path transliterated
+// to ASCII and the ones without an ASCII form dropped, for pretty mode, whose
+// sanitized names would otherwise lose every accented letter.
+func asciiURLPath(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	var b strings.Builder
+	for _, r := range u.Path {
+		b.WriteString(transliterate(r))
+	}
+	if b.String() == u.Path {
+		return rawURL
+	}
+	u.Path, u.RawPath = b.String(), ""
+	return u.String()
+}
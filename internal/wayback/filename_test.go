@@ -0,0 +1,79 @@
+package wayback
+
+import (
+	"net/url"
+	"testing"
+)
+
+// Each FilenameEncoding writes the non-ASCII bytes of a preserve-mode path
+// its own way and never decodes ASCII escapes.
+func TestLocalPathForFilenameEncoding(t *testing.T) {
+	const (
+		utf8URL   = "https://example.com/caf%C3%A9/%E6%97%A5%E6%9C%AC.html?q=%3F"
+		latin1URL = "https://example.com/caf%E9.html"
+		symbolURL = "https://example.com/%E2%98%83-%C3%9Fe.html"
+	)
+	cases := []struct{ enc, url, want string }{
+		{"", utf8URL, "caf%C3%A9/%E6%97%A5%E6%9C%AC.html%3Fq=%3F"},
+		{FilenamePercent, latin1URL, "caf%E9.html"},
+		{FilenameUnicode, utf8URL, "café/日本.html%3Fq=%3F"},
+		{FilenameUnicode, latin1URL, "caf%E9.html"},
+		{FilenameRaw, latin1URL, "caf\xe9.html"},
+		{FilenameASCII, utf8URL, "cafe/%E6%97%A5%E6%9C%AC.html%3Fq=%3F"},
+		{FilenameASCII, symbolURL, "%E2%98%83-sse.html"},
+		{FilenameUnicode, "https://example.com/100%25.html", "100%25.html"},
+	}
+	for _, tc := range cases {
+		cfg := &Config{FilenameEncoding: tc.enc}
+		if got := localPathFor(tc.url, cfg); got != tc.want {
+			t.Errorf("%s: localPathFor(%s) = %q, want %q", tc.enc, tc.url, got, tc.want)
+		}
+	}
+
+	pretty := &Config{PrettyPath: true, FilenameEncoding: FilenameASCII}
+	if got := localPathFor("https://example.com/caf%C3%A9/cr%C3%A8me.html", pretty); got != "cafe/creme.html" {
+		t.Errorf("pretty ascii = %q, want cafe/creme.html", got)
+	}
+}
+
+// NormalizeEncodedPaths decodes escaped safe characters in names, and links
+// to the files name them the same way; other escapes stay.
+func TestNormalizeEncodedPaths(t *testing.T) {
+	cfg := &Config{Directory: "out", NormalizeEncodedPaths: true}
+	for raw, want := range map[string]string{
+		"https://example.com/my%2Dfile.html":           "my-file.html",
+		"https://example.com/%41bc/x%5Fy%2e%4A%53":     "Abc/x_y.JS",
+		"https://example.com/a%20b%2Fc.html":           "a%20b%2Fc.html",
+		"https://example.com/caf%C3%A9%2D1.html?q=%41": "caf%C3%A9-1.html%3Fq=A",
+		"https://example.com/100%25%32.html":           "100%252.html",
+	} {
+		if got := localPathFor(raw, cfg); got != want {
+			t.Errorf("localPathFor(%s) = %q, want %q", raw, got, want)
+		}
+	}
+
+	// Decoding never makes a parent-directory segment.
+	if got := decodeSafeEscapes("a/%2E%2E/b%2E"); got != "a/%2E%2E/b." {
+		t.Errorf("decodeSafeEscapes = %q", got)
+	}
+
+	target, _ := url.Parse("https://example.com/docs/my%2Dfile%20v2.html")
+	if got, want := localHref(target, "out", cfg, nil), "docs/my-file%2520v2.html"; got != want {
+		t.Errorf("href = %q, want %q", got, want)
+	}
+}
+
+// Links to files named in another encoding percent-encode their bytes, so a
+// browser maps them back to the names on disk.
+func TestLocalHrefFilenameEncoding(t *testing.T) {
+	target, _ := url.Parse("https://example.com/caf%C3%A9/menu%3F.html")
+	for enc, want := range map[string]string{
+		FilenamePercent: "caf%25C3%25A9/menu%253F.html",
+		FilenameUnicode: "caf%C3%A9/menu%253F.html",
+	} {
+		cfg := &Config{Directory: "out", FilenameEncoding: enc}
+		if got := localHref(target, "out", cfg, nil); got != want {
+			t.Errorf("%s: href = %q, want %q", enc, got, want)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package wayback
+
+import (
+	"net/http"
+
+	"golang.org/x/net/http/httpguts"
+)
+
+// headerTransport sets fixed headers on every outgoing request.
+type headerTransport struct {
+	base    http.RoundTripper
+	headers http.Header
+}
+
+// RoundTrip implements http.RoundTripper. The request is cloned before the
+// headers are set, as required by the RoundTripper contract.
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	for k, v := range t.headers {
+		req.Header[k] = v
+	}
+	return t.base.RoundTrip(req)
+}
+
+// withMirrorHeaders returns a copy of c whose transport sets
+// cfg.MirrorHeaders on each request, or c itself when none are configured.
+// Only the download client gets them; CDX queries go out unchanged.
+func withMirrorHeaders(c *http.Client, cfg *Config) *http.Client {
+	if len(cfg.MirrorHeaders) == 0 {
+		return c
+	}
+	base := c.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	headers := make(http.Header, len(cfg.MirrorHeaders))
+	for k, v := range cfg.MirrorHeaders {
+		headers.Set(k, v)
+	}
+	cp := *c
+	cp.Transport = &headerTransport{base: base, headers: headers}
+	return &cp
+}
+
+// validHeaders reports whether every name and value in headers may be sent
+// in an HTTP request.
+func validHeaders(headers map[string]string) bool {
+	for k, v := range headers {
+		if !httpguts.ValidHeaderFieldName(k) || !httpguts.ValidHeaderFieldValue(v) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,50 @@
+package wayback
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Mirror headers go out with archive downloads only, never with CDX queries.
+func TestDownloadAllMirrorHeaders(t *testing.T) {
+	var mu sync.Mutex
+	seen := make(map[string]string) // request kind → Accept-Language
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		kind := "download"
+		if strings.HasPrefix(r.URL.Path, "/cdx/search/") {
+			kind = "cdx"
+			_, _ = io.WriteString(w, `[["timestamp","original"],["20200101000000","http://example.com/a.html"]]`)
+		} else {
+			_, _ = io.WriteString(w, "<html></html>")
+		}
+		mu.Lock()
+		seen[kind] = r.Header.Get("Accept-Language")
+		mu.Unlock()
+	}))
+	defer srv.Close()
+	useTestArchive(t, srv)
+
+	cfg := &Config{
+		BaseURL: "http://example.com/", Variants: []string{"http://example.com/"}, BareHost: "example.com",
+		ExactURL: true, Directory: t.TempDir(), Threads: 1, CDXRatePerMin: 6000,
+		MirrorHeaders: map[string]string{"accept-language": "de-DE"},
+	}
+	if err := DownloadAll(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if seen["download"] != "de-DE" {
+		t.Errorf("download Accept-Language = %q, want de-DE", seen["download"])
+	}
+	if v, ok := seen["cdx"]; !ok || v != "" {
+		t.Errorf("CDX Accept-Language = %q (seen %v), want none", v, ok)
+	}
+
+	bad := &Config{Threads: 1, CDXRatePerMin: 1, MirrorHeaders: map[string]string{"Bad Name": "x"}}
+	if err := bad.Validate(); err == nil {
+		t.Error("expected an invalid header name to be rejected")
+	}
+}
@@ -0,0 +1,64 @@
+package wayback
+
+import "time"
+
+// Hooks are optional callbacks through which an embedding program can follow
+// a run, e.g. to drive its own progress display or export metrics. Any field
+// may be nil. Snapshot callbacks are called concurrently from the download
+// workers, so they must be safe for concurrent use, and should return quickly.
+type Hooks struct {
+	OnCDXPage       func(CDXPageEvent)   // a CDX page was fetched
+	OnRetry         func(RetryEvent)     // a request failed and will be retried
+	OnSnapshotStart func(Snapshot)       // a snapshot download is starting
+	OnSnapshotDone  func(SnapshotResult) // a snapshot download finished, successfully or not
+}
+
+// CDXPageEvent describes one fetched page of CDX results.
+type CDXPageEvent struct {
+	Query   string // the queried URL (pattern)
+	Page    int    // page index; -1 for an unpaginated query
+	Entries int    // entries on the page
+}
+
+// RetryEvent describes a failed request that is about to be retried.
+type RetryEvent struct {
+	URL     string        // the request URL
+	Attempt int           // attempts made so far
+	Status  int           // HTTP status of the failed attempt
+	Delay   time.Duration // wait before the next attempt
+}
+
+// SnapshotResult describes the outcome of one snapshot download.
+type SnapshotResult struct {
+	Snapshot  Snapshot
+	LocalPath string        // logical path the capture is stored at
+	Bytes     int64         // bytes stored; 0 when skipped
+	Skipped   bool          // the file already existed and was not fetched
+	NotFound  bool          // the archive answered 404; Err is nil
+	Err       error         // non-nil when the download failed
+	Duration  time.Duration // time spent on the snapshot
+}
+
+func (h *Hooks) cdxPage(e CDXPageEvent) {
+	if h != nil && h.OnCDXPage != nil {
+		h.OnCDXPage(e)
+	}
+}
+
+func (h *Hooks) retry(e RetryEvent) {
+	if h != nil && h.OnRetry != nil {
+		h.OnRetry(e)
+	}
+}
+
+func (h *Hooks) snapshotStart(s Snapshot) {
+	if h != nil && h.OnSnapshotStart != nil {
+		h.OnSnapshotStart(s)
+	}
+}
+
+func (h *Hooks) snapshotDone(r SnapshotResult) {
+	if h != nil && h.OnSnapshotDone != nil {
+		h.OnSnapshotDone(r)
+	}
+}
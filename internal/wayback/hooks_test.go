@@ -0,0 +1,107 @@
+package wayback
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sigman78/wayback-dl/internal/wayback/testserver"
+	"golang.org/x/time/rate"
+)
+
+// Every hook fires for its event: each CDX page, and a start and a result
+// for each snapshot, including skipped and failed ones.
+func TestDownloadAllHooks(t *testing.T) {
+	srv := testserver.NewTestServer(t, map[string]testserver.TestEntry{
+		"http://example.com/a.html":    {Timestamp: "20200101000000", Body: "aaaa"},
+		"http://example.com/gone.html": {Timestamp: "20200101000000", Status: http.StatusNotFound},
+	})
+	var mu sync.Mutex
+	var pages []CDXPageEvent
+	var started []string
+	done := make(map[string]SnapshotResult)
+	hooks := &Hooks{
+		OnCDXPage: func(e CDXPageEvent) { mu.Lock(); pages = append(pages, e); mu.Unlock() },
+		OnSnapshotStart: func(s Snapshot) {
+			mu.Lock()
+			started = append(started, s.FileURL)
+			mu.Unlock()
+		},
+		OnSnapshotDone: func(r SnapshotResult) {
+			mu.Lock()
+			done[r.Snapshot.FileURL] = r
+			mu.Unlock()
+		},
+	}
+
+	dir := t.TempDir()
+	cfg := archiveConfig(srv, dir)
+	cfg.Variants = []string{"http://example.com/"}
+	cfg.Hooks = hooks
+	if err := DownloadAll(cfg); err != nil {
+		t.Fatal(err)
+	}
+	// Page 0 holds both entries; the empty page 1 ends the pagination.
+	if len(pages) != 2 || pages[0].Page != 0 || pages[0].Entries != 2 || pages[1].Entries != 0 {
+		t.Errorf("CDX page events = %+v", pages)
+	}
+	slices.Sort(started)
+	if !slices.Equal(started, []string{"http://example.com/a.html", "http://example.com/gone.html"}) {
+		t.Errorf("started = %v", started)
+	}
+	if r := done["http://example.com/a.html"]; r.Err != nil || r.Bytes != 4 || r.LocalPath != "a.html" || r.Skipped {
+		t.Errorf("a.html result = %+v", r)
+	}
+	if r := done["http://example.com/gone.html"]; !r.NotFound || r.Err != nil {
+		t.Errorf("gone.html result = %+v", r)
+	}
+
+	// A rerun skips the stored file.
+	clear(done)
+	if err := DownloadAll(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if r := done["http://example.com/a.html"]; !r.Skipped || r.Bytes != 0 {
+		t.Errorf("rerun a.html result = %+v", r)
+	}
+}
+
+// A nil Hooks, and one with nil fields, accept every event.
+func TestHooksNilSafe(t *testing.T) {
+	for _, h := range []*Hooks{nil, {}} {
+		h.cdxPage(CDXPageEvent{})
+		h.retry(RetryEvent{})
+		h.snapshotStart(Snapshot{})
+		h.snapshotDone(SnapshotResult{})
+	}
+}
+
+// OnRetry reports a throttled CDX request before the backoff wait.
+func TestFetchCDXPageRetryHook(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "30")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var got []RetryEvent
+	hooks := &Hooks{OnRetry: func(e RetryEvent) {
+		got = append(got, e)
+		cancel() // skip the wait
+	}}
+	_, err := fetchCDXPage(ctx, testClientFor(t, srv), rate.NewLimiter(rate.Inf, 1), "example.com/*", 0,
+		cdxOptions{MaxRetries: 3, Hooks: hooks})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("err = %v, want context.Canceled", err)
+	}
+	if len(got) != 1 || got[0].Attempt != 1 || got[0].Status != http.StatusTooManyRequests || got[0].Delay != 30*time.Second {
+		t.Errorf("retry events = %+v", got)
+	}
+}
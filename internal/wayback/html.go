@@ -4,24 +4,26 @@ import (
 	"bytes"
 	"net/url"
 	"path"
-	"path/filepath"
+	"regexp"
 	"strings"
 
 	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
 )
 
 // HTMLRewriter implements Rewriter for HTML resources.
 type HTMLRewriter struct{}
 
 // Match reports whether this resource should be treated as HTML.
-// Checks Content-Type, file extension (.html/.htm), then magic bytes.
+// Checks Content-Type (text/html, application/xhtml+xml), file extension
+// (.html/.htm/.xhtml), then magic bytes.
 func (HTMLRewriter) Match(logicalPath, contentType string, firstBytes []byte) bool {
 	ct := strings.ToLower(contentType)
-	if strings.Contains(ct, "text/html") {
+	if strings.Contains(ct, "text/html") || strings.Contains(ct, "application/xhtml+xml") {
 		return true
 	}
 	ext := strings.ToLower(path.Ext(logicalPath))
-	if ext == ".html" || ext == ".htm" {
+	if ext == ".html" || ext == ".htm" || ext == ".xhtml" {
 		return true
 	}
 	if len(firstBytes) > 0 {
@@ -42,10 +44,22 @@ func (HTMLRewriter) Rewrite(store Storage, logicalPath, pageURL string, cfg *Con
 		return err
 	}
 
+	// XHTML is parsed as HTML, which would turn its XML declaration into a
+	// comment; set the declaration aside and put it back in front.
+	decl, data := splitXMLDecl(data)
 	doc, err := html.Parse(bytes.NewReader(data))
 	if err != nil {
 		return err
 	}
+	if cfg.HTMLParser == HTMLParserStrict {
+		if n := htmlCorrections(data, doc); n > 0 {
+			cfg.Log(LogDebug, "html %s: parser made %d structural correction(s)", logicalPath, n)
+			if cfg.HTMLMaxCorrections > 0 && n > cfg.HTMLMaxCorrections {
+				cfg.Log(LogInfo, "html %s: %d corrections exceed %d, left unrewritten", logicalPath, n, cfg.HTMLMaxCorrections)
+				return nil
+			}
+		}
+	}
 
 	pageU, err := url.Parse(pageURL)
 	if err != nil {
@@ -53,54 +67,395 @@ func (HTMLRewriter) Rewrite(store Storage, logicalPath, pageURL string, cfg *Con
 	}
 
 	// Relative directory of the output file (used for RelativeLink)
-	localDir := ToPosix(filepath.ToSlash(filepath.Dir(filepath.Join(cfg.Directory, filepath.FromSlash(logicalPath)))))
+	localDir := localDirFor(logicalPath, cfg)
+	rewriteHTMLTree(doc, pageU, localDir, cfg, idx, store, 0)
+	if cfg.XHTMLOutput {
+		makeXMLSafe(doc)
+	}
+
+	var buf bytes.Buffer
+	buf.Write(decl)
+	if err := html.Render(&buf, doc); err != nil {
+		return err
+	}
+	out := buf.Bytes()
+	if cfg.StripWaybackComments {
+		out = stripWaybackComments(out)
+	}
+	return store.PutBytes(logicalPath, out)
+}
+
+// waybackCommentRes match the comments archiving tools leave in pages: the
+// Wayback Machine's toolbar block (with everything between its markers) and
+// its "FILE ARCHIVED ON" and playback timing notes, HTTrack's "Mirrored
+// from" and "Added by HTTrack" markers, and the "saved from url" mark of
+// pages saved by Internet Explorer. A line break after a comment goes too.
+var waybackCommentRes = []*regexp.Regexp{
+	regexp.MustCompile(`(?s)<!--\s*BEGIN WAYBACK TOOLBAR INSERT\s*-->.*?<!--\s*END WAYBACK TOOLBAR INSERT\s*-->\r?\n?`),
+	regexp.MustCompile(`(?s)<!--\s*(?:FILE ARCHIVED ON|playback timings|Mirrored from|saved from url=\(\d+\)).*?-->\r?\n?`),
+	regexp.MustCompile(`<!--\s*/?Added by HTTrack\s*-->\r?\n?`),
+}
+
+// stripWaybackComments removes the comments matched by waybackCommentRes
+// from a rendered page, for Config.StripWaybackComments.
+func stripWaybackComments(page []byte) []byte {
+	for _, re := range waybackCommentRes {
+		page = re.ReplaceAll(page, nil)
+	}
+	return page
+}
+
+// ExtractURLs returns the absolute URLs on internal hosts (see
+// isInternalHost) referenced by the page data fetched from pageURL: href,
+// src, srcset, action and inline style attributes of any element, in
+// document order without duplicates. Nested archive URLs are reduced to the
+// original URL and fragments dropped. Config.TwoPassExtraction uses it to
+// find the URLs a page needs that the CDX index does not list.
+func (HTMLRewriter) ExtractURLs(data []byte, pageURL string, cfg *Config) ([]string, error) {
+	return extractHTMLURLs(data, pageURL, cfg.ArchiveBase, func(host string) bool { return isInternalHost(host, cfg) })
+}
+
+// extractHTMLURLs is ExtractURLs for the http(s) URLs whose host keep
+// accepts, in a page downloaded from the archive at base (see archiveRoot).
+func extractHTMLURLs(data []byte, pageURL, base string, keep func(host string) bool) ([]string, error) {
+	pageU, err := url.Parse(pageURL)
+	if err != nil {
+		return nil, err
+	}
+	doc, err := html.Parse(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	var out []string
+	add := func(ref string) {
+		ref = strings.TrimSpace(ref)
+		if ref == "" || strings.HasPrefix(ref, "#") {
+			return
+		}
+		u, err := pageU.Parse(ref)
+		if err != nil {
+			return
+		}
+		u = stripWaybackPrefix(u, base)
+		if (u.Scheme != "http" && u.Scheme != "https") || !keep(u.Host) {
+			return
+		}
+		u.Fragment = ""
+		if s := u.String(); !seen[s] {
+			seen[s] = true
+			out = append(out, s)
+		}
+	}
 
 	var walk func(*html.Node)
 	walk = func(n *html.Node) {
 		if n.Type == html.ElementNode {
-			switch n.Data {
-			case "a", "form":
-				rewriteAttr(n, attrName(n.Data), pageU, localDir, cfg, idx, false)
+			for _, a := range n.Attr {
+				switch a.Key {
+				case "href", "src", "action":
+					add(a.Val)
+				case "srcset":
+					for _, c := range parseSrcset(a.Val) {
+						add(c.URL)
+					}
+				case "style":
+					for _, ref := range cssRefs(a.Val) {
+						add(ref)
+					}
+				}
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(doc)
+	return out, nil
+}
 
-			case "img", "script", "iframe", "source", "video", "audio":
-				rewriteAttr(n, "src", pageU, localDir, cfg, idx, true)
+// splitXMLDecl splits a leading XML declaration (<?xml …?>, after an
+// optional byte order mark), with the whitespace following it, off data.
+// decl is nil when data has none.
+func splitXMLDecl(data []byte) (decl, rest []byte) {
+	b := bytes.TrimPrefix(data, []byte("\xEF\xBB\xBF"))
+	if !bytes.HasPrefix(b, []byte("<?xml")) {
+		return nil, data
+	}
+	end := bytes.Index(b, []byte("?>"))
+	if end < 0 {
+		return nil, data
+	}
+	rest = b[end+2:]
+	trimmed := bytes.TrimLeft(rest, " \t\r\n")
+	return b[:len(b)-len(trimmed)], trimmed
+}
 
+// makeXMLSafe adjusts doc so that html.Render writes well-formed XML, for
+// Config.XHTMLOutput. Render already closes void elements (<br/>) and quotes
+// every attribute; what is left is the raw text of <script> and <style>,
+// which goes into a CDATA section behind comment markers so HTML parsers
+// still run it unchanged, the raw text of the other elements Render writes
+// unescaped (<noscript>, <iframe>, <noembed>, <noframes>, <xmp>), and "--"
+// inside comments, which XML forbids. The markup in <noscript>, <noembed>
+// and <noframes> becomes child nodes (see reparseRawText); any text left
+// in those elements is escaped.
+func makeXMLSafe(doc *html.Node) {
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		switch {
+		case n.Type == html.ElementNode && (n.Data == "noscript" || n.Data == "noembed" || n.Data == "noframes"):
+			reparseRawText(n)
+		case n.Type == html.TextNode && n.Parent != nil && n.Parent.Type == html.ElementNode &&
+			(n.Parent.Data == "noscript" || n.Parent.Data == "iframe" || n.Parent.Data == "noembed" ||
+				n.Parent.Data == "noframes" || n.Parent.Data == "xmp"):
+			n.Data = html.EscapeString(n.Data)
+		case n.Type == html.CommentNode:
+			for strings.Contains(n.Data, "--") {
+				n.Data = strings.ReplaceAll(n.Data, "--", "- -")
+			}
+			n.Data = strings.TrimRight(n.Data, "-") // "x--->" would contain "--"
+		case n.Type == html.TextNode && n.Parent != nil && n.Parent.Type == html.ElementNode &&
+			(n.Parent.Data == "script" || n.Parent.Data == "style") &&
+			strings.ContainsAny(n.Data, "<&") && !strings.Contains(n.Data, "<![CDATA["):
+			if n.Parent.Data == "script" {
+				n.Data = "//<![CDATA[\n" + n.Data + "\n//]]>"
+			} else {
+				n.Data = "/*<![CDATA[*/" + n.Data + "/*]]>*/"
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(doc)
+}
+
+// reparseRawText replaces the text n holds as raw text (the parser keeps
+// the content of <noscript> as text when scripting is on) with the nodes it
+// parses into. n is left alone when it has element children already.
+func reparseRawText(n *html.Node) {
+	var text strings.Builder
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type != html.TextNode {
+			return
+		}
+		text.WriteString(c.Data)
+	}
+	if !strings.Contains(text.String(), "<") {
+		return
+	}
+	nodes, err := html.ParseFragment(strings.NewReader(text.String()), &html.Node{Type: html.ElementNode, Data: "div", DataAtom: atom.Div})
+	if err != nil {
+		return
+	}
+	for n.FirstChild != nil {
+		n.RemoveChild(n.FirstChild)
+	}
+	for _, c := range nodes {
+		n.AppendChild(c)
+	}
+}
+
+// maxSrcdocDepth bounds how deeply nested <iframe srcdoc> documents are
+// rewritten, so a pathological page cannot recurse without limit.
+const maxSrcdocDepth = 4
+
+// rewriteHTMLTree rewrites the links in the parsed document doc in place.
+// pageU is the page's URL and localDir the directory of its local copy.
+// depth counts the <iframe srcdoc> documents doc is nested in.
+func rewriteHTMLTree(doc *html.Node, pageU *url.URL, localDir string, cfg *Config, idx *SnapshotIndex, store Storage, depth int) {
+	pageURL := pageU.String()
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode {
+			switch n.Data {
 			case "link":
-				if isCanonical(n) {
-					if cfg.CanonicalAction == "remove" {
-						removeNode(n)
-						return
-					}
-				} else {
-					rewriteAttr(n, "href", pageU, localDir, cfg, idx, true)
+				if isCanonical(n) && cfg.CanonicalAction == "remove" {
+					removeNode(n)
+					return
+				}
+				// AMP alternates (and canonicals naming an AMP page) lead
+				// away from the archived page.
+				if cfg.StripAMP && (hasRel(n, "amphtml") || isCanonical(n) && isAMPURL(attrValue(n, "href"))) {
+					removeNode(n)
+					return
+				}
+				// Resource hints only trigger network lookups when browsing offline.
+				if cfg.RemovePreconnect && hasRel(n, "dns-prefetch", "preconnect") {
+					removeNode(n)
+					return
+				}
+				// NoFonts skips font files, so their preloads would point nowhere.
+				if cfg.NoFonts && hasRel(n, "preload") && strings.EqualFold(attrValue(n, "as"), "font") {
+					removeNode(n)
+					return
 				}
 
 			case "style":
 				rewriteStyleNode(n, pageURL, cfg, idx)
 
+			case "iframe":
+				if depth < maxSrcdocDepth {
+					rewriteSrcdoc(n, pageU, localDir, cfg, idx, store, depth+1)
+				}
+
 			case "base":
-				// Do not touch <base>
+				// A <base> injected by the Wayback Machine re-roots every
+				// relative link at the archive; drop it. Others are kept.
+				if isWaybackBase(n, cfg.ArchiveBase) {
+					removeNode(n)
+					return
+				}
 			}
 
-			// Inline style attribute
+			if attr, isAsset, ok := urlAttr(n); ok {
+				rewriteAttr(n, attr, pageU, localDir, cfg, idx, isAsset)
+			}
+			if n.Data == "img" || n.Data == "source" {
+				rewriteSrcset(n, pageU, localDir, cfg, idx, store)
+			}
+
+			// Inline style attribute, and onclick navigation when enabled
 			for i, a := range n.Attr {
-				if a.Key == "style" {
+				switch {
+				case a.Key == "style":
 					n.Attr[i].Val = RewriteCSSContent(a.Val, pageURL, cfg, idx)
+				case a.Key == "onclick" && cfg.RewriteOnclick:
+					n.Attr[i].Val = rewriteOnclick(a.Val, localDir, cfg, idx)
 				}
 			}
 		}
 
-		for c := n.FirstChild; c != nil; c = c.NextSibling {
+		// Capture the next sibling first: walk may detach c, which clears
+		// c.NextSibling. The content of a <template> needs no special case:
+		// x/net/html parses it as the element's children, not a separate
+		// fragment, so it is walked like any other subtree.
+		for c := n.FirstChild; c != nil; {
+			next := c.NextSibling
 			walk(c)
+			c = next
 		}
 	}
 	walk(doc)
+}
 
-	var buf bytes.Buffer
-	if err := html.Render(&buf, doc); err != nil {
-		return err
+// rewriteSrcdoc rewrites the links in the document held by n's srcdoc
+// attribute. The parser has already decoded the attribute's entities and
+// Render re-encodes them. Relative URLs in a srcdoc document resolve
+// against the embedding page, so pageU and localDir carry over.
+func rewriteSrcdoc(n *html.Node, pageU *url.URL, localDir string, cfg *Config, idx *SnapshotIndex, store Storage, depth int) {
+	for i, a := range n.Attr {
+		if a.Key != "srcdoc" {
+			continue
+		}
+		doc, err := html.Parse(strings.NewReader(a.Val))
+		if err != nil {
+			return
+		}
+		rewriteHTMLTree(doc, pageU, localDir, cfg, idx, store, depth)
+		var buf bytes.Buffer
+		if err := html.Render(&buf, doc); err != nil {
+			return
+		}
+		n.Attr[i].Val = buf.String()
+		return
+	}
+}
+
+// urlAttr returns the URL-bearing attribute of element n and whether it
+// references an embedded asset (img, script, …) rather than a navigable page
+// (a, form). ok is false for elements without a rewritable URL attribute;
+// <link rel="canonical"> is excluded because it names the page itself.
+func urlAttr(n *html.Node) (attr string, isAsset, ok bool) {
+	switch n.Data {
+	case "a", "form":
+		return attrName(n.Data), false, true
+	case "source":
+		// Only media sources (<video>, <audio>) load src; a <source> in
+		// <picture> selects images by srcset (see rewriteSrcset).
+		if n.Parent != nil && n.Parent.Type == html.ElementNode && n.Parent.Data == "picture" {
+			return "", false, false
+		}
+		return "src", true, true
+	case "img", "script", "iframe", "video", "audio":
+		return "src", true, true
+	case "link":
+		if isCanonical(n) {
+			return "", false, false
+		}
+		return "href", true, true
+	}
+	return "", false, false
+}
+
+// extractAssetURLs returns the absolute http(s) URLs of every embedded asset
+// referenced by doc — asset attributes per urlAttr, srcset candidates,
+// <style> blocks and inline style attributes — in document order without
+// duplicates. Fragments are dropped.
+func extractAssetURLs(doc *html.Node, pageU *url.URL) []string {
+	seen := make(map[string]bool)
+	var out []string
+	add := func(ref string) {
+		ref = strings.TrimSpace(ref)
+		if ref == "" || strings.HasPrefix(ref, "#") || strings.HasPrefix(ref, "data:") ||
+			strings.HasPrefix(ref, "javascript:") || strings.HasPrefix(ref, "mailto:") {
+			return
+		}
+		u, err := pageU.Parse(ref)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return
+		}
+		u.Fragment = ""
+		if s := u.String(); !seen[s] {
+			seen[s] = true
+			out = append(out, s)
+		}
+	}
+
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode {
+			if attr, isAsset, ok := urlAttr(n); ok && isAsset {
+				for _, a := range n.Attr {
+					if a.Key == attr {
+						add(a.Val)
+					}
+				}
+			}
+			if n.Data == "img" || n.Data == "source" {
+				for _, a := range n.Attr {
+					if a.Key == "srcset" {
+						for _, c := range parseSrcset(a.Val) {
+							add(c.URL)
+						}
+					}
+				}
+			}
+			if n.Data == "style" {
+				for c := n.FirstChild; c != nil; c = c.NextSibling {
+					if c.Type == html.TextNode {
+						for _, ref := range cssRefs(c.Data) {
+							add(ref)
+						}
+					}
+				}
+			}
+			for _, a := range n.Attr {
+				if a.Key == "style" {
+					for _, ref := range cssRefs(a.Val) {
+						add(ref)
+					}
+				}
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
 	}
-	return store.PutBytes(logicalPath, buf.Bytes())
+	walk(doc)
+	return out
 }
 
 // attrName returns the relevant URL attribute for a given tag name.
@@ -121,6 +476,63 @@ func isCanonical(n *html.Node) bool {
 	return false
 }
 
+// attrValue returns the value of n's attribute key, or "" when absent.
+func attrValue(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+// isAMPURL reports whether ref names an AMP page: an "amp" query parameter
+// ("?amp", "?amp=1") or an "amp" path segment ("/amp/", "/post/amp").
+func isAMPURL(ref string) bool {
+	u, err := url.Parse(strings.TrimSpace(ref))
+	if err != nil {
+		return false
+	}
+	if _, ok := u.Query()["amp"]; ok {
+		return true
+	}
+	for _, seg := range strings.Split(u.Path, "/") {
+		if strings.EqualFold(seg, "amp") {
+			return true
+		}
+	}
+	return false
+}
+
+// hasRel reports whether n's space-separated rel attribute contains any of values.
+func hasRel(n *html.Node, values ...string) bool {
+	for _, a := range n.Attr {
+		if a.Key != "rel" {
+			continue
+		}
+		for _, tok := range strings.Fields(strings.ToLower(a.Val)) {
+			for _, v := range values {
+				if tok == v {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// isWaybackBase returns true for <base href> pointing at the archive at
+// base (see archiveRoot).
+func isWaybackBase(n *html.Node, base string) bool {
+	host := strings.ToLower(archiveHostPath(base))
+	for _, a := range n.Attr {
+		if a.Key == "href" && strings.Contains(strings.ToLower(a.Val), host) {
+			return true
+		}
+	}
+	return false
+}
+
 // removeNode detaches a node from the tree.
 func removeNode(n *html.Node) {
 	if n.Parent != nil {
@@ -149,26 +561,20 @@ func rewriteAttr(n *html.Node, attr string, pageU *url.URL, localDir string,
 		if err != nil {
 			return
 		}
+		resolved = stripWaybackPrefix(resolved, cfg.ArchiveBase)
 		if resolved.Scheme != "http" && resolved.Scheme != "https" {
 			return
 		}
 
-		internal := isInternalHost(resolved.Host, cfg.BareHost)
+		internal := isInternalHost(resolved.Host, cfg)
 		if !internal {
 			// External asset: optionally queue download; leave link as-is for now
 			return
 		}
 
-		// Build local file path for the resolved URL
-		localTarget := URLToLocalPath(resolved.String(), cfg.PrettyPath)
-		localTarget = filepath.Join(cfg.Directory, filepath.FromSlash(localTarget))
-		localTarget = ToPosix(localTarget)
-
-		rel := RelativeLink(localDir, localTarget)
-		// Literal % in the filesystem path (e.g. %3F for ?) must be re-encoded
-		// so browsers decode the href to the actual on-disk filename.
-		rel = strings.ReplaceAll(rel, "%", "%25")
-		n.Attr[i].Val = rel
+		local := internalHref(resolved, localDir, cfg, idx)
+		cfg.recordRewrite(attr, val, local)
+		n.Attr[i].Val = local
 		return
 	}
 }
@@ -181,3 +587,30 @@ func rewriteStyleNode(n *html.Node, pageURL string, cfg *Config, idx *SnapshotIn
 		}
 	}
 }
+
+// onclickNavRe matches an assignment of an absolute URL to window.location
+// (or window.location.href) in an inline handler; group 2 is the URL.
+var onclickNavRe = regexp.MustCompile(`window\.location(?:\.href)?\s*=\s*(['"])(https?://[^'"\s]+)(['"])`)
+
+// rewriteOnclick points window.location assignments in the onclick handler
+// js at the local copies of internal pages. It is a heuristic: handlers
+// that build the URL any other way are returned unchanged.
+func rewriteOnclick(js, localDir string, cfg *Config, idx *SnapshotIndex) string {
+	return onclickNavRe.ReplaceAllStringFunc(js, func(m string) string {
+		sub := onclickNavRe.FindStringSubmatch(m)
+		if sub[1] != sub[3] {
+			return m
+		}
+		u, err := url.Parse(sub[2])
+		if err != nil {
+			return m
+		}
+		u = stripWaybackPrefix(u, cfg.ArchiveBase)
+		if !isInternalHost(u.Host, cfg) {
+			return m
+		}
+		local := internalHref(u, localDir, cfg, idx)
+		cfg.recordRewrite("onclick", sub[2], local)
+		return strings.Replace(m, sub[2], local, 1)
+	})
+}
@@ -1,8 +1,14 @@
 package wayback
 
 import (
+	"encoding/xml"
+	"errors"
+	"io"
+	"net/url"
 	"strings"
 	"testing"
+
+	"golang.org/x/net/html"
 )
 
 // processHTMLInTemp writes htmlContent into a LocalStorage backed by a temp
@@ -239,3 +245,530 @@ func TestProcessHTMLInlineStyleRewritten(t *testing.T) {
 		t.Errorf("rewritten filename not found in inline style\n  got: %s", out)
 	}
 }
+
+// Inline style url() values with escaped slashes must be rewritten too.
+func TestProcessHTMLInlineStyleEscapedSlashes(t *testing.T) {
+	cfg := testHTMLCfg()
+	in := `<html><body><div style="background: url(&quot;http:\/\/example.com\/img\/bg.png&quot;)"></div></body></html>`
+	out := processHTMLInTemp(t, in, "http://example.com/", cfg)
+
+	if strings.Contains(out, "example.com") {
+		t.Errorf("escaped inline style URL not rewritten\n  got: %s", out)
+	}
+	if !strings.Contains(out, "img/bg.png") {
+		t.Errorf("rewritten path not found in inline style\n  got: %s", out)
+	}
+}
+
+// A <base href> injected by the Wayback Machine must be removed; a site's own
+// <base> is left alone.
+func TestProcessHTMLWaybackBaseRemoved(t *testing.T) {
+	cfg := testHTMLCfg()
+	in := `<html><head><base href="https://web.archive.org/web/20230601000000/https://example.com/"/>` +
+		`<link rel="stylesheet" href="http://example.com/style.css"/></head>` +
+		`<body><a href="about.html">About</a></body></html>`
+	out := processHTMLInTemp(t, in, "http://example.com/", cfg)
+
+	if strings.Contains(out, "<base") || strings.Contains(out, "web.archive.org") {
+		t.Errorf("wayback <base> should have been removed\n  got: %s", out)
+	}
+	if !strings.Contains(out, `href="about.html"`) {
+		t.Errorf("relative link should survive\n  got: %s", out)
+	}
+	if !strings.Contains(out, `href="style.css"`) {
+		t.Errorf("sibling after removed <base> should still be rewritten\n  got: %s", out)
+	}
+
+	in = `<html><head><base href="https://example.com/"/></head><body></body></html>`
+	out = processHTMLInTemp(t, in, "http://example.com/", cfg)
+	if !strings.Contains(out, `<base href="https://example.com/"/>`) {
+		t.Errorf("site <base> should be kept\n  got: %s", out)
+	}
+
+	// On another archive, its own <base> and replay URLs are recognised.
+	cfg.ArchiveBase = "https://wayback.internal/"
+	in = `<html><head><base href="https://wayback.internal/web/20230601000000/https://example.com/"/></head>` +
+		`<body><img src="https://wayback.internal/web/20230601000000im_/https://example.com/logo.png"></body></html>`
+	out = processHTMLInTemp(t, in, "http://example.com/", cfg)
+	if strings.Contains(out, "<base") || !strings.Contains(out, `src="logo.png"`) {
+		t.Errorf("archive <base> and replay URL not handled for -archive-base\n  got: %s", out)
+	}
+}
+
+// extractAssetURLs must return embedded assets only (no anchors or canonical),
+// resolved against the page, including CSS references.
+func TestExtractAssetURLs(t *testing.T) {
+	in := `<html><head>` +
+		`<link rel="canonical" href="http://example.com/post.html"/>` +
+		`<link rel="stylesheet" href="/css/site.css"/>` +
+		`<style>body { background: url("img/bg.png"); }</style>` +
+		`<script src="js/app.js"></script></head><body>` +
+		`<a href="other.html">Next</a>` +
+		`<img src="img/photo.jpg#frag"/><img src="img/photo.jpg"/>` +
+		`<div style="background: url('/img/tile.gif')"></div>` +
+		`<img src="data:image/png;base64,AAAA"/>` +
+		`</body></html>`
+	doc, err := html.Parse(strings.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pageU, _ := url.Parse("http://example.com/blog/post.html")
+	got := extractAssetURLs(doc, pageU)
+	want := []string{
+		"http://example.com/css/site.css",
+		"http://example.com/blog/img/bg.png",
+		"http://example.com/blog/js/app.js",
+		"http://example.com/blog/img/photo.jpg",
+		"http://example.com/img/tile.gif",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("extractAssetURLs\n  got  %v\n  want %v", got, want)
+	}
+}
+
+// HTMLRewriter.ExtractURLs returns every internal href, src, srcset, action
+// and style reference, including navigation links, but no external ones.
+func TestHTMLRewriterExtractURLs(t *testing.T) {
+	in := `<html><head><link rel="stylesheet" href="/css/site.css"/></head><body>` +
+		`<a href="other.html#top">Next</a><a href="https://other.org/x">Out</a>` +
+		`<form action="/search"></form>` +
+		`<img src="img/a.jpg" srcset="img/a-2x.jpg 2x, /img/a-3x.jpg 3x"/>` +
+		`<div style="background: url('//www.example.com/img/tile.gif')"></div>` +
+		`<a href="https://web.archive.org/web/2020id_/http://example.com/old.html">Old</a>` +
+		`<a href="mailto:me@example.com">Mail</a>` +
+		`</body></html>`
+	cfg := testHTMLCfg()
+	got, err := HTMLRewriter{}.ExtractURLs([]byte(in), "http://example.com/blog/post.html", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"http://example.com/css/site.css",
+		"http://example.com/blog/other.html",
+		"http://example.com/search",
+		"http://example.com/blog/img/a.jpg",
+		"http://example.com/blog/img/a-2x.jpg",
+		"http://example.com/img/a-3x.jpg",
+		"http://www.example.com/img/tile.gif",
+		"http://example.com/old.html",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("ExtractURLs\n  got  %v\n  want %v", got, want)
+	}
+}
+
+// Attributes pointing at a Wayback replay of an internal URL are unwrapped.
+func TestProcessHTMLWaybackPrefixStripped(t *testing.T) {
+	cfg := testHTMLCfg()
+	in := `<html><body><img src="https://web.archive.org/web/20230601000000im_/http://example.com/img/logo.png"/></body></html>`
+	out := processHTMLInTemp(t, in, "http://example.com/", cfg)
+
+	if !strings.Contains(out, `src="img/logo.png"`) {
+		t.Errorf("wayback-prefixed img src not rewritten\n  got: %s", out)
+	}
+}
+
+// dns-prefetch and preconnect hints (external or same-host) are removed when
+// RemovePreconnect is set, and kept otherwise.
+func TestProcessHTMLRemovePreconnect(t *testing.T) {
+	in := `<html><head>` +
+		`<link rel="dns-prefetch" href="//cdn.example.com"/>` +
+		`<link rel="preconnect" href="https://fonts.googleapis.com"/>` +
+		`<link rel="preconnect" href="http://example.com" crossorigin/>` +
+		`<link rel="stylesheet" href="http://example.com/style.css"/>` +
+		`</head><body></body></html>`
+
+	cfg := testHTMLCfg()
+	cfg.RemovePreconnect = true
+	out := processHTMLInTemp(t, in, "http://example.com/", cfg)
+	if strings.Contains(out, "dns-prefetch") || strings.Contains(out, "preconnect") {
+		t.Errorf("resource hints should have been removed\n  got: %s", out)
+	}
+	if !strings.Contains(out, `href="style.css"`) {
+		t.Errorf("stylesheet should be kept and rewritten\n  got: %s", out)
+	}
+
+	out = processHTMLInTemp(t, in, "http://example.com/", testHTMLCfg())
+	if !strings.Contains(out, "dns-prefetch") || !strings.Contains(out, "preconnect") {
+		t.Errorf("resource hints should be kept by default\n  got: %s", out)
+	}
+}
+
+// With StripAMP, <link rel="amphtml"> and canonicals naming an AMP page are
+// removed, while an ordinary canonical survives -canonical keep.
+func TestProcessHTMLStripAMP(t *testing.T) {
+	cases := []struct {
+		name, link string
+		removed    bool
+	}{
+		{"amphtml", `<link rel="amphtml" href="http://example.com/post/amp/"/>`, true},
+		{"amp canonical path", `<link rel="canonical" href="http://example.com/amp/post/"/>`, true},
+		{"amp canonical query", `<link rel="canonical" href="http://example.com/post/?amp"/>`, true},
+		{"plain canonical", `<link rel="canonical" href="http://example.com/post/"/>`, false},
+		{"amp as a prefix", `<link rel="canonical" href="http://example.com/amplify/"/>`, false},
+	}
+	for _, tc := range cases {
+		in := `<html><head>` + tc.link + `</head><body></body></html>`
+		cfg := testHTMLCfg()
+		cfg.StripAMP = true
+		out := processHTMLInTemp(t, in, "http://example.com/post/", cfg)
+		if got := strings.Contains(out, "<link"); got == tc.removed {
+			t.Errorf("%s: removed = %v, want %v\n  got: %s", tc.name, !got, tc.removed, out)
+		}
+	}
+
+	in := `<html><head><link rel="amphtml" href="http://example.com/post/amp/"/></head><body></body></html>`
+	if out := processHTMLInTemp(t, in, "http://example.com/post/", testHTMLCfg()); !strings.Contains(out, "amphtml") {
+		t.Errorf("amphtml should be kept by default\n  got: %s", out)
+	}
+}
+
+// srcdocOf returns the srcdoc attribute of the first <iframe> in out.
+func srcdocOf(t *testing.T, out string) string {
+	t.Helper()
+	doc, err := html.Parse(strings.NewReader(out))
+	if err != nil {
+		t.Fatalf("parse output: %v", err)
+	}
+	var find func(*html.Node) string
+	find = func(n *html.Node) string {
+		if n.Type == html.ElementNode && n.Data == "iframe" {
+			return attrValue(n, "srcdoc")
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			if v := find(c); v != "" {
+				return v
+			}
+		}
+		return ""
+	}
+	return find(doc)
+}
+
+// Links inside an <iframe srcdoc> document are rewritten like the page's
+// own, including srcdoc documents nested inside one another.
+func TestProcessHTMLIframeSrcdoc(t *testing.T) {
+	inner := `<a href="http://example.com/about/">About</a>`
+	in := `<html><body><iframe srcdoc="` + html.EscapeString(inner) + `"></iframe></body></html>`
+	out := processHTMLInTemp(t, in, "http://example.com/", testHTMLCfg())
+	if got := srcdocOf(t, out); !strings.Contains(got, `href="about/index.html"`) {
+		t.Errorf("srcdoc link not rewritten\n  srcdoc: %s\n  got: %s", got, out)
+	}
+
+	nested := `<iframe srcdoc="` + html.EscapeString(inner) + `"></iframe>`
+	in = `<html><body><iframe srcdoc="` + html.EscapeString(nested) + `"></iframe></body></html>`
+	out = processHTMLInTemp(t, in, "http://example.com/", testHTMLCfg())
+	if got := srcdocOf(t, srcdocOf(t, out)); !strings.Contains(got, `href="about/index.html"`) {
+		t.Errorf("nested srcdoc link not rewritten\n  got: %s", out)
+	}
+}
+
+func TestHTMLCorrections(t *testing.T) {
+	cases := []struct {
+		name, in string
+		want     int
+	}{
+		{"well formed", `<!DOCTYPE html><html><head><title>t</title></head><body><p>a<br>b</p><img src="x.png"/></body></html>`, 0},
+		{"omitted wrappers and end tags", `<title>t</title><ul><li>a<li>b</ul><p>c`, 0},
+		{"stray end tag", `<body><p>a</p></div></body>`, 1},
+		{"misplaced end br", `<body>a</br>b</body>`, 2},
+		{"script text is not markup", `<script>if (a</b) {}</script>`, 0},
+	}
+	for _, tc := range cases {
+		doc, err := html.Parse(strings.NewReader(tc.in))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := htmlCorrections([]byte(tc.in), doc); got != tc.want {
+			t.Errorf("%s: htmlCorrections = %d, want %d", tc.name, got, tc.want)
+		}
+	}
+}
+
+// In strict mode a page with more corrections than HTMLMaxCorrections is left
+// byte for byte as archived.
+func TestProcessHTMLStrictParser(t *testing.T) {
+	in := `<body><a href="http://example.com/about/">About</a></div></span></body>`
+	cfg := testHTMLCfg()
+	cfg.HTMLParser, cfg.HTMLMaxCorrections = HTMLParserStrict, 1
+	if out := processHTMLInTemp(t, in, "http://example.com/", cfg); out != in {
+		t.Errorf("page should be left unrewritten\n  got: %s", out)
+	}
+
+	cfg.HTMLMaxCorrections = 2
+	if out := processHTMLInTemp(t, in, "http://example.com/", cfg); !strings.Contains(out, `href="about/index.html"`) {
+		t.Errorf("page within the limit should be rewritten\n  got: %s", out)
+	}
+}
+
+// With NoFonts, font preloads are removed and other preloads kept.
+func TestProcessHTMLNoFontsPreload(t *testing.T) {
+	in := `<html><head><link rel="preload" as="font" href="/f.woff2" crossorigin>` +
+		`<link rel="preload" as="style" href="/a.css"></head><body></body></html>`
+	cfg := testHTMLCfg()
+	cfg.NoFonts = true
+	out := processHTMLInTemp(t, in, "http://example.com/", cfg)
+	if strings.Contains(out, "f.woff2") || !strings.Contains(out, "a.css") {
+		t.Errorf("expected only the font preload removed\n  got: %s", out)
+	}
+	if out := processHTMLInTemp(t, in, "http://example.com/", testHTMLCfg()); !strings.Contains(out, "f.woff2") {
+		t.Errorf("font preload should be kept by default\n  got: %s", out)
+	}
+}
+
+// <source> children of <video> and <audio> have their same-host src
+// rewritten and keep their type; external sources stay absolute.
+func TestProcessHTMLMediaSources(t *testing.T) {
+	cfg := testHTMLCfg()
+	in := `<html><body><video controls>` +
+		`<source src="http://example.com/media/clip.webm" type="video/webm">` +
+		`<source src="/media/clip.mp4" type="video/mp4">` +
+		`<source src="https://cdn.other.org/clip.ogv" type="video/ogg">` +
+		`</video><audio><source src="media/song.mp3" type="audio/mpeg"></audio></body></html>`
+	out := processHTMLInTemp(t, in, "http://example.com/", cfg)
+	for _, want := range []string{
+		`<source src="media/clip.webm" type="video/webm"/>`,
+		`<source src="media/clip.mp4" type="video/mp4"/>`,
+		`<source src="https://cdn.other.org/clip.ogv" type="video/ogg"/>`,
+		`<source src="media/song.mp3" type="audio/mpeg"/>`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected %s\n  got: %s", want, out)
+		}
+	}
+}
+
+// A <source> in <picture> is rewritten through its srcset only.
+func TestProcessHTMLPictureSource(t *testing.T) {
+	cfg := testHTMLCfg()
+	in := `<html><body><picture><source srcset="http://example.com/a.webp 1x" src="http://example.com/b.webp">` +
+		`<img src="http://example.com/a.png"></picture></body></html>`
+	out := processHTMLInTemp(t, in, "http://example.com/", cfg)
+	if !strings.Contains(out, `srcset="a.webp 1x"`) || !strings.Contains(out, `src="http://example.com/b.webp"`) {
+		t.Errorf("picture source rewritten unexpectedly\n  got: %s", out)
+	}
+}
+
+// XHTML pages are detected by Content-Type and extension, and rewritten with
+// their XML declaration kept in front.
+func TestProcessHTMLXHTML(t *testing.T) {
+	const decl = `<?xml version="1.0" encoding="UTF-8"?>` + "\n"
+	in := decl + `<!DOCTYPE html PUBLIC "-//W3C//DTD XHTML 1.0 Strict//EN" "http://www.w3.org/TR/xhtml1/DTD/xhtml1-strict.dtd">` +
+		`<html xmlns="http://www.w3.org/1999/xhtml"><head><title>t</title></head>` +
+		`<body><a href="http://example.com/about.xhtml">About</a></body></html>`
+	for _, tc := range []struct{ path, ct string }{
+		{"page", "application/xhtml+xml; charset=utf-8"},
+		{"page.xhtml", ""},
+	} {
+		rw := DetectRewriter(tc.path, tc.ct, nil)
+		if _, ok := rw.(HTMLRewriter); !ok {
+			t.Errorf("DetectRewriter(%q, %q) = %T, want HTMLRewriter", tc.path, tc.ct, rw)
+		}
+	}
+
+	out := processHTMLInTemp(t, in, "http://example.com/", testHTMLCfg())
+	if !strings.HasPrefix(out, decl+"<!DOCTYPE html") {
+		t.Errorf("XML declaration not kept in front\n  got: %s", out)
+	}
+	if strings.Contains(out, "<!--?xml") {
+		t.Errorf("XML declaration turned into a comment\n  got: %s", out)
+	}
+	if !strings.Contains(out, `href="about.xhtml"`) {
+		t.Errorf("link not rewritten\n  got: %s", out)
+	}
+}
+
+// With RewriteOnclick, window.location assignments of internal URLs in
+// onclick handlers are pointed at the local copies; anything else is left
+// exactly as it was.
+func TestProcessHTMLRewriteOnclick(t *testing.T) {
+	cases := []struct{ name, in, want string }{
+		{"location", `window.location='http://example.com/about/'`, `window.location='about/index.html'`},
+		{"location.href", `window.location.href = "https://www.example.com/contact.html"; return false`, `window.location.href = "contact.html"; return false`},
+		{"external", `window.location='http://other.com/page'`, `window.location='http://other.com/page'`},
+		{"relative", `window.location='/about/'`, `window.location='/about/'`},
+		{"other handler", `doSomething('http://example.com/about/')`, `doSomething('http://example.com/about/')`},
+		{"mismatched quotes", `window.location='http://example.com/about/"`, `window.location='http://example.com/about/"`},
+	}
+	for _, tc := range cases {
+		in := `<html><body><a onclick="` + html.EscapeString(tc.in) + `">x</a></body></html>`
+		cfg := testHTMLCfg()
+		cfg.RewriteOnclick = true
+		out := processHTMLInTemp(t, in, "http://example.com/post/", cfg)
+		if got := onclickOf(t, out); got != tc.want {
+			t.Errorf("%s: onclick = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+
+	in := `<html><body><a onclick="window.location='http://example.com/about/'">x</a></body></html>`
+	out := processHTMLInTemp(t, in, "http://example.com/post/", testHTMLCfg())
+	if got := onclickOf(t, out); got != "window.location='http://example.com/about/'" {
+		t.Errorf("onclick should be kept by default, got %q", got)
+	}
+}
+
+// onclickOf returns the onclick attribute of the first <a> in out.
+func onclickOf(t *testing.T, out string) string {
+	t.Helper()
+	doc, err := html.Parse(strings.NewReader(out))
+	if err != nil {
+		t.Fatalf("parse output: %v", err)
+	}
+	var find func(*html.Node) string
+	find = func(n *html.Node) string {
+		if n.Type == html.ElementNode && n.Data == "a" {
+			return attrValue(n, "onclick")
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			if v := find(c); v != "" {
+				return v
+			}
+		}
+		return ""
+	}
+	return find(doc)
+}
+
+// With MaxPathDepth, links into a pathologically deep URL space point at the
+// same truncated path the downloader stores the target under.
+func TestProcessHTMLMaxPathDepth(t *testing.T) {
+	const deep = "http://example.com/shop/a/b/c/d/e/f/g/"
+	cfg := testHTMLCfg()
+	cfg.MaxPathDepth = 3
+	out := processHTMLInTemp(t, `<html><body><a href="`+deep+`">x</a></body></html>`, "http://example.com/", cfg)
+	want := localPathFor(deep, cfg)
+	if strings.Count(want, "/") != 2 {
+		t.Fatalf("localPathFor(%s) = %q, want 3 components", deep, want)
+	}
+	if !strings.Contains(out, `href="`+want+`"`) {
+		t.Errorf("link does not point at %s\n  got: %s", want, out)
+	}
+}
+
+// With XHTMLOutput, a rewritten XHTML page is still well-formed XML: void
+// elements are closed, script and style text is in CDATA sections, and
+// comments lose their "--", and the markup of <noscript> is parsed into
+// elements. Without it, the script breaks the XML.
+func TestProcessHTMLXHTMLOutput(t *testing.T) {
+	in := `<?xml version="1.0" encoding="UTF-8"?>` + "\n" +
+		`<!DOCTYPE html><html xmlns="http://www.w3.org/1999/xhtml"><head>` +
+		`<style>a::after { content: "&" }</style>` +
+		`<script>if (a < b && c) { go() }</script></head>` +
+		`<body><!-- old -- nav ---><br><img src="/logo.png" alt="logo"><input type="checkbox" checked>` +
+		`<p>a&nbsp;b &amp; c</p><a href="http://example.com/about.xhtml">About</a>` +
+		`<noscript><img src="https://px.example.org/p.gif?a=1&b=2" alt=""> on & off</noscript>` +
+		`<xmp>a < b & c</xmp><iframe>no <b>frames</b></iframe></body></html>`
+
+	cfg := testHTMLCfg()
+	cfg.XHTMLOutput = true
+	out := processHTMLInTemp(t, in, "http://example.com/", cfg)
+	if err := checkXML(out); err != nil {
+		t.Fatalf("output is not well-formed XML: %v\n%s", err, out)
+	}
+	for _, want := range []string{
+		"//<![CDATA[\nif (a < b && c) { go() }\n//]]>",
+		`/*<![CDATA[*/a::after { content: "&" }/*]]>*/`,
+		`<br/>`,
+		`href="about.xhtml"`,
+		`<noscript><img src="https://px.example.org/p.gif?a=1&amp;b=2" alt=""/> on &amp; off</noscript>`,
+		`<xmp>a &lt; b &amp; c</xmp>`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output lacks %q\n  got: %s", want, out)
+		}
+	}
+
+	if err := checkXML(processHTMLInTemp(t, in, "http://example.com/", testHTMLCfg())); err == nil {
+		t.Error("without XHTMLOutput the script should break the XML")
+	}
+}
+
+// checkXML reports whether s parses as well-formed XML.
+func checkXML(s string) error {
+	d := xml.NewDecoder(strings.NewReader(s))
+	for {
+		_, err := d.Token()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Hosts in CDNMap are internal: their URLs in markup and inline CSS are
+// rewritten to the mapped directory, other external hosts are left alone.
+func TestProcessHTMLCDNMap(t *testing.T) {
+	cfg := testHTMLCfg()
+	cfg.CDNMap = map[string]string{"cdn.example.com": "cdn", "static.example.net": "assets/static"}
+	in := `<html><head><link rel="stylesheet" href="https://cdn.example.com/css/site.css"></head><body>` +
+		`<img src="//static.example.net/img/a.png">` +
+		`<div style="background: url(https://CDN.example.com/img/bg.png)"></div>` +
+		`<script src="https://other.example.org/x.js"></script></body></html>`
+	out := processHTMLInTemp(t, in, "http://example.com/test.html", cfg)
+
+	for _, want := range []string{
+		`href="cdn/css/site.css"`,
+		`src="assets/static/img/a.png"`,
+		`url(cdn/img/bg.png)`,
+		`src="https://other.example.org/x.js"`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %s\n  got: %s", want, out)
+		}
+	}
+	if got := localPathFor("https://cdn.example.com/css/site.css?v=2", cfg); got != "cdn/css/site.css%3Fv=2" {
+		t.Errorf("localPathFor(CDN URL) = %q", got)
+	}
+}
+
+// With StripWaybackComments, the comments archiving tools leave in a page are
+// removed, along with the toolbar block; other comments stay.
+func TestProcessHTMLStripWaybackComments(t *testing.T) {
+	in := "<!-- saved from url=(0034)https://example.com/ -->\n" +
+		"<html><head>\n" +
+		"<!-- Added by HTTrack --><meta http-equiv=\"content-type\" content=\"text/html;charset=utf-8\"><!-- /Added by HTTrack -->\n" +
+		"<!-- Mirrored from example.com/ by HTTrack Website Copier/3.x [XR&CO'2014], Sat, 01 Jan 2005 00:00:00 GMT -->\n" +
+		"</head><body>\n" +
+		"<!-- BEGIN WAYBACK TOOLBAR INSERT -->\n<div id=\"wm-ipp-base\"><script>__wm.bt(650)</script></div>\n<!-- END WAYBACK TOOLBAR INSERT -->\n" +
+		"<p>content</p><!-- keep me -->\n" +
+		"</body></html>\n" +
+		"<!--\n     FILE ARCHIVED ON 12:00:00 Jan 01, 2020 AND RETRIEVED FROM THE\n     INTERNET ARCHIVE ON 12:00:00 Jan 02, 2020.\n-->\n" +
+		"<!--\nplayback timings (ms):\n  captures_list: 0.5\n  load_resource: 12.0\n-->"
+
+	for _, strip := range []bool{false, true} {
+		cfg := testHTMLCfg()
+		cfg.StripWaybackComments = strip
+		out := processHTMLInTemp(t, in, "http://example.com/", cfg)
+		for _, marker := range []string{"saved from url", "Added by HTTrack", "Mirrored from", "WAYBACK TOOLBAR", "wm-ipp-base", "FILE ARCHIVED ON", "playback timings"} {
+			if strings.Contains(out, marker) == strip {
+				t.Errorf("strip %v: %q present = %v\n  got: %s", strip, marker, !strip, out)
+			}
+		}
+		for _, want := range []string{"<p>content</p><!-- keep me -->", `<meta http-equiv="content-type"`} {
+			if !strings.Contains(out, want) {
+				t.Errorf("strip %v: missing %s\n  got: %s", strip, want, out)
+			}
+		}
+	}
+}
+
+// Links inside <template> content (web components) are rewritten like any
+// others, in <body> and in <head>.
+func TestProcessHTMLTemplateContent(t *testing.T) {
+	cfg := testHTMLCfg()
+	in := `<html><head><template id="meta"><link rel="stylesheet" href="http://example.com/css/card.css"></template></head>` +
+		`<body><template id="card"><div class="card"><img src="http://example.com/img/a.png">` +
+		`<a href="http://example.com/about/">About</a></div></template></body></html>`
+	out := processHTMLInTemp(t, in, "http://example.com/", cfg)
+
+	for _, want := range []string{`href="css/card.css"`, `src="img/a.png"`, `href="about/index.html"`} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %s\n  got: %s", want, out)
+		}
+	}
+	if !strings.Contains(out, `<template id="card"><div class="card">`) {
+		t.Errorf("template content moved out of the template\n  got: %s", out)
+	}
+}
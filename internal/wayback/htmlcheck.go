@@ -0,0 +1,85 @@
+package wayback
+
+import (
+	"bytes"
+	"io"
+
+	"golang.org/x/net/html"
+)
+
+// HTML parser modes (Config.HTMLParser).
+const (
+	HTMLParserLenient = "lenient" // rewrite whatever html.Parse makes of the markup
+	HTMLParserStrict  = "strict"  // count the parser's corrections first; see htmlCorrections
+)
+
+// voidElements never have content or an end tag.
+var voidElements = map[string]bool{
+	"area": true, "base": true, "br": true, "col": true, "embed": true, "hr": true, "img": true,
+	"input": true, "link": true, "meta": true, "param": true, "source": true, "track": true, "wbr": true,
+}
+
+// impliedElements are the wrappers the parser adds to any document that
+// leaves them out; spec-valid markup may omit them, so they are not counted.
+var impliedElements = map[string]bool{"html": true, "head": true, "body": true, "tbody": true}
+
+// htmlCorrections estimates how many structural corrections html.Parse made
+// when it turned the markup src into doc: end tags that close no open element,
+// plus the difference between the elements in the source and in the tree
+// (elements the parser inserted or dropped). Omitted html/head/body/tbody
+// wrappers and end tags are legal and not counted.
+func htmlCorrections(src []byte, doc *html.Node) int {
+	z := html.NewTokenizer(bytes.NewReader(src))
+	var open []string
+	srcElems, stray := 0, 0
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			if z.Err() != io.EOF {
+				return stray
+			}
+			break
+		}
+		name, _ := z.TagName()
+		tag := string(name)
+		switch tt {
+		case html.StartTagToken, html.SelfClosingTagToken:
+			if !impliedElements[tag] {
+				srcElems++
+			}
+			if tt == html.StartTagToken && !voidElements[tag] {
+				open = append(open, tag)
+			}
+		case html.EndTagToken:
+			i := len(open) - 1
+			for i >= 0 && open[i] != tag {
+				i--
+			}
+			if i < 0 {
+				if !impliedElements[tag] {
+					stray++
+				}
+				continue
+			}
+			open = open[:i]
+		}
+	}
+
+	treeElems := 0
+	var count func(*html.Node)
+	count = func(n *html.Node) {
+		if n.Type == html.ElementNode && !impliedElements[n.Data] {
+			treeElems++
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			count(c)
+		}
+	}
+	count(doc)
+
+	diff := treeElems - srcElems
+	if diff < 0 {
+		diff = -diff
+	}
+	return stray + diff
+}
@@ -0,0 +1,155 @@
+package wayback
+
+import (
+	"bytes"
+	"html/template"
+	"path"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// IndexFile is the logical path of the generated archive index page.
+// The leading underscore keeps it from clobbering the site's own index.html.
+const IndexFile = "_index.html"
+
+var indexTemplate = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+li { margin: .4em 0; }
+.meta { color: #666; font-size: .85em; }
+img { display: block; max-width: 240px; margin-top: .3em; border: 1px solid #ccc; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p>{{len .Pages}} page(s)</p>
+<ul>
+{{- range .Pages}}
+<li><a href="{{.Href}}">{{.Path}}</a>
+{{- if .URL}} <span class="meta">{{.Timestamp}} · {{.URL}}</span>{{end}}
+{{- if .Thumb}}<img src="{{.Thumb}}" alt="">{{end}}</li>
+{{- end}}
+</ul>
+</body>
+</html>
+`))
+
+// indexPage is one row of the generated index.
+type indexPage struct {
+	Path      string // logical path, as shown
+	Href      string // link to Path, %-escaped for browsers
+	Timestamp string // CDX timestamp, when known
+	URL       string // original URL, when known
+	Thumb     string // thumbnail link, when one was downloaded
+}
+
+// WriteIndex scans store for HTML pages and writes IndexFile, titled
+// cfg.BaseURL, linking to each of them, sorted alphabetically. manifest
+// supplies the CDX timestamp and original URL for pages downloaded in this
+// run, matched to the paths cfg stored them at (see localPathFor) and, with
+// a non-nil idx, the names merge suffixes gave them.
+func WriteIndex(store Storage, manifest []Snapshot, cfg *Config, idx *SnapshotIndex) error {
+	var merge *mergeIndex
+	if idx != nil {
+		merge = idx.merge
+	}
+	meta := make(map[string]Snapshot, len(manifest))
+	for _, s := range manifest {
+		p := merge.lookup(localPathFor(s.FileURL, cfg), s.FileURL)
+		meta[storedPath(p, cfg)] = s // as Walk names it
+	}
+	thumbs := make(map[string]bool)
+
+	var pages []indexPage
+	err := store.Walk(func(p string) error {
+		if p == IndexFile {
+			return nil
+		}
+		if strings.HasPrefix(p, ThumbnailDir+"/") {
+			thumbs[p] = true
+			return nil
+		}
+		if !isIndexablePage(store, p) {
+			return nil
+		}
+		s := meta[p]
+		pages = append(pages, indexPage{
+			Path:      p,
+			Href:      hrefForLocalPath(p),
+			Timestamp: s.Timestamp,
+			URL:       s.FileURL,
+		})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for i, pg := range pages {
+		if thumbs[thumbnailPath(pg.Path)] {
+			pages[i].Thumb = hrefForLocalPath(thumbnailPath(pg.Path))
+		}
+	}
+	sort.Slice(pages, func(i, j int) bool { return pages[i].Path < pages[j].Path })
+
+	var buf bytes.Buffer
+	if err := indexTemplate.Execute(&buf, struct {
+		Title string
+		Pages []indexPage
+	}{cfg.BaseURL, pages}); err != nil {
+		return err
+	}
+	return store.PutBytes(IndexFile, buf.Bytes())
+}
+
+// isIndexablePage reports whether the stored file at p is an HTML page:
+// by .html/.htm/.xhtml extension, or by sniffing content (see isPage) for
+// extension-less files.
+func isIndexablePage(store Storage, p string) bool {
+	name := strings.ToLower(p)
+	if i := strings.Index(name, "%3f"); i >= 0 {
+		name = name[:i] // preserve mode appends the query after the extension
+	}
+	switch path.Ext(name) {
+	case ".html", ".htm", ".xhtml":
+		return true
+	case "":
+		data, err := store.Get(p)
+		return err == nil && isPage(p, "", data[:min(len(data), 512)])
+	}
+	return false
+}
+
+// hrefForLocalPath escapes literal % in a logical path so the browser decodes
+// the link back to the on-disk name (preserve-mode names contain %3F etc.),
+// and percent-encodes the non-ASCII bytes of names written in another
+// FilenameEncoding, which need not be valid UTF-8.
+func hrefForLocalPath(p string) string {
+	p = strings.ReplaceAll(p, "%", "%25")
+	if !hasNonASCII(p) {
+		return p
+	}
+	var b strings.Builder
+	for i := 0; i < len(p); i++ {
+		if p[i] >= utf8.RuneSelf {
+			writePercent(&b, []byte{p[i]})
+		} else {
+			b.WriteByte(p[i])
+		}
+	}
+	return b.String()
+}
+
+// hasNonASCII reports whether s contains a byte outside ASCII.
+func hasNonASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,63 @@
+package wayback
+
+import (
+	"strings"
+	"testing"
+)
+
+// WriteIndex must link every HTML page (sorted), skip non-HTML files, attach
+// CDX metadata and thumbnails, and %-escape preserve-mode names.
+func TestWriteIndex(t *testing.T) {
+	dir := t.TempDir()
+	store := NewLocalStorage(dir)
+	files := map[string]string{
+		"index.html":                  "<html>home</html>",
+		"about/index.html":            "<html>about</html>",
+		"blog.example.com/index.html": "<html>blog</html>",
+		"search%3Fq=go":               "<!DOCTYPE html><html>results</html>",
+		"style.css":                   "body{}",
+		"img/logo.png":                "\x89PNG",
+		"_thumbs/index.html.png":      "\x89PNG",
+	}
+	for p, data := range files {
+		if err := store.PutBytes(p, []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	manifest := []Snapshot{
+		{FileURL: "https://example.com/about/", Timestamp: "20230601000000"},
+		{FileURL: "https://blog.example.com/", Timestamp: "20230701000000"},
+	}
+	cfg := &Config{BaseURL: "https://example.com/", BareHost: "example.com", ExtraSubdomains: []string{"blog"}, Directory: dir}
+
+	if err := WriteIndex(store, manifest, cfg, nil); err != nil {
+		t.Fatalf("WriteIndex: %v", err)
+	}
+	data, err := store.Get(IndexFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := string(data)
+
+	for _, want := range []string{
+		`<a href="about/index.html">`,
+		`<a href="index.html">`,
+		`<a href="search%253Fq=go">`,
+		"20230601000000",
+		"https://example.com/about/",
+		`<a href="blog.example.com/index.html">blog.example.com/index.html</a> <span class="meta">20230701000000 · https://blog.example.com/</span>`,
+		`<img src="_thumbs/index.html.png"`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("index missing %q\n  got: %s", want, out)
+		}
+	}
+	for _, unwanted := range []string{"style.css", "logo.png", `href="_index.html"`} {
+		if strings.Contains(out, unwanted) {
+			t.Errorf("index should not contain %q\n  got: %s", unwanted, out)
+		}
+	}
+	if strings.Index(out, `href="about/index.html"`) > strings.Index(out, `href="index.html"`) {
+		t.Errorf("pages not sorted alphabetically\n  got: %s", out)
+	}
+}
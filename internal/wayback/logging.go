@@ -0,0 +1,45 @@
+package wayback
+
+import (
+	"fmt"
+	"log"
+)
+
+// Log levels for Config.LogLevel, from most to least verbose.
+const (
+	LogDebug = "debug" // everything, including per-request URLs
+	LogInfo  = "info"  // summary messages (the default)
+	LogWarn  = "warn"  // warnings and errors
+	LogError = "error" // errors only
+)
+
+// logLevelRank orders the log levels; higher is less verbose.
+var logLevelRank = map[string]int{LogDebug: 0, LogInfo: 1, LogWarn: 2, LogError: 3}
+
+// LogEnabled reports whether messages at level are shown under c's
+// LogLevel. An empty LogLevel means LogInfo; the deprecated Debug flag
+// means LogDebug.
+func (c *Config) LogEnabled(level string) bool {
+	threshold := logLevelRank[LogInfo]
+	if c.Debug {
+		threshold = logLevelRank[LogDebug]
+	} else if r, ok := logLevelRank[c.LogLevel]; ok {
+		threshold = r
+	}
+	return logLevelRank[level] >= threshold
+}
+
+// Log writes a message at level to the standard logger if LogEnabled.
+func (c *Config) Log(level, format string, args ...any) {
+	if c.LogEnabled(level) {
+		log.Printf(format, args...)
+	}
+}
+
+// printf writes a message at level to stdout if LogEnabled; run summaries
+// go there rather than to the logger.
+func (c *Config) printf(level, format string, args ...any) {
+	if c.LogEnabled(level) {
+		fmt.Printf(format, args...)
+	}
+}
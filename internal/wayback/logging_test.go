@@ -0,0 +1,51 @@
+package wayback
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"testing"
+)
+
+// Each level shows its own messages and the less verbose ones; the
+// deprecated Debug flag enables everything.
+func TestConfigLogEnabled(t *testing.T) {
+	cases := []struct {
+		cfg  Config
+		show []string
+		hide []string
+	}{
+		{Config{}, []string{LogInfo, LogWarn, LogError}, []string{LogDebug}},
+		{Config{LogLevel: LogDebug}, []string{LogDebug, LogInfo, LogWarn, LogError}, nil},
+		{Config{LogLevel: LogWarn}, []string{LogWarn, LogError}, []string{LogDebug, LogInfo}},
+		{Config{LogLevel: LogError}, []string{LogError}, []string{LogDebug, LogInfo, LogWarn}},
+		{Config{LogLevel: LogError, Debug: true}, []string{LogDebug, LogInfo}, nil},
+	}
+	for _, tc := range cases {
+		for _, l := range tc.show {
+			if !tc.cfg.LogEnabled(l) {
+				t.Errorf("level %q, debug %v: %s messages hidden", tc.cfg.LogLevel, tc.cfg.Debug, l)
+			}
+		}
+		for _, l := range tc.hide {
+			if tc.cfg.LogEnabled(l) {
+				t.Errorf("level %q, debug %v: %s messages shown", tc.cfg.LogLevel, tc.cfg.Debug, l)
+			}
+		}
+	}
+}
+
+// At warn level, info messages are suppressed and warnings are logged.
+func TestConfigLogWarnSuppressesInfo(t *testing.T) {
+	var buf bytes.Buffer
+	prev := log.Writer()
+	log.SetOutput(&buf)
+	defer log.SetOutput(prev)
+
+	cfg := &Config{LogLevel: LogWarn}
+	cfg.Log(LogInfo, "info message")
+	cfg.Log(LogWarn, "warn message")
+	if out := buf.String(); strings.Contains(out, "info message") || !strings.Contains(out, "warn message") {
+		t.Errorf("log output = %q, want only the warning", out)
+	}
+}
@@ -0,0 +1,156 @@
+package wayback
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// MergeIndexFile is the logical path of the merge index: which URL each
+// file in a merged output directory was downloaded from.
+const MergeIndexFile = "merge.tsv"
+
+// mergeIndex records the owner of every logical path in an output directory
+// that several captures (e.g. a site and its subdomains, whose URLs map to
+// the same paths) are merged into, across runs. A nil *mergeIndex is valid;
+// place returns paths unchanged.
+type mergeIndex struct {
+	mu     sync.Mutex
+	owners map[string]string // logical path → URL it was claimed for
+}
+
+// loadMergeIndex reads MergeIndexFile from store, or returns an empty index
+// when the directory has none yet.
+func loadMergeIndex(store Storage) (*mergeIndex, error) {
+	m := &mergeIndex{owners: make(map[string]string)}
+	if !store.Exists(MergeIndexFile) {
+		return m, nil
+	}
+	data, err := store.Get(MergeIndexFile)
+	if err != nil {
+		return nil, err
+	}
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for first := true; sc.Scan(); first = false {
+		p, u, ok := strings.Cut(sc.Text(), "\t")
+		if first || !ok {
+			continue // header or blank line
+		}
+		m.owners[p] = u
+	}
+	return m, sc.Err()
+}
+
+// mergeKey identifies the resource behind rawURL independently of scheme,
+// a www. prefix and query parameter order, so re-fetching it (from any
+// variant) is recognised as the same capture.
+func mergeKey(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	return fileIDFor(u)
+}
+
+// place returns the logical path to store rawURL at. The first URL to use
+// logicalPath owns it; a different resource mapping to the same path gets a
+// "~<crc32>" suffix before the extension so it lands in a file of its own.
+// Files already on disk that the index does not know are left to the
+// caller's existence check, as without merging.
+func (m *mergeIndex) place(logicalPath, rawURL string) string {
+	if m == nil {
+		return logicalPath
+	}
+	key := mergeKey(rawURL)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	owner, ok := m.owners[logicalPath]
+	if !ok {
+		m.owners[logicalPath] = rawURL
+		return logicalPath
+	}
+	if mergeKey(owner) == key {
+		return logicalPath
+	}
+	alt := mergeAlt(logicalPath, key)
+	if _, taken := m.owners[alt]; !taken {
+		m.owners[alt] = rawURL
+	}
+	return alt
+}
+
+// lookup returns the logical path rawURL is stored at, or will be once
+// place has been called for it: logicalPath, unless another resource owns
+// it, in which case the suffixed name place gives rawURL.
+func (m *mergeIndex) lookup(logicalPath, rawURL string) string {
+	if m == nil {
+		return logicalPath
+	}
+	key := mergeKey(rawURL)
+	m.mu.Lock()
+	owner, ok := m.owners[logicalPath]
+	m.mu.Unlock()
+	if !ok || mergeKey(owner) == key {
+		return logicalPath
+	}
+	return mergeAlt(logicalPath, key)
+}
+
+// mergeAlt returns the name a resource with merge key key gets when another
+// owns logicalPath.
+func mergeAlt(logicalPath, key string) string {
+	return withSuffix(logicalPath, fmt.Sprintf("~%08x", crc32.ChecksumIEEE([]byte(key))))
+}
+
+// Len returns the number of owned paths.
+func (m *mergeIndex) Len() int {
+	if m == nil {
+		return 0
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.owners)
+}
+
+// WriteTSV writes a "path\turl" header followed by one line per owned path,
+// sorted by path.
+func (m *mergeIndex) WriteTSV(w io.Writer) error {
+	m.mu.Lock()
+	owners := make(map[string]string, len(m.owners))
+	paths := make([]string, 0, len(m.owners))
+	for p, u := range m.owners {
+		owners[p] = u
+		paths = append(paths, p)
+	}
+	m.mu.Unlock()
+	sort.Strings(paths)
+
+	if _, err := fmt.Fprintln(w, "path\turl"); err != nil {
+		return err
+	}
+	for _, p := range paths {
+		if _, err := fmt.Fprintf(w, "%s\t%s\n", p, owners[p]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// withSuffix inserts suffix into the last segment of logical path p, before
+// its extension; a preserve-mode query ("%3F…") stays after the extension.
+func withSuffix(p, suffix string) string {
+	dir, name := path.Split(p)
+	stem, query, _ := strings.Cut(name, "%3F")
+	if query != "" {
+		query = "%3F" + query
+	}
+	ext := path.Ext(stem)
+	return dir + strings.TrimSuffix(stem, ext) + suffix + ext + query
+}
@@ -0,0 +1,109 @@
+package wayback
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// The first URL owns a path; the same resource under another scheme or www.
+// keeps it, and a different resource gets a suffixed path of its own.
+func TestMergeIndexPlace(t *testing.T) {
+	m := &mergeIndex{owners: make(map[string]string)}
+	if got := m.place("index.html", "https://example.com/"); got != "index.html" {
+		t.Errorf("first owner placed at %q", got)
+	}
+	if got := m.place("index.html", "http://www.example.com/"); got != "index.html" {
+		t.Errorf("same resource placed at %q", got)
+	}
+	alt := m.place("index.html", "https://blog.example.com/")
+	if alt == "index.html" || !strings.HasPrefix(alt, "index~") || !strings.HasSuffix(alt, ".html") {
+		t.Errorf("colliding resource placed at %q, want index~<crc>.html", alt)
+	}
+	if again := m.place("index.html", "https://blog.example.com/"); again != alt {
+		t.Errorf("second placement %q differs from %q", again, alt)
+	}
+	if got := m.lookup("index.html", "https://blog.example.com/"); got != alt {
+		t.Errorf("lookup = %q, want %q", got, alt)
+	}
+	if got := m.lookup("index.html", "http://example.com/"); got != "index.html" {
+		t.Errorf("lookup of the owner = %q", got)
+	}
+	if got := (*mergeIndex)(nil).place("a.html", "https://example.com/a.html"); got != "a.html" {
+		t.Errorf("nil index changed the path: %q", got)
+	}
+}
+
+// The index written by one run is what the next run loads.
+func TestMergeIndexRoundTrip(t *testing.T) {
+	store := NewLocalStorage(t.TempDir())
+	m := &mergeIndex{owners: map[string]string{"a.html": "https://example.com/a.html", "b.css": "https://cdn.example.com/b.css"}}
+	var buf bytes.Buffer
+	if err := m.WriteTSV(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.PutBytes(MergeIndexFile, buf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	got, err := loadMergeIndex(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Len() != 2 || got.owners["b.css"] != "https://cdn.example.com/b.css" {
+		t.Errorf("loaded owners = %v", got.owners)
+	}
+}
+
+// Two captures merged into one directory keep both home pages, and each
+// links its own.
+func TestDownloadAllMerge(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/cdx/search/") {
+			host := strings.TrimSuffix(r.URL.Query().Get("url"), "/")
+			_, _ = io.WriteString(w, `[["timestamp","original"],["20200101000000","`+host+`/"]]`)
+			return
+		}
+		_, _ = io.WriteString(w, `<html><a href="/">home</a>`+r.URL.Path+"</html>")
+	}))
+	defer srv.Close()
+	useTestArchive(t, srv)
+
+	dir := t.TempDir()
+	for _, host := range []string{"example.com", "blog.example.com"} {
+		cfg := &Config{
+			BaseURL: "http://" + host + "/", Variants: []string{"http://" + host + "/"}, BareHost: host,
+			ExactURL: true, Directory: dir, Threads: 1, CDXRatePerMin: 6000, Merge: true, RewriteLinks: true,
+		}
+		if err := DownloadAll(cfg); err != nil {
+			t.Fatalf("%s: %v", host, err)
+		}
+	}
+
+	first, err := os.ReadFile(filepath.Join(dir, "index.html"))
+	if err != nil || !strings.Contains(string(first), "http://example.com/") {
+		t.Errorf("index.html = %q, %v; want the first capture", first, err)
+	}
+	m, err := loadMergeIndex(NewLocalStorage(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Len() != 2 {
+		t.Fatalf("merge index = %v, want 2 paths", m.owners)
+	}
+	for p, u := range m.owners {
+		if u == "http://blog.example.com/" {
+			data, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(p)))
+			if err != nil || !strings.Contains(string(data), "http://blog.example.com/") {
+				t.Errorf("%s = %q, %v; want the blog capture", p, data, err)
+			}
+			if want := `href="` + p + `"`; !strings.Contains(string(data), want) {
+				t.Errorf("%s = %q, want it to link itself with %s", p, data, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package wayback
+
+import (
+	"errors"
+	"time"
+)
+
+// stampedMarker is written to the output directory by a run that stamped
+// its files with their capture times (Config.KeepNewer). Without it the
+// files carry their download times, all later than their captures, and
+// a repair cannot tell edited files from the rest. The ".wbdl-" prefix
+// keeps it out of LocalStorage.Walk.
+const stampedMarker = ".wbdl-stamped"
+
+// modTimeStorage is implemented by a Storage whose files carry a
+// modification time, which Config.KeepNewer compares with capture times.
+type modTimeStorage interface {
+	// ModTime returns path's modification time; false when it has none.
+	ModTime(path string) (time.Time, bool)
+	// SetModTime sets path's modification time to t.
+	SetModTime(path string, t time.Time) error
+}
+
+// captureTime parses a CDX timestamp ("20060102150405", or a prefix of it)
+// as UTC.
+func captureTime(ts string) (time.Time, bool) {
+	const layout = "20060102150405"
+	if len(ts) < 4 || len(ts) > len(layout) {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(layout[:len(ts)], ts)
+	return t, err == nil
+}
+
+// newerThanCapture reports whether the file at path was modified after the
+// capture taken at ts, i.e. was edited after wayback-dl stamped it. It is
+// false when store keeps no modification times or ts does not parse.
+func newerThanCapture(store Storage, path, ts string) bool {
+	times, ok := store.(modTimeStorage)
+	if !ok {
+		return false
+	}
+	captured, ok := captureTime(ts)
+	if !ok {
+		return false
+	}
+	mod, ok := times.ModTime(path)
+	return ok && mod.After(captured)
+}
+
+// stampCaptureTime sets the modification time of the file at path to the
+// capture time ts, when store keeps modification times.
+func stampCaptureTime(store Storage, path, ts string) error {
+	times, ok := store.(modTimeStorage)
+	if !ok {
+		return nil
+	}
+	captured, ok := captureTime(ts)
+	if !ok {
+		return nil
+	}
+	return times.SetModTime(path, captured)
+}
+
+// stampCaptureTimes stamps every file written by this run with its capture
+// time (see stampCaptureTime), then writes stampedMarker with the current
+// time. Files skipped as already present keep theirs.
+func stampCaptureTimes(store Storage, idx *SnapshotIndex) error {
+	if _, ok := store.(modTimeStorage); !ok {
+		return nil
+	}
+	manifest := idx.GetManifest()
+	idx.mu.Lock()
+	for _, s := range manifest {
+		if f, ok := idx.files[s.FileID]; ok && f.Written {
+			if err := stampCaptureTime(store, f.LocalPath, s.Timestamp); err != nil {
+				idx.mu.Unlock()
+				return err
+			}
+		}
+	}
+	idx.mu.Unlock()
+	return store.PutBytes(stampedMarker, []byte(time.Now().UTC().Format(time.RFC3339)+"\n"))
+}
+
+// checkStamped fails when store keeps modification times but holds no
+// stampedMarker, for Config.KeepNewer in a repair: every file would look
+// modified after its capture and be skipped.
+func checkStamped(store Storage) error {
+	if _, ok := store.(modTimeStorage); !ok || store.Exists(stampedMarker) {
+		return nil
+	}
+	return errors.New("-keep-newer: the files were not downloaded with -keep-newer, so their modification times are download times and every file would be kept as edited; repair without -keep-newer, or download again with it")
+}
@@ -0,0 +1,87 @@
+package wayback
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// OutputDirData is the data an OutputDirTemplate is executed with.
+type OutputDirData struct {
+	Host  string // BareHost, e.g. "example.com"
+	Year  string // four digits
+	Month string // two digits, 01-12
+	Day   string // two digits, 01-31
+}
+
+// ParseOutputDirTemplate parses an output directory template such as
+// "archives/{{.Year}}/{{.Host}}" and checks that it only references the
+// fields of OutputDirData.
+func ParseOutputDirTemplate(text string) (*template.Template, error) {
+	tmpl, err := template.New("output-dir").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("output dir template: %w", err)
+	}
+	if err := tmpl.Execute(new(strings.Builder), OutputDirData{}); err != nil {
+		return nil, fmt.Errorf("output dir template: %w", err)
+	}
+	return tmpl, nil
+}
+
+// ExpandOutputDir executes tmpl for host and the date of t (in UTC).
+func ExpandOutputDir(tmpl *template.Template, host string, t time.Time) (string, error) {
+	t = t.UTC()
+	var b strings.Builder
+	err := tmpl.Execute(&b, OutputDirData{
+		Host:  host,
+		Year:  t.Format("2006"),
+		Month: t.Format("01"),
+		Day:   t.Format("02"),
+	})
+	if err != nil {
+		return "", fmt.Errorf("output dir template: %w", err)
+	}
+	return b.String(), nil
+}
+
+// DatedDirLayout is the time layout of the per-run subdirectory added by
+// Config.DatedDir, e.g. "20240131-154500".
+const DatedDirLayout = "20060102-150405"
+
+// datedDir returns the subdirectory of dir for a run started at t (local
+// time, as the name is meant for people filing runs by when they happened).
+func datedDir(dir string, t time.Time) string {
+	return filepath.Join(dir, t.Format(DatedDirLayout))
+}
+
+// outputDirDate returns the date an OutputDirTemplate is expanded for: the
+// start of the requested capture range (FromTimestamp, which a SnapshotDate
+// has already been resolved into, else ToTimestamp), or now when the range
+// is open.
+func outputDirDate(cfg *Config, now time.Time) time.Time {
+	for _, ts := range []string{cfg.FromTimestamp, cfg.ToTimestamp} {
+		if t, ok := parseTimestampPrefix(ts); ok {
+			return t
+		}
+	}
+	return now
+}
+
+// parseTimestampPrefix parses a possibly truncated CDX timestamp ("2020",
+// "202006", "20200601123000"); missing month and day default to 01.
+func parseTimestampPrefix(ts string) (time.Time, bool) {
+	if len(ts) < 4 {
+		return time.Time{}, false
+	}
+	ts = (ts + "0101")[:8]
+	if ts[4:6] == "00" {
+		ts = ts[:4] + "01" + ts[6:]
+	}
+	if ts[6:8] == "00" {
+		ts = ts[:6] + "01"
+	}
+	t, err := time.Parse("20060102", ts)
+	return t, err == nil
+}
@@ -0,0 +1,67 @@
+package wayback
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDatedDir(t *testing.T) {
+	at := time.Date(2024, 1, 31, 15, 45, 0, 0, time.Local)
+	if got, want := datedDir("websites/example.com", at), filepath.Join("websites", "example.com", "20240131-154500"); got != want {
+		t.Errorf("datedDir = %q, want %q", got, want)
+	}
+}
+
+func TestExpandOutputDir(t *testing.T) {
+	tmpl, err := ParseOutputDirTemplate("archives/{{.Year}}/{{.Month}}-{{.Day}}/{{.Host}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		date time.Time
+		want string
+	}{
+		{time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC), "archives/2020/06-01/example.com"},
+		{time.Date(1999, 12, 31, 23, 59, 59, 0, time.UTC), "archives/1999/12-31/example.com"},
+		// Dates are taken in UTC, like Wayback timestamps.
+		{time.Date(2023, 1, 1, 1, 0, 0, 0, time.FixedZone("UTC+3", 3*3600)), "archives/2022/12-31/example.com"},
+	}
+	for _, tc := range cases {
+		got, err := ExpandOutputDir(tmpl, "example.com", tc.date)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tc.want {
+			t.Errorf("ExpandOutputDir(%v) = %q, want %q", tc.date, got, tc.want)
+		}
+	}
+}
+
+func TestParseOutputDirTemplateRejectsBadTemplates(t *testing.T) {
+	for _, bad := range []string{"archives/{{.Year", "archives/{{.Hostname}}"} {
+		if _, err := ParseOutputDirTemplate(bad); err == nil {
+			t.Errorf("ParseOutputDirTemplate(%q): expected error", bad)
+		}
+	}
+}
+
+// The template date is the start of the capture range, falling back to now.
+func TestOutputDirDate(t *testing.T) {
+	now := time.Date(2024, 3, 9, 0, 0, 0, 0, time.UTC)
+	cases := []struct {
+		from, to string
+		want     string
+	}{
+		{"20200601000000", "20200601235959", "20200601"},
+		{"2019", "", "20190101"},
+		{"", "201805", "20180501"},
+		{"", "", "20240309"},
+	}
+	for _, tc := range cases {
+		got := outputDirDate(&Config{FromTimestamp: tc.from, ToTimestamp: tc.to}, now).Format("20060102")
+		if got != tc.want {
+			t.Errorf("outputDirDate(from=%q, to=%q) = %s, want %s", tc.from, tc.to, got, tc.want)
+		}
+	}
+}
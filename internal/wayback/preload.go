@@ -0,0 +1,89 @@
+package wayback
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// preloadRels are the Link header relations whose targets a page needs to
+// render, and that PreloadHeaders therefore downloads.
+var preloadRels = []string{"preload", "stylesheet"}
+
+// parseLinkHeader returns the targets of the entries in the HTTP Link header
+// value v (RFC 8288: `<url>; rel=preload; as=style, <url2>; rel="x y"`)
+// whose rel lists one of rels.
+func parseLinkHeader(v string, rels []string) []string {
+	var targets []string
+	for {
+		start := strings.IndexByte(v, '<')
+		if start < 0 {
+			return targets
+		}
+		end := strings.IndexByte(v[start:], '>')
+		if end < 0 {
+			return targets
+		}
+		target := strings.TrimSpace(v[start+1 : start+end])
+		v = v[start+end+1:]
+		params := v
+		if next := strings.IndexByte(v, '<'); next >= 0 {
+			params = v[:next]
+		}
+		if linkHasRel(strings.TrimRight(params, " \t,"), rels) {
+			targets = append(targets, target)
+		}
+	}
+}
+
+// linkHasRel reports whether the Link parameters params carry a rel
+// naming one of rels.
+func linkHasRel(params string, rels []string) bool {
+	for _, p := range strings.Split(params, ";") {
+		key, val, ok := strings.Cut(strings.TrimSpace(p), "=")
+		if !ok || !strings.EqualFold(strings.TrimSpace(key), "rel") {
+			continue
+		}
+		val = strings.Trim(strings.TrimSpace(val), `"`)
+		for _, r := range strings.Fields(val) {
+			for _, want := range rels {
+				if strings.EqualFold(r, want) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// preloadSnapshots returns a snapshot for every same-host asset that the
+// archived response headers h of snap preload. The archive replays the
+// original Link header either as-is or as X-Archive-Orig-Link; its own
+// memento Link entries use other relations and are ignored. Timestamps are
+// resolved through idx, falling back to the page's capture time.
+func preloadSnapshots(h http.Header, snap Snapshot, cfg *Config, idx *SnapshotIndex) []Snapshot {
+	pageU, err := url.Parse(snap.FileURL)
+	if err != nil {
+		return nil
+	}
+	var out []Snapshot
+	for _, v := range append(h.Values("Link"), h.Values("X-Archive-Orig-Link")...) {
+		for _, target := range parseLinkHeader(v, preloadRels) {
+			u, err := pageU.Parse(target)
+			if err != nil {
+				continue
+			}
+			u = stripWaybackPrefix(u, cfg.ArchiveBase)
+			if (u.Scheme != "http" && u.Scheme != "https") || !isInternalHost(u.Host, cfg) {
+				continue
+			}
+			u.Fragment = ""
+			out = append(out, Snapshot{
+				FileURL:   u.String(),
+				Timestamp: idx.Resolve(u.String(), snap.Timestamp),
+				FileID:    fileIDFor(u),
+			})
+		}
+	}
+	return out
+}
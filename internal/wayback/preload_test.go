@@ -0,0 +1,70 @@
+package wayback
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestParseLinkHeader(t *testing.T) {
+	cases := []struct {
+		in   string
+		want []string
+	}{
+		{`</css/app.css>; rel=preload; as=style`, []string{"/css/app.css"}},
+		{`</a.css>; rel="stylesheet", </font.woff2>; rel=preload; as=font; crossorigin`, []string{"/a.css", "/font.woff2"}},
+		{`<https://example.com/>; rel="original", </b.js>; rel="preconnect prefetch"`, nil},
+		{`</c.js>; REL="alternate Preload"`, []string{"/c.js"}},
+		{`no link here`, nil},
+	}
+	for _, tc := range cases {
+		if got := parseLinkHeader(tc.in, preloadRels); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("parseLinkHeader(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+// With PreloadHeaders, an asset named only in a page's archived Link header
+// is downloaded too, and one preloaded twice is fetched once.
+func TestDownloadAllPreloadHeaders(t *testing.T) {
+	var cssHits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/cdx/search/"):
+			_, _ = io.WriteString(w, `[["timestamp","original"],`+
+				`["20200101000000","http://example.com/a.html"],`+
+				`["20200101000000","http://example.com/b.html"]]`)
+		case strings.HasSuffix(r.URL.Path, ".html"):
+			w.Header().Add("X-Archive-Orig-Link", `</css/app.css>; rel=preload; as=style, <http://other.com/x.css>; rel=preload`)
+			_, _ = io.WriteString(w, "<html></html>")
+		case strings.HasSuffix(r.URL.Path, "/css/app.css"):
+			cssHits.Add(1)
+			_, _ = io.WriteString(w, "body{}")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	useTestArchive(t, srv)
+
+	dir := t.TempDir()
+	cfg := &Config{
+		BaseURL: "http://example.com/", Variants: []string{"http://example.com/"}, BareHost: "example.com",
+		ExactURL: true, Directory: dir, Threads: 1, CDXRatePerMin: 6000, PreloadHeaders: true,
+	}
+	if err := DownloadAll(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "css", "app.css")); err != nil {
+		t.Errorf("preloaded asset not stored: %v", err)
+	}
+	if n := cssHits.Load(); n != 1 {
+		t.Errorf("preloaded asset fetched %d times, want 1", n)
+	}
+}
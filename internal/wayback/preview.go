@@ -0,0 +1,43 @@
+package wayback
+
+import (
+	"net/http"
+	"path"
+	"strings"
+)
+
+// PreviewHandler returns an http.Handler serving the capture stored under dir
+// for local browsing, where file:// URLs break root-relative links and
+// guess content types from extensions. A directory request is answered with
+// its index.html. A file listed in types (logical path → Content-Type, see
+// PreviewTypes) is served as that type, which matters for extension-less
+// files; others get a type from their extension or content.
+func PreviewHandler(dir string, types map[string]string) http.Handler {
+	files := http.FileServer(http.Dir(dir))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+		if p == "" || strings.HasSuffix(r.URL.Path, "/") {
+			p = path.Join(p, "index.html")
+		}
+		if ct, ok := types[p]; ok && ct != "" {
+			w.Header().Set("Content-Type", ct)
+		}
+		files.ServeHTTP(w, r)
+	})
+}
+
+// PreviewTypes reads the Content-Type of each stored file from a manifest
+// written by Config.ManifestOut (JSON or CSV), keyed by local path.
+func PreviewTypes(manifestPath string) (map[string]string, error) {
+	recs, err := readURLMap(manifestPath)
+	if err != nil {
+		return nil, err
+	}
+	types := make(map[string]string, len(recs))
+	for _, r := range recs {
+		if r.LocalPath != "" && r.MimeType != "" {
+			types[r.LocalPath] = r.MimeType
+		}
+	}
+	return types, nil
+}
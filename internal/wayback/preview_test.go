@@ -0,0 +1,69 @@
+package wayback
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// The preview server answers directories with their index.html and takes
+// content types from the manifest, for extension-less files in particular.
+func TestPreviewHandler(t *testing.T) {
+	dir := t.TempDir()
+	for p, body := range map[string]string{
+		"index.html":      "<p>home</p>",
+		"docs/index.html": "<p>docs</p>",
+		"api/feed":        `{"items":[]}`,
+		"style.css":       "p{}",
+	} {
+		full := filepath.Join(dir, filepath.FromSlash(p))
+		if err := os.MkdirAll(filepath.Dir(full), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(full, []byte(body), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	manifest := filepath.Join(t.TempDir(), "manifest.csv")
+	csv := "timestamp,url,local_path,size_bytes,mime_type\n" +
+		"20200101000000,http://example.com/api/feed,api/feed,12,application/json\n" +
+		"20200101000000,http://example.com/,index.html,11,text/html; charset=utf-8\n"
+	if err := os.WriteFile(manifest, []byte(csv), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	types, err := PreviewTypes(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := PreviewHandler(dir, types)
+
+	for _, tc := range []struct {
+		path, body, ctype string
+	}{
+		{"/", "<p>home</p>", "text/html; charset=utf-8"},
+		{"/docs/", "<p>docs</p>", "text/html; charset=utf-8"},
+		{"/api/feed", `{"items":[]}`, "application/json"},
+		{"/style.css", "p{}", "text/css; charset=utf-8"},
+	} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", tc.path, nil))
+		if rec.Code != 200 {
+			t.Errorf("GET %s: status %d", tc.path, rec.Code)
+			continue
+		}
+		if got := rec.Body.String(); got != tc.body {
+			t.Errorf("GET %s: body %q, want %q", tc.path, got, tc.body)
+		}
+		if got := rec.Header().Get("Content-Type"); !strings.EqualFold(got, tc.ctype) {
+			t.Errorf("GET %s: Content-Type %q, want %q", tc.path, got, tc.ctype)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/missing.html", nil))
+	if rec.Code != 404 {
+		t.Errorf("GET /missing.html: status %d, want 404", rec.Code)
+	}
+}
@@ -0,0 +1,106 @@
+package wayback
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// probeRequests is how many CDX queries and capture downloads Probe makes.
+const probeRequests = 3
+
+// ProbeReport is what Probe found out about the archive.
+type ProbeReport struct {
+	CDXRequests       int           // CDX requests made, retries included
+	CDXThrottled      int           // CDX answers with 429 Too Many Requests
+	CDXLatency        time.Duration // mean duration of a CDX query, retries included
+	Capture           string        // capture URL the downloads were tested with ("" = none found)
+	DownloadRequests  int           // capture downloads made
+	DownloadThrottled int           // download answers with 429 Too Many Requests
+	DownloadStatus    int           // status of the last download
+	DownloadLatency   time.Duration // mean time until a download's response headers
+	CDXRate           int           // recommended Config.CDXRatePerMin
+	Threads           int           // recommended Config.Threads
+}
+
+// Probe checks that the archive is reachable before a big run, without
+// storing anything: it makes probeRequests one-row CDX queries for the first
+// of cfg.Variants, at cfg.CDXRatePerMin and with the usual retries, then
+// requests the capture found as many times. The report halves the CDX rate
+// or thread count in cfg when the archive throttled that kind of request,
+// and keeps them otherwise. cfg is validated first, as by DownloadAll.
+func Probe(cfg *Config) (*ProbeReport, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	if len(cfg.Variants) == 0 {
+		return nil, fmt.Errorf("probe: no URL")
+	}
+	ctx := context.Background()
+	rep := &ProbeReport{CDXRate: cfg.CDXRatePerMin, Threads: cfg.Threads}
+
+	cdxClient := newCDXClient(cfg)
+	lim := rate.NewLimiter(rate.Every(time.Minute/time.Duration(cfg.CDXRatePerMin)), probeRequests)
+	opts := cdxOptions{
+		MaxRetries:  cfg.CDXMaxRetries,
+		Timeout:     cfg.CDXRequestTimeout,
+		Endpoint:    resolveCDXEndpoint(ctx, cdxClient, lim, cdxEndpoints, cfg.CDXEndpoint, cfg.ArchiveBase, cfg.Variants[0]),
+		ArchiveBase: cfg.ArchiveBase,
+		Limit:       1,
+		Hooks: &Hooks{OnRetry: func(e RetryEvent) {
+			rep.CDXRequests++
+			if e.Status == http.StatusTooManyRequests {
+				rep.CDXThrottled++
+			}
+		}},
+	}
+	var entries []CDXEntry
+	var spent time.Duration
+	for range probeRequests {
+		start := time.Now()
+		var err error
+		entries, err = fetchCDXPage(ctx, cdxClient, lim, cfg.Variants[0], -1, opts)
+		spent += time.Since(start)
+		rep.CDXRequests++
+		if err != nil {
+			return rep, fmt.Errorf("%w: %w", ErrCDX, err)
+		}
+	}
+	rep.CDXLatency = spent / probeRequests
+	if rep.CDXThrottled > 0 {
+		rep.CDXRate = max(cfg.CDXRatePerMin/2, 1)
+	}
+	if len(entries) == 0 {
+		return rep, nil
+	}
+
+	dlClient := withMirrorHeaders(withCookies(withInsecureTLS(withTransportTuning(downloadHTTPClient, cfg), cfg), cfg), cfg)
+	rep.Capture = rawCaptureURL(cfg.ArchiveBase, entries[0].Timestamp, entries[0].OriginalURL)
+	spent = 0
+	for range probeRequests {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, rep.Capture, nil)
+		if err != nil {
+			return rep, err
+		}
+		start := time.Now()
+		resp, err := dlClient.Do(req)
+		spent += time.Since(start)
+		rep.DownloadRequests++
+		if err != nil {
+			return rep, fmt.Errorf("http get: %w", err)
+		}
+		_ = resp.Body.Close()
+		rep.DownloadStatus = resp.StatusCode
+		if resp.StatusCode == http.StatusTooManyRequests {
+			rep.DownloadThrottled++
+		}
+	}
+	rep.DownloadLatency = spent / probeRequests
+	if rep.DownloadThrottled > 0 {
+		rep.Threads = max(cfg.Threads/2, 1)
+	}
+	return rep, nil
+}
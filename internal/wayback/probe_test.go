@@ -0,0 +1,71 @@
+package wayback
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/sigman78/wayback-dl/internal/wayback/testserver"
+)
+
+// A healthy archive answers every probe and keeps the configured settings.
+func TestProbe(t *testing.T) {
+	srv := testserver.NewTestServer(t, map[string]testserver.TestEntry{
+		"http://example.com/": {Timestamp: "20200101000000", Body: "<html></html>"},
+	})
+	cfg := archiveConfig(srv, t.TempDir())
+	rep, err := Probe(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.CDXRequests != probeRequests || rep.CDXThrottled != 0 {
+		t.Errorf("CDX requests = %d, throttled = %d", rep.CDXRequests, rep.CDXThrottled)
+	}
+	if want := srv.URL + "/web/20200101000000id_/http://example.com/"; rep.Capture != want {
+		t.Errorf("capture = %q, want %q", rep.Capture, want)
+	}
+	if rep.DownloadRequests != probeRequests || rep.DownloadStatus != http.StatusOK {
+		t.Errorf("downloads = %d, last status %d", rep.DownloadRequests, rep.DownloadStatus)
+	}
+	if rep.CDXRate != cfg.CDXRatePerMin || rep.Threads != cfg.Threads {
+		t.Errorf("recommended cdx rate %d, threads %d; want the configured %d, %d", rep.CDXRate, rep.Threads, cfg.CDXRatePerMin, cfg.Threads)
+	}
+	if n := len(srv.ContentRequests()); n != probeRequests {
+		t.Errorf("%d content requests, want %d", n, probeRequests)
+	}
+}
+
+// An invalid config is rejected before any request, not divided by.
+func TestProbeInvalidConfig(t *testing.T) {
+	srv := testserver.NewTestServer(t, nil)
+	cfg := archiveConfig(srv, t.TempDir())
+	cfg.CDXRatePerMin = 0
+	if _, err := Probe(cfg); err == nil || !strings.Contains(err.Error(), "cdx rate") {
+		t.Errorf("Probe with a zero cdx rate: err = %v", err)
+	}
+	if n := len(srv.ContentRequests()); n != 0 {
+		t.Errorf("%d content requests, want none", n)
+	}
+}
+
+// Throttled downloads halve the recommended thread count.
+func TestProbeDownloadThrottled(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/cdx/") {
+			_, _ = w.Write([]byte(`[["timestamp","original"],["20200101000000","http://example.com/"]]`))
+			return
+		}
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer srv.Close()
+
+	cfg := &Config{Variants: []string{"http://example.com/"}, ArchiveBase: srv.URL, CDXEndpoint: "cdx", CDXRatePerMin: 6000, Threads: 4}
+	rep, err := Probe(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.DownloadThrottled != probeRequests || rep.Threads != 2 || rep.CDXRate != 6000 {
+		t.Errorf("throttled %d, threads %d, cdx rate %d", rep.DownloadThrottled, rep.Threads, rep.CDXRate)
+	}
+}
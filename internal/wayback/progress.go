@@ -1,22 +1,85 @@
 package wayback
 
 import (
+	"context"
+	"encoding/json"
+	"io"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/schollz/progressbar/v3"
 )
 
-// Progress is a nil-safe wrapper around progressbar.ProgressBar.
+// Progress phases, as passed to NewProgress and reported in JSON updates.
+const (
+	PhaseCDX      = "cdx"      // fetching the CDX index; one step per page
+	PhaseDownload = "download" // downloading snapshots; one step per file
+	PhaseRepair   = "repair"   // rewriting links in place (Config.Repair)
+)
+
+// Progress reports the progress of one phase, either as a progressbar on
+// stderr ("text" format) or as one JSON object per update ("json" format).
 // A nil *Progress is valid; all methods are no-ops, making it trivial
 // to disable output in tests or non-interactive pipelines.
 type Progress struct {
-	bar *progressbar.ProgressBar
+	bar  *progressbar.ProgressBar // text format
+	once sync.Once
+	done chan struct{} // closed by Finish
+
+	mu    sync.Mutex
+	state progressUpdate // running count, for JSON output and the status file
+	w     io.Writer      // json format: where updates are written
+	file  *progressFile  // optional status file sink, see WithFile
+}
+
+// progressUpdate is one line of JSON progress output.
+type progressUpdate struct {
+	Phase     string `json:"phase"`
+	Completed int    `json:"completed"`
+	Total     int    `json:"total,omitempty"` // omitted while unknown
+}
+
+// NewProgress returns the progress display for phase (PhaseCDX,
+// PhaseDownload or PhaseRepair) in format: "json" writes a progressUpdate
+// line to stderr on every step, anything else (normally "text") draws a
+// progressbar. total is the number of steps, or -1 when unknown.
+func NewProgress(format, phase string, total int) *Progress {
+	if format == "json" {
+		return newJSONProgress(os.Stderr, phase, total)
+	}
+	var p *Progress
+	switch phase {
+	case PhaseCDX:
+		p = newCDXBar()
+	case PhaseRepair:
+		p = newDownloadBar(total, "Repairing links")
+	default:
+		p = newDownloadBar(total, "[green][2/2][reset] Downloading pages")
+	}
+	p.state = progressUpdate{Phase: phase, Total: max(total, 0)}
+	return p
 }
 
-// NewCDXProgress creates an indeterminate spinner for the CDX index-fetch phase.
+// newProgress wraps bar in a Progress.
+func newProgress(bar *progressbar.ProgressBar) *Progress {
+	return &Progress{bar: bar, done: make(chan struct{})}
+}
+
+// newJSONProgress returns a Progress that writes a progressUpdate to w on
+// every step.
+func newJSONProgress(w io.Writer, phase string, total int) *Progress {
+	return &Progress{w: w, done: make(chan struct{}), state: progressUpdate{Phase: phase, Total: max(total, 0)}}
+}
+
+// emit writes the current state as one JSON line; p.mu must be held.
+func (p *Progress) emit() {
+	_ = json.NewEncoder(p.w).Encode(p.state)
+}
+
+// newCDXBar creates an indeterminate spinner for the CDX index-fetch phase.
 // Each call to Inc() advances the spinner and adds one to the page counter.
-func NewCDXProgress() *Progress {
+func newCDXBar() *Progress {
 	bar := progressbar.NewOptions(-1,
 		progressbar.OptionSetWriter(os.Stderr),
 		progressbar.OptionEnableColorCodes(true),
@@ -27,15 +90,15 @@ func NewCDXProgress() *Progress {
 		progressbar.OptionSetRenderBlankState(true),
 		progressbar.OptionClearOnFinish(),
 	)
-	return &Progress{bar: bar}
+	return newProgress(bar)
 }
 
-// NewDownloadProgress creates a determinate bar for the file-download phase.
-func NewDownloadProgress(total int) *Progress {
+// newDownloadBar creates a determinate bar for the file-download phase.
+func newDownloadBar(total int, description string) *Progress {
 	bar := progressbar.NewOptions(total,
 		progressbar.OptionSetWriter(os.Stderr),
 		progressbar.OptionEnableColorCodes(true),
-		progressbar.OptionSetDescription("[green][2/2][reset] Downloading pages"),
+		progressbar.OptionSetDescription(description),
 		progressbar.OptionShowCount(),
 		progressbar.OptionSetWidth(40),
 		progressbar.OptionThrottle(65*time.Millisecond),
@@ -44,28 +107,99 @@ func NewDownloadProgress(total int) *Progress {
 			_, _ = os.Stderr.WriteString("\n")
 		}),
 	)
-	return &Progress{bar: bar}
+	return newProgress(bar)
+}
+
+// WithFile also reports every update of p to the status file f, and
+// returns p.
+func (p *Progress) WithFile(f *progressFile) *Progress {
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	p.file = f
+	f.set(p.state.Phase, p.state.Completed, p.state.Total)
+	p.mu.Unlock()
+	return p
 }
 
-// Inc increments the progress bar by one step.
+// Inc increments the progress by one step.
 func (p *Progress) Inc() {
 	if p == nil {
 		return
 	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.state.Completed++
+	p.file.set(p.state.Phase, p.state.Completed, p.state.Total)
+	if p.w != nil {
+		p.emit()
+		return
+	}
 	_ = p.bar.Add(1)
 }
 
+// Fail records a failed step. Only the status file reports failures.
+func (p *Progress) Fail() {
+	if p == nil {
+		return
+	}
+	p.file.fail()
+}
+
+// SetMax changes the total number of steps.
 func (p *Progress) SetMax(num int) {
 	if p == nil {
 		return
 	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.state.Total = num
+	p.file.set(p.state.Phase, p.state.Completed, p.state.Total)
+	if p.w != nil {
+		p.emit()
+		return
+	}
 	p.bar.ChangeMax(num)
 }
 
-// Finish marks the bar as complete and moves to a new line.
+// SetDescription replaces the label drawn in front of the bar. The JSON
+// format has no label and ignores it.
+func (p *Progress) SetDescription(desc string) {
+	if p == nil || p.bar == nil {
+		return
+	}
+	p.bar.Describe(desc)
+}
+
+// WithContext finishes the bar as soon as ctx is cancelled, so an interrupted
+// run never leaves a half-drawn bar on the terminal. The watcher goroutine
+// exits when either ctx is done or the bar is finished normally.
+func (p *Progress) WithContext(ctx context.Context) *Progress {
+	if p == nil {
+		return nil
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			p.Finish()
+		case <-p.done:
+		}
+	}()
+	return p
+}
+
+// Finish marks the bar as complete and moves to a new line; in JSON format
+// the last update already carries the final count.
+// It is safe to call more than once and from multiple goroutines.
 func (p *Progress) Finish() {
 	if p == nil {
 		return
 	}
-	_ = p.bar.Finish()
+	p.once.Do(func() {
+		if p.bar != nil {
+			_ = p.bar.Finish()
+		}
+		close(p.done)
+	})
 }
@@ -0,0 +1,65 @@
+package wayback
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/schollz/progressbar/v3"
+)
+
+func testProgress() *Progress {
+	return newProgress(progressbar.NewOptions(10, progressbar.OptionSetWriter(io.Discard)))
+}
+
+// Cancelling the context must finish the bar.
+func TestProgressWithContextFinishesOnCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	p := testProgress().WithContext(ctx)
+	p.Inc()
+	cancel()
+
+	select {
+	case <-p.done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("bar was not finished after context cancellation")
+	}
+	// A later normal Finish must be a harmless no-op.
+	p.Finish()
+}
+
+// A nil Progress must accept every call.
+func TestProgressNilSafe(t *testing.T) {
+	var p *Progress
+	p = p.WithContext(context.Background())
+	p.Inc()
+	p.SetMax(3)
+	p.SetDescription("x")
+	p.Finish()
+}
+
+// The JSON format writes one object per update with the running count.
+func TestJSONProgress(t *testing.T) {
+	var buf bytes.Buffer
+	p := newJSONProgress(&buf, PhaseDownload, 2)
+	p.Inc()
+	p.Inc()
+	p.Finish()
+	want := `{"phase":"download","completed":1,"total":2}` + "\n" +
+		`{"phase":"download","completed":2,"total":2}` + "\n"
+	if buf.String() != want {
+		t.Errorf("got  %q\nwant %q", buf.String(), want)
+	}
+
+	buf.Reset()
+	p = newJSONProgress(&buf, PhaseCDX, -1)
+	p.Inc()
+	p.SetMax(4)
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 || lines[0] != `{"phase":"cdx","completed":1}` || lines[1] != `{"phase":"cdx","completed":1,"total":4}` {
+		t.Errorf("cdx updates = %q", lines)
+	}
+}
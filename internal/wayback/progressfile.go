@@ -0,0 +1,101 @@
+package wayback
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// progressFileInterval is how often a progressFile is rewritten.
+const progressFileInterval = time.Second
+
+// progressStatus is the content of the -progress-file status file.
+type progressStatus struct {
+	Phase   string `json:"phase"`   // PhaseCDX, PhaseDownload or PhaseRepair
+	Current int    `json:"current"` // steps completed in this phase
+	Total   int    `json:"total"`   // steps in this phase, 0 while unknown
+	Failed  int    `json:"failed"`  // failed downloads so far
+	Elapsed int64  `json:"elapsed"` // seconds since the run started
+}
+
+// progressFile keeps a small JSON status file up to date for headless
+// monitoring: it is rewritten every progressFileInterval and on Close, via a
+// temporary file and a rename so readers never see a partial write. A nil
+// *progressFile is valid and does nothing.
+type progressFile struct {
+	path  string
+	start time.Time
+
+	mu     sync.Mutex
+	status progressStatus
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// newProgressFile starts keeping the status file at path up to date.
+func newProgressFile(path string) *progressFile {
+	f := &progressFile{path: path, start: time.Now(), stop: make(chan struct{}), done: make(chan struct{})}
+	go func() {
+		defer close(f.done)
+		tick := time.NewTicker(progressFileInterval)
+		defer tick.Stop()
+		for {
+			select {
+			case <-tick.C:
+				_ = f.write()
+			case <-f.stop:
+				return
+			}
+		}
+	}()
+	return f
+}
+
+// set records the position of phase; failures are counted by fail.
+func (f *progressFile) set(phase string, current, total int) {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	f.status.Phase, f.status.Current, f.status.Total = phase, current, max(total, 0)
+	f.mu.Unlock()
+}
+
+// fail counts one failed download.
+func (f *progressFile) fail() {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	f.status.Failed++
+	f.mu.Unlock()
+}
+
+// write replaces the status file with the current status.
+func (f *progressFile) write() error {
+	f.mu.Lock()
+	s := f.status
+	f.mu.Unlock()
+	s.Elapsed = int64(time.Since(f.start) / time.Second)
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	tmp := f.path + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, f.path)
+}
+
+// Close stops the periodic updates and writes the final status.
+func (f *progressFile) Close() error {
+	if f == nil {
+		return nil
+	}
+	close(f.stop)
+	<-f.done
+	return f.write()
+}
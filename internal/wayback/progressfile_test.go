@@ -0,0 +1,49 @@
+package wayback
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Updates from a Progress reach the status file, which holds the final
+// state after Close.
+func TestProgressFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "status.json")
+	f := newProgressFile(path)
+	p := newJSONProgress(io.Discard, PhaseDownload, 3).WithFile(f)
+	p.Inc()
+	p.Inc()
+	p.Fail()
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got progressStatus
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("%v in %q", err, data)
+	}
+	want := progressStatus{Phase: PhaseDownload, Current: 2, Total: 3, Failed: 1}
+	if got != want {
+		t.Errorf("status = %+v, want %+v", got, want)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary file left behind: %v", err)
+	}
+}
+
+// A nil status file accepts every call.
+func TestProgressFileNilSafe(t *testing.T) {
+	var f *progressFile
+	f.set(PhaseCDX, 1, 2)
+	f.fail()
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
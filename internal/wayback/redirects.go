@@ -0,0 +1,84 @@
+package wayback
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// RedirectsFile is the logical path the redirect graph is written to.
+const RedirectsFile = "redirects.tsv"
+
+// RedirectHop is one archived redirect: From answered with Status and a
+// Location pointing at To. Both are original (non-Wayback) URLs.
+type RedirectHop struct {
+	From   string
+	To     string
+	Status int
+}
+
+// RedirectLog collects redirect hops from concurrent downloads.
+// A nil *RedirectLog is valid; Add is a no-op.
+type RedirectLog struct {
+	archiveBase string // archive the hops are on (see archiveRoot); "" = DefaultArchiveBase
+
+	mu   sync.Mutex
+	hops []RedirectHop
+}
+
+// Add records a hop.
+func (l *RedirectLog) Add(hop RedirectHop) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	l.hops = append(l.hops, hop)
+	l.mu.Unlock()
+}
+
+// Len returns the number of recorded hops.
+func (l *RedirectLog) Len() int {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.hops)
+}
+
+// WriteTSV writes a "from\tto\tstatus" header followed by one line per hop,
+// sorted by source URL so output is stable between runs.
+func (l *RedirectLog) WriteTSV(w io.Writer) error {
+	l.mu.Lock()
+	hops := append([]RedirectHop(nil), l.hops...)
+	l.mu.Unlock()
+
+	sort.SliceStable(hops, func(i, j int) bool { return hops[i].From < hops[j].From })
+
+	if _, err := fmt.Fprintln(w, "from\tto\tstatus"); err != nil {
+		return err
+	}
+	for _, h := range hops {
+		if _, err := fmt.Fprintf(w, "%s\t%s\t%d\n", h.From, h.To, h.Status); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkRedirect returns an http.Client CheckRedirect hook that records each
+// hop into l. Wayback-internal hops that only change the capture timestamp
+// (same original URL) are not part of the archived site's graph and are skipped.
+func (l *RedirectLog) checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return fmt.Errorf("stopped after %d redirects", len(via))
+	}
+	from := unwrapWaybackURL(via[len(via)-1].URL.String(), l.archiveBase)
+	to := unwrapWaybackURL(req.URL.String(), l.archiveBase)
+	if from != to && req.Response != nil {
+		l.Add(RedirectHop{From: from, To: to, Status: req.Response.StatusCode})
+	}
+	return nil
+}
@@ -0,0 +1,36 @@
+package wayback
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// checkRedirect must record real hops and skip timestamp-only Wayback hops.
+func TestRedirectLogCheckRedirect(t *testing.T) {
+	mkReq := func(raw string, status int) *http.Request {
+		u, _ := url.Parse(raw)
+		return &http.Request{URL: u, Response: &http.Response{StatusCode: status}}
+	}
+	l := &RedirectLog{}
+	via := []*http.Request{mkReq("https://web.archive.org/web/20230101000000id_/http://example.com/old", 0)}
+
+	// Same original URL, different timestamp: skipped.
+	if err := l.checkRedirect(mkReq("https://web.archive.org/web/20230102000000id_/http://example.com/old", 302), via); err != nil {
+		t.Fatal(err)
+	}
+	// Archived 301 to a new path: recorded.
+	if err := l.checkRedirect(mkReq("https://web.archive.org/web/20230101000000id_/http://example.com/new", 301), via); err != nil {
+		t.Fatal(err)
+	}
+
+	var sb strings.Builder
+	if err := l.WriteTSV(&sb); err != nil {
+		t.Fatal(err)
+	}
+	want := "from\tto\tstatus\nhttp://example.com/old\thttp://example.com/new\t301\n"
+	if sb.String() != want {
+		t.Errorf("WriteTSV\n  got  %q\n  want %q", sb.String(), want)
+	}
+}
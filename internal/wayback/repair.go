@@ -0,0 +1,201 @@
+package wayback
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// repairLinks runs the link rewriters over the files already stored under
+// cfg.Directory, without consulting the CDX index or downloading anything.
+// The original URL of each file comes from the cfg.URLMap manifest when it
+// lists the file, and is otherwise rebuilt from its path under cfg.BaseURL.
+// Files written by the downloader itself (index, redirects, merge index,
+// thumbnails) are skipped, as are, with cfg.KeepNewer, files modified after
+// the capture the URL map gives for them. With cfg.RewriteDryRun, nothing
+// is written back and the link changes are listed in that file instead.
+func repairLinks(cfg *Config) error {
+	store := openStorage(cfg)
+	if cfg.KeepNewer {
+		if err := checkStamped(store); err != nil {
+			return err
+		}
+	}
+
+	byPath := make(map[string]ManifestRecord)
+	if cfg.URLMap != "" {
+		recs, err := readURLMap(cfg.URLMap)
+		if err != nil {
+			return fmt.Errorf("url map: %w", err)
+		}
+		// Walk yields the names on disk; key the records by those.
+		for _, r := range recs {
+			if r.LocalPath != "" {
+				byPath[storedPath(r.LocalPath, cfg)] = r
+			}
+		}
+	}
+
+	var paths []string
+	err := store.Walk(func(p string) error {
+		if p != IndexFile && p != RedirectsFile && p != MergeIndexFile && p != stampedMarker && !strings.HasPrefix(p, ThumbnailDir+"/") {
+			paths = append(paths, p)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("walk %s: %w", cfg.Directory, err)
+	}
+
+	idx := NewSnapshotIndex()
+	origin := make(map[string]ManifestRecord, len(paths))
+	for _, p := range paths {
+		rec, ok := byPath[p]
+		if !ok {
+			rec = ManifestRecord{URL: urlForLocalPath(cfg.BaseURL, p), LocalPath: p}
+		}
+		origin[p] = rec
+		idx.Register(rec.URL, rec.Timestamp)
+	}
+
+	var statusFile *progressFile
+	if cfg.ProgressFile != "" {
+		statusFile = newProgressFile(cfg.ProgressFile)
+		defer func() { _ = statusFile.Close() }()
+	}
+	target := rewriteTarget(store, cfg)
+	if cfg.RewriteDryRun != "" {
+		target = discardStorage{Storage: store}
+		cfg.rewrites = &rewriteRecorder{}
+	}
+	prog := NewProgress(cfg.ProgressFormat, PhaseRepair, len(paths)).WithFile(statusFile)
+	var failed int
+	for _, p := range paths {
+		rec := origin[p]
+		if cfg.rewrites != nil {
+			cfg.rewrites.file = p
+		}
+		if cfg.KeepNewer && newerThanCapture(store, p, rec.Timestamp) {
+			cfg.Log(LogInfo, "keep %s: modified after its capture", p)
+			prog.Inc()
+			continue
+		}
+		data, err := store.Get(p)
+		if err != nil {
+			failed++
+			prog.Fail()
+			cfg.Log(LogError, "repair %s: %v", p, err)
+			prog.Inc()
+			continue
+		}
+		if rw := DetectRewriter(p, contentTypeFor(p, rec.MimeType, cfg), data[:min(len(data), 512)]); rw != nil {
+			if err := rw.Rewrite(target, p, rec.URL, cfg, idx); err != nil {
+				failed++
+				prog.Fail()
+				cfg.Log(LogError, "repair %s: %v", p, err)
+			} else if cfg.KeepNewer && cfg.RewriteStorage == nil && cfg.RewriteDryRun == "" {
+				// Rewritten in place: restamp, or the next repair would
+				// take the rewrite for an edit.
+				if err := stampCaptureTime(store, p, rec.Timestamp); err != nil {
+					cfg.Log(LogWarn, "repair %s: %v", p, err)
+				}
+			}
+		}
+		prog.Inc()
+	}
+	prog.Finish()
+
+	if cfg.rewrites != nil {
+		if err := writeRewriteReport(cfg.RewriteDryRun, cfg.rewrites.records); err != nil {
+			return fmt.Errorf("write rewrite report: %w", err)
+		}
+		cfg.printf(LogInfo, "Wrote %d would-be link rewrite(s) to %s.\n", len(cfg.rewrites.records), cfg.RewriteDryRun)
+	}
+	if failed > 0 {
+		return &PartialError{Failed: failed, Total: len(paths)}
+	}
+	return nil
+}
+
+// urlForLocalPath rebuilds the URL a file at logical path p was most likely
+// downloaded from: p appended to the scheme and host of baseURL, with the
+// query suffix of preserve mode ("%3F…") turned back into a query string.
+// A first directory named after a subdomain of baseURL's host (see
+// localPathFor) is taken as the host instead.
+func urlForLocalPath(baseURL, p string) string {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return baseURL
+	}
+	host := u.Host
+	if first, rest, ok := strings.Cut(p, "/"); ok && strings.HasSuffix(first, "."+hostKey(u)) {
+		host, p = first, rest
+	}
+	pathPart, query, _ := strings.Cut(p, "%3F")
+	ref := &url.URL{Scheme: u.Scheme, Host: host, RawQuery: query}
+	if unescaped, err := url.PathUnescape(pathPart); err == nil {
+		ref.Path = "/" + unescaped
+	} else {
+		ref.Path = "/" + pathPart
+	}
+	return ref.String()
+}
+
+// readURLMap reads a manifest written by -manifest-out, in JSON or CSV
+// (detected from the content), for mapping local files back to their URLs.
+func readURLMap(path string) ([]ManifestRecord, error) {
+	data, err := os.ReadFile(path) //nolint:gosec // G304: path is supplied by the user
+	if err != nil {
+		return nil, err
+	}
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("[")) {
+		var recs []ManifestRecord
+		if err := json.Unmarshal(data, &recs); err != nil {
+			return nil, err
+		}
+		return recs, nil
+	}
+
+	r := csv.NewReader(bytes.NewReader(data))
+	header, err := r.Read()
+	if err != nil {
+		return nil, err
+	}
+	col := make(map[string]int, len(header))
+	for i, name := range header {
+		col[name] = i
+	}
+	if _, ok := col["url"]; !ok {
+		return nil, fmt.Errorf("csv header has no url column")
+	}
+	if _, ok := col["local_path"]; !ok {
+		return nil, fmt.Errorf("csv header has no local_path column")
+	}
+	field := func(row []string, name string) string {
+		if i, ok := col[name]; ok && i < len(row) {
+			return row[i]
+		}
+		return ""
+	}
+	var recs []ManifestRecord
+	for {
+		row, err := r.Read()
+		if err == io.EOF {
+			return recs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		recs = append(recs, ManifestRecord{
+			Timestamp: field(row, "timestamp"),
+			URL:       field(row, "url"),
+			LocalPath: field(row, "local_path"),
+			MimeType:  field(row, "mime_type"),
+		})
+	}
+}
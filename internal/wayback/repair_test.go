@@ -0,0 +1,201 @@
+package wayback
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sigman78/wayback-dl/internal/wayback/testserver"
+)
+
+// A repair run rewrites links in stored pages and stylesheets in place and
+// leaves the downloader's own files alone.
+func TestRepairRewritesExistingFiles(t *testing.T) {
+	dir := t.TempDir()
+	store := NewLocalStorage(dir)
+	files := map[string]string{
+		"index.html":      `<html><head><link rel="stylesheet" href="http://example.com/css/site.css"></head><body><a href="https://example.com/blog/post.html">Post</a></body></html>`,
+		"blog/post.html":  `<html><body><a href="/index.html">Home</a><img src="http://www.example.com/img/a.png"></body></html>`,
+		"css/site.css":    `body { background: url(http://example.com/img/bg.png); }`,
+		IndexFile:         `<a href="http://example.com/">untouched</a>`,
+		"img/a.png":       "\x89PNG",
+		"img/bg.png":      "\x89PNG",
+		"blog/feed%3Fa=1": "not html",
+	}
+	for p, body := range files {
+		if err := store.PutBytes(p, []byte(body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sensitive := true
+	cfg := &Config{
+		BaseURL: "https://example.com/", BareHost: "example.com", Directory: dir, Repair: true,
+		Threads: 1, CDXRatePerMin: 60, CaseSensitiveFS: &sensitive,
+	}
+	if err := DownloadAll(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	read := func(p string) string {
+		b, err := store.Get(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+	for p, want := range map[string][]string{
+		"index.html":     {`href="css/site.css"`, `href="blog/post.html"`},
+		"blog/post.html": {`href="../index.html"`, `src="../img/a.png"`},
+		"css/site.css":   {`url(../img/bg.png)`},
+	} {
+		got := read(p)
+		for _, w := range want {
+			if !strings.Contains(got, w) {
+				t.Errorf("%s: missing %s\n  got: %s", p, w, got)
+			}
+		}
+	}
+	if got := read(IndexFile); got != files[IndexFile] {
+		t.Errorf("%s was modified: %s", IndexFile, got)
+	}
+}
+
+func TestURLForLocalPath(t *testing.T) {
+	cases := []struct{ path, want string }{
+		{"index.html", "https://example.com/index.html"},
+		{"blog/my%20post.html", "https://example.com/blog/my%20post.html"},
+		{"search%3Fq=go", "https://example.com/search?q=go"},
+		{"blog.example.com/about.html", "https://blog.example.com/about.html"},
+	}
+	for _, tc := range cases {
+		if got := urlForLocalPath("https://example.com/", tc.path); got != tc.want {
+			t.Errorf("urlForLocalPath(%q) = %q, want %q", tc.path, got, tc.want)
+		}
+	}
+}
+
+// readURLMap accepts both formats written by Export.
+func TestReadURLMapRoundTrip(t *testing.T) {
+	idx := NewSnapshotIndex()
+	idx.Register("http://example.com/about", "20230101000000")
+	idx.RecordFile("example.com/about", StoredFile{LocalPath: "about", MimeType: "text/html"})
+
+	for _, format := range []string{"json", "csv"} {
+		var buf bytes.Buffer
+		if err := idx.Export(&buf, format); err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(t.TempDir(), "manifest."+format)
+		if err := os.WriteFile(path, buf.Bytes(), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		recs, err := readURLMap(path)
+		if err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		if len(recs) != 1 || recs[0].URL != "http://example.com/about" || recs[0].LocalPath != "about" || recs[0].MimeType != "text/html" {
+			t.Errorf("%s: unexpected records %+v", format, recs)
+		}
+	}
+}
+
+// With KeepNewer, downloads are stamped with their capture time and a later
+// repair leaves files edited since alone.
+func TestRepairKeepNewer(t *testing.T) {
+	srv := testserver.NewTestServer(t, map[string]testserver.TestEntry{
+		"http://example.com/a.html": {Timestamp: "20200101000000", ContentType: "text/html", Body: `<a href="http://example.com/b.html">b</a>`},
+		"http://example.com/b.html": {Timestamp: "20210101000000", ContentType: "text/html", Body: `<a href="http://example.com/a.html">a</a>`},
+	})
+	dir := t.TempDir()
+	out := filepath.Join(dir, "out")
+	cfg := archiveConfig(srv, out)
+	cfg.KeepNewer = true
+	cfg.ManifestOut = filepath.Join(dir, "manifest.json")
+	if err := DownloadAll(cfg); err != nil {
+		t.Fatal(err)
+	}
+	store := NewLocalStorage(out)
+	for p, ts := range map[string]string{"a.html": "20200101000000", "b.html": "20210101000000"} {
+		want, _ := captureTime(ts)
+		if got, ok := store.ModTime(p); !ok || !got.Equal(want) {
+			t.Errorf("%s modified %v, want %v", p, got, want)
+		}
+	}
+
+	edited := `<a href="http://example.com/a.html">edited</a>`
+	if err := store.PutBytes("b.html", []byte(edited)); err != nil {
+		t.Fatal(err)
+	}
+	repair := &Config{
+		BaseURL: "http://example.com/", BareHost: "example.com", Directory: out, Repair: true,
+		URLMap: cfg.ManifestOut, KeepNewer: true, Threads: 1, CDXRatePerMin: 60,
+	}
+	if err := DownloadAll(repair); err != nil {
+		t.Fatal(err)
+	}
+	if got := readOutput(t, out, "a.html"); !strings.Contains(got, `href="b.html"`) {
+		t.Errorf("a.html not rewritten: %s", got)
+	}
+	if got := readOutput(t, out, "b.html"); got != edited {
+		t.Errorf("edited b.html was rewritten: %s", got)
+	}
+	if !newerThanCapture(store, "b.html", "20210101000000") || newerThanCapture(store, "a.html", "20200101000000") {
+		t.Error("repair left the wrong modification times")
+	}
+
+	// A mirror downloaded without KeepNewer has download times, not capture
+	// times: the repair refuses rather than skip every file.
+	plain := filepath.Join(dir, "plain")
+	cfg = archiveConfig(srv, plain)
+	if err := DownloadAll(cfg); err != nil {
+		t.Fatal(err)
+	}
+	repair.Directory = plain
+	if err := DownloadAll(repair); err == nil || !strings.Contains(err.Error(), "-keep-newer") {
+		t.Errorf("repair of an unstamped mirror: err = %v, want a -keep-newer error", err)
+	}
+}
+
+// A dry run leaves every file as it was and lists the changes the repair
+// would make, per file and attribute.
+func TestRepairRewriteDryRun(t *testing.T) {
+	dir := t.TempDir()
+	out := filepath.Join(dir, "out")
+	store := NewLocalStorage(out)
+	files := map[string]string{
+		"index.html":   `<html><body><a href="https://example.com/blog/">Blog</a><img srcset="http://example.com/a.png 2x"><a href="https://other.org/">x</a></body></html>`,
+		"css/site.css": `body { background: url(/img/bg.png); }`,
+	}
+	for p, body := range files {
+		if err := store.PutBytes(p, []byte(body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	report := filepath.Join(dir, "rewrites.tsv")
+	cfg := &Config{
+		BaseURL: "https://example.com/", BareHost: "example.com", Directory: out, Repair: true,
+		RewriteDryRun: report, Threads: 1, CDXRatePerMin: 60,
+	}
+	if err := DownloadAll(cfg); err != nil {
+		t.Fatal(err)
+	}
+	for p, body := range files {
+		if got := readOutput(t, out, p); got != body {
+			t.Errorf("%s was modified: %s", p, got)
+		}
+	}
+	got, err := os.ReadFile(report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "file\tattr\toriginal\tlocal\n" +
+		"css/site.css\tcss\t/img/bg.png\t../img/bg.png\n" +
+		"index.html\thref\thttps://example.com/blog/\tblog/index.html\n" +
+		"index.html\tsrcset\thttp://example.com/a.png\ta.png\n"
+	if string(got) != want {
+		t.Errorf("report =\n%s\nwant\n%s", got, want)
+	}
+}
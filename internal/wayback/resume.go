@@ -0,0 +1,109 @@
+package wayback
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// partialStorage is implemented by a Storage that can keep the partial file
+// of an interrupted download and continue it later (Config.AcceptRanges).
+type partialStorage interface {
+	// PartSize returns the number of bytes in path's partial file, 0 when
+	// there is none.
+	PartSize(path string) int64
+	// AppendPart appends r to path's partial file, creating it if needed.
+	// On error the bytes written so far are kept.
+	AppendPart(path string, r io.Reader) error
+	// CommitPart moves path's completed partial file into place.
+	CommitPart(path string) error
+	// RemovePart deletes path's partial file, if any.
+	RemovePart(path string) error
+}
+
+// resumeState returns the partialStorage to download logicalPath through
+// and the offset to resume it from: nil and 0 unless cfg.AcceptRanges is
+// set and store keeps partial files.
+func resumeState(store Storage, logicalPath string, cfg *Config) (partialStorage, int64) {
+	parts, ok := store.(partialStorage)
+	if !cfg.AcceptRanges || !ok {
+		return nil, 0
+	}
+	return parts, parts.PartSize(logicalPath)
+}
+
+// getCapture GETs waybackURL, asking for the bytes from offset on when
+// offset > 0; the returned offset is where the response body starts. When
+// the archive sends the whole capture (200) instead of the matching 206, or
+// refuses the range (416), the partial file is dropped and the capture
+// fetched whole. Any other answer (a 503, a 206 for other bytes) fails the
+// download and keeps the partial file for the next attempt; a 404 is
+// returned to the caller as it is.
+func getCapture(ctx context.Context, client *http.Client, waybackURL string, parts partialStorage, logicalPath string, offset int64) (*http.Response, int64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, waybackURL, nil)
+	if err != nil {
+		return nil, 0, fmt.Errorf("create request: %w", err)
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, 0, fmt.Errorf("http get: %w", err)
+	}
+	switch {
+	case offset == 0 || resp.StatusCode == http.StatusPartialContent && contentRangeStart(resp) == offset:
+		return resp, offset, nil
+	case resp.StatusCode == http.StatusOK:
+		// Ranges unsupported: the whole capture follows.
+		_ = parts.RemovePart(logicalPath)
+		return resp, 0, nil
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable:
+		// Refused, e.g. because the capture changed size: start over.
+		_ = resp.Body.Close()
+		_ = parts.RemovePart(logicalPath)
+		return getCapture(ctx, client, waybackURL, parts, logicalPath, 0)
+	case resp.StatusCode == http.StatusNotFound:
+		return resp, offset, nil
+	}
+	_ = resp.Body.Close()
+	return nil, 0, fmt.Errorf("resume at byte %d: HTTP %d for %s", offset, resp.StatusCode, waybackURL)
+}
+
+// contentRangeStart returns the first byte position of resp's Content-Range
+// ("bytes 100-199/200" → 100), or -1 when it has none.
+func contentRangeStart(resp *http.Response) int64 {
+	cr, ok := strings.CutPrefix(resp.Header.Get("Content-Range"), "bytes ")
+	if !ok {
+		return -1
+	}
+	start, _, ok := strings.Cut(cr, "-")
+	if !ok {
+		return -1
+	}
+	n, err := strconv.ParseInt(start, 10, 64)
+	if err != nil {
+		return -1
+	}
+	return n
+}
+
+// keepsPart reports whether the full download in resp goes through a
+// partial file, so that it can be resumed if interrupted: the archive must
+// accept byte ranges, and the body must be the bytes it serves, not ones
+// the client decompressed.
+func keepsPart(parts partialStorage, resp *http.Response) bool {
+	return parts != nil && resp.Header.Get("Accept-Ranges") == "bytes" && !resp.Uncompressed
+}
+
+// storePart appends r to logicalPath's partial file and, once r is read to
+// the end, moves the file into place.
+func storePart(parts partialStorage, logicalPath string, r io.Reader) error {
+	if err := parts.AppendPart(logicalPath, r); err != nil {
+		return err
+	}
+	return parts.CommitPart(logicalPath)
+}
@@ -0,0 +1,149 @@
+package wayback
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// rangeArchive serves one capture of http://example.com/big.bin with byte
+// range support. While broken is set it sends only the first half of the
+// body and drops the connection.
+type rangeArchive struct {
+	*httptest.Server
+	content []byte
+	broken  atomic.Bool
+
+	mu     sync.Mutex
+	ranges []string // Range headers of the content requests
+}
+
+func newRangeArchive(t *testing.T, content []byte) *rangeArchive {
+	a := &rangeArchive{content: content}
+	a.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/cdx/search/") {
+			_, _ = io.WriteString(w, `[["timestamp","original"],["20200101000000","http://example.com/big.bin"]]`)
+			return
+		}
+		a.mu.Lock()
+		a.ranges = append(a.ranges, r.Header.Get("Range"))
+		a.mu.Unlock()
+		if a.broken.Load() {
+			w.Header().Set("Accept-Ranges", "bytes")
+			w.Header().Set("Content-Length", strconv.Itoa(len(a.content)))
+			_, _ = w.Write(a.content[:len(a.content)/2])
+			panic(http.ErrAbortHandler)
+		}
+		http.ServeContent(w, r, "big.bin", time.Time{}, bytes.NewReader(a.content))
+	}))
+	t.Cleanup(a.Close)
+	return a
+}
+
+func (a *rangeArchive) config(dir string) *Config {
+	return &Config{
+		BaseURL: "http://example.com/", Variants: []string{"http://example.com/"}, BareHost: "example.com",
+		ExactURL: true, Directory: dir, Threads: 1, CDXRatePerMin: 6000, ArchiveBase: a.URL,
+		CDXEndpoint: "xd", AcceptRanges: true, LogLevel: LogError,
+	}
+}
+
+// An interrupted download leaves a partial file that the next run completes
+// with a Range request instead of starting over.
+func TestDownloadAllAcceptRangesResumes(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 10000)
+	a := newRangeArchive(t, content)
+	dir := t.TempDir()
+	cfg := a.config(dir)
+
+	a.broken.Store(true)
+	var partial *PartialError
+	if err := DownloadAll(cfg); !errors.As(err, &partial) {
+		t.Fatalf("interrupted run: err = %v, want a PartialError", err)
+	}
+	part := filepath.Join(dir, ".wbdl-part-big.bin")
+	info, err := os.Stat(part)
+	if err != nil || info.Size() == 0 || info.Size() >= int64(len(content)) {
+		t.Fatalf("partial file after the interrupted run: %v, %v", info, err)
+	}
+
+	a.broken.Store(false)
+	if err := DownloadAll(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(dir, "big.bin")); !bytes.Equal(got, content) {
+		t.Errorf("resumed file has %d bytes, want the %d-byte capture", len(got), len(content))
+	}
+	if _, err := os.Stat(part); !os.IsNotExist(err) {
+		t.Errorf("partial file left behind: %v", err)
+	}
+	if want := "bytes=" + strconv.FormatInt(info.Size(), 10) + "-"; a.ranges[len(a.ranges)-1] != want {
+		t.Errorf("resume request Range = %q, want %q", a.ranges[len(a.ranges)-1], want)
+	}
+}
+
+// When the archive answers a range request with the whole capture, the
+// partial file is dropped and the download starts over.
+func TestDownloadAllAcceptRangesUnsupported(t *testing.T) {
+	content := []byte("the whole capture")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/cdx/search/") {
+			_, _ = io.WriteString(w, `[["timestamp","original"],["20200101000000","http://example.com/big.bin"]]`)
+			return
+		}
+		_, _ = w.Write(content)
+	}))
+	defer srv.Close()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, ".wbdl-part-big.bin"), []byte("stale"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := (&rangeArchive{Server: srv}).config(dir)
+	if err := DownloadAll(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(dir, "big.bin")); !bytes.Equal(got, content) {
+		t.Errorf("file = %q, want %q", got, content)
+	}
+	if _, err := os.Stat(filepath.Join(dir, ".wbdl-part-big.bin")); !os.IsNotExist(err) {
+		t.Errorf("stale partial file left behind: %v", err)
+	}
+}
+
+// A resume request that fails for another reason (here a 503) fails the
+// download but keeps the partial file for the next run.
+func TestDownloadAllAcceptRangesKeepsPartOnError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/cdx/search/") {
+			_, _ = io.WriteString(w, `[["timestamp","original"],["20200101000000","http://example.com/big.bin"]]`)
+			return
+		}
+		http.Error(w, "busy", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	dir := t.TempDir()
+	part := filepath.Join(dir, ".wbdl-part-big.bin")
+	if err := os.WriteFile(part, []byte("partial"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := (&rangeArchive{Server: srv}).config(dir)
+	var partial *PartialError
+	if err := DownloadAll(cfg); !errors.As(err, &partial) {
+		t.Fatalf("err = %v, want a PartialError", err)
+	}
+	if got, err := os.ReadFile(part); err != nil || string(got) != "partial" {
+		t.Errorf("partial file = %q, %v; want it kept", got, err)
+	}
+}
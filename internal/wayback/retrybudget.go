@@ -0,0 +1,29 @@
+package wayback
+
+import "sync/atomic"
+
+// retryBudget bounds the retries a whole run may spend, so an archive that
+// is down fails the run quickly instead of every request retrying on its
+// own. It is shared by all CDX requests of a run (downloads are not
+// retried); a nil budget is unlimited.
+type retryBudget struct {
+	left atomic.Int64
+}
+
+// newRetryBudget returns a budget of n retries, or nil (unlimited) if n <= 0.
+func newRetryBudget(n int) *retryBudget {
+	if n <= 0 {
+		return nil
+	}
+	b := &retryBudget{}
+	b.left.Store(int64(n))
+	return b
+}
+
+// take spends one retry and reports whether the budget allowed it.
+func (b *retryBudget) take() bool {
+	if b == nil {
+		return true
+	}
+	return b.left.Add(-1) >= 0
+}
@@ -1,5 +1,7 @@
 package wayback
 
+import "io"
+
 // Rewriter detects and rewrites a stored resource in-place.
 type Rewriter interface {
 	// Match reports whether this rewriter handles the given resource.
@@ -9,8 +11,9 @@ type Rewriter interface {
 }
 
 // rewriters is the ordered list of all known rewriter types.
-// DetectRewriter tries them in order and returns the first match.
-var rewriters = []Rewriter{HTMLRewriter{}, CSSRewriter{}}
+// DetectRewriter tries them in order and returns the first match. FeedRewriter
+// precedes HTMLRewriter, whose markup sniffing would also claim XML feeds.
+var rewriters = []Rewriter{FeedRewriter{}, HTMLRewriter{}, CSSRewriter{}, JSRewriter{}}
 
 // DetectRewriter returns the Rewriter appropriate for the given resource,
 // or nil when no rewriting is needed.
@@ -22,3 +25,24 @@ func DetectRewriter(logicalPath, contentType string, firstBytes []byte) Rewriter
 	}
 	return nil
 }
+
+// rewriteStorage is the Storage rewriters work on when their output goes to
+// a separate Storage: it reads the originals from the embedded Storage and
+// writes the rewritten files to out, leaving the originals untouched.
+type rewriteStorage struct {
+	Storage
+	out Storage
+}
+
+func (s rewriteStorage) Put(path string, r io.Reader) error { return s.out.Put(path, r) }
+
+func (s rewriteStorage) PutBytes(path string, data []byte) error { return s.out.PutBytes(path, data) }
+
+// rewriteTarget returns the Storage rewriters use for files in store: store
+// itself, or a rewriteStorage writing to cfg.RewriteStorage when it is set.
+func rewriteTarget(store Storage, cfg *Config) Storage {
+	if cfg.RewriteStorage == nil {
+		return store
+	}
+	return rewriteStorage{Storage: store, out: cfg.RewriteStorage}
+}
@@ -0,0 +1,57 @@
+package wayback
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// rewriteRecord is one link a rewriter changed (or, in a dry run, would
+// change): in File, the Original reference of Attr became Local.
+type rewriteRecord struct {
+	File     string // logical path of the rewritten file
+	Attr     string // HTML attribute, or "css", "onclick", "feed" or "sourcemap"
+	Original string
+	Local    string
+}
+
+// rewriteRecorder collects the changes of a repair walk for
+// Config.RewriteDryRun. The walk is sequential and sets file before each
+// rewrite.
+type rewriteRecorder struct {
+	file    string
+	records []rewriteRecord
+}
+
+// recordRewrite notes that the rewriter turned orig into local in attr, when
+// cfg is recording and the reference actually changed.
+func (c *Config) recordRewrite(attr, orig, local string) {
+	if c.rewrites == nil || orig == local {
+		return
+	}
+	c.rewrites.records = append(c.rewrites.records, rewriteRecord{File: c.rewrites.file, Attr: attr, Original: orig, Local: local})
+}
+
+// discardStorage is the Storage a dry run rewrites through: it reads the
+// stored files and drops whatever is written back.
+type discardStorage struct {
+	Storage
+}
+
+func (discardStorage) Put(string, io.Reader) error { return nil }
+
+func (discardStorage) PutBytes(string, []byte) error { return nil }
+
+// writeRewriteReport writes recs to the OS file at path as TSV, one row per
+// change under a "file attr original local" header. Tabs and newlines in the
+// references are replaced by spaces.
+func writeRewriteReport(path string, recs []rewriteRecord) error {
+	clean := strings.NewReplacer("\t", " ", "\n", " ", "\r", " ")
+	var b strings.Builder
+	b.WriteString("file\tattr\toriginal\tlocal\n")
+	for _, r := range recs {
+		fmt.Fprintf(&b, "%s\t%s\t%s\t%s\n", r.File, r.Attr, clean.Replace(r.Original), clean.Replace(r.Local))
+	}
+	return os.WriteFile(path, []byte(b.String()), 0600)
+}
@@ -0,0 +1,129 @@
+package wayback
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Schedule is a daily time-of-day window used to throttle downloads.
+// Times are wall-clock offsets from local midnight; a window whose end is
+// before its start wraps past midnight (e.g. 22:00-06:00).
+type Schedule struct {
+	Start, End time.Duration
+	OffPeak    bool // true: the window is off-peak (full speed); false: the window is peak
+}
+
+// ParseSchedule parses "off-peak:HH:MM-HH:MM" or "peak:HH:MM-HH:MM".
+func ParseSchedule(s string) (*Schedule, error) {
+	kind, window, ok := strings.Cut(strings.TrimSpace(s), ":")
+	if !ok {
+		return nil, fmt.Errorf("schedule %q: want off-peak:HH:MM-HH:MM or peak:HH:MM-HH:MM", s)
+	}
+	sched := &Schedule{}
+	switch strings.ToLower(kind) {
+	case "off-peak", "offpeak":
+		sched.OffPeak = true
+	case "peak":
+	default:
+		return nil, fmt.Errorf("schedule %q: unknown window kind %q", s, kind)
+	}
+	from, to, ok := strings.Cut(window, "-")
+	if !ok {
+		return nil, fmt.Errorf("schedule %q: missing '-' in time range", s)
+	}
+	var err error
+	if sched.Start, err = parseClock(from); err != nil {
+		return nil, fmt.Errorf("schedule %q: %w", s, err)
+	}
+	if sched.End, err = parseClock(to); err != nil {
+		return nil, fmt.Errorf("schedule %q: %w", s, err)
+	}
+	if sched.Start == sched.End {
+		return nil, fmt.Errorf("schedule %q: empty time range", s)
+	}
+	return sched, nil
+}
+
+// parseClock parses "HH:MM" into an offset from midnight.
+func parseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q (want HH:MM)", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// inWindow reports whether t's time of day falls inside [Start, End).
+func (s *Schedule) inWindow(t time.Time) bool {
+	tod := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute +
+		time.Duration(t.Second())*time.Second
+	if s.Start < s.End {
+		return tod >= s.Start && tod < s.End
+	}
+	return tod >= s.Start || tod < s.End
+}
+
+// IsPeak reports whether t falls in peak hours.
+func (s *Schedule) IsPeak(t time.Time) bool {
+	return s.inWindow(t) != s.OffPeak
+}
+
+// untilOffPeak returns how long from t until peak hours end.
+func (s *Schedule) untilOffPeak(t time.Time) time.Duration {
+	boundary := s.Start // peak window given: it ends at End; off-peak window: peak ends at Start
+	if !s.OffPeak {
+		boundary = s.End
+	}
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	next := midnight.Add(boundary)
+	if !next.After(t) {
+		next = next.Add(24 * time.Hour)
+	}
+	return next.Sub(t)
+}
+
+// scheduledLimiter gates downloads according to a Schedule: off-peak requests
+// pass straight through; peak requests are throttled by peak, or paused until
+// off-peak hours when peak is nil. A nil *scheduledLimiter never blocks.
+type scheduledLimiter struct {
+	sched *Schedule
+	peak  *rate.Limiter
+	now   func() time.Time
+	// maxSleep bounds a single pause so clock changes are noticed.
+	maxSleep time.Duration
+}
+
+// newScheduledLimiter returns a limiter for sched. peakPerMin is the request
+// rate allowed during peak hours; 0 pauses downloads entirely.
+func newScheduledLimiter(sched *Schedule, peakPerMin int) *scheduledLimiter {
+	l := &scheduledLimiter{sched: sched, now: time.Now, maxSleep: time.Minute}
+	if peakPerMin > 0 {
+		l.peak = rate.NewLimiter(rate.Every(time.Minute/time.Duration(peakPerMin)), 1)
+	}
+	return l
+}
+
+// Wait blocks until a download may start or ctx is done.
+func (l *scheduledLimiter) Wait(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	for {
+		now := l.now()
+		if !l.sched.IsPeak(now) {
+			return nil
+		}
+		if l.peak != nil {
+			return l.peak.Wait(ctx)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(min(l.sched.untilOffPeak(now), l.maxSleep)):
+		}
+	}
+}
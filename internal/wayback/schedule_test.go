@@ -0,0 +1,81 @@
+package wayback
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func at(hh, mm int) time.Time {
+	return time.Date(2024, 3, 5, hh, mm, 0, 0, time.Local)
+}
+
+func TestParseScheduleIsPeak(t *testing.T) {
+	offPeak, err := ParseSchedule("off-peak:22:00-06:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	peak, err := ParseSchedule("peak:09:00-17:30")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		sched *Schedule
+		t     time.Time
+		want  bool
+	}{
+		{offPeak, at(23, 0), false},
+		{offPeak, at(3, 0), false},
+		{offPeak, at(6, 0), true},
+		{offPeak, at(12, 0), true},
+		{peak, at(8, 59), false},
+		{peak, at(9, 0), true},
+		{peak, at(17, 29), true},
+		{peak, at(17, 30), false},
+	}
+	for _, tc := range cases {
+		if got := tc.sched.IsPeak(tc.t); got != tc.want {
+			t.Errorf("%+v IsPeak(%s) = %v, want %v", *tc.sched, tc.t.Format("15:04"), got, tc.want)
+		}
+	}
+
+	for _, bad := range []string{"", "night:22:00-06:00", "off-peak:22:00", "peak:25:00-06:00", "peak:10:00-10:00"} {
+		if _, err := ParseSchedule(bad); err == nil {
+			t.Errorf("ParseSchedule(%q): expected error", bad)
+		}
+	}
+}
+
+func TestScheduleUntilOffPeak(t *testing.T) {
+	sched, _ := ParseSchedule("off-peak:22:00-06:00")
+	if got := sched.untilOffPeak(at(21, 0)); got != time.Hour {
+		t.Errorf("untilOffPeak(21:00) = %v, want 1h", got)
+	}
+	sched, _ = ParseSchedule("peak:09:00-17:00")
+	if got := sched.untilOffPeak(at(16, 30)); got != 30*time.Minute {
+		t.Errorf("untilOffPeak(16:30) = %v, want 30m", got)
+	}
+}
+
+// Off-peak passes immediately; peak with a zero rate pauses until ctx ends.
+func TestScheduledLimiterWait(t *testing.T) {
+	sched, _ := ParseSchedule("off-peak:22:00-06:00")
+	l := newScheduledLimiter(sched, 0)
+
+	l.now = func() time.Time { return at(23, 0) }
+	if err := l.Wait(context.Background()); err != nil {
+		t.Fatalf("off-peak Wait: %v", err)
+	}
+
+	l.now = func() time.Time { return at(12, 0) }
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := l.Wait(ctx); err == nil {
+		t.Fatal("peak Wait with zero rate should block until ctx is done")
+	}
+
+	var nilLimiter *scheduledLimiter
+	if err := nilLimiter.Wait(context.Background()); err != nil {
+		t.Fatalf("nil limiter Wait: %v", err)
+	}
+}
@@ -1,25 +1,87 @@
 package wayback
 
 import (
+	"container/heap"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
 	"net/url"
+	"slices"
 	"sort"
+	"strconv"
+	"strings"
+	"sync"
 )
 
 // Snapshot represents a single archived file to download.
 type Snapshot struct {
 	FileURL   string // original URL
 	Timestamp string // CDX timestamp string
-	FileID    string // decoded URL path (deduplication key)
+	FileID    string // canonical host+path+query (deduplication key, see fileIDFor)
 }
 
 // SnapshotIndex deduplicates CDX entries and builds lookup maps.
 type SnapshotIndex struct {
-	byPath         map[string]Snapshot // path → latest snapshot
-	byPathAndQuery map[string]Snapshot // path+query → latest snapshot
+	byPath         map[string]Snapshot // host+path → latest snapshot
+	byPathAndQuery map[string]Snapshot // host+path+query → latest snapshot
 	manifest       []Snapshot          // sorted newest-first (lazy)
 	lookupPath     map[string]string   // path → timestamp (lazy)
 	lookupQuery    map[string]string   // path+query → timestamp (lazy)
 	built          bool
+
+	mu         sync.Mutex
+	files      map[string]StoredFile // FileID → what was written for it
+	downloaded map[string]struct{}   // logical paths known to be stored
+
+	merge *mergeIndex // path owners in Config.Merge mode, nil otherwise
+
+	// MaxSize caps the captures Register keeps; once reached, the oldest is
+	// evicted for each newer one. 0 = unlimited.
+	MaxSize     int
+	oldest      captureHeap             // byPathAndQuery keys, oldest on top (MaxSize > 0)
+	heapPos     map[string]*heapEntry   // byPathAndQuery key → its heap entry
+	pathEntries map[string][]*heapEntry // byPath key → heap entries of its query variants
+	evicted     int
+}
+
+// StoredFile describes the local copy of a downloaded snapshot.
+type StoredFile struct {
+	LocalPath string // logical storage path
+	Size      int64  // bytes written, 0 when unknown
+	MimeType  string // Content-Type reported by the archive
+	Written   bool   // stored by this run, not skipped as already present
+}
+
+// fileIDFor returns the deduplication key of u: pathKeyFor(u) plus the raw
+// query with its parameters sorted, so "/about/?b=2&a=1" and "/About?a=1&b=2"
+// share a key.
+func fileIDFor(u *url.URL) string {
+	id := pathKeyFor(u)
+	if u.RawQuery != "" {
+		params := strings.Split(u.RawQuery, "&")
+		sort.Strings(params)
+		id += "?" + strings.Join(params, "&")
+	}
+	return id
+}
+
+// pathKeyFor returns the path key of u in a SnapshotIndex: pathIDFor(u)
+// behind the host (see hostKey), so the same path on two hosts, such as
+// example.com/ and blog.example.com/, stays two captures. The scheme and a
+// www. prefix are left out, so those variants still share a key.
+func pathKeyFor(u *url.URL) string {
+	return hostKey(u) + pathIDFor(u)
+}
+
+// pathIDFor returns the decoded path of u lower-cased and without trailing
+// slashes; the root (and an empty path) is "/".
+func pathIDFor(u *url.URL) string {
+	p := strings.ToLower(strings.TrimRight(u.Path, "/"))
+	if p == "" {
+		return "/"
+	}
+	return p
 }
 
 // NewSnapshotIndex creates an empty index.
@@ -27,21 +89,51 @@ func NewSnapshotIndex() *SnapshotIndex {
 	return &SnapshotIndex{
 		byPath:         make(map[string]Snapshot),
 		byPathAndQuery: make(map[string]Snapshot),
+		files:          make(map[string]StoredFile),
+		downloaded:     make(map[string]struct{}),
 	}
 }
 
 // Register adds a CDX entry to the index, keeping the lexicographically greatest timestamp.
+// A #fragment of rawURL is dropped, so it never reaches the download URL.
+// Registering after GetManifest makes the next call rebuild the manifest.
 func (idx *SnapshotIndex) Register(rawURL, timestamp string) {
+	idx.invalidate()
+	idx.add(rawURL, timestamp)
+}
+
+// Import registers every CDX entry, as a Register call for each would, in
+// one pass: the manifest is invalidated once, and an empty index sizes its
+// maps for entries up front. Only the URL and timestamp of an entry are
+// indexed.
+func (idx *SnapshotIndex) Import(entries []CDXEntry) {
+	idx.invalidate()
+	if len(idx.byPath) == 0 && len(idx.byPathAndQuery) == 0 && len(entries) > 0 {
+		idx.byPath = make(map[string]Snapshot, len(entries))
+		idx.byPathAndQuery = make(map[string]Snapshot, len(entries))
+	}
+	for _, e := range entries {
+		idx.add(e.OriginalURL, e.Timestamp)
+	}
+}
+
+// invalidate drops the built manifest, for the next GetManifest to rebuild.
+func (idx *SnapshotIndex) invalidate() {
+	if idx.built {
+		idx.built, idx.manifest = false, nil
+	}
+}
+
+// add is Register without invalidating the manifest.
+func (idx *SnapshotIndex) add(rawURL, timestamp string) {
+	rawURL = stripFragment(rawURL)
 	u, err := url.Parse(rawURL)
 	if err != nil {
 		return
 	}
 
-	pathKey := u.Path
-	queryKey := pathKey
-	if u.RawQuery != "" {
-		queryKey += "?" + u.RawQuery
-	}
+	pathKey := pathKeyFor(u)
+	queryKey := fileIDFor(u)
 
 	snap := Snapshot{
 		FileURL:   rawURL,
@@ -49,15 +141,108 @@ func (idx *SnapshotIndex) Register(rawURL, timestamp string) {
 		FileID:    queryKey,
 	}
 
+	existing, ok := idx.byPathAndQuery[queryKey]
+	if !ok && idx.MaxSize > 0 && len(idx.byPathAndQuery) >= idx.MaxSize {
+		// Full: a capture older than all kept ones is dropped, a newer
+		// one replaces the oldest.
+		if timestamp <= idx.oldest[0].timestamp {
+			idx.evicted++
+			return
+		}
+		idx.evictOldest()
+	}
+
 	// Keep only the snapshot with the greatest (latest) timestamp string.
-	if existing, ok := idx.byPathAndQuery[queryKey]; !ok || timestamp > existing.Timestamp {
+	if !ok || timestamp > existing.Timestamp {
 		idx.byPathAndQuery[queryKey] = snap
+		idx.track(queryKey, pathKey, timestamp)
 	}
 	if existing, ok := idx.byPath[pathKey]; !ok || timestamp > existing.Timestamp {
 		idx.byPath[pathKey] = snap
 	}
 }
 
+// Evicted returns the number of captures Register dropped to stay within
+// MaxSize.
+func (idx *SnapshotIndex) Evicted() int {
+	return idx.evicted
+}
+
+// track records the timestamp of byPathAndQuery[queryKey] in the eviction
+// heap when MaxSize is set.
+func (idx *SnapshotIndex) track(queryKey, pathKey, timestamp string) {
+	if idx.MaxSize <= 0 {
+		return
+	}
+	if e, ok := idx.heapPos[queryKey]; ok {
+		e.timestamp = timestamp
+		heap.Fix(&idx.oldest, e.pos)
+		return
+	}
+	if idx.heapPos == nil {
+		idx.heapPos = make(map[string]*heapEntry)
+	}
+	if idx.pathEntries == nil {
+		idx.pathEntries = make(map[string][]*heapEntry)
+	}
+	e := &heapEntry{queryKey: queryKey, pathKey: pathKey, timestamp: timestamp}
+	heap.Push(&idx.oldest, e)
+	idx.heapPos[queryKey] = e
+	idx.pathEntries[pathKey] = append(idx.pathEntries[pathKey], e)
+}
+
+// evictOldest removes the capture with the oldest timestamp from the index.
+// When it is its path's latest capture, byPath falls back to the newest
+// query variant of that path still kept, if any.
+func (idx *SnapshotIndex) evictOldest() {
+	e := heap.Pop(&idx.oldest).(*heapEntry)
+	delete(idx.heapPos, e.queryKey)
+	delete(idx.byPathAndQuery, e.queryKey)
+	variants := slices.DeleteFunc(idx.pathEntries[e.pathKey], func(v *heapEntry) bool { return v == e })
+	if len(variants) == 0 {
+		delete(idx.pathEntries, e.pathKey)
+	} else {
+		idx.pathEntries[e.pathKey] = variants
+	}
+	if s, ok := idx.byPath[e.pathKey]; ok && s.FileID == e.queryKey {
+		if len(variants) == 0 {
+			delete(idx.byPath, e.pathKey)
+		} else {
+			newest := slices.MaxFunc(variants, func(a, b *heapEntry) int { return strings.Compare(a.timestamp, b.timestamp) })
+			idx.byPath[e.pathKey] = idx.byPathAndQuery[newest.queryKey]
+		}
+	}
+	idx.evicted++
+}
+
+// heapEntry is a byPathAndQuery key in a captureHeap.
+type heapEntry struct {
+	queryKey, pathKey string
+	timestamp         string
+	pos               int // index in the heap
+}
+
+// captureHeap is a min-heap of captures by timestamp (container/heap).
+type captureHeap []*heapEntry
+
+func (h captureHeap) Len() int           { return len(h) }
+func (h captureHeap) Less(i, j int) bool { return h[i].timestamp < h[j].timestamp }
+func (h captureHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].pos, h[j].pos = i, j
+}
+func (h *captureHeap) Push(x any) {
+	e := x.(*heapEntry)
+	e.pos = len(*h)
+	*h = append(*h, e)
+}
+func (h *captureHeap) Pop() any {
+	old := *h
+	e := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return e
+}
+
 // GetManifest builds and returns the full sorted snapshot list (newest first).
 // Also initialises the lookup maps for Resolve.
 func (idx *SnapshotIndex) GetManifest() []Snapshot {
@@ -105,11 +290,8 @@ func (idx *SnapshotIndex) Resolve(assetURL, fallback string) string {
 		return fallback
 	}
 
-	pathKey := u.Path
-	queryKey := pathKey
-	if u.RawQuery != "" {
-		queryKey += "?" + u.RawQuery
-	}
+	pathKey := pathKeyFor(u)
+	queryKey := fileIDFor(u)
 
 	if ts, ok := idx.lookupQuery[queryKey]; ok {
 		return ts
@@ -119,3 +301,119 @@ func (idx *SnapshotIndex) Resolve(assetURL, fallback string) string {
 	}
 	return fallback
 }
+
+// Lookup returns the registered snapshot for rawURL, matching path+query
+// first and then path only.
+func (idx *SnapshotIndex) Lookup(rawURL string) (Snapshot, bool) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return Snapshot{}, false
+	}
+	if s, ok := idx.byPathAndQuery[fileIDFor(u)]; ok {
+		return s, true
+	}
+	s, ok := idx.byPath[pathKeyFor(u)]
+	return s, ok
+}
+
+// RecordFile notes that the snapshot with fileID was stored as f.
+// It is safe for concurrent use by download workers.
+func (idx *SnapshotIndex) RecordFile(fileID string, f StoredFile) {
+	idx.mu.Lock()
+	idx.files[fileID] = f
+	idx.mu.Unlock()
+}
+
+// MarkDownloaded notes that logicalPath has been written to storage, so a
+// later IsDownloaded check can skip asking the storage (which can be slow on
+// network-mounted output directories). It is safe for concurrent use.
+func (idx *SnapshotIndex) MarkDownloaded(logicalPath string) {
+	idx.mu.Lock()
+	idx.downloaded[logicalPath] = struct{}{}
+	idx.mu.Unlock()
+}
+
+// IsDownloaded reports whether logicalPath was passed to MarkDownloaded.
+// It is safe for concurrent use.
+func (idx *SnapshotIndex) IsDownloaded(logicalPath string) bool {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	_, ok := idx.downloaded[logicalPath]
+	return ok
+}
+
+// Downloaded returns the logical paths passed to MarkDownloaded, sorted, for
+// persisting between runs.
+func (idx *SnapshotIndex) Downloaded() []string {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	paths := make([]string, 0, len(idx.downloaded))
+	for p := range idx.downloaded {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// ManifestRecord is one exported manifest row.
+type ManifestRecord struct {
+	Timestamp string `json:"timestamp"`
+	URL       string `json:"url"`
+	LocalPath string `json:"local_path"`
+	SizeBytes int64  `json:"size_bytes"`
+	MimeType  string `json:"mime_type"`
+}
+
+// manifestCSVHeader is the header row written by Export in CSV format.
+var manifestCSVHeader = []string{"timestamp", "url", "local_path", "size_bytes", "mime_type"}
+
+// Records returns the manifest (newest first) joined with the stored-file
+// details recorded by RecordFile.
+func (idx *SnapshotIndex) Records() []ManifestRecord {
+	manifest := idx.GetManifest()
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	recs := make([]ManifestRecord, len(manifest))
+	for i, s := range manifest {
+		f := idx.files[s.FileID]
+		recs[i] = ManifestRecord{
+			Timestamp: s.Timestamp,
+			URL:       s.FileURL,
+			LocalPath: f.LocalPath,
+			SizeBytes: f.Size,
+			MimeType:  f.MimeType,
+		}
+	}
+	return recs
+}
+
+// Export writes the manifest to w as "json" (an array of ManifestRecord) or
+// "csv" (a header row followed by one row per snapshot).
+func (idx *SnapshotIndex) Export(w io.Writer, format string) error {
+	return exportRecords(w, idx.Records(), format)
+}
+
+// exportRecords writes recs to w in format, as described for Export.
+func exportRecords(w io.Writer, recs []ManifestRecord, format string) error {
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(recs)
+	case "csv":
+		cw := csv.NewWriter(w)
+		if err := cw.Write(manifestCSVHeader); err != nil {
+			return err
+		}
+		for _, r := range recs {
+			row := []string{r.Timestamp, r.URL, r.LocalPath, strconv.FormatInt(r.SizeBytes, 10), r.MimeType}
+			if err := cw.Write(row); err != nil {
+				return err
+			}
+		}
+		cw.Flush()
+		return cw.Error()
+	default:
+		return fmt.Errorf("unknown manifest format %q (want csv or json)", format)
+	}
+}
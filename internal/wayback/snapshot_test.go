@@ -1,6 +1,16 @@
 package wayback
 
 import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 )
 
@@ -21,6 +31,116 @@ func TestSnapshotIndexRegisterAddsEntries(t *testing.T) {
 	}
 }
 
+// A fragment never makes it into the snapshot's URL, so the capture is
+// fetched without it.
+func TestSnapshotIndexRegisterStripsFragment(t *testing.T) {
+	idx := NewSnapshotIndex()
+	idx.Register("https://example.com/page.html", "20220101000000")
+	idx.Register("https://example.com/page.html#section", "20230101000000")
+
+	m := idx.GetManifest()
+	if len(m) != 1 || m[0].FileURL != "https://example.com/page.html" || m[0].Timestamp != "20230101000000" {
+		t.Fatalf("unexpected manifest %+v", m)
+	}
+	if got, want := rawCaptureURL("", m[0].Timestamp, "https://example.com/a#b"), "https://web.archive.org/web/20230101000000id_/https://example.com/a"; got != want {
+		t.Errorf("rawCaptureURL = %q, want %q", got, want)
+	}
+}
+
+// With MaxSize, the index keeps the newest captures and counts the rest as
+// evicted, whatever order they arrive in.
+func TestSnapshotIndexMaxSize(t *testing.T) {
+	idx := NewSnapshotIndex()
+	idx.MaxSize = 100
+	for _, i := range rand.New(rand.NewPCG(1, 2)).Perm(300) {
+		idx.Register(fmt.Sprintf("https://example.com/p%d.html", i), fmt.Sprintf("2020%010d", i))
+	}
+	// A newer capture of a kept URL replaces it without evicting anything.
+	idx.Register("https://example.com/p299.html", "20219999999999")
+
+	m := idx.GetManifest()
+	if len(m) != 100 {
+		t.Fatalf("kept %d captures, want 100", len(m))
+	}
+	if m[0].Timestamp != "20219999999999" {
+		t.Errorf("newest = %s, want the re-registered capture", m[0].Timestamp)
+	}
+	for _, s := range m[1:] {
+		if s.Timestamp < fmt.Sprintf("2020%010d", 200) {
+			t.Errorf("kept older capture %s", s.FileURL)
+		}
+	}
+	if n := idx.Evicted(); n != 200 {
+		t.Errorf("Evicted() = %d, want 200", n)
+	}
+	if _, ok := idx.Lookup("https://example.com/p5.html"); ok {
+		t.Error("evicted capture still resolvable by path")
+	}
+
+	// Evicting the capture a path resolves to hands the path to the newest
+	// query variant still kept.
+	idx = NewSnapshotIndex()
+	idx.MaxSize = 3
+	idx.Register("https://example.com/a?x=1", "20200101000000")
+	idx.Register("https://example.com/a?x=2", "20200101000000")
+	idx.Register("https://example.com/a?x=3", "20190101000000")
+	idx.Register("https://example.com/b", "20210101000000") // evicts a?x=3
+	idx.Register("https://example.com/c", "20210101000000") // evicts a?x=1, which /a resolved to
+	if s, ok := idx.Lookup("https://example.com/a"); !ok || s.FileURL != "https://example.com/a?x=2" {
+		t.Errorf("Lookup(/a) = %v, %v; want the kept variant a?x=2", s, ok)
+	}
+	if ts := idx.Resolve("https://example.com/a?x=9", "none"); ts != "20200101000000" {
+		t.Errorf("Resolve(/a?x=9) = %s, want the kept variant's timestamp", ts)
+	}
+	idx.Register("https://example.com/d", "20210101000000") // evicts a?x=2
+	if _, ok := idx.Lookup("https://example.com/a"); ok {
+		t.Error("path still resolvable with all its variants evicted")
+	}
+}
+
+// Import leaves the index in the state registering each entry in turn does,
+// with and without MaxSize, and on an index already holding captures.
+func TestSnapshotIndexImportMatchesRegister(t *testing.T) {
+	var entries []CDXEntry
+	for _, i := range rand.New(rand.NewPCG(3, 4)).Perm(200) {
+		entries = append(entries, CDXEntry{
+			Timestamp:   fmt.Sprintf("2020%010d", i),
+			OriginalURL: fmt.Sprintf("https://example.com/p%d.html?v=%d#top", i%70, i%3),
+			Digest:      fmt.Sprintf("D%d", i),
+			Length:      int64(i),
+		})
+	}
+	entries = append(entries, CDXEntry{Timestamp: "20200101000000", OriginalURL: "http://[::1"})
+
+	for _, maxSize := range []int{0, 50} {
+		for _, prefilled := range []bool{false, true} {
+			registered, imported := NewSnapshotIndex(), NewSnapshotIndex()
+			for _, idx := range []*SnapshotIndex{registered, imported} {
+				idx.MaxSize = maxSize
+				if prefilled {
+					idx.Register("https://example.com/p1.html?v=1", "20300101000000")
+					idx.GetManifest()
+				}
+			}
+			for _, e := range entries {
+				registered.Register(e.OriginalURL, e.Timestamp)
+			}
+			imported.Import(entries)
+
+			if !reflect.DeepEqual(imported.byPath, registered.byPath) ||
+				!reflect.DeepEqual(imported.byPathAndQuery, registered.byPathAndQuery) {
+				t.Errorf("MaxSize %d, prefilled %v: Import and Register indexes differ", maxSize, prefilled)
+			}
+			if got, want := imported.GetManifest(), registered.GetManifest(); !reflect.DeepEqual(got, want) {
+				t.Errorf("MaxSize %d, prefilled %v: manifests differ:\n  import:   %v\n  register: %v", maxSize, prefilled, got, want)
+			}
+			if imported.Evicted() != registered.Evicted() {
+				t.Errorf("MaxSize %d, prefilled %v: Evicted() = %d, want %d", maxSize, prefilled, imported.Evicted(), registered.Evicted())
+			}
+		}
+	}
+}
+
 // Register the same URL twice: only the lexicographically greatest timestamp
 // should survive.
 func TestSnapshotIndexDeduplicateKeepsLatest(t *testing.T) {
@@ -37,6 +157,36 @@ func TestSnapshotIndexDeduplicateKeepsLatest(t *testing.T) {
 	}
 }
 
+// URLs differing only in trailing slash, path case or query parameter order
+// deduplicate to one entry; the first registered URL is kept as FileURL.
+func TestSnapshotIndexCanonicalFileID(t *testing.T) {
+	idx := NewSnapshotIndex()
+	idx.Register("https://example.com/about", "20230101000000")
+	idx.Register("https://example.com/about/", "20230101000000")
+	idx.Register("https://example.com/About//", "20230101000000")
+	idx.Register("https://example.com/list?b=2&a=1", "20230101000000")
+	idx.Register("https://example.com/list?a=1&b=2", "20230101000000")
+	idx.Register("https://example.com", "20230101000000")
+	idx.Register("https://example.com/", "20230101000000")
+
+	m := idx.GetManifest()
+	got := make(map[string]string, len(m))
+	for _, s := range m {
+		got[s.FileID] = s.FileURL
+	}
+	want := map[string]string{
+		"example.com/about":        "https://example.com/about",
+		"example.com/list?a=1&b=2": "https://example.com/list?b=2&a=1",
+		"example.com/":             "https://example.com",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("manifest FileID → FileURL = %v, want %v", got, want)
+	}
+	if ts := idx.Resolve("https://example.com/ABOUT/", "fallback"); ts != "20230101000000" {
+		t.Errorf("Resolve of a case/slash variant = %q", ts)
+	}
+}
+
 // GetManifest must sort snapshots newest-first.
 func TestSnapshotIndexManifestSortedNewestFirst(t *testing.T) {
 	idx := NewSnapshotIndex()
@@ -121,3 +271,105 @@ func TestSnapshotIndexRegisterInvalidURL(t *testing.T) {
 		t.Errorf("invalid URL should not be registered, got %d entries", len(m))
 	}
 }
+
+// Lookup must find a snapshot by path+query, then by path alone.
+func TestSnapshotIndexLookup(t *testing.T) {
+	idx := NewSnapshotIndex()
+	idx.Register("http://www.example.com/blog/post.html", "20230101000000")
+
+	s, ok := idx.Lookup("https://example.com/blog/post.html?utm=x")
+	if !ok || s.FileURL != "http://www.example.com/blog/post.html" || s.Timestamp != "20230101000000" {
+		t.Errorf("Lookup = %+v, %v", s, ok)
+	}
+	if _, ok := idx.Lookup("https://example.com/missing.html"); ok {
+		t.Error("Lookup of unknown URL should fail")
+	}
+}
+
+func exportTestIndex() (*SnapshotIndex, []ManifestRecord) {
+	idx := NewSnapshotIndex()
+	idx.Register("https://example.com/page.html", "20230601000000")
+	idx.Register("https://example.com/style.css?v=1", "20230101000000")
+	idx.RecordFile("example.com/page.html", StoredFile{LocalPath: "page.html", Size: 1234, MimeType: "text/html; charset=utf-8"})
+	want := []ManifestRecord{
+		{Timestamp: "20230601000000", URL: "https://example.com/page.html", LocalPath: "page.html", SizeBytes: 1234, MimeType: "text/html; charset=utf-8"},
+		{Timestamp: "20230101000000", URL: "https://example.com/style.css?v=1"},
+	}
+	return idx, want
+}
+
+// JSON export must decode back to the same records.
+func TestSnapshotIndexExportJSONRoundTrip(t *testing.T) {
+	idx, want := exportTestIndex()
+	var buf bytes.Buffer
+	if err := idx.Export(&buf, "json"); err != nil {
+		t.Fatal(err)
+	}
+	var got []ManifestRecord
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("decode: %v\n%s", err, buf.String())
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("JSON round-trip\n  got  %+v\n  want %+v", got, want)
+	}
+}
+
+// CSV export must have the documented header and parse back to the same rows.
+func TestSnapshotIndexExportCSVRoundTrip(t *testing.T) {
+	idx, want := exportTestIndex()
+	var buf bytes.Buffer
+	if err := idx.Export(&buf, "csv"); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != len(want)+1 {
+		t.Fatalf("expected %d rows, got %d", len(want)+1, len(rows))
+	}
+	if strings.Join(rows[0], ",") != "timestamp,url,local_path,size_bytes,mime_type" {
+		t.Errorf("unexpected header %v", rows[0])
+	}
+	for i, w := range want {
+		size, _ := strconv.ParseInt(rows[i+1][3], 10, 64)
+		got := ManifestRecord{Timestamp: rows[i+1][0], URL: rows[i+1][1], LocalPath: rows[i+1][2], SizeBytes: size, MimeType: rows[i+1][4]}
+		if got != w {
+			t.Errorf("row %d\n  got  %+v\n  want %+v", i, got, w)
+		}
+	}
+}
+
+func TestSnapshotIndexExportUnknownFormat(t *testing.T) {
+	if err := NewSnapshotIndex().Export(io.Discard, "xml"); err == nil {
+		t.Error("expected error for unknown format")
+	}
+}
+
+// MarkDownloaded and IsDownloaded may be called from many download workers
+// at once; every marked path is reported afterwards.
+func TestSnapshotIndexDownloadedConcurrent(t *testing.T) {
+	idx := NewSnapshotIndex()
+	var wg sync.WaitGroup
+	for w := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range 100 {
+				p := fmt.Sprintf("w%d/%d.html", w, i)
+				idx.MarkDownloaded(p)
+				if !idx.IsDownloaded(p) {
+					t.Errorf("%s not reported right after MarkDownloaded", p)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if idx.IsDownloaded("never.html") {
+		t.Error("unmarked path reported as downloaded")
+	}
+	if n := len(idx.Downloaded()); n != 800 {
+		t.Errorf("Downloaded() has %d paths, want 800", n)
+	}
+}
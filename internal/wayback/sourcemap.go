@@ -0,0 +1,123 @@
+package wayback
+
+import (
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// reSourceMapURL matches a JavaScript source map comment on a line of its
+// own ("//# sourceMappingURL=app.js.map", or the older "//@" form).
+// Groups: 1 comment up to the URL, 2 URL.
+var reSourceMapURL = regexp.MustCompile(`(?m)^([ \t]*//[#@][ \t]*sourceMappingURL=)([^\s'"]+)[ \t]*\r?$`)
+
+// JSRewriter implements Rewriter for JavaScript, pointing a script's
+// sourceMappingURL comment at the local copy of its source map when
+// Config.SourceMaps is set. Nothing else in the script is touched.
+type JSRewriter struct{}
+
+// Match reports whether this resource should be treated as JavaScript.
+// Checks Content-Type, then the file extension (.js/.mjs); anything served
+// as HTML is left to HTMLRewriter.
+func (JSRewriter) Match(logicalPath, contentType string, firstBytes []byte) bool {
+	ct := strings.ToLower(contentType)
+	if strings.Contains(ct, "javascript") || strings.Contains(ct, "ecmascript") {
+		return true
+	}
+	if strings.Contains(ct, "text/html") {
+		return false
+	}
+	ext := strings.ToLower(path.Ext(logicalPath))
+	return ext == ".js" || ext == ".mjs"
+}
+
+func (JSRewriter) Rewrite(store Storage, logicalPath, pageURL string, cfg *Config, idx *SnapshotIndex) error {
+	if !cfg.SourceMaps {
+		return nil
+	}
+	data, err := store.Get(logicalPath)
+	if err != nil {
+		return err
+	}
+	rewritten := RewriteSourceMapURL(string(data), pageURL, cfg, idx)
+	if rewritten == string(data) {
+		return nil
+	}
+	return store.PutBytes(logicalPath, []byte(rewritten))
+}
+
+// RewriteSourceMapURL points the sourceMappingURL comment of the script js,
+// fetched from scriptURL, at the local copy of an internal source map. Only
+// the last such comment counts, as in browsers; data: maps and external
+// ones are left as they are.
+func RewriteSourceMapURL(js, scriptURL string, cfg *Config, idx *SnapshotIndex) string {
+	loc := lastSourceMapURL(js)
+	if loc == nil {
+		return js
+	}
+	ref := js[loc[4]:loc[5]]
+	target, ok := sourceMapTarget(ref, scriptURL, cfg)
+	if !ok {
+		return js
+	}
+	local := internalHref(target, localDirFor(localPathFor(scriptURL, cfg), cfg), cfg, idx)
+	cfg.recordRewrite("sourcemap", ref, local)
+	return js[:loc[4]] + local + js[loc[5]:]
+}
+
+// sourceMapSnapshots returns a snapshot of the internal source map the
+// script stored at logicalPath names, if any, dated as WaybackAssetURL
+// would fetch it: its indexed capture, else the script's.
+func sourceMapSnapshots(store Storage, logicalPath string, snap Snapshot, cfg *Config, idx *SnapshotIndex) []Snapshot {
+	data, err := store.Get(logicalPath)
+	if err != nil {
+		return nil
+	}
+	js := string(data)
+	loc := lastSourceMapURL(js)
+	if loc == nil {
+		return nil
+	}
+	target, ok := sourceMapTarget(js[loc[4]:loc[5]], snap.FileURL, cfg)
+	if !ok {
+		return nil
+	}
+	return []Snapshot{{
+		FileURL:   target.String(),
+		Timestamp: idx.Resolve(target.String(), snap.Timestamp),
+		FileID:    fileIDFor(target),
+	}}
+}
+
+// lastSourceMapURL returns the submatch indexes of the last
+// reSourceMapURL match in js, or nil.
+func lastSourceMapURL(js string) []int {
+	if !strings.Contains(js, "sourceMappingURL=") {
+		return nil
+	}
+	all := reSourceMapURL.FindAllStringSubmatchIndex(js, -1)
+	if len(all) == 0 {
+		return nil
+	}
+	return all[len(all)-1]
+}
+
+// sourceMapTarget resolves the source map reference ref of the script at
+// scriptURL; false when it is not an http(s) URL on an internal host.
+func sourceMapTarget(ref, scriptURL string, cfg *Config) (*url.URL, bool) {
+	scriptU, err := url.Parse(scriptURL)
+	if err != nil {
+		return nil, false
+	}
+	u, err := scriptU.Parse(ref)
+	if err != nil {
+		return nil, false
+	}
+	u = stripWaybackPrefix(u, cfg.ArchiveBase)
+	if (u.Scheme != "http" && u.Scheme != "https") || !isInternalHost(u.Host, cfg) {
+		return nil, false
+	}
+	u.Fragment = ""
+	return u, true
+}
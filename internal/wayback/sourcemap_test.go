@@ -0,0 +1,68 @@
+package wayback
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sigman78/wayback-dl/internal/wayback/testserver"
+)
+
+// The last sourceMappingURL comment of a script is pointed at the local copy
+// of an internal map; data: and external maps, and other text, stay.
+func TestRewriteSourceMapURL(t *testing.T) {
+	cfg := &Config{BareHost: "example.com", Directory: "out"}
+	idx := NewSnapshotIndex()
+	const script = "https://example.com/static/js/app.js"
+	cases := []struct{ in, want string }{
+		{"f();\n//# sourceMappingURL=https://example.com/static/js/app.js.map\n",
+			"f();\n//# sourceMappingURL=app.js.map\n"},
+		{"f();\n//@ sourceMappingURL=/maps/app.map", "f();\n//@ sourceMappingURL=../../maps/app.map"},
+		{"f();\r\n//# sourceMappingURL=https://web.archive.org/web/2020/https://example.com/static/js/app.js.map\r\n",
+			"f();\r\n//# sourceMappingURL=app.js.map\r\n"},
+		{"//# sourceMappingURL=old.map\nf();\n//# sourceMappingURL=new.map", "//# sourceMappingURL=old.map\nf();\n//# sourceMappingURL=new.map"},
+		{"f();\n//# sourceMappingURL=https://cdn.other.org/app.js.map", "f();\n//# sourceMappingURL=https://cdn.other.org/app.js.map"},
+		{"f();\n//# sourceMappingURL=data:application/json;base64,e30=", "f();\n//# sourceMappingURL=data:application/json;base64,e30="},
+		{`var s = "//# sourceMappingURL=https://example.com/x.map";`, `var s = "//# sourceMappingURL=https://example.com/x.map";`},
+	}
+	for _, tc := range cases {
+		if got := RewriteSourceMapURL(tc.in, script, cfg, idx); got != tc.want {
+			t.Errorf("RewriteSourceMapURL(%q)\n  got  %q\n  want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+// With SourceMaps, a script's source map is fetched even when the CDX query
+// does not list it, and the script links the local copy.
+func TestDownloadAllSourceMaps(t *testing.T) {
+	srv := testserver.NewTestServer(t, map[string]testserver.TestEntry{
+		"http://example.com/js/app.js": {Timestamp: "20200101000000", ContentType: "application/javascript",
+			Body: "f();\n//# sourceMappingURL=http://example.com/js/app.js.map\n"},
+		// Older than -from: outside the CDX results, but still served.
+		"http://example.com/js/app.js.map": {Timestamp: "20100101000000", ContentType: "application/json",
+			Body: `{"version":3}`},
+	})
+	for _, maps := range []bool{false, true} {
+		dir := t.TempDir()
+		cfg := archiveConfig(srv, filepath.Join(dir, "out"))
+		cfg.FromTimestamp = "2019"
+		cfg.RewriteLinks = true
+		cfg.SourceMaps = maps
+		if err := DownloadAll(cfg); err != nil {
+			t.Fatal(err)
+		}
+		js := readOutput(t, cfg.Directory, "js/app.js")
+		if !maps {
+			if !strings.Contains(js, "sourceMappingURL=http://example.com/js/app.js.map") {
+				t.Errorf("script rewritten without SourceMaps: %q", js)
+			}
+			continue
+		}
+		if got := readOutput(t, cfg.Directory, "js/app.js.map"); got != `{"version":3}` {
+			t.Errorf("js/app.js.map = %q", got)
+		}
+		if !strings.Contains(js, "//# sourceMappingURL=app.js.map\n") {
+			t.Errorf("script not pointed at the local map: %q", js)
+		}
+	}
+}
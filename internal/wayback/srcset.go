@@ -0,0 +1,109 @@
+package wayback
+
+import (
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// srcsetCandidate is one image candidate of a srcset attribute.
+type srcsetCandidate struct {
+	URL        string
+	Descriptor string // "2x", "800w" or "" (1x)
+}
+
+// parseSrcset splits a srcset attribute value into its candidates. URLs are
+// taken up to the next whitespace (a trailing comma ends the candidate) and
+// descriptors up to the next comma, following the HTML parsing rules closely
+// enough for real-world markup; URLs containing commas followed by
+// whitespace are not supported.
+func parseSrcset(val string) []srcsetCandidate {
+	var out []srcsetCandidate
+	s := val
+	for {
+		s = strings.TrimLeft(s, " \t\n\r\f,")
+		if s == "" {
+			return out
+		}
+		end := strings.IndexAny(s, " \t\n\r\f")
+		if end < 0 {
+			end = len(s)
+		}
+		u := s[:end]
+		s = s[end:]
+		var desc string
+		if trimmed := strings.TrimRight(u, ","); trimmed != u {
+			u = trimmed // "a.png," ends the candidate
+		} else if i := strings.IndexByte(s, ','); i >= 0 {
+			desc, s = s[:i], s[i+1:]
+		} else {
+			desc, s = s, ""
+		}
+		out = append(out, srcsetCandidate{URL: u, Descriptor: strings.Join(strings.Fields(desc), " ")})
+	}
+}
+
+// formatSrcset joins candidates back into a srcset attribute value.
+func formatSrcset(cands []srcsetCandidate) string {
+	parts := make([]string, len(cands))
+	for i, c := range cands {
+		parts[i] = c.URL
+		if c.Descriptor != "" {
+			parts[i] += " " + c.Descriptor
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// rewriteSrcset points the internal candidates of n's srcset attribute at
+// their local copies. With cfg.RewriteSrcsetDescriptors set, candidates
+// without a capture in idx (or a file in store) are dropped; a lone
+// survivor loses its descriptor, and when none survive the attribute is
+// removed so the browser falls back to src.
+func rewriteSrcset(n *html.Node, pageU *url.URL, localDir string, cfg *Config, idx *SnapshotIndex, store Storage) {
+	for i, a := range n.Attr {
+		if a.Key != "srcset" {
+			continue
+		}
+		var kept []srcsetCandidate
+		for _, c := range parseSrcset(a.Val) {
+			resolved, err := pageU.Parse(c.URL)
+			if err != nil {
+				kept = append(kept, c)
+				continue
+			}
+			resolved = stripWaybackPrefix(resolved, cfg.ArchiveBase)
+			internal := (resolved.Scheme == "http" || resolved.Scheme == "https") && isInternalHost(resolved.Host, cfg)
+			if cfg.RewriteSrcsetDescriptors && !(internal && isArchived(resolved.String(), cfg, idx, store)) {
+				continue
+			}
+			if internal {
+				local := internalHref(resolved, localDir, cfg, idx)
+				cfg.recordRewrite("srcset", c.URL, local)
+				c.URL = local
+			}
+			kept = append(kept, c)
+		}
+		if cfg.RewriteSrcsetDescriptors {
+			switch len(kept) {
+			case 0:
+				n.Attr = append(n.Attr[:i], n.Attr[i+1:]...)
+				return
+			case 1:
+				kept[0].Descriptor = ""
+			}
+		}
+		n.Attr[i].Val = formatSrcset(kept)
+		return
+	}
+}
+
+// isArchived reports whether rawURL has a capture in idx or its local copy
+// is already in store.
+func isArchived(rawURL string, cfg *Config, idx *SnapshotIndex, store Storage) bool {
+	if _, ok := idx.Lookup(rawURL); ok {
+		return true
+	}
+	return store != nil && store.Exists(localPathFor(rawURL, cfg))
+}
@@ -0,0 +1,73 @@
+package wayback
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseSrcset(t *testing.T) {
+	cases := []struct {
+		in   string
+		want []srcsetCandidate
+	}{
+		{"a.png", []srcsetCandidate{{"a.png", ""}}},
+		{"a.png 1x, b.png 2x", []srcsetCandidate{{"a.png", "1x"}, {"b.png", "2x"}}},
+		{" a.png  480w,\n b.png 800w ", []srcsetCandidate{{"a.png", "480w"}, {"b.png", "800w"}}},
+		{"a.png,b.png 2x", []srcsetCandidate{{"a.png,b.png", "2x"}}},
+		{"a.png, b.png", []srcsetCandidate{{"a.png", ""}, {"b.png", ""}}},
+		{"", nil},
+	}
+	for _, tc := range cases {
+		if got := parseSrcset(tc.in); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("parseSrcset(%q) = %v, want %v", tc.in, got, tc.want)
+		}
+	}
+}
+
+// srcset candidates on the site are rewritten to local paths; external ones
+// are kept.
+func TestProcessHTMLSrcset(t *testing.T) {
+	in := `<html><body><img src="/img/a.png" srcset="/img/a.png 1x, http://example.com/img/a@2x.png 2x, https://cdn.other.com/a.png 3x"/></body></html>`
+	out := processHTMLInTemp(t, in, "http://example.com/", testHTMLCfg())
+	want := `srcset="img/a.png 1x, img/a@2x.png 2x, https://cdn.other.com/a.png 3x"`
+	if !strings.Contains(out, want) {
+		t.Errorf("expected %s\n  got: %s", want, out)
+	}
+}
+
+// With RewriteSrcsetDescriptors, only archived candidates are kept; a lone
+// survivor loses its descriptor and an empty srcset is removed.
+func TestProcessHTMLSrcsetDescriptors(t *testing.T) {
+	cfg := testHTMLCfg()
+	cfg.RewriteSrcsetDescriptors = true
+	idx := NewSnapshotIndex()
+	idx.Register("http://example.com/img/a.png", "20200101000000")
+	idx.Register("http://example.com/img/b-800.png", "20200101000000")
+	idx.Register("http://example.com/img/b-1600.png", "20200101000000")
+
+	cases := []struct {
+		srcset, want string
+	}{
+		{"/img/a.png 1x, /img/a@2x.png 2x", `srcset="img/a.png"`},
+		{"/img/b-800.png 800w, /img/b-1600.png 1600w, /img/b-3200.png 3200w", `srcset="img/b-800.png 800w, img/b-1600.png 1600w"`},
+		{"/img/c@2x.png 2x, https://cdn.other.com/c.png 1x", `<img src="img/c.png"/>`},
+	}
+	for _, tc := range cases {
+		store := NewLocalStorage(t.TempDir())
+		in := `<html><body><img src="/img/c.png" srcset="` + tc.srcset + `"/></body></html>`
+		if err := store.PutBytes("test.html", []byte(in)); err != nil {
+			t.Fatal(err)
+		}
+		if err := (HTMLRewriter{}).Rewrite(store, "test.html", "http://example.com/", cfg, idx); err != nil {
+			t.Fatal(err)
+		}
+		out, err := store.Get("test.html")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(out), tc.want) {
+			t.Errorf("srcset %q: expected %s\n  got: %s", tc.srcset, tc.want, out)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package wayback
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+)
+
+// stateMagic starts every state file; stateVersion follows it as a
+// big-endian uint32 and changes whenever the encoded layout does.
+const (
+	stateMagic   = "WBDLSTAT"
+	stateVersion = 1
+)
+
+// ErrStateFormat is returned by ReadState for a file that is not a state
+// file or was written in another format version.
+var ErrStateFormat = errors.New("unsupported state file")
+
+// state is the gob-encoded body of a state file.
+type state struct {
+	Snapshots  []Snapshot // every registered capture
+	Downloaded []string   // logical paths already stored
+}
+
+// WriteState saves the captures of idx and the set of downloaded logical
+// paths to the OS path path, a binary checkpoint ReadState restores. The
+// file is written beside path, flushed to disk and renamed over it, so an
+// interrupted write never leaves a truncated state behind.
+func WriteState(path string, idx *SnapshotIndex, downloaded map[string]struct{}) error {
+	st := state{Snapshots: idx.GetManifest(), Downloaded: make([]string, 0, len(downloaded))}
+	for p := range downloaded {
+		st.Downloaded = append(st.Downloaded, p)
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(f.Name()) }() // no-op after the rename
+	w := bufio.NewWriter(f)
+	_, _ = w.WriteString(stateMagic)
+	_ = binary.Write(w, binary.BigEndian, uint32(stateVersion))
+	err = gob.NewEncoder(w).Encode(st)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// ReadState restores a SnapshotIndex and the set of downloaded logical paths
+// from a file written by WriteState. A file that is not a state file, or
+// was written in another format version, fails with ErrStateFormat.
+func ReadState(path string) (*SnapshotIndex, map[string]struct{}, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() { _ = f.Close() }()
+	r := bufio.NewReader(f)
+
+	header := make([]byte, len(stateMagic)+4)
+	if _, err := io.ReadFull(r, header); err != nil || string(header[:len(stateMagic)]) != stateMagic {
+		return nil, nil, fmt.Errorf("%s: %w: not a wayback-dl state file", path, ErrStateFormat)
+	}
+	if v := binary.BigEndian.Uint32(header[len(stateMagic):]); v != stateVersion {
+		return nil, nil, fmt.Errorf("%s: %w: format version %d, want %d", path, ErrStateFormat, v, stateVersion)
+	}
+	var st state
+	if err := gob.NewDecoder(r).Decode(&st); err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	idx := NewSnapshotIndex()
+	for _, s := range st.Snapshots {
+		idx.Register(s.FileURL, s.Timestamp)
+	}
+	downloaded := make(map[string]struct{}, len(st.Downloaded))
+	for _, p := range st.Downloaded {
+		downloaded[p] = struct{}{}
+	}
+	return idx, downloaded, nil
+}
+
+// resumeIndex returns the index saved in cfg.StateFile with its downloaded
+// paths marked, or nil when no state file is configured or none exists yet.
+func resumeIndex(cfg *Config) (*SnapshotIndex, error) {
+	if cfg.StateFile == "" {
+		return nil, nil
+	}
+	idx, downloaded, err := ReadState(cfg.StateFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read state: %w", err)
+	}
+	for p := range downloaded {
+		idx.MarkDownloaded(p)
+	}
+	cfg.printf(LogInfo, "Resuming from %s: %d capture(s), %d already downloaded; CDX query skipped.\n",
+		cfg.StateFile, len(idx.GetManifest()), len(downloaded))
+	return idx, nil
+}
+
+// downloadedSet returns a copy of the logical paths marked downloaded.
+func (idx *SnapshotIndex) downloadedSet() map[string]struct{} {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	return maps.Clone(idx.downloaded)
+}
@@ -0,0 +1,100 @@
+package wayback
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/sigman78/wayback-dl/internal/wayback/testserver"
+)
+
+// A state file restores the same captures and downloaded paths.
+func TestStateRoundTrip(t *testing.T) {
+	idx := NewSnapshotIndex()
+	idx.Register("http://example.com/", "20200101000000")
+	idx.Register("http://example.com/a.css?v=1", "20200102000000")
+	idx.Register("http://example.com/a.css?v=2", "20200103000000")
+	downloaded := map[string]struct{}{"index.html": {}, "a.css%3Fv=1": {}}
+
+	path := filepath.Join(t.TempDir(), "state.gob")
+	if err := WriteState(path, idx, downloaded); err != nil {
+		t.Fatal(err)
+	}
+	got, gotDownloaded, err := ReadState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got.GetManifest(), idx.GetManifest()) {
+		t.Errorf("manifest = %v, want %v", got.GetManifest(), idx.GetManifest())
+	}
+	if !reflect.DeepEqual(gotDownloaded, downloaded) {
+		t.Errorf("downloaded = %v, want %v", gotDownloaded, downloaded)
+	}
+	if s, ok := got.Lookup("http://example.com/a.css"); !ok || s.Timestamp != "20200103000000" {
+		t.Errorf("Lookup by path = %+v, %v", s, ok)
+	}
+}
+
+// Files that are not state files, or of another version, are rejected with
+// ErrStateFormat.
+func TestReadStateFormatMismatch(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "state.gob")
+	if err := WriteState(path, NewSnapshotIndex(), nil); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	binary.BigEndian.PutUint32(data[len(stateMagic):], stateVersion+1)
+	newer := filepath.Join(dir, "newer.gob")
+	other := filepath.Join(dir, "other.gob")
+	if err := os.WriteFile(newer, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(other, []byte(`{"json": true}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{newer, other} {
+		if _, _, err := ReadState(p); !errors.Is(err, ErrStateFormat) {
+			t.Errorf("ReadState(%s) = %v, want ErrStateFormat", filepath.Base(p), err)
+		}
+	}
+	if _, _, err := ReadState(newer); err == nil || !strings.Contains(err.Error(), "version 2, want 1") {
+		t.Errorf("version error not descriptive: %v", err)
+	}
+}
+
+// A run with StateFile saves its index; the next run resumes from it without
+// querying the CDX index again or refetching what was downloaded.
+func TestDownloadAllStateFile(t *testing.T) {
+	srv := testserver.NewTestServer(t, map[string]testserver.TestEntry{
+		"http://example.com/":          {Timestamp: "20200101000000", Body: "<html>home</html>", ContentType: "text/html"},
+		"http://example.com/style.css": {Timestamp: "20200102000000", Body: "body{}"},
+	})
+	dir := t.TempDir()
+	cfg := archiveConfig(srv, dir)
+	cfg.StateFile = filepath.Join(t.TempDir(), "state.gob")
+	if err := DownloadAll(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(dir, "style.css")); err != nil {
+		t.Fatal(err)
+	}
+	before, contentBefore := len(srv.Requests()), len(srv.ContentRequests())
+
+	if err := DownloadAll(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if cdx := len(srv.Requests()) - before - (len(srv.ContentRequests()) - contentBefore); cdx != 0 {
+		t.Errorf("resumed run made %d CDX requests, want 0", cdx)
+	}
+	if n := len(srv.ContentRequests()) - contentBefore; n != 0 {
+		t.Errorf("resumed run fetched %d captures, want 0 (both were downloaded)", n)
+	}
+}
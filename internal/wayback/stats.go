@@ -0,0 +1,57 @@
+package wayback
+
+import (
+	"errors"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// errNotFound is returned by downloadOne when the archive answers 404 for a
+// snapshot the CDX index listed. DownloadAll does not count it as a failure.
+var errNotFound = errors.New("not found in archive")
+
+// DownloadStats counts the outcomes of a DownloadAll run. Set Config.Stats to
+// a non-nil *DownloadStats to receive them; counters may be read while the
+// run is in progress.
+type DownloadStats struct {
+	Downloaded404s atomic.Int64 // indexed URLs the archive answered 404 for (with Track404s)
+
+	mu       sync.Mutex
+	notFound []string // URLs counted in Downloaded404s
+}
+
+// NotFoundURLs returns the URLs counted in Downloaded404s, sorted.
+func (s *DownloadStats) NotFoundURLs() []string {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := append([]string(nil), s.notFound...)
+	sort.Strings(out)
+	return out
+}
+
+// add404 records a 404 for rawURL.
+func (s *DownloadStats) add404(rawURL string) {
+	if s == nil {
+		return
+	}
+	s.Downloaded404s.Add(1)
+	s.mu.Lock()
+	s.notFound = append(s.notFound, rawURL)
+	s.mu.Unlock()
+}
+
+// writeNotFoundLog writes urls, one per line, to the OS file at path.
+func writeNotFoundLog(path string, urls []string) error {
+	var b strings.Builder
+	for _, u := range urls {
+		b.WriteString(u)
+		b.WriteByte('\n')
+	}
+	return os.WriteFile(path, []byte(b.String()), 0600)
+}
@@ -1,9 +1,22 @@
 package wayback
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
 	"io"
+	"io/fs"
+	"maps"
 	"os"
+	"path"
 	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
 )
 
 // Storage abstracts reading and writing downloaded snapshot files.
@@ -20,12 +33,23 @@ type Storage interface {
 	Get(path string) ([]byte, error)
 	// PutBytes writes data to path (convenience wrapper around Put).
 	PutBytes(path string, data []byte) error
+	// Walk calls fn for every stored file's logical path, in lexical order.
+	// A non-nil error from fn stops the walk and is returned.
+	Walk(fn func(path string) error) error
 }
 
 // LocalStorage is the default Storage implementation that mirrors the
 // logical layout into a root directory on the OS filesystem.
 type LocalStorage struct {
-	rootDir string
+	rootDir  string
+	foldCase bool // filesystem ignores case; see normalizePath
+	fsync    bool // flush each file to disk before it is renamed into place
+
+	maxPathLen int                              // see SetMaxPathLen; 0 = no limit
+	logf       func(format string, args ...any) // notified of each path shortened, if non-nil
+
+	mu        sync.Mutex
+	shortened map[string]struct{} // paths already reported to logf
 }
 
 // NewLocalStorage returns a LocalStorage rooted at dir.
@@ -34,9 +58,140 @@ func NewLocalStorage(dir string) *LocalStorage {
 	return &LocalStorage{rootDir: dir}
 }
 
+// NewCaseInsensitiveStorage returns a LocalStorage rooted at dir for a
+// filesystem that ignores case (macOS, Windows). Logical paths are stored
+// lower-cased, and paths that differ only in case get distinct files instead
+// of overwriting one another (see foldPathCase).
+func NewCaseInsensitiveStorage(dir string) *LocalStorage {
+	return &LocalStorage{rootDir: dir, foldCase: true}
+}
+
+// SetFsync makes Put and PutBytes flush every file to disk before renaming
+// it into place, so a power failure cannot leave a truncated file behind.
+// It is off by default because it slows down writes considerably.
+func (s *LocalStorage) SetFsync(on bool) {
+	s.fsync = on
+}
+
+// SetMaxPathLen keeps the absolute OS path of every file within n bytes
+// (see fitPathLen), for filesystems with a path length limit such as
+// Windows' MAX_PATH; 0 turns the check off. Each path shortened is reported
+// to logf when it is non-nil.
+func (s *LocalStorage) SetMaxPathLen(n int, logf func(format string, args ...any)) {
+	s.maxPathLen, s.logf = n, logf
+}
+
+// syncFile flushes f to disk; a variable so tests can observe the calls.
+var syncFile = (*os.File).Sync
+
+// IsCaseSensitiveFS reports whether the filesystem holding dir distinguishes
+// file names by case. It creates dir if needed and probes it with a temp
+// file; when the probe cannot be made it assumes a case-sensitive filesystem.
+func IsCaseSensitiveFS(dir string) bool {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return true
+	}
+	f, err := os.CreateTemp(dir, ".wbdl-case-*")
+	if err != nil {
+		return true
+	}
+	name := f.Name()
+	_ = f.Close()
+	defer func() { _ = os.Remove(name) }()
+	upper := filepath.Join(filepath.Dir(name), strings.ToUpper(filepath.Base(name)))
+	_, err = os.Stat(upper)
+	return err != nil
+}
+
 // abs converts a logical forward-slash path to an absolute OS path.
 func (s *LocalStorage) abs(path string) string {
-	return filepath.Join(s.rootDir, filepath.FromSlash(path))
+	p := s.stored(path)
+	if p != s.normalizePath(path) {
+		s.mu.Lock()
+		_, seen := s.shortened[path]
+		if !seen {
+			if s.shortened == nil {
+				s.shortened = make(map[string]struct{})
+			}
+			s.shortened[path] = struct{}{}
+		}
+		s.mu.Unlock()
+		if !seen && s.logf != nil {
+			s.logf("path of %s is too long, stored as %s", path, p)
+		}
+	}
+	return filepath.Join(s.rootDir, filepath.FromSlash(p))
+}
+
+// diskPath returns the path, relative to root, at which a LocalStorage
+// rooted there keeps the logical path p: case-folded when foldCase is set
+// (see foldPathCase), then fitted within max bytes (see fitPathLen). Link
+// rewriting maps paths through it too (see storedPath), so that links
+// point at the files as stored. It depends only on its arguments, and a
+// path it returns maps to itself.
+func diskPath(root, p string, foldCase bool, max int) string {
+	if foldCase {
+		p = foldPathCase(p)
+	}
+	return fitPathLen(root, p, max)
+}
+
+// fitPathLen returns the logical path p, or, when the absolute OS path of
+// p under root is longer than max bytes (and max > 0), a shorter stand-in:
+// the file name is replaced by a SHA-256 hash of p, keeping a short
+// extension, and directories are dropped from the end of p until the path
+// fits. The result depends only on its arguments, so storage and link
+// rewriting agree on it.
+func fitPathLen(root, p string, max int) string {
+	if max <= 0 {
+		return p
+	}
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		absRoot = root
+	}
+	fits := func(q string) bool { return len(filepath.Join(absRoot, filepath.FromSlash(q))) <= max }
+	if fits(p) {
+		return p
+	}
+	sum := sha256.Sum256([]byte(p))
+	name := hex.EncodeToString(sum[:16])
+	if ext := path.Ext(p); len(ext) <= 10 && !strings.Contains(ext, "%") {
+		name += ext
+	}
+	dir := path.Dir(p)
+	for dir != "." && !fits(path.Join(dir, name)) {
+		dir = path.Dir(dir)
+	}
+	return path.Join(dir, name)
+}
+
+// normalizePath maps a logical path to the case used on disk: the identity
+// on a case-sensitive filesystem, foldPathCase otherwise.
+func (s *LocalStorage) normalizePath(p string) string {
+	if !s.foldCase {
+		return p
+	}
+	return foldPathCase(p)
+}
+
+// foldPathCase returns p lower-cased for a filesystem that ignores case. A
+// path that was not lower-case already also gets a "~<crc32 of p>" suffix
+// before the extension, so spellings that differ only in case land in files
+// of their own, whichever is stored first and on every run.
+func foldPathCase(p string) string {
+	folded := strings.ToLower(p)
+	if folded == p {
+		return p
+	}
+	ext := path.Ext(folded)
+	return fmt.Sprintf("%s~%08x%s", strings.TrimSuffix(folded, ext), crc32.ChecksumIEEE([]byte(p)), ext)
+}
+
+// stored returns the path, relative to the root directory, the file for
+// logical path p is kept at (see diskPath).
+func (s *LocalStorage) stored(p string) string {
+	return diskPath(s.rootDir, p, s.foldCase, s.maxPathLen)
 }
 
 // Exists reports whether path already exists in storage.
@@ -45,7 +200,8 @@ func (s *LocalStorage) Exists(path string) bool {
 	return err == nil
 }
 
-// Put streams r into path atomically via a temp file + rename.
+// Put streams r into path atomically via a temp file + rename, flushing the
+// temp file to disk first when fsync is on (see SetFsync).
 func (s *LocalStorage) Put(path string, r io.Reader) error {
 	fullPath := s.abs(path)
 	dir := filepath.Dir(fullPath)
@@ -64,6 +220,11 @@ func (s *LocalStorage) Put(path string, r io.Reader) error {
 	if _, err := io.Copy(tmpFile, r); err != nil {
 		return err
 	}
+	if s.fsync {
+		if err := syncFile(tmpFile); err != nil {
+			return err
+		}
+	}
 	if err := tmpFile.Close(); err != nil {
 		return err
 	}
@@ -75,11 +236,161 @@ func (s *LocalStorage) Get(path string) ([]byte, error) {
 	return os.ReadFile(s.abs(path)) //nolint:gosec // G304: path is written by this program
 }
 
-// PutBytes writes data to path, creating parent directories as needed.
+// PutBytes writes data to path atomically, like Put.
 func (s *LocalStorage) PutBytes(path string, data []byte) error {
-	fullPath := s.abs(path)
-	if err := os.MkdirAll(filepath.Dir(fullPath), 0750); err != nil {
+	return s.Put(path, bytes.NewReader(data))
+}
+
+// Walk calls fn for every file under the root directory, skipping in-flight
+// temp files. A missing root directory is treated as empty. The paths are
+// the names on disk, case-folded or shortened (see diskPath); they map to
+// themselves, so they read back as they are.
+func (s *LocalStorage) Walk(fn func(path string) error) error {
+	err := filepath.WalkDir(s.rootDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || strings.HasPrefix(d.Name(), ".wbdl-") {
+			return nil
+		}
+		rel, err := filepath.Rel(s.rootDir, p)
+		if err != nil {
+			return err
+		}
+		return fn(filepath.ToSlash(rel))
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// partPath returns the OS path of the partial file kept for path. Its
+// ".wbdl-" prefix hides it from Walk, like Put's temp files.
+func (s *LocalStorage) partPath(path string) string {
+	full := s.abs(path)
+	return filepath.Join(filepath.Dir(full), ".wbdl-part-"+filepath.Base(full))
+}
+
+// PartSize returns the size of path's partial file, 0 when there is none.
+func (s *LocalStorage) PartSize(path string) int64 {
+	info, err := os.Stat(s.partPath(path))
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+// AppendPart appends r to path's partial file, creating it if needed. The
+// bytes written before an error are kept for a later resume.
+func (s *LocalStorage) AppendPart(path string, r io.Reader) error {
+	p := s.partPath(path)
+	if err := os.MkdirAll(filepath.Dir(p), 0750); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600) //nolint:gosec // G304: p is derived from a sanitized logical path
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if s.fsync {
+		if err := syncFile(f); err != nil {
+			_ = f.Close()
+			return err
+		}
+	}
+	return f.Close()
+}
+
+// CommitPart renames path's completed partial file into place.
+func (s *LocalStorage) CommitPart(path string) error {
+	return os.Rename(s.partPath(path), s.abs(path))
+}
+
+// RemovePart deletes path's partial file; a missing one is not an error.
+func (s *LocalStorage) RemovePart(path string) error {
+	if err := os.Remove(s.partPath(path)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// ModTime returns the modification time of the file at path.
+func (s *LocalStorage) ModTime(path string) (time.Time, bool) {
+	info, err := os.Stat(s.abs(path))
+	if err != nil {
+		return time.Time{}, false
+	}
+	return info.ModTime(), true
+}
+
+// SetModTime sets the access and modification times of the file at path to t.
+func (s *LocalStorage) SetModTime(path string, t time.Time) error {
+	return os.Chtimes(s.abs(path), t, t)
+}
+
+// MemStorage is a Storage that keeps every file in memory. It suits library
+// callers that post-process the download themselves, and tests.
+type MemStorage struct {
+	mu    sync.Mutex
+	files map[string][]byte
+}
+
+// NewMemStorage returns an empty MemStorage.
+func NewMemStorage() *MemStorage {
+	return &MemStorage{files: make(map[string][]byte)}
+}
+
+// Exists reports whether path has been stored.
+func (s *MemStorage) Exists(path string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.files[path]
+	return ok
+}
+
+// Put reads r to the end and stores its content at path; a failed read
+// leaves any previous content in place.
+func (s *MemStorage) Put(path string, r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
 		return err
 	}
-	return os.WriteFile(fullPath, data, 0600)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.files[path] = data
+	return nil
+}
+
+// Get returns the content of path, or an error wrapping fs.ErrNotExist.
+func (s *MemStorage) Get(path string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.files[path]
+	if !ok {
+		return nil, &fs.PathError{Op: "get", Path: path, Err: fs.ErrNotExist}
+	}
+	return bytes.Clone(data), nil
+}
+
+// PutBytes stores a copy of data at path.
+func (s *MemStorage) PutBytes(path string, data []byte) error {
+	return s.Put(path, bytes.NewReader(data))
+}
+
+// Walk calls fn for every stored path in lexical order. Files stored while
+// the walk runs may or may not be visited.
+func (s *MemStorage) Walk(fn func(path string) error) error {
+	s.mu.Lock()
+	paths := slices.Sorted(maps.Keys(s.files))
+	s.mu.Unlock()
+	for _, p := range paths {
+		if err := fn(p); err != nil {
+			return err
+		}
+	}
+	return nil
 }
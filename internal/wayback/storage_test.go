@@ -0,0 +1,212 @@
+package wayback
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Paths differing only in case must land in distinct files on a
+// case-insensitive filesystem, and each must read back its own content.
+func TestCaseInsensitiveStorageKeepsCaseVariantsApart(t *testing.T) {
+	store := NewCaseInsensitiveStorage(t.TempDir())
+	files := map[string]string{
+		"example.com/css/style.css": "lower",
+		"example.com/CSS/Style.CSS": "mixed",
+		"example.com/css/STYLE.css": "upper",
+	}
+	for p, body := range files {
+		if err := store.PutBytes(p, []byte(body)); err != nil {
+			t.Fatalf("PutBytes(%q): %v", p, err)
+		}
+	}
+	for p, body := range files {
+		got, err := store.Get(p)
+		if err != nil {
+			t.Fatalf("Get(%q): %v", p, err)
+		}
+		if string(got) != body {
+			t.Errorf("Get(%q) = %q, want %q", p, got, body)
+		}
+	}
+
+	var walked int
+	if err := store.Walk(func(string) error { walked++; return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if walked != len(files) {
+		t.Errorf("stored %d files, want %d", walked, len(files))
+	}
+}
+
+// Case folding depends on the path alone: a lower-case path is kept, any
+// other spelling gets its suffix whichever is stored first, and links map
+// to the same names as the files.
+func TestCaseInsensitiveStorageFoldsByPath(t *testing.T) {
+	const mixed, want = "example.com/Images/Logo.PNG", "example.com/images/logo~505d2b70.png"
+	for _, order := range [][]string{{mixed, "example.com/images/logo.png"}, {"example.com/images/logo.png", mixed}} {
+		store := NewCaseInsensitiveStorage(t.TempDir())
+		for _, p := range order {
+			if err := store.PutBytes(p, []byte(p)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if got := store.normalizePath(mixed); got != want {
+			t.Errorf("normalizePath(%q) = %q, want %q", mixed, got, want)
+		}
+		if got := store.normalizePath("example.com/images/logo.png"); got != "example.com/images/logo.png" {
+			t.Errorf("normalizePath(lower-case) = %q", got)
+		}
+	}
+	if got := foldPathCase(want); got != want {
+		t.Errorf("foldPathCase(%q) = %q, want it unchanged", want, got)
+	}
+	if got := NewLocalStorage("x").normalizePath("A/B.css"); got != "A/B.css" {
+		t.Errorf("case-sensitive normalizePath = %q, want identity", got)
+	}
+
+	insensitive := false
+	cfg := &Config{BareHost: "example.com", Directory: "out", CaseSensitiveFS: &insensitive}
+	u, _ := url.Parse("https://example.com/Images/Logo.PNG")
+	if got, want := localHref(u, "out", cfg, nil), foldPathCase("Images/Logo.PNG"); got != want || got == "Images/Logo.PNG" {
+		t.Errorf("localHref = %q, want %q", got, want)
+	}
+}
+
+// The case-sensitivity probe must clean up after itself.
+func TestIsCaseSensitiveFSLeavesNoFiles(t *testing.T) {
+	dir := t.TempDir()
+	IsCaseSensitiveFS(dir)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("probe left %d files behind", len(entries))
+	}
+}
+
+// With fsync on, every write is flushed before the rename; without it, none.
+func TestLocalStorageFsync(t *testing.T) {
+	var synced int
+	old := syncFile
+	syncFile = func(f *os.File) error { synced++; return old(f) }
+	t.Cleanup(func() { syncFile = old })
+
+	store := NewLocalStorage(t.TempDir())
+	if err := store.PutBytes("a.html", []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if synced != 0 {
+		t.Errorf("synced %d times with fsync off", synced)
+	}
+
+	store.SetFsync(true)
+	if err := store.PutBytes("b.html", []byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Put("c/d.css", strings.NewReader("d")); err != nil {
+		t.Fatal(err)
+	}
+	if synced != 2 {
+		t.Errorf("synced %d times, want 2", synced)
+	}
+	if got, err := store.Get("c/d.css"); err != nil || string(got) != "d" {
+		t.Errorf("Get = %q, %v", got, err)
+	}
+
+	// A failed flush must fail the write and leave no file behind.
+	syncFile = func(*os.File) error { return errors.New("disk gone") }
+	if err := store.PutBytes("e.html", []byte("e")); err == nil {
+		t.Error("expected the sync error")
+	}
+	if store.Exists("e.html") {
+		t.Error("file stored despite the failed sync")
+	}
+}
+
+// A logical path too long for the limit is stored under a hashed name within
+// it, and reads back through the same logical path.
+func TestLocalStorageMaxPathLen(t *testing.T) {
+	dir, err := filepath.Abs(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := NewLocalStorage(dir)
+	var logged []string
+	max := len(dir) + 80
+	store.SetMaxPathLen(max, func(format string, args ...any) { logged = append(logged, fmt.Sprintf(format, args...)) })
+
+	long := "docs/" + strings.Repeat("section/", 10) + strings.Repeat("x", 120) + ".html"
+	if err := store.PutBytes(long, []byte("long")); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := store.Get(long); err != nil || string(got) != "long" {
+		t.Errorf("Get = %q, %v", got, err)
+	}
+	if !store.Exists(long) {
+		t.Error("Exists = false for the long path")
+	}
+	if err := store.PutBytes("short.html", []byte("s")); err != nil {
+		t.Fatal(err)
+	}
+
+	var stored []string
+	err = filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			stored = append(stored, p)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored) != 2 {
+		t.Fatalf("stored %q, want 2 files", stored)
+	}
+	for _, p := range stored {
+		if len(p) > max {
+			t.Errorf("%s is %d bytes long, limit %d", p, len(p), max)
+		}
+		if rel, _ := filepath.Rel(dir, p); rel != "short.html" && (!strings.HasPrefix(filepath.ToSlash(rel), "docs/") || filepath.Ext(rel) != ".html") {
+			t.Errorf("long path stored as %s, want a hashed .html under docs/", rel)
+		}
+	}
+	if len(logged) != 1 {
+		t.Errorf("logged %q, want one note for the shortened path", logged)
+	}
+}
+
+// MemStorage reads back what was stored, walks in lexical order and reports
+// a missing path as fs.ErrNotExist.
+func TestMemStorage(t *testing.T) {
+	s := NewMemStorage()
+	if err := s.PutBytes("b/page.html", []byte("page")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put("a.css", strings.NewReader("css")); err != nil {
+		t.Fatal(err)
+	}
+	if !s.Exists("a.css") || s.Exists("c.js") {
+		t.Error("Exists reports the wrong paths")
+	}
+	if got, err := s.Get("b/page.html"); err != nil || string(got) != "page" {
+		t.Errorf("Get = %q, %v", got, err)
+	}
+	if _, err := s.Get("c.js"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Get missing: %v, want fs.ErrNotExist", err)
+	}
+	var paths []string
+	_ = s.Walk(func(p string) error {
+		paths = append(paths, p)
+		return nil
+	})
+	if strings.Join(paths, ",") != "a.css,b/page.html" {
+		t.Errorf("Walk = %v", paths)
+	}
+}
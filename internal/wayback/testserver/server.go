@@ -0,0 +1,161 @@
+// Package testserver provides a mock Wayback Machine for tests: an
+// httptest.Server answering the CDX API and serving raw capture content
+// from a fixed set of entries, so downloads run without network access.
+package testserver
+
+import (
+	"encoding/json"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// TestEntry is the capture of one URL served by a TestServer.
+type TestEntry struct {
+	Timestamp   string // 14-digit CDX timestamp
+	Body        string
+	ContentType string // "" lets net/http sniff it
+	Status      int    // status of the content request; 0 = 200
+}
+
+// TestServer is a mock archive. Point Config.ArchiveBase at its URL.
+type TestServer struct {
+	*httptest.Server
+	entries map[string]TestEntry
+
+	mu       sync.Mutex
+	requests []string
+}
+
+// NewTestServer starts a TestServer serving entries (original URL →
+// capture) and closes it when t finishes.
+func NewTestServer(t testing.TB, entries map[string]TestEntry) *TestServer {
+	s := New(entries)
+	t.Cleanup(s.Close)
+	return s
+}
+
+// New starts a TestServer serving entries, for use outside a test (e.g. in
+// an example); the caller must Close it.
+func New(entries map[string]TestEntry) *TestServer {
+	s := &TestServer{entries: entries}
+	// A plain handler rather than a ServeMux: the mux would "clean" the
+	// "http://" inside capture URLs and redirect.
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.requests = append(s.requests, r.URL.RequestURI())
+		s.mu.Unlock()
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/cdx/search/"):
+			s.CDXHandler(w, r)
+		case strings.HasPrefix(r.URL.Path, "/web/"):
+			s.ContentHandler(w, r)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	return s
+}
+
+// Requests returns the request URIs received so far, in arrival order.
+func (s *TestServer) Requests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.requests)
+}
+
+// ContentRequests returns the received capture (/web/) request URIs.
+func (s *TestServer) ContentRequests() []string {
+	var out []string
+	for _, r := range s.Requests() {
+		if strings.HasPrefix(r, "/web/") {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+// CDXHandler answers a CDX query (either endpoint) in JSON output format. It
+// honours url (exact, or a prefix when it ends in "/*"), matchType=domain,
+// from and to; scheme and a www. prefix are ignored when matching, as in the
+// real index. Every row is returned on page 0 and later pages are empty.
+func (s *TestServer) CDXHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	rows := [][]string{{"timestamp", "original"}}
+	if q.Get("page") == "" || q.Get("page") == "0" {
+		for _, u := range slices.Sorted(maps.Keys(s.entries)) {
+			e := s.entries[u]
+			if matches(u, q.Get("url"), q.Get("matchType")) && inRange(e.Timestamp, q.Get("from"), q.Get("to")) {
+				rows = append(rows, []string{e.Timestamp, u})
+			}
+		}
+		if q.Get("limit") == "1" && len(rows) > 2 {
+			rows = rows[:2]
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(rows)
+}
+
+// ContentHandler serves /web/<timestamp>id_/<url> with the entry for url,
+// whatever the timestamp (the archive redirects to the closest capture), or
+// 404 when there is none.
+func (s *TestServer) ContentHandler(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.EscapedPath(), "/web/")
+	_, orig, ok := strings.Cut(rest, "id_/")
+	if r.URL.RawQuery != "" {
+		orig += "?" + r.URL.RawQuery
+	}
+	e, found := s.entries[orig]
+	if !ok || !found {
+		http.NotFound(w, r)
+		return
+	}
+	if e.ContentType != "" {
+		w.Header().Set("Content-Type", e.ContentType)
+	}
+	if e.Status != 0 {
+		w.WriteHeader(e.Status)
+	}
+	_, _ = w.Write([]byte(e.Body))
+}
+
+// matches reports whether the original URL u is selected by the CDX url
+// parameter query under matchType.
+func matches(u, query, matchType string) bool {
+	key := urlKey(u)
+	if matchType == "domain" {
+		host, _, _ := strings.Cut(key, "/")
+		q, _, _ := strings.Cut(urlKey(query), "/")
+		return host == q || strings.HasSuffix(host, "."+q)
+	}
+	if prefix, ok := strings.CutSuffix(query, "*"); ok {
+		return strings.HasPrefix(key, urlKey(prefix))
+	}
+	return strings.TrimSuffix(key, "/") == strings.TrimSuffix(urlKey(query), "/")
+}
+
+// urlKey drops the scheme and a www. prefix from u and lower-cases its host.
+func urlKey(u string) string {
+	if p, err := url.Parse(u); err == nil && p.Host != "" {
+		u = strings.ToLower(p.Host) + p.RequestURI()
+	}
+	return strings.TrimPrefix(u, "www.")
+}
+
+// inRange reports whether timestamp ts falls within the CDX from/to bounds,
+// which may be any prefix of a 14-digit timestamp.
+func inRange(ts, from, to string) bool {
+	if from != "" && ts < from {
+		return false
+	}
+	if to != "" && len(ts) >= len(to) && ts[:len(to)] > to {
+		return false
+	}
+	return true
+}
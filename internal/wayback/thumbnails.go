@@ -0,0 +1,50 @@
+package wayback
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+)
+
+// ThumbnailDir is the logical directory page thumbnails are stored under.
+const ThumbnailDir = "_thumbs"
+
+// thumbnailPath returns the logical path of the thumbnail for a page stored
+// at logicalPath, e.g. "about/index.html" → "_thumbs/about/index.html.png".
+func thumbnailPath(logicalPath string) string {
+	return ThumbnailDir + "/" + logicalPath + ".png"
+}
+
+// thumbnailURL returns the URL of the rendered screenshot for pageURL on the
+// archive at base. The Wayback Machine stores screenshots as captures of
+// web.archive.org/screenshot/<url>, so they are fetched through the
+// raw-content (id_) endpoint like any capture.
+func thumbnailURL(base, timestamp, pageURL string) string {
+	return rawCaptureURL(base, timestamp, "http://web.archive.org/screenshot/"+pageURL)
+}
+
+// fetchThumbnail downloads the screenshot of snap from the archive at base
+// into storage.
+// It returns (false, nil) when the archive has no screenshot for the page.
+func fetchThumbnail(ctx context.Context, client *http.Client, base string, snap Snapshot, logicalPath string, store Storage) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, thumbnailURL(base, snap.Timestamp, snap.FileURL), nil)
+	if err != nil {
+		return false, fmt.Errorf("create request: %w", err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("http get: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("HTTP %d for thumbnail of %s", resp.StatusCode, snap.FileURL)
+	}
+	if err := store.Put(thumbnailPath(logicalPath), resp.Body); err != nil {
+		return false, fmt.Errorf("store: %w", err)
+	}
+	return true, nil
+}
@@ -0,0 +1,19 @@
+package wayback
+
+import "testing"
+
+func TestThumbnailPathAndURL(t *testing.T) {
+	if got, want := thumbnailPath("about/index.html"), "_thumbs/about/index.html.png"; got != want {
+		t.Errorf("thumbnailPath = %q, want %q", got, want)
+	}
+	got := thumbnailURL("", "20230601000000", "https://example.com/about/")
+	want := "https://web.archive.org/web/20230601000000id_/http://web.archive.org/screenshot/https://example.com/about/"
+	if got != want {
+		t.Errorf("thumbnailURL\n  got  %q\n  want %q", got, want)
+	}
+	got = thumbnailURL("https://wayback.internal/", "20230601000000", "https://example.com/")
+	want = "https://wayback.internal/web/20230601000000id_/http://web.archive.org/screenshot/https://example.com/"
+	if got != want {
+		t.Errorf("thumbnailURL with base\n  got  %q\n  want %q", got, want)
+	}
+}
@@ -0,0 +1,145 @@
+package wayback
+
+import (
+	"cmp"
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// withInsecureTLS returns a copy of c that skips TLS certificate
+// verification, or c itself unless cfg.Insecure is set. Only an
+// *http.Transport (or the default transport) can be reconfigured; a client
+// with any other RoundTripper is returned unchanged.
+func withInsecureTLS(c *http.Client, cfg *Config) *http.Client {
+	if !cfg.Insecure {
+		return c
+	}
+	base := c.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	t, ok := base.(*http.Transport)
+	if !ok {
+		return c
+	}
+	t = t.Clone()
+	if t.TLSClientConfig == nil {
+		t.TLSClientConfig = &tls.Config{} //nolint:gosec // G402: MinVersion left at the Go default
+	}
+	t.TLSClientConfig.InsecureSkipVerify = true //nolint:gosec // G402: explicit opt-in via Config.Insecure
+	cp := *c
+	cp.Transport = t
+	return &cp
+}
+
+// defaultIdleConnTimeout is how long an idle connection is kept when
+// Config.IdleConnTimeout is 0 (net/http's default).
+const defaultIdleConnTimeout = 90 * time.Second
+
+// withTransportTuning returns a copy of c whose transport keeps enough idle
+// connections for cfg.Threads concurrent requests to the archive (net/http
+// keeps 2 per host by default, so larger pools reconnect constantly), drops
+// them after cfg.IdleConnTimeout, and with cfg.DNSCacheTTL set, caches name
+// lookups. Like withInsecureTLS, it only reconfigures an *http.Transport (or
+// the default transport) and returns c unchanged otherwise.
+func withTransportTuning(c *http.Client, cfg *Config) *http.Client {
+	base := c.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	t, ok := base.(*http.Transport)
+	if !ok {
+		return c
+	}
+	t = t.Clone()
+	perHost := cfg.MaxIdleConnsPerHost
+	if perHost <= 0 {
+		perHost = max(cfg.Threads, 1)
+	}
+	t.MaxIdleConnsPerHost = perHost
+	if t.MaxIdleConns > 0 {
+		t.MaxIdleConns = max(t.MaxIdleConns, perHost)
+	}
+	t.IdleConnTimeout = cmp.Or(cfg.IdleConnTimeout, defaultIdleConnTimeout)
+	if cfg.DNSCacheTTL > 0 {
+		t.DialContext = newDNSCache(cfg.DNSCacheTTL).DialContext
+	}
+	cp := *c
+	cp.Transport = t
+	return &cp
+}
+
+// dnsCache resolves host names once per TTL for DialContext, saving a
+// lookup for every new connection of a long run.
+type dnsCache struct {
+	ttl      time.Duration
+	dialer   *net.Dialer
+	resolver *net.Resolver
+	now      func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]dnsEntry
+}
+
+// dnsEntry is the cached result of one lookup.
+type dnsEntry struct {
+	addrs   []string
+	expires time.Time
+}
+
+func newDNSCache(ttl time.Duration) *dnsCache {
+	return &dnsCache{
+		ttl:      ttl,
+		dialer:   &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second},
+		resolver: net.DefaultResolver,
+		now:      time.Now,
+		entries:  make(map[string]dnsEntry),
+	}
+}
+
+// lookup returns the addresses of host, from the cache while they are
+// fresh. Failed lookups are not cached.
+func (d *dnsCache) lookup(ctx context.Context, host string) ([]string, error) {
+	d.mu.Lock()
+	e, ok := d.entries[host]
+	d.mu.Unlock()
+	if ok && d.now().Before(e.expires) {
+		return e.addrs, nil
+	}
+	addrs, err := d.resolver.LookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	d.mu.Lock()
+	d.entries[host] = dnsEntry{addrs: addrs, expires: d.now().Add(d.ttl)}
+	d.mu.Unlock()
+	return addrs, nil
+}
+
+// DialContext dials addr through the cached addresses of its host, trying
+// each in turn; IP literals are dialled directly.
+func (d *dnsCache) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || net.ParseIP(host) != nil {
+		return d.dialer.DialContext(ctx, network, addr)
+	}
+	addrs, err := d.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var firstErr error
+	for _, a := range addrs {
+		conn, err := d.dialer.DialContext(ctx, network, net.JoinHostPort(a, port))
+		if err == nil {
+			return conn, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return nil, firstErr
+}
@@ -0,0 +1,97 @@
+package wayback
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A self-signed server is rejected by default and accepted with Insecure.
+func TestWithInsecureTLS(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	get := func(c *http.Client) error {
+		resp, err := c.Get(srv.URL)
+		if err == nil {
+			_ = resp.Body.Close()
+		}
+		return err
+	}
+
+	base := &http.Client{}
+	if err := get(withInsecureTLS(base, &Config{})); err == nil {
+		t.Error("expected a certificate error without Insecure")
+	}
+	if err := get(withInsecureTLS(base, &Config{Insecure: true})); err != nil {
+		t.Errorf("Insecure request failed: %v", err)
+	}
+	if base.Transport != nil {
+		t.Error("the original client must not be modified")
+	}
+}
+
+// The idle pool is sized for Threads unless set, and a client with a custom
+// RoundTripper is left alone.
+func TestWithTransportTuning(t *testing.T) {
+	for _, tc := range []struct {
+		cfg  Config
+		want int
+	}{
+		{Config{Threads: 16}, 16},
+		{Config{Threads: 16, MaxIdleConnsPerHost: 4}, 4},
+		{Config{}, 1},
+	} {
+		c := withTransportTuning(&http.Client{}, &tc.cfg)
+		tr, ok := c.Transport.(*http.Transport)
+		if !ok {
+			t.Fatalf("transport = %T, want *http.Transport", c.Transport)
+		}
+		if tr.MaxIdleConnsPerHost != tc.want || tr.IdleConnTimeout != defaultIdleConnTimeout {
+			t.Errorf("%+v: per host %d, idle timeout %v; want %d, %v", tc.cfg, tr.MaxIdleConnsPerHost, tr.IdleConnTimeout, tc.want, defaultIdleConnTimeout)
+		}
+	}
+
+	custom := &http.Client{Transport: redirectTransport{}}
+	if c := withTransportTuning(custom, &Config{Threads: 8}); c != custom {
+		t.Error("a client with a custom RoundTripper must be returned unchanged")
+	}
+}
+
+// Lookups are answered from the cache until the TTL passes, and dialling
+// through the cache reaches the server.
+func TestDNSCache(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	now := time.Now()
+	d := newDNSCache(time.Minute)
+	d.now = func() time.Time { return now }
+	ctx := context.Background()
+	if _, err := d.lookup(ctx, "localhost"); err != nil {
+		t.Skipf("localhost does not resolve: %v", err)
+	}
+	d.entries["localhost"] = dnsEntry{addrs: []string{"127.0.0.1"}, expires: now.Add(time.Minute)}
+	if addrs, _ := d.lookup(ctx, "localhost"); !slices.Equal(addrs, []string{"127.0.0.1"}) {
+		t.Errorf("fresh entry not used: %v", addrs)
+	}
+
+	_, port, _ := net.SplitHostPort(strings.TrimPrefix(srv.URL, "http://"))
+	c := &http.Client{Transport: &http.Transport{DialContext: d.DialContext}}
+	resp, err := c.Get("http://localhost:" + port + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+
+	now = now.Add(2 * time.Minute)
+	d.entries["localhost"] = dnsEntry{addrs: []string{"192.0.2.1"}, expires: now.Add(-time.Second)}
+	if addrs, _ := d.lookup(ctx, "localhost"); slices.Contains(addrs, "192.0.2.1") {
+		t.Error("expired entry was used")
+	}
+}
@@ -1,11 +1,18 @@
 package wayback
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"log"
+	"maps"
 	"net/url"
 	"path"
 	"path/filepath"
+	"regexp"
+	"slices"
 	"strings"
+	"sync"
 
 	sanitize "github.com/mrz1836/go-sanitize"
 	"golang.org/x/net/idna"
@@ -14,13 +21,15 @@ import (
 // NormalizedBase holds the canonical form and all URL variants for a base URL.
 type NormalizedBase struct {
 	CanonicalURL string
-	Variants     []string // all http/https + www combinations
+	Variants     []string // all http/https + www (+ extra subdomain) combinations
 	BareHost     string   // hostname without www.
 	UnicodeHost  string   // IDN-decoded hostname
 }
 
 // NormalizeBaseURL parses and normalises the user-supplied URL/domain input.
-func NormalizeBaseURL(input string) (*NormalizedBase, error) {
+// Each of subdomains (e.g. "blog") is prepended to the bare host and added to
+// the variants alongside the bare and www. forms.
+func NormalizeBaseURL(input string, subdomains ...string) (*NormalizedBase, error) {
 	input = strings.TrimSpace(input)
 	if input == "" {
 		return nil, fmt.Errorf("empty URL")
@@ -60,9 +69,12 @@ func NormalizeBaseURL(input string) (*NormalizedBase, error) {
 		urlPath = "/"
 	}
 
-	// Build all http/https × bare/www variants
+	// Build all http/https × bare/www/subdomain variants
 	schemes := []string{"https", "http"}
 	hostVariants := []string{bareHost, "www." + bareHost}
+	for _, sub := range normalizeSubdomains(subdomains) {
+		hostVariants = append(hostVariants, sub+"."+bareHost)
+	}
 	var variants []string
 	for _, s := range schemes {
 		for _, h := range hostVariants {
@@ -87,6 +99,88 @@ func NormalizeBaseURL(input string) (*NormalizedBase, error) {
 	}, nil
 }
 
+// normalizeSubdomains lower-cases and trims subdomain labels, dropping empty
+// entries, duplicates and "www" (which is always included).
+func normalizeSubdomains(subdomains []string) []string {
+	seen := make(map[string]bool)
+	var out []string
+	for _, sub := range subdomains {
+		sub = strings.Trim(strings.ToLower(strings.TrimSpace(sub)), ".")
+		if sub == "" || sub == "www" || seen[sub] {
+			continue
+		}
+		seen[sub] = true
+		out = append(out, sub)
+	}
+	return out
+}
+
+// waybackPrefixes caches the result of reWaybackPrefix per archive root.
+var waybackPrefixes sync.Map // archiveRoot → *regexp.Regexp
+
+// reWaybackPrefix returns the regexp that matches a replay URL on the
+// archive at base (see archiveRoot), with an optional im_/id_/js_… flag
+// after the timestamp, and captures the original URL.
+func reWaybackPrefix(base string) *regexp.Regexp {
+	root := archiveRoot(base)
+	if re, ok := waybackPrefixes.Load(root); ok {
+		return re.(*regexp.Regexp)
+	}
+	re := regexp.MustCompile(`^(?:https?:)?//(?i:` + regexp.QuoteMeta(archiveHostPath(base)) + `)/web/\d+(?:[a-z]{2}_)?/(.+)$`)
+	waybackPrefixes.Store(root, re)
+	return re
+}
+
+// archiveHostPath returns the archive root for base (see archiveRoot)
+// without its scheme, e.g. "web.archive.org".
+func archiveHostPath(base string) string {
+	root := archiveRoot(base)
+	if _, rest, ok := strings.Cut(root, "://"); ok {
+		return rest
+	}
+	return root
+}
+
+// reCollapsedScheme matches "http:/host" where the archive collapsed "//".
+var reCollapsedScheme = regexp.MustCompile(`^(https?:)/+`)
+
+// unwrapWaybackURL strips the <archive>/web/<timestamp><flag>_/ prefix of
+// the archive at base (see archiveRoot), returning the original URL. Other
+// URLs are returned unchanged. A scheme-less or slash-collapsed original
+// ("example.com/a", "http:/example.com/a") is repaired to an absolute
+// http(s) URL.
+func unwrapWaybackURL(u, base string) string {
+	m := reWaybackPrefix(base).FindStringSubmatch(u)
+	if m == nil {
+		return u
+	}
+	orig := m[1]
+	if reCollapsedScheme.MatchString(orig) {
+		return reCollapsedScheme.ReplaceAllString(orig, "$1//")
+	}
+	return "http://" + orig
+}
+
+// stripFragment returns rawURL without its #fragment, if any.
+func stripFragment(rawURL string) string {
+	if i := strings.IndexByte(rawURL, '#'); i >= 0 {
+		return rawURL[:i]
+	}
+	return rawURL
+}
+
+// stripWaybackPrefix returns the original URL that a resolved replay URL on
+// the archive at base points at, or u itself when it is not a replay URL.
+func stripWaybackPrefix(u *url.URL, base string) *url.URL {
+	s := u.String()
+	if orig := unwrapWaybackURL(s, base); orig != s {
+		if ou, err := url.Parse(orig); err == nil {
+			return ou
+		}
+	}
+	return u
+}
+
 // RelativeLink returns the relative path from fromDir to toFile.
 func RelativeLink(fromDir, toFile string) string {
 	rel, err := filepath.Rel(filepath.FromSlash(fromDir), filepath.FromSlash(toFile))
@@ -96,6 +190,71 @@ func RelativeLink(fromDir, toFile string) string {
 	return ToPosix(rel)
 }
 
+// localHref returns the link from a file in localDir to the local copy of
+// target, mapped with the same localPathFor and storedPath calls the
+// downloader uses, and, in Config.Merge mode, through idx's merge index, so
+// a URL stored under a suffixed name is linked there. idx may be nil.
+//
+// Preserve-mode filenames contain literal % sequences (e.g. %3F for ?), which
+// must be re-encoded as %25 so browsers decode the href back to the on-disk
+// name. Pretty-mode filenames are sanitized and never contain an encoded %, so
+// the re-encoding is skipped there to avoid mangling the link.
+func localHref(target *url.URL, localDir string, cfg *Config, idx *SnapshotIndex) string {
+	localTarget := localPathFor(target.String(), cfg)
+	if idx != nil {
+		localTarget = idx.merge.lookup(localTarget, target.String())
+	}
+	localTarget = storedPath(localTarget, cfg)
+	localTarget = ToPosix(filepath.Join(cfg.Directory, filepath.FromSlash(localTarget)))
+	rel := RelativeLink(localDir, localTarget)
+	if !cfg.PrettyPath {
+		rel = hrefForLocalPath(rel)
+	}
+	if cfg.DebugURLs {
+		debugURL("link", target.String(), rel+" (from "+localDir+")")
+	}
+	return rel
+}
+
+// storedPath returns the path, relative to cfg.Directory, at which the
+// LocalStorage of a run under cfg keeps logical path p (see diskPath); p
+// itself when cfg.Storage is another Storage.
+func storedPath(p string, cfg *Config) string {
+	if cfg.Storage != nil {
+		return p
+	}
+	foldCase := cfg.CaseSensitiveFS != nil && !*cfg.CaseSensitiveFS
+	return diskPath(cfg.Directory, p, foldCase, cfg.MaxAbsPathLen)
+}
+
+// localDirFor returns the directory, joined with cfg.Directory, the file
+// for logical path p is stored in (see storedPath): the directory links in
+// that file are made relative to.
+func localDirFor(p string, cfg *Config) string {
+	return ToPosix(filepath.ToSlash(filepath.Dir(filepath.Join(cfg.Directory, filepath.FromSlash(storedPath(p, cfg))))))
+}
+
+// internalHref returns the link from a file in localDir to the internal URL
+// target: its local copy (see localHref), or, with cfg.SkipAssets, for a
+// target that is not a page and so is never downloaded, its capture on the
+// archive, or target itself when idx knows no capture of it.
+func internalHref(target *url.URL, localDir string, cfg *Config, idx *SnapshotIndex) string {
+	if cfg.SkipAssets && !isPageURL(target.String()) {
+		if snap, ok := idx.Lookup(target.String()); ok {
+			return rawCaptureURL(cfg.ArchiveBase, snap.Timestamp, snap.FileURL)
+		}
+		return target.String()
+	}
+	return localHref(target, localDir, cfg, idx)
+}
+
+// debugURL logs one step of mapping the URL src to a local path, for
+// Config.DebugURLs. step is "cdx" (original URL), "local" (localPathFor),
+// "file" (joined with the output directory) or "link" (rewritten reference).
+func debugURL(step, src, result string) {
+	log.Printf("url: %-5s %s => %s", step, src, result)
+}
+
 // ToPosix converts backslashes to forward slashes.
 func ToPosix(p string) string {
 	return strings.ReplaceAll(p, "\\", "/")
@@ -105,10 +264,11 @@ func ToPosix(p string) string {
 // fragment (no leading slash) suitable for joining with the output directory.
 // The URL fragment (#…) is always stripped.
 //
-// When pretty is true (–prettyPath flag), extension-less last segments are
-// treated as implicit directories and resolved to index.html; query parameters
-// are embedded before the file extension using "_" separators; characters are
-// normalised with sanitize.PathName (keeps [a-zA-Z0-9_-] only).
+// When pretty is true (–prettyPath flag), last segments without a known
+// extension (see segmentExt) are treated as implicit directories and resolved
+// to index.html; query parameters are embedded before the file extension
+// using "_" separators; characters are normalised with sanitize.PathName
+// (keeps [a-zA-Z0-9_-] only, plus the dots between them).
 //
 // When pretty is false (default), the original URL structure is preserved:
 //   - Path percent-encodings from the source URL are kept as-is.
@@ -122,6 +282,13 @@ func URLToLocalPath(rawURL string, pretty bool) string {
 	if err != nil {
 		return "unknown"
 	}
+	if escaped := u.EscapedPath(); escaped != "" {
+		if cleaned := cleanPath(escaped); cleaned != escaped {
+			if decoded, err := url.PathUnescape(cleaned); err == nil {
+				u.Path, u.RawPath = decoded, cleaned
+			}
+		}
+	}
 
 	isDir := u.Path == "" || strings.HasSuffix(u.Path, "/")
 
@@ -146,7 +313,7 @@ func URLToLocalPath(rawURL string, pretty bool) string {
 			filename = buildIndexName(u.RawQuery)
 		default:
 			last := segments[len(segments)-1]
-			ext := path.Ext(last)
+			ext := segmentExt(last)
 			if ext == "" {
 				dirSegs = segments
 				filename = buildIndexName(u.RawQuery)
@@ -193,6 +360,337 @@ func URLToLocalPath(rawURL string, pretty bool) string {
 	return last
 }
 
+// localPathFor returns the logical path rawURL is stored at under cfg:
+// URLToLocalPath in cfg's path mode, truncated to cfg.MaxPathDepth. With
+// cfg.TrailingSlash "collapse", rawURL is first given a trailing slash when
+// its last segment has no extension (see collapseTrailingSlash).
+// Non-ASCII characters are written in cfg.FilenameEncoding and, with
+// cfg.NormalizeEncodedPaths, escaped safe characters decoded
+// (see decodeSafeEscapes). Files of hosts other than cfg.BareHost, such as
+// cfg.ExtraSubdomains, go under a directory named after their host, so the
+// paths the hosts share stay apart; with cfg.OnlyLatestPerHost every host
+// gets one. CDN hosts of cfg.CDNMap go under their mapped directory.
+func localPathFor(rawURL string, cfg *Config) string {
+	if cfg.TrailingSlash == "collapse" {
+		rawURL = collapseTrailingSlash(rawURL)
+	}
+	if cfg.PrettyPath && cfg.FilenameEncoding == FilenameASCII {
+		rawURL = asciiURLPath(rawURL)
+	}
+	p := URLToLocalPath(rawURL, cfg.PrettyPath)
+	if !cfg.PrettyPath {
+		p = encodeFilename(p, cfg.FilenameEncoding)
+		if cfg.NormalizeEncodedPaths {
+			p = decodeSafeEscapes(p)
+		}
+	}
+	p = truncatePathDepth(p, cfg.MaxPathDepth)
+	if prefix, ok := cdnPrefix(rawURL, cfg); ok {
+		p = prefix + "/" + p
+	} else if u, err := url.Parse(rawURL); err == nil && u.Hostname() != "" &&
+		(cfg.OnlyLatestPerHost || cfg.BareHost != "" && hostKey(u) != strings.TrimPrefix(strings.ToLower(cfg.BareHost), "www.")) {
+		p = hostKey(u) + "/" + p
+	}
+	return p
+}
+
+// cdnPrefix returns the directory cfg.CDNMap assigns to the host of rawURL,
+// and false when the host is not a mapped CDN.
+func cdnPrefix(rawURL string, cfg *Config) (string, bool) {
+	if len(cfg.CDNMap) == 0 {
+		return "", false
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", false
+	}
+	prefix, ok := cfg.CDNMap[strings.ToLower(u.Host)]
+	return prefix, ok
+}
+
+// validCDNMap reports whether every key of m is a lower-case host and every
+// value a relative directory that stays inside the output directory.
+func validCDNMap(m map[string]string) bool {
+	for host, prefix := range m {
+		if host == "" || host != strings.ToLower(host) || strings.ContainsAny(host, "/ ") ||
+			prefix == "" || strings.Contains(prefix, `\`) || path.IsAbs(prefix) ||
+			path.Clean(prefix) != prefix || prefix == "." || prefix == ".." || strings.HasPrefix(prefix, "../") {
+			return false
+		}
+	}
+	return true
+}
+
+// collapseTrailingSlash returns rawURL with a trailing slash added to its
+// path when the last segment has no extension, so "/dir" and "/dir/" map to
+// the same dir/index.html instead of a file dir that would clash with the
+// directory holding /dir/'s children. SnapshotIndex already keys both forms
+// alike (see pathIDFor); this makes their local paths, and the links the
+// rewriters compute to them, agree too.
+func collapseTrailingSlash(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Path == "" || strings.HasSuffix(u.Path, "/") || path.Ext(path.Base(u.Path)) != "" {
+		return rawURL
+	}
+	u.Path += "/"
+	if u.RawPath != "" {
+		u.RawPath += "/"
+	}
+	return u.String()
+}
+
+// hostKey returns u's host name lower-cased and without a www. prefix.
+func hostKey(u *url.URL) string {
+	return strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.")
+}
+
+// truncatePathDepth shortens logical path p to at most depth components
+// (0 = unlimited): the first depth-1 directories are kept and the file name
+// gets a "~" plus 16 hex digits of the SHA-256 of p inserted before its
+// extension, so distinct deep paths stay distinct.
+// "a/b/c/d/page.html" at depth 3 becomes "a/b/page~<hash>.html".
+func truncatePathDepth(p string, depth int) string {
+	segs := strings.Split(p, "/")
+	if depth <= 0 || len(segs) <= depth {
+		return p
+	}
+	sum := sha256.Sum256([]byte(p))
+	short := withSuffix(segs[len(segs)-1], "~"+hex.EncodeToString(sum[:8]))
+	return strings.Join(append(segs[:depth-1:depth-1], short), "/")
+}
+
+// cyclicSegmentRepeats is how many times one path segment may occur before
+// isCyclicPath treats the URL as a crawler loop.
+const cyclicSegmentRepeats = 4
+
+// isCyclicPath reports whether the path of rawURL repeats one segment
+// cyclicSegmentRepeats or more times, as in "/a/a/a/a/" or "/a/b/a/b/a/b/a/b":
+// the signature of a buggy relative link followed over and over by the
+// archive's crawler.
+func isCyclicPath(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return false
+	}
+	count := make(map[string]int)
+	for _, seg := range strings.Split(u.EscapedPath(), "/") {
+		if seg == "" {
+			continue
+		}
+		if count[seg]++; count[seg] >= cyclicSegmentRepeats {
+			return true
+		}
+	}
+	return false
+}
+
+// dropCyclicPaths returns manifest without the snapshots whose URL has a
+// cyclic path (see isCyclicPath), logging each dropped URL at LogDebug.
+func dropCyclicPaths(manifest []Snapshot, cfg *Config) []Snapshot {
+	out := manifest[:0:0]
+	for _, s := range manifest {
+		if isCyclicPath(s.FileURL) {
+			cfg.Log(LogDebug, "skip cyclic path %s", s.FileURL)
+			continue
+		}
+		out = append(out, s)
+	}
+	return out
+}
+
+// latestRootPerHost reduces entries to the newest capture of the root page
+// of each host (www. folded into the bare host), ordered by host.
+func latestRootPerHost(entries []CDXEntry) []Snapshot {
+	latest := make(map[string]Snapshot)
+	for _, e := range entries {
+		u, err := url.Parse(e.OriginalURL)
+		if err != nil || u.Hostname() == "" || u.RawQuery != "" || pathIDFor(u) != "/" {
+			continue
+		}
+		host := hostKey(u)
+		if cur, ok := latest[host]; !ok || e.Timestamp > cur.Timestamp {
+			latest[host] = Snapshot{FileURL: e.OriginalURL, Timestamp: e.Timestamp, FileID: fileIDFor(u)}
+		}
+	}
+	hosts := slices.Sorted(maps.Keys(latest))
+	out := make([]Snapshot, len(hosts))
+	for i, h := range hosts {
+		out[i] = latest[h]
+	}
+	return out
+}
+
+// fontExtensions are the web font file extensions that NoFonts skips.
+var fontExtensions = map[string]bool{".woff": true, ".woff2": true, ".ttf": true, ".eot": true, ".otf": true}
+
+// isFontURL reports whether rawURL names a web font, judged by the extension
+// of its path.
+func isFontURL(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return false
+	}
+	return fontExtensions[strings.ToLower(path.Ext(u.Path))]
+}
+
+// dropFonts returns manifest without its web fonts (see isFontURL), logging
+// each dropped URL at LogDebug.
+func dropFonts(manifest []Snapshot, cfg *Config) []Snapshot {
+	out := manifest[:0:0]
+	for _, s := range manifest {
+		if isFontURL(s.FileURL) {
+			cfg.Log(LogDebug, "skip font %s", s.FileURL)
+			continue
+		}
+		out = append(out, s)
+	}
+	return out
+}
+
+// urlExt returns the extension of rawURL's path, lower-cased and without
+// the dot; "" when it has none.
+func urlExt(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(strings.TrimPrefix(path.Ext(u.Path), "."))
+}
+
+// limitPerExt returns manifest with at most cfg.LimitPerExt[ext] snapshots
+// of each listed extension: the first ones, so the newest of a newest-first
+// manifest. Each dropped URL is logged at LogDebug.
+func limitPerExt(manifest []Snapshot, cfg *Config) []Snapshot {
+	kept := make(map[string]int)
+	out := manifest[:0:0]
+	for _, s := range manifest {
+		ext := urlExt(s.FileURL)
+		if limit, ok := cfg.LimitPerExt[ext]; ok {
+			if kept[ext] >= limit {
+				cfg.Log(LogDebug, "skip %s: over the limit of %d .%s files", s.FileURL, limit, ext)
+				continue
+			}
+			kept[ext]++
+		}
+		out = append(out, s)
+	}
+	return out
+}
+
+// validExtLimits reports whether every key of limits is a lower-case
+// extension without a dot and every limit is 0 or more.
+func validExtLimits(limits map[string]int) bool {
+	for ext, n := range limits {
+		if ext == "" || ext != strings.ToLower(ext) || strings.ContainsAny(ext, "./") || n < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// pageExts are the extensions of the (often server-rendered) HTML pages that
+// SkipAssets keeps along with extension-less URLs.
+var pageExts = map[string]bool{
+	".html": true, ".htm": true, ".xhtml": true, ".shtml": true,
+	".php": true, ".asp": true, ".aspx": true, ".jsp": true, ".cfm": true, ".cgi": true,
+}
+
+// isPageURL reports whether rawURL looks like an HTML page: the last segment
+// of its path has no extension (a directory or a clean URL) or one in
+// pageExts.
+func isPageURL(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return false
+	}
+	ext := strings.ToLower(path.Ext(u.Path))
+	return ext == "" || pageExts[ext]
+}
+
+// dropAssets returns manifest without the snapshots that are not pages (see
+// isPageURL), logging each dropped URL at LogDebug.
+func dropAssets(manifest []Snapshot, cfg *Config) []Snapshot {
+	out := manifest[:0:0]
+	for _, s := range manifest {
+		if !isPageURL(s.FileURL) {
+			cfg.Log(LogDebug, "skip asset %s", s.FileURL)
+			continue
+		}
+		out = append(out, s)
+	}
+	return out
+}
+
+// assetExts are the extensions of the styles, scripts, images and fonts that
+// AssetsFirst downloads ahead of pages.
+var assetExts = map[string]bool{
+	".css": true, ".js": true, ".mjs": true,
+	".png": true, ".jpg": true, ".jpeg": true, ".gif": true, ".webp": true, ".avif": true,
+	".svg": true, ".ico": true, ".bmp": true,
+	".woff": true, ".woff2": true, ".ttf": true, ".otf": true, ".eot": true,
+}
+
+// isAssetURL reports whether rawURL names a style, script, image or font,
+// judged by the extension of its path.
+func isAssetURL(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return false
+	}
+	return assetExts[strings.ToLower(path.Ext(u.Path))]
+}
+
+// sortAssetsFirst moves the asset snapshots of manifest (see isAssetURL)
+// ahead of the rest, keeping the order within each group.
+func sortAssetsFirst(manifest []Snapshot) {
+	slices.SortStableFunc(manifest, func(a, b Snapshot) int {
+		switch ia, ib := isAssetURL(a.FileURL), isAssetURL(b.FileURL); {
+		case ia && !ib:
+			return -1
+		case ib && !ia:
+			return 1
+		}
+		return 0
+	})
+}
+
+// cleanPath resolves "." and ".." segments in an escaped URL path, including
+// percent-encoded forms such as %2E%2E. Each segment is decoded only to test
+// whether it is a dot segment; all other segments keep their original
+// encoding. ".." at the root is dropped, so the result can never climb above
+// the output directory. A path that ends in a dot segment keeps a trailing
+// slash because it names a directory.
+func cleanPath(p string) string {
+	segs := strings.Split(p, "/")
+	out := make([]string, 0, len(segs))
+	trailing := strings.HasSuffix(p, "/")
+	for i, seg := range segs {
+		dec, err := url.PathUnescape(seg)
+		if err != nil {
+			dec = seg
+		}
+		last := i == len(segs)-1
+		switch dec {
+		case ".":
+			trailing = trailing || last
+		case "..":
+			if len(out) > 0 {
+				out = out[:len(out)-1]
+			}
+			trailing = trailing || last
+		case "":
+			// Empty segments come from leading/trailing or doubled slashes.
+		default:
+			out = append(out, seg)
+		}
+	}
+	cleaned := "/" + strings.Join(out, "/")
+	if trailing && len(out) > 0 {
+		cleaned += "/"
+	}
+	return cleaned
+}
+
 // encodeForFS percent-encodes characters that are forbidden in Windows (and
 // disruptive on most other systems) file names: \ : * ? " < > | and ASCII
 // control characters (< 0x20).  The forward slash '/' is intentionally not
@@ -215,23 +713,72 @@ func encodeForFS(s string) string {
 	return b.String()
 }
 
+// knownExtensions are file extensions pretty mode recognises on a path
+// segment beyond the short alphabetic ones it takes for extensions anyway
+// (see segmentExt): those with digits, such as .mp4 or .woff2, and long
+// ones such as .xhtml. Other dot-delimited tails with digits (v2.3, api.v2)
+// are part of the name, so such a segment is not mistaken for a file.
+var knownExtensions = map[string]bool{
+	".html": true, ".htm": true, ".xhtml": true, ".shtml": true,
+	".php": true, ".asp": true, ".aspx": true, ".jsp": true, ".cfm": true, ".cgi": true, ".pl": true,
+	".css": true, ".js": true, ".mjs": true, ".map": true, ".wasm": true,
+	".json": true, ".xml": true, ".rss": true, ".atom": true, ".txt": true, ".csv": true, ".md": true,
+	".png": true, ".jpg": true, ".jpeg": true, ".gif": true, ".webp": true, ".avif": true,
+	".svg": true, ".ico": true, ".bmp": true, ".tif": true, ".tiff": true,
+	".woff": true, ".woff2": true, ".ttf": true, ".otf": true, ".eot": true,
+	".mp3": true, ".mp4": true, ".m4a": true, ".m4v": true, ".webm": true, ".ogg": true, ".ogv": true,
+	".oga": true, ".wav": true, ".mov": true, ".avi": true, ".flv": true, ".swf": true,
+	".pdf": true, ".doc": true, ".docx": true, ".xls": true, ".xlsx": true, ".ppt": true, ".pptx": true,
+	".odt": true, ".rtf": true, ".zip": true, ".gz": true, ".tgz": true, ".tar": true, ".bz2": true,
+	".7z": true, ".rar": true, ".exe": true, ".dmg": true, ".iso": true, ".apk": true,
+	".m3u8": true, ".3gp": true,
+}
+
+// isKnownExtension reports whether ext (with its leading dot, any case) is
+// in knownExtensions.
+func isKnownExtension(ext string) bool {
+	return knownExtensions[strings.ToLower(ext)]
+}
+
+// segmentExt returns the extension of path segment seg: its dot-delimited
+// tail when that is one to five letters (.yaml, .ts) or a known extension
+// (see isKnownExtension), else "".
+func segmentExt(seg string) string {
+	ext := path.Ext(seg)
+	if isKnownExtension(ext) {
+		return ext
+	}
+	if len(ext) < 2 || len(ext) > 6 {
+		return ""
+	}
+	for _, c := range ext[1:] {
+		if (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') {
+			return ""
+		}
+	}
+	return ext
+}
+
 // sanitizeSegment sanitizes a single URL path segment.
-// The extension is split off first and sanitized separately so it is
-// never discarded by PathName (which strips dots).
+// Each dot-delimited part is sanitized on its own, so the dots of names like
+// example.v2.com and of a known extension (see segmentExt) survive PathName,
+// which strips them. Empty parts are dropped.
 func sanitizeSegment(seg string) string {
-	ext := path.Ext(seg)
+	ext := segmentExt(seg)
+	var parts []string
+	for _, part := range strings.Split(seg[:len(seg)-len(ext)], ".") {
+		if part = sanitize.PathName(part); part != "" {
+			parts = append(parts, part)
+		}
+	}
+	base := strings.Join(parts, ".")
 	if ext == "" {
-		return sanitize.PathName(seg)
+		return base
 	}
-	base := sanitize.PathName(seg[:len(seg)-len(ext)])
-	extPart := sanitize.PathName(ext[1:]) // strip leading dot before sanitizing
 	if base == "" {
 		base = "file"
 	}
-	if extPart == "" {
-		return base
-	}
-	return base + "." + extPart
+	return base + ext
 }
 
 // buildIndexName returns "index[_querySuffix].html".
@@ -1,6 +1,10 @@
 package wayback
 
 import (
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
 	"testing"
 )
 
@@ -45,6 +49,15 @@ func TestURLToLocalPathPretty(t *testing.T) {
 		{"https://example.com/dir/?q=search", "dir/index_q_search.html"},
 		// Root with query
 		{"https://example.com/?q=search", "index_q_search.html"},
+		// Dots that do not start a known extension belong to the name
+		{"https://example.com/docs/v2.3", "docs/v2.3/index.html"},
+		{"https://example.com/api.v2/users", "api.v2/users/index.html"},
+		{"https://example.com/example.v2.com/my.config.json", "example.v2.com/my.config.json"},
+		// Short alphabetic extensions need not be listed
+		{"https://example.com/data/config.yaml", "data/config.yaml"},
+		{"https://example.com/live/seg1.ts", "live/seg1.ts"},
+		{"https://example.com/live/stream.m3u8", "live/stream.m3u8"},
+		{"https://example.com/books/novel.epub", "books/novel.epub"},
 	}
 
 	for _, tc := range cases {
@@ -55,6 +68,23 @@ func TestURLToLocalPathPretty(t *testing.T) {
 	}
 }
 
+func TestSanitizeSegment(t *testing.T) {
+	cases := []struct{ seg, want string }{
+		{"v2.3", "v2.3"},
+		{"api.v2", "api.v2"},
+		{"my.config.json", "my.config.json"},
+		{"photo.JPG", "photo.JPG"},
+		{"my file!.html", "myfile.html"},
+		{".htaccess", "htaccess"},
+		{"!.css", "file.css"},
+	}
+	for _, tc := range cases {
+		if got := sanitizeSegment(tc.seg); got != tc.want {
+			t.Errorf("sanitizeSegment(%q) = %q, want %q", tc.seg, got, tc.want)
+		}
+	}
+}
+
 // ---------------------------------------------------------------------------
 // Preserve mode (URLToLocalPath with pretty=false, the default)
 // ---------------------------------------------------------------------------
@@ -154,3 +184,337 @@ func TestEncodeForFS(t *testing.T) {
 		}
 	}
 }
+
+// ---------------------------------------------------------------------------
+// Subdomains: NormalizeBaseURL variants and isInternalHost
+// ---------------------------------------------------------------------------
+
+func TestNormalizeBaseURLSubdomains(t *testing.T) {
+	base, err := NormalizeBaseURL("example.com", "blog", "CDN", "www", "")
+	if err != nil {
+		t.Fatalf("NormalizeBaseURL: %v", err)
+	}
+	want := []string{
+		"https://example.com/",
+		"https://www.example.com/",
+		"https://blog.example.com/",
+		"https://cdn.example.com/",
+		"http://example.com/",
+		"http://www.example.com/",
+		"http://blog.example.com/",
+		"http://cdn.example.com/",
+	}
+	if len(base.Variants) != len(want) {
+		t.Fatalf("got %d variants %v, want %d", len(base.Variants), base.Variants, len(want))
+	}
+	for i, v := range want {
+		if base.Variants[i] != v {
+			t.Errorf("variant[%d] = %q, want %q", i, base.Variants[i], v)
+		}
+	}
+}
+
+func TestIsInternalHostSubdomains(t *testing.T) {
+	cfg := &Config{BareHost: "example.com", ExtraSubdomains: []string{"blog", "cdn"}}
+	cases := []struct {
+		host string
+		want bool
+	}{
+		{"example.com", true},
+		{"www.example.com", true},
+		{"blog.example.com", true},
+		{"CDN.example.com", true},
+		{"shop.example.com", false},
+		{"blog.other.com", false},
+	}
+	for _, tc := range cases {
+		if got := isInternalHost(tc.host, cfg); got != tc.want {
+			t.Errorf("isInternalHost(%q) = %v, want %v", tc.host, got, tc.want)
+		}
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Dot segments: cleanPath and URLToLocalPath
+// ---------------------------------------------------------------------------
+
+func TestCleanPath(t *testing.T) {
+	cases := []struct {
+		in   string
+		want string
+	}{
+		{"/a/b/page.html", "/a/b/page.html"},
+		{"/a/../b/./page.html", "/b/page.html"},
+		{"/a/%2E%2E/b/%2e/page.html", "/b/page.html"},
+		{"/a/b/..", "/a/"},
+		{"/a/b/.", "/a/b/"},
+		{"/../../etc/passwd", "/etc/passwd"},
+		{"/%2E%2E/%2E%2E/secret", "/secret"},
+		{"/dir/", "/dir/"},
+		{"/", "/"},
+		{"/path%20spaces/file.html", "/path%20spaces/file.html"},
+	}
+	for _, tc := range cases {
+		if got := cleanPath(tc.in); got != tc.want {
+			t.Errorf("cleanPath(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestURLToLocalPathDotSegments(t *testing.T) {
+	cases := []struct {
+		url    string
+		pretty bool
+		want   string
+	}{
+		{"https://example.com/a/../b/./page.html", false, "b/page.html"},
+		{"https://example.com/a/../b/./page.html", true, "b/page.html"},
+		{"https://example.com/a/%2E%2E/b/%2E/page.html", false, "b/page.html"},
+		{"https://example.com/a/%2E%2E/b/%2E/page.html", true, "b/page.html"},
+		{"https://example.com/../../etc/passwd", false, "etc/passwd"},
+		{"https://example.com/%2E%2E/%2E%2E/etc/passwd", false, "etc/passwd"},
+		{"https://example.com/a/b/..", false, "a/index.html"},
+		{"https://example.com/a/b/..", true, "a/index.html"},
+		{"https://example.com/caf%C3%A9/./menu.html", false, "caf%C3%A9/menu.html"},
+	}
+	for _, tc := range cases {
+		got := URLToLocalPath(tc.url, tc.pretty)
+		if got != tc.want {
+			t.Errorf("URLToLocalPath(%q, pretty=%v)\n  got  %q\n  want %q", tc.url, tc.pretty, got, tc.want)
+		}
+		if strings.Contains("/"+got+"/", "/../") {
+			t.Errorf("URLToLocalPath(%q) escapes the output directory: %q", tc.url, got)
+		}
+	}
+}
+
+// Paths deeper than MaxPathDepth are cut to that many components, keep their
+// extension and query, and stay distinct through the hash suffix.
+func TestLocalPathForMaxPathDepth(t *testing.T) {
+	cfg := &Config{MaxPathDepth: 3}
+	if got := localPathFor("https://example.com/a/b/page.html", cfg); got != "a/b/page.html" {
+		t.Errorf("path within the limit changed: %q", got)
+	}
+
+	seen := make(map[string]string)
+	for _, u := range []string{
+		"https://example.com/a/b/c/d/e/page.html",
+		"https://example.com/a/b/x/y/z/page.html",
+		"https://example.com/a/b/c/d/e/page.html?id=2",
+		"https://example.com/a/b/c/d/e/",
+	} {
+		got := localPathFor(u, cfg)
+		if n := strings.Count(got, "/") + 1; n != 3 {
+			t.Errorf("%s => %q: %d components, want 3", u, got, n)
+		}
+		if !strings.HasPrefix(got, "a/b/") || !strings.Contains(got, "~") {
+			t.Errorf("%s => %q: want a/b/<name>~<hash>", u, got)
+		}
+		if prev, dup := seen[got]; dup {
+			t.Errorf("%s and %s both map to %q", prev, u, got)
+		}
+		seen[got] = u
+	}
+	if got := localPathFor("https://example.com/a/b/c/d/e/page.html?id=2", cfg); !strings.HasSuffix(got, ".html%3Fid=2") {
+		t.Errorf("query suffix lost: %q", got)
+	}
+	if got := localPathFor("https://example.com/a/b/c/d/e/page.html", &Config{}); got != "a/b/c/d/e/page.html" {
+		t.Errorf("unlimited depth changed the path: %q", got)
+	}
+}
+
+// Paths that keep repeating a segment are crawler loops; ordinary paths with
+// an occasional repeat are not.
+func TestIsCyclicPath(t *testing.T) {
+	cases := []struct {
+		url  string
+		want bool
+	}{
+		{"https://example.com/a/a/a/a/page.html", true},
+		{"https://example.com/a/b/a/b/a/b/a/b/", true},
+		{"https://example.com/img/img/img/img/img/logo.png", true},
+		{"https://example.com/2020/01/01/post.html", false},
+		{"https://example.com/a/a/a/", false},
+		{"https://example.com/", false},
+	}
+	for _, tc := range cases {
+		if got := isCyclicPath(tc.url); got != tc.want {
+			t.Errorf("isCyclicPath(%q) = %v, want %v", tc.url, got, tc.want)
+		}
+	}
+
+	manifest := []Snapshot{
+		{FileURL: "https://example.com/a/a/a/a/"},
+		{FileURL: "https://example.com/about/"},
+	}
+	if got := dropCyclicPaths(manifest, &Config{}); len(got) != 1 || got[0].FileURL != "https://example.com/about/" {
+		t.Errorf("dropCyclicPaths = %v", got)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// localHref: link text agrees with URLToLocalPath in both modes
+// ---------------------------------------------------------------------------
+
+func TestLocalHref(t *testing.T) {
+	cases := []struct {
+		target string
+		pretty bool
+		want   string
+	}{
+		// Preserve mode: on-disk %3F must be linked as %253F.
+		{"https://example.com/search?q=go", false, "search%253Fq=go"},
+		{"https://example.com/caf%C3%A9/menu.html", false, "caf%25C3%25A9/menu.html"},
+		// Pretty mode: sanitized names are linked verbatim.
+		{"https://example.com/search?q=go", true, "search/index_q_go.html"},
+		{"https://example.com/style.css?v=1", true, "style_v_1.css"},
+	}
+	for _, tc := range cases {
+		cfg := &Config{Directory: "websites/100%/example.com", PrettyPath: tc.pretty}
+		u, err := url.Parse(tc.target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := localHref(u, "websites/100%/example.com", cfg, nil)
+		if got != tc.want {
+			t.Errorf("localHref(%q, pretty=%v)\n  got  %q\n  want %q", tc.target, tc.pretty, got, tc.want)
+		}
+		if tc.pretty && strings.Contains(got, "%25") {
+			t.Errorf("pretty-mode link must not be %%25-encoded: %q", got)
+		}
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Wayback replay URLs
+// ---------------------------------------------------------------------------
+
+func TestUnwrapWaybackURL(t *testing.T) {
+	cases := []struct {
+		in   string
+		want string
+	}{
+		{"https://web.archive.org/web/20230101000000id_/http://example.com/old", "http://example.com/old"},
+		{"https://web.archive.org/web/20230101000000im_/https://example.com/bg.png", "https://example.com/bg.png"},
+		{"https://web.archive.org/web/20230101000000/https://example.com/", "https://example.com/"},
+		{"//web.archive.org/web/20230101000000im_/https://example.com/bg.png", "https://example.com/bg.png"},
+		{"https://web.archive.org/web/20230101000000im_/http:/example.com/a.png", "http://example.com/a.png"},
+		{"https://web.archive.org/web/20230101000000/example.com/a.png", "http://example.com/a.png"},
+		{"https://example.com/plain", "https://example.com/plain"},
+	}
+	for _, tc := range cases {
+		if got := unwrapWaybackURL(tc.in, ""); got != tc.want {
+			t.Errorf("unwrapWaybackURL(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+
+	// Another archive's replay URLs are unwrapped in its stead.
+	const mirror = "http://localhost:8080/wayback"
+	for in, want := range map[string]string{
+		"http://localhost:8080/wayback/web/20230101000000id_/http://example.com/old": "http://example.com/old",
+		"https://web.archive.org/web/20230101000000id_/http://example.com/old":       "https://web.archive.org/web/20230101000000id_/http://example.com/old",
+	} {
+		if got := unwrapWaybackURL(in, mirror); got != want {
+			t.Errorf("unwrapWaybackURL(%q, %q) = %q, want %q", in, mirror, got, want)
+		}
+	}
+}
+
+// sortAssetsFirst moves styles, scripts, images and fonts ahead of pages and
+// keeps each group in its original (newest-first) order.
+func TestSortAssetsFirst(t *testing.T) {
+	manifest := []Snapshot{
+		{FileURL: "https://example.com/", Timestamp: "5"},
+		{FileURL: "https://example.com/app.css?v=2", Timestamp: "4"},
+		{FileURL: "https://example.com/about.html", Timestamp: "3"},
+		{FileURL: "https://example.com/img/Logo.PNG", Timestamp: "2"},
+		{FileURL: "https://example.com/fonts/a.woff2", Timestamp: "1"},
+	}
+	sortAssetsFirst(manifest)
+	var got []string
+	for _, s := range manifest {
+		got = append(got, s.Timestamp)
+	}
+	if want := []string{"4", "2", "1", "5", "3"}; !slices.Equal(got, want) {
+		t.Errorf("order = %v, want %v", got, want)
+	}
+}
+
+// latestRootPerHost keeps the newest root capture of each host, folding
+// www. into the bare host and ignoring every other page.
+func TestLatestRootPerHost(t *testing.T) {
+	entries := []CDXEntry{
+		{Timestamp: "20200101000000", OriginalURL: "http://example.com/"},
+		{Timestamp: "20230101000000", OriginalURL: "https://www.example.com/"},
+		{Timestamp: "20240101000000", OriginalURL: "https://example.com/about/"},
+		{Timestamp: "20210101000000", OriginalURL: "https://blog.example.com"},
+		{Timestamp: "20220101000000", OriginalURL: "https://blog.example.com/?page=2"},
+	}
+	got := latestRootPerHost(entries)
+	want := []Snapshot{
+		{FileURL: "https://blog.example.com", Timestamp: "20210101000000", FileID: "blog.example.com/"},
+		{FileURL: "https://www.example.com/", Timestamp: "20230101000000", FileID: "example.com/"},
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("latestRootPerHost = %+v\nwant %+v", got, want)
+	}
+
+	cfg := &Config{OnlyLatestPerHost: true}
+	if p := localPathFor("https://blog.example.com", cfg); p != "blog.example.com/index.html" {
+		t.Errorf("localPathFor = %q", p)
+	}
+}
+
+// With TrailingSlash "collapse", /dir and /dir/ share dir/index.html (and a
+// link to either points there) rather than /dir becoming a file named dir
+// next to the directory holding /dir/'s children.
+func TestLocalPathForTrailingSlash(t *testing.T) {
+	cfg := &Config{Directory: "out", TrailingSlash: "collapse"}
+	cases := []struct{ url, want string }{
+		{"https://example.com/dir", "dir/index.html"},
+		{"https://example.com/dir/", "dir/index.html"},
+		{"https://example.com/dir?page=2", "dir/index.html%3Fpage=2"},
+		{"https://example.com/dir/style.css", "dir/style.css"},
+		{"https://example.com/v1.2", "v1.2"},
+		{"https://example.com", "index.html"},
+	}
+	for _, tc := range cases {
+		if got := localPathFor(tc.url, cfg); got != tc.want {
+			t.Errorf("localPathFor(%q) = %q, want %q", tc.url, got, tc.want)
+		}
+	}
+	if got := localPathFor("https://example.com/dir", &Config{}); got != "dir" {
+		t.Errorf("keep: localPathFor(/dir) = %q, want dir", got)
+	}
+
+	target, _ := url.Parse("https://example.com/dir")
+	if got := localHref(target, "out", cfg, nil); got != "dir/index.html" {
+		t.Errorf("link to /dir = %q, want dir/index.html", got)
+	}
+
+	idx := NewSnapshotIndex()
+	idx.Register("https://example.com/dir", "20200101000000")
+	idx.Register("https://example.com/dir/", "20210101000000")
+	manifest := idx.GetManifest()
+	if len(manifest) != 1 || manifest[0].Timestamp != "20210101000000" {
+		t.Fatalf("manifest = %+v, want the 2021 capture only", manifest)
+	}
+}
+
+// With LimitPerExt css=2, only the two newest CSS files of the index are
+// downloaded; other extensions are untouched.
+func TestDownloadManifestLimitPerExt(t *testing.T) {
+	idx := NewSnapshotIndex()
+	for i, u := range []string{"a.css", "b.css", "c.CSS", "d.css?v=2", "app.js", "page.html", "about/"} {
+		idx.Register("http://example.com/"+u, fmt.Sprintf("202001%02d000000", i+1))
+	}
+	cfg := &Config{LimitPerExt: map[string]int{"css": 2}}
+	var got []string
+	for _, s := range downloadManifest(idx, nil, cfg) {
+		got = append(got, strings.TrimPrefix(s.FileURL, "http://example.com/"))
+	}
+	want := []string{"about/", "page.html", "app.js", "d.css?v=2", "c.CSS"}
+	if !slices.Equal(got, want) {
+		t.Errorf("manifest = %v, want %v", got, want)
+	}
+}